@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signatureNamespace must match fort-provider's verifier
+const signatureNamespace = "fort-agent"
+
+// Client calls fort-provider capabilities on cluster hosts, signing each
+// request with an SSH key exactly as the fort CLI does. The dashboard holds
+// no other credential: hosts authorize it through hosts.json and rbac.json
+// like any other peer. With control plane clientAuth, it also presents the
+// TLS client certificate wrapping that key, as the fort CLI does.
+type Client struct {
+	Origin  string            // X-Fort-Origin; must be a name in hosts.json
+	KeyPath string            // private key matching Origin's pubkey
+	Domain  string            // hosts are reached at <host>.fort.<domain>
+	Peers   map[string]string // optional host -> base URL override (FORT_PEERS)
+	Cert    *tls.Certificate  // optional client certificate (FORT_CLIENT_CERT/FORT_CLIENT_KEY)
+	HTTP    *http.Client
+}
+
+func (c *Client) baseURL(host string) string {
+	if base, ok := c.Peers[host]; ok {
+		return strings.TrimSuffix(base, "/")
+	}
+	return fmt.Sprintf("https://%s.fort.%s", host, c.Domain)
+}
+
+// Call POSTs body to /fort/<capability> on host and returns the response
+// body. Non-2xx responses are errors carrying the provider's error message.
+func (c *Client) Call(host, capability string, body []byte) ([]byte, error) {
+	path := "/fort/" + capability
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature, err := signRequest(c.KeyPath, "POST", path, timestamp, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", c.baseURL(host)+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Fort-Origin", c.Origin)
+	req.Header.Set("X-Fort-Timestamp", timestamp)
+	req.Header.Set("X-Fort-Signature", signature)
+
+	client := c.HTTP
+	if client == nil {
+		// Same posture as the fort CLI (curl -sk): hosts use self-signed
+		// certs and authenticity comes from the request signature
+		tlsConfig := &tls.Config{InsecureSkipVerify: true}
+		if c.Cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{*c.Cert}
+		}
+		client = &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", host, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response from %s: %w", host, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(respBody, &e) == nil && e.Error != "" {
+			return respBody, fmt.Errorf("%s/%s: HTTP %d: %s", host, capability, resp.StatusCode, e.Error)
+		}
+		return respBody, fmt.Errorf("%s/%s: HTTP %d", host, capability, resp.StatusCode)
+	}
+	return respBody, nil
+}
+
+// signRequest signs METHOD\nPATH\nTIMESTAMP\nSHA256(body) with ssh-keygen
+// -Y sign and returns the signature with its armor stripped
+func signRequest(keyPath, method, path, timestamp string, body []byte) (string, error) {
+	bodyHash := sha256.Sum256(body)
+	canonical := fmt.Sprintf("%s\n%s\n%s\n%s", method, path, timestamp, hex.EncodeToString(bodyHash[:]))
+
+	cmd := exec.Command("ssh-keygen", "-Y", "sign", "-f", keyPath, "-n", signatureNamespace, "-q")
+	cmd.Stdin = strings.NewReader(canonical)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("ssh-keygen sign: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var b64 strings.Builder
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "-----") {
+			continue
+		}
+		b64.WriteString(strings.TrimSpace(line))
+	}
+	return b64.String(), nil
+}
@@ -0,0 +1,67 @@
+# Cluster-wide control plane dashboard
+#
+# Polls every host's status/needs/capabilities over the fort-provider API,
+# signing as this host with its SSH host key (no separate credential), and
+# renders the provider/consumer graph: unsatisfied or stale needs, failed
+# callbacks, unreachable hosts. Refresh buttons call the mandatory refresh
+# capability, whose RBAC admits hosts running this app (control-plane.nix).
+{ subdomain ? "control", rootManifest, cluster, ... }:
+{ config, pkgs, lib, ... }:
+let
+  domain = rootManifest.fortConfig.settings.domain;
+  # Hosts may require a TLS client certificate (control-plane.nix); present
+  # the one activation mints from the host key
+  clientAuthEnabled = (rootManifest.fortConfig.settings.controlPlane.clientAuth or "off") != "off";
+
+  fort-dashboard = pkgs.buildGoModule {
+    pname = "fort-dashboard";
+    version = "0.1.0";
+    src = ./.;
+    vendorHash = null;
+  };
+
+  hostDirs = builtins.attrNames (builtins.readDir cluster.hostsDir);
+  hostsFile = pkgs.writeText "fort-dashboard-hosts.json" (builtins.toJSON hostDirs);
+in
+{
+  systemd.services.fort-dashboard = {
+    description = "Fort control plane dashboard";
+    after = [ "network-online.target" ];
+    wants = [ "network-online.target" ];
+    wantedBy = [ "multi-user.target" ];
+    path = [ pkgs.openssh ];
+
+    serviceConfig = {
+      ExecStart = "${fort-dashboard}/bin/fort-dashboard";
+      Restart = "on-failure";
+      RestartSec = "5s";
+      DynamicUser = true;
+      # Host key handed over as a credential so the service needn't run as root
+      LoadCredential = [ "host-key:/etc/ssh/ssh_host_ed25519_key" ]
+        ++ lib.optionals clientAuthEnabled [
+          "client-cert:/var/lib/fort/tls/client-cert.pem"
+          "client-key:/var/lib/fort/tls/client-key.pem"
+        ];
+      Environment = [
+        "DASHBOARD_HOSTS=${hostsFile}"
+        "FORT_DOMAIN=${domain}"
+        "FORT_ORIGIN=${config.networking.hostName}"
+        "FORT_SSH_KEY=%d/host-key"
+        "POLL_INTERVAL=60s"
+        "LISTEN_ADDR=127.0.0.1:9483"
+      ] ++ lib.optionals clientAuthEnabled [
+        "FORT_CLIENT_CERT=%d/client-cert"
+        "FORT_CLIENT_KEY=%d/client-key"
+      ];
+    };
+  };
+
+  fort.cluster.services = [{
+    name = "fort-dashboard";
+    subdomain = subdomain;
+    port = 9483;
+    visibility = "vpn";
+    sso = { mode = "identity"; groups = [ "admin" ]; };
+    health.endpoint = "/health";
+  }];
+}
@@ -0,0 +1,3 @@
+module fort-nix/apps/fort-dashboard
+
+go 1.23
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostStatus is the subset of a host's status capability the dashboard reads.
+// provider_detail and consumer_detail are absent on hosts that predate them;
+// consumer_state is the older need -> satisfied summary.
+type HostStatus struct {
+	Status         string                              `json:"status"`
+	UptimeSeconds  int64                               `json:"uptime_seconds"`
+	GeneratedAt    string                              `json:"generated_at"`
+	ProviderDetail map[string]map[string]ProviderEntry `json:"provider_detail"`
+	ConsumerDetail map[string]ConsumerEntry            `json:"consumer_detail"`
+	ConsumerState  map[string]bool                     `json:"consumer_state"`
+}
+
+// ProviderEntry is one origin:need entry in a provider's state
+type ProviderEntry struct {
+	UpdatedAt     int64  `json:"updated_at"`
+	Fulfilled     bool   `json:"fulfilled"`
+	CallbackAt    int64  `json:"callback_at"`
+	CallbackError string `json:"callback_error"`
+}
+
+// ConsumerEntry is one declared need joined with its fulfillment state
+type ConsumerEntry struct {
+	Capability string `json:"capability"`
+	From       string `json:"from"`
+	NagSeconds int64  `json:"nag_seconds"`
+	Satisfied  bool   `json:"satisfied"`
+	LastSought int64  `json:"last_sought"`
+}
+
+// CapabilityInfo is an entry from a host's capabilities listing
+type CapabilityInfo struct {
+	Name string `json:"name"`
+	Mode string `json:"mode"`
+	TTL  int64  `json:"ttl"`
+}
+
+// Snapshot is the result of polling one host
+type Snapshot struct {
+	Host         string
+	PolledAt     time.Time
+	Err          error // status unreachable; everything else is best-effort
+	Status       HostStatus
+	Needs        []string // "capability/name" paths from the needs capability
+	Capabilities map[string]CapabilityInfo
+}
+
+// pollHost queries status, needs and capabilities on host. Only a status
+// failure marks the host unreachable: needs and capabilities may be denied by
+// RBAC or missing on older providers.
+func pollHost(c *Client, host string) Snapshot {
+	snap := Snapshot{Host: host, PolledAt: time.Now(), Capabilities: make(map[string]CapabilityInfo)}
+
+	body, err := c.Call(host, "status", []byte("{}"))
+	if err != nil {
+		snap.Err = err
+		return snap
+	}
+	if err := json.Unmarshal(body, &snap.Status); err != nil {
+		snap.Err = fmt.Errorf("parse status: %w", err)
+		return snap
+	}
+
+	if body, err := c.Call(host, "needs", []byte("{}")); err == nil {
+		var resp struct {
+			Needs []string `json:"needs"`
+		}
+		if json.Unmarshal(body, &resp) == nil {
+			snap.Needs = resp.Needs
+		}
+	}
+
+	if body, err := c.Call(host, "capabilities", []byte("{}")); err == nil {
+		var resp struct {
+			Capabilities []CapabilityInfo `json:"capabilities"`
+		}
+		if json.Unmarshal(body, &resp) == nil {
+			for _, info := range resp.Capabilities {
+				snap.Capabilities[info.Name] = info
+			}
+		}
+	}
+	return snap
+}
+
+// pollAll polls every host concurrently
+func pollAll(c *Client, hosts []string) map[string]Snapshot {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	snaps := make(map[string]Snapshot, len(hosts))
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			snap := pollHost(c, host)
+			mu.Lock()
+			snaps[host] = snap
+			mu.Unlock()
+		}(host)
+	}
+	wg.Wait()
+	return snaps
+}
+
+// Graph is the aggregated provider/consumer view of the cluster
+type Graph struct {
+	GeneratedAt time.Time    `json:"generated_at"`
+	Hosts       []HostNode   `json:"hosts"`
+	Edges       []NeedEdge   `json:"edges"`
+	Providers   []Capability `json:"providers"`
+	Problems    []string     `json:"problems"`
+}
+
+// HostNode is a host and whether the last poll reached it
+type HostNode struct {
+	Name          string    `json:"name"`
+	Reachable     bool      `json:"reachable"`
+	Error         string    `json:"error,omitempty"`
+	PolledAt      time.Time `json:"polled_at"`
+	UptimeSeconds int64     `json:"uptime_seconds,omitempty"`
+}
+
+// NeedEdge links a consumer's need to the host that provides it
+type NeedEdge struct {
+	Consumer   string `json:"consumer"`
+	NeedID     string `json:"need_id"`
+	Capability string `json:"capability"`
+	Provider   string `json:"provider,omitempty"` // empty when the consumer predates consumer_detail
+	Satisfied  bool   `json:"satisfied"`
+	LastSought int64  `json:"last_sought,omitempty"`
+
+	// Provider-side view of this need, when the provider was reachable
+	ProviderUpdatedAt int64  `json:"provider_updated_at,omitempty"`
+	CallbackAt        int64  `json:"callback_at,omitempty"`
+	CallbackError     string `json:"callback_error,omitempty"`
+
+	Stale  bool   `json:"stale"`
+	Reason string `json:"reason,omitempty"` // why the edge is unhealthy
+}
+
+// Healthy reports whether the edge needs no attention
+func (e NeedEdge) Healthy() bool {
+	return e.Reason == ""
+}
+
+// Capability summarizes one capability on one provider host
+type Capability struct {
+	Host           string `json:"host"`
+	Name           string `json:"name"`
+	Entries        int    `json:"entries"`
+	LastRun        int64  `json:"last_run,omitempty"`      // newest entry update
+	LastCallback   int64  `json:"last_callback,omitempty"` // newest callback attempt
+	FailedCallback int    `json:"failed_callbacks"`
+}
+
+// buildGraph aggregates host snapshots into a Graph. A satisfied need is
+// stale when the provider's entry for it has outlived the capability TTL
+// (GC should have rotated it) or the provider no longer holds it at all.
+func buildGraph(snaps map[string]Snapshot, now time.Time) Graph {
+	g := Graph{GeneratedAt: now, Hosts: []HostNode{}, Edges: []NeedEdge{}, Providers: []Capability{}, Problems: []string{}}
+
+	names := make([]string, 0, len(snaps))
+	for name := range snaps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		snap := snaps[name]
+		node := HostNode{Name: name, Reachable: snap.Err == nil, PolledAt: snap.PolledAt}
+		if snap.Err != nil {
+			node.Error = snap.Err.Error()
+			g.Problems = append(g.Problems, fmt.Sprintf("%s unreachable: %v", name, snap.Err))
+		} else {
+			node.UptimeSeconds = snap.Status.UptimeSeconds
+		}
+		g.Hosts = append(g.Hosts, node)
+
+		for _, edge := range consumerEdges(snap) {
+			annotateEdge(&edge, snaps, now)
+			if !edge.Healthy() {
+				g.Problems = append(g.Problems, fmt.Sprintf("%s %s: %s", edge.Consumer, edge.NeedID, edge.Reason))
+			}
+			g.Edges = append(g.Edges, edge)
+		}
+
+		capNames := make([]string, 0, len(snap.Status.ProviderDetail))
+		for capName := range snap.Status.ProviderDetail {
+			capNames = append(capNames, capName)
+		}
+		sort.Strings(capNames)
+		for _, capName := range capNames {
+			summary := Capability{Host: name, Name: capName}
+			for _, entry := range snap.Status.ProviderDetail[capName] {
+				summary.Entries++
+				summary.LastRun = max(summary.LastRun, entry.UpdatedAt)
+				summary.LastCallback = max(summary.LastCallback, entry.CallbackAt)
+				if entry.CallbackError != "" {
+					summary.FailedCallback++
+				}
+			}
+			g.Providers = append(g.Providers, summary)
+		}
+	}
+	return g
+}
+
+// consumerEdges lists a reachable host's needs, preferring consumer_detail
+// and falling back to the needs listing plus consumer_state
+func consumerEdges(snap Snapshot) []NeedEdge {
+	if snap.Err != nil {
+		return nil
+	}
+	var edges []NeedEdge
+	seen := make(map[string]bool)
+	for id, need := range snap.Status.ConsumerDetail {
+		seen[id] = true
+		edges = append(edges, NeedEdge{
+			Consumer:   snap.Host,
+			NeedID:     id,
+			Capability: need.Capability,
+			Provider:   need.From,
+			Satisfied:  need.Satisfied,
+			LastSought: need.LastSought,
+		})
+	}
+	for _, path := range snap.Needs {
+		capability, name, ok := strings.Cut(path, "/")
+		id := capability + "-" + name
+		if !ok || seen[id] {
+			continue
+		}
+		edges = append(edges, NeedEdge{
+			Consumer:   snap.Host,
+			NeedID:     id,
+			Capability: capability,
+			Satisfied:  snap.Status.ConsumerState[id],
+		})
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].NeedID < edges[j].NeedID })
+	return edges
+}
+
+// annotateEdge fills in the provider's view of an edge and decides whether
+// it needs attention
+func annotateEdge(edge *NeedEdge, snaps map[string]Snapshot, now time.Time) {
+	provider, known := snaps[edge.Provider]
+	providerUp := known && provider.Err == nil
+
+	if providerUp {
+		key := edge.Consumer + ":" + edge.NeedID
+		if entry, ok := provider.Status.ProviderDetail[edge.Capability][key]; ok {
+			edge.ProviderUpdatedAt = entry.UpdatedAt
+			edge.CallbackAt = entry.CallbackAt
+			edge.CallbackError = entry.CallbackError
+			if ttl := provider.Capabilities[edge.Capability].TTL; ttl > 0 && now.Unix()-entry.UpdatedAt > ttl {
+				edge.Stale = true
+			}
+		} else if edge.Satisfied && provider.Status.ProviderDetail != nil {
+			// Provider reports detail but has forgotten this need
+			edge.Stale = true
+		}
+	}
+
+	switch {
+	case !edge.Satisfied && edge.Provider != "" && known && !providerUp:
+		edge.Reason = fmt.Sprintf("unsatisfied, provider %s unreachable", edge.Provider)
+	case !edge.Satisfied:
+		edge.Reason = "unsatisfied"
+	case edge.CallbackError != "":
+		edge.Reason = "callback failed: " + edge.CallbackError
+	case edge.Stale:
+		edge.Reason = "stale"
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func edgeFor(t *testing.T, g Graph, consumer, needID string) NeedEdge {
+	t.Helper()
+	for _, e := range g.Edges {
+		if e.Consumer == consumer && e.NeedID == needID {
+			return e
+		}
+	}
+	t.Fatalf("no edge %s %s in %+v", consumer, needID, g.Edges)
+	return NeedEdge{}
+}
+
+func TestBuildGraph(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	snaps := map[string]Snapshot{
+		"provider": {
+			Host: "provider",
+			Status: HostStatus{ProviderDetail: map[string]map[string]ProviderEntry{
+				"token": {
+					"fresh:token-default":  {UpdatedAt: now.Unix() - 60, Fulfilled: true, CallbackAt: now.Unix() - 60},
+					"old:token-default":    {UpdatedAt: now.Unix() - 7200, Fulfilled: true},
+					"broken:token-default": {UpdatedAt: now.Unix() - 60, CallbackAt: now.Unix() - 60, CallbackError: "HTTP 502"},
+				},
+			}},
+			Capabilities: map[string]CapabilityInfo{"token": {Name: "token", Mode: "async", TTL: 3600}},
+		},
+		"fresh": {Host: "fresh", Status: HostStatus{ConsumerDetail: map[string]ConsumerEntry{
+			"token-default": {Capability: "token", From: "provider", Satisfied: true},
+		}}},
+		"old": {Host: "old", Status: HostStatus{ConsumerDetail: map[string]ConsumerEntry{
+			"token-default": {Capability: "token", From: "provider", Satisfied: true},
+		}}},
+		"broken": {Host: "broken", Status: HostStatus{ConsumerDetail: map[string]ConsumerEntry{
+			"token-default": {Capability: "token", From: "provider", Satisfied: true},
+			"cert-default":  {Capability: "cert", From: "down", Satisfied: false, LastSought: now.Unix() - 30},
+		}}},
+		// Predates consumer_detail: needs listing plus consumer_state only
+		"legacy": {Host: "legacy", Needs: []string{"token/default"}, Status: HostStatus{
+			ConsumerState: map[string]bool{"token-default": false},
+		}},
+		"down": {Host: "down", Err: errors.New("connect to down: connection refused")},
+	}
+
+	g := buildGraph(snaps, now)
+
+	if e := edgeFor(t, g, "fresh", "token-default"); !e.Healthy() || e.Stale {
+		t.Errorf("fresh edge = %+v, want healthy", e)
+	}
+	if e := edgeFor(t, g, "old", "token-default"); !e.Stale || e.Reason != "stale" {
+		t.Errorf("old edge = %+v, want stale past the 1h TTL", e)
+	}
+	if e := edgeFor(t, g, "broken", "token-default"); !strings.Contains(e.Reason, "HTTP 502") {
+		t.Errorf("broken edge = %+v, want the callback error", e)
+	}
+	if e := edgeFor(t, g, "broken", "cert-default"); !strings.Contains(e.Reason, "provider down unreachable") {
+		t.Errorf("cert edge = %+v, want unsatisfied with unreachable provider", e)
+	}
+	if e := edgeFor(t, g, "legacy", "token-default"); e.Provider != "" || e.Reason != "unsatisfied" {
+		t.Errorf("legacy edge = %+v, want unsatisfied with unknown provider", e)
+	}
+
+	var down HostNode
+	for _, h := range g.Hosts {
+		if h.Name == "down" {
+			down = h
+		}
+	}
+	if down.Reachable || down.Error == "" {
+		t.Errorf("down host = %+v, want unreachable", down)
+	}
+
+	// Unreachable host + stale + failed callback + two unsatisfied
+	if len(g.Problems) != 5 {
+		t.Errorf("problems = %q, want 5", g.Problems)
+	}
+
+	if len(g.Providers) != 1 {
+		t.Fatalf("providers = %+v", g.Providers)
+	}
+	if p := g.Providers[0]; p.Entries != 3 || p.FailedCallback != 1 || p.LastRun != now.Unix()-60 {
+		t.Errorf("token summary = %+v", p)
+	}
+}
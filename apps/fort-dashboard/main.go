@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dashboard polls every host on an interval and serves the latest graph
+type Dashboard struct {
+	client   *Client
+	hosts    []string
+	interval time.Duration
+
+	mu    sync.RWMutex
+	graph Graph
+	snaps map[string]Snapshot
+}
+
+func (d *Dashboard) poll() {
+	snaps := pollAll(d.client, d.hosts)
+	graph := buildGraph(snaps, time.Now())
+	d.mu.Lock()
+	d.snaps = snaps
+	d.graph = graph
+	d.mu.Unlock()
+	log.Printf("polled %d hosts, %d problems", len(d.hosts), len(graph.Problems))
+}
+
+// pollHostNow re-polls a single host after a refresh so the page reflects it
+func (d *Dashboard) pollHostNow(host string) {
+	snap := pollHost(d.client, host)
+	d.mu.Lock()
+	snaps := make(map[string]Snapshot, len(d.snaps))
+	for name, s := range d.snaps {
+		snaps[name] = s
+	}
+	snaps[host] = snap
+	d.snaps = snaps
+	d.graph = buildGraph(snaps, time.Now())
+	d.mu.Unlock()
+}
+
+func (d *Dashboard) run() {
+	for {
+		d.poll()
+		time.Sleep(d.interval)
+	}
+}
+
+func (d *Dashboard) current() Graph {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.graph
+}
+
+func (d *Dashboard) isHost(name string) bool {
+	for _, h := range d.hosts {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/":
+		if err := renderPage(w, d.current()); err != nil {
+			log.Printf("render: %v", err)
+		}
+
+	case "/api/graph":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d.current())
+
+	case "/refresh":
+		d.handleRefresh(w, r)
+
+	case "/health":
+		fmt.Fprintln(w, "ok")
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleRefresh asks a provider to re-run a capability handler and
+// re-deliver to its subscribers, via the mandatory refresh capability
+func (d *Dashboard) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		log.Printf("refused cross-site refresh (origin %q, sec-fetch-site %q)", r.Header.Get("Origin"), r.Header.Get("Sec-Fetch-Site"))
+		http.Error(w, "cross-site request refused", http.StatusForbidden)
+		return
+	}
+	host := r.FormValue("host")
+	capability := r.FormValue("capability")
+	if !d.isHost(host) || capability == "" {
+		http.Error(w, "host and capability required", http.StatusBadRequest)
+		return
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"capability": capability,
+		"force":      r.FormValue("force") == "true",
+	})
+	output, err := d.client.Call(host, "refresh", body)
+	if err != nil {
+		log.Printf("refresh %s on %s failed: %v", capability, host, err)
+		http.Error(w, fmt.Sprintf("refresh failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	log.Printf("refreshed %s on %s: %s", capability, host, strings.TrimSpace(string(output)))
+
+	d.pollHostNow(host)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// sameOrigin reports whether a request came from the dashboard's own page.
+// The SSO cookie rides along on any site's form POST, so the refresh buttons
+// only count when the browser says the form was ours: Sec-Fetch-Site where
+// it sends one, else Origin against Host (nginx passes the public Host
+// through). Requests with neither header are not from a browser.
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin"
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// loadHosts reads the JSON list of host names to poll
+func loadHosts(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	if err := json.Unmarshal(data, &hosts); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return hosts, nil
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func main() {
+	hosts, err := loadHosts(envOr("DASHBOARD_HOSTS", "/etc/fort-dashboard/hosts.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	interval, err := time.ParseDuration(envOr("POLL_INTERVAL", "60s"))
+	if err != nil {
+		log.Fatalf("POLL_INTERVAL: %v", err)
+	}
+
+	origin := os.Getenv("FORT_ORIGIN")
+	if origin == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatal(err)
+		}
+		origin, _, _ = strings.Cut(hostname, ".")
+	}
+
+	client := &Client{
+		Origin:  origin,
+		KeyPath: envOr("FORT_SSH_KEY", "/etc/ssh/ssh_host_ed25519_key"),
+		Domain:  os.Getenv("FORT_DOMAIN"),
+	}
+	// The pair `fort-provider client-cert` mints from the host key at
+	// activation, when the control plane requires client certificates
+	if certFile := os.Getenv("FORT_CLIENT_CERT"); certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, os.Getenv("FORT_CLIENT_KEY"))
+		if err != nil {
+			log.Fatalf("client certificate: %v", err)
+		}
+		client.Cert = &cert
+	}
+	// FORT_PEERS points at a host -> base URL map, as with fort-provider
+	// (e.g. to watch a fort-provider dev-cluster)
+	if peersFile := os.Getenv("FORT_PEERS"); peersFile != "" {
+		data, err := os.ReadFile(peersFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &client.Peers); err != nil {
+			log.Fatalf("parse %s: %v", peersFile, err)
+		}
+	} else if client.Domain == "" {
+		log.Fatal("FORT_DOMAIN or FORT_PEERS required")
+	}
+
+	dashboard := &Dashboard{client: client, hosts: hosts, interval: interval}
+	go dashboard.run()
+
+	listenAddr := envOr("LISTEN_ADDR", "127.0.0.1:9483")
+	log.Printf("fort-dashboard listening on %s (%d hosts, signing as %s)", listenAddr, len(hosts), origin)
+	log.Fatal(http.ListenAndServe(listenAddr, dashboard))
+}
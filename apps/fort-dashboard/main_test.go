@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRefreshRefusesCrossSiteRequests(t *testing.T) {
+	d := &Dashboard{hosts: []string{"alice"}}
+	cases := []struct {
+		name    string
+		headers map[string]string
+	}{
+		{"cross-site fetch metadata", map[string]string{"Sec-Fetch-Site": "cross-site"}},
+		{"same-site sibling", map[string]string{"Sec-Fetch-Site": "same-site"}},
+		{"foreign origin", map[string]string{"Origin": "https://evil.example"}},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "https://control.fort.example/refresh", strings.NewReader("host=alice&capability=oidc"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		d.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", c.name, rec.Code)
+		}
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	req := httptest.NewRequest("POST", "https://control.fort.example/refresh", nil)
+	if !sameOrigin(req) {
+		t.Error("request without browser headers refused")
+	}
+	req.Header.Set("Origin", "https://control.fort.example")
+	if !sameOrigin(req) {
+		t.Error("own origin refused")
+	}
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	if !sameOrigin(req) {
+		t.Error("same-origin fetch metadata refused")
+	}
+}
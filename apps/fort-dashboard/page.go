@@ -0,0 +1,78 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"time"
+)
+
+var funcs = template.FuncMap{
+	// ago renders a unix timestamp relative to now ("3m ago"), or "-"
+	"ago": func(ts int64) string {
+		if ts == 0 {
+			return "-"
+		}
+		return time.Since(time.Unix(ts, 0)).Truncate(time.Second).String() + " ago"
+	},
+	"uptime": func(secs int64) string {
+		return (time.Duration(secs) * time.Second).String()
+	},
+}
+
+var page = template.Must(template.New("page").Funcs(funcs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>fort control plane</title>
+<style>
+body { font-family: monospace; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+.bad { background: #fdd; }
+.warn { background: #ffd; }
+form { display: inline; }
+</style>
+</head>
+<body>
+<h1>fort control plane</h1>
+<p>Polled {{.GeneratedAt.Format "2006-01-02 15:04:05"}}</p>
+
+<h2>Problems ({{len .Problems}})</h2>
+{{if .Problems}}<ul>{{range .Problems}}<li>{{.}}</li>{{end}}</ul>{{else}}<p>None.</p>{{end}}
+
+<h2>Hosts</h2>
+<table>
+<tr><th>host</th><th>reachable</th><th>uptime</th><th>error</th></tr>
+{{range .Hosts}}<tr{{if not .Reachable}} class="bad"{{end}}>
+<td>{{.Name}}</td><td>{{.Reachable}}</td><td>{{if .Reachable}}{{uptime .UptimeSeconds}}{{end}}</td><td>{{.Error}}</td>
+</tr>
+{{end}}</table>
+
+<h2>Needs</h2>
+<table>
+<tr><th>consumer</th><th>need</th><th>provider</th><th>satisfied</th><th>last sought</th><th>provider updated</th><th>last callback</th><th>issue</th></tr>
+{{range .Edges}}<tr{{if not .Satisfied}} class="bad"{{else if not .Healthy}} class="warn"{{end}}>
+<td>{{.Consumer}}</td><td>{{.NeedID}}</td><td>{{or .Provider "?"}}</td><td>{{.Satisfied}}</td>
+<td>{{ago .LastSought}}</td><td>{{ago .ProviderUpdatedAt}}</td><td>{{ago .CallbackAt}}</td><td>{{.Reason}}</td>
+</tr>
+{{end}}</table>
+
+<h2>Providers</h2>
+<table>
+<tr><th>host</th><th>capability</th><th>entries</th><th>last run</th><th>last callback</th><th>failed callbacks</th><th></th></tr>
+{{range .Providers}}<tr{{if .FailedCallback}} class="warn"{{end}}>
+<td>{{.Host}}</td><td>{{.Name}}</td><td>{{.Entries}}</td><td>{{ago .LastRun}}</td><td>{{ago .LastCallback}}</td><td>{{.FailedCallback}}</td>
+<td>
+<form method="post" action="/refresh"><input type="hidden" name="host" value="{{.Host}}"><input type="hidden" name="capability" value="{{.Name}}"><button>refresh</button></form>
+<form method="post" action="/refresh"><input type="hidden" name="host" value="{{.Host}}"><input type="hidden" name="capability" value="{{.Name}}"><input type="hidden" name="force" value="true"><button>force</button></form>
+</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func renderPage(w io.Writer, g Graph) error {
+	return page.Execute(w, g)
+}
@@ -1,6 +1,14 @@
-{ ... }:
+{ rootManifest, ... }:
 { config, pkgs, lib, ... }:
 let
+  # Publishers: principals with the "overlay-publish" role, signing entries
+  # with their agentKey (ssh-keygen -Y sign -n fort-overlay; see
+  # `overlay-registry sign`). Writes from anyone else are rejected.
+  publishers = lib.mapAttrs (_: p: p.agentKey or p.publicKey) (lib.filterAttrs
+    (_: p: builtins.elem "overlay-publish" (p.roles or [ ]))
+    rootManifest.fortConfig.settings.principals);
+  publishersFile = pkgs.writeText "overlay-registry-publishers.json" (builtins.toJSON publishers);
+
   overlay-registry = pkgs.buildGoModule {
     pname = "overlay-registry";
     version = "0.1.0";
@@ -13,6 +21,7 @@ in
     description = "Fort overlay registry";
     after = [ "network.target" ];
     wantedBy = [ "multi-user.target" ];
+    path = [ pkgs.openssh pkgs.sqlite ];
 
     serviceConfig = {
       ExecStart = "${overlay-registry}/bin/overlay-registry";
@@ -20,8 +29,15 @@ in
       RestartSec = "5s";
       StateDirectory = "overlay-registry";
       Environment = [
+        # SQLite store; registry.json is imported into it once, when empty,
+        # and stays as it was (`overlay-registry export` writes a fresh one)
+        "REGISTRY_STORE=sqlite"
+        "REGISTRY_DB=/var/lib/overlay-registry/registry.db"
         "REGISTRY_DATA_FILE=/var/lib/overlay-registry/registry.json"
         "LISTEN_ADDR=127.0.0.1:9480"
+        "REGISTRY_PUBLISHERS=${publishersFile}"
+        # Host keys for the signed status reports staged rollouts wait on
+        "REGISTRY_HOSTS=/etc/fort/hosts.json"
       ];
     };
   };
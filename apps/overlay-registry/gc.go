@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Dead packages. Every listing a host fetches (GET /?host=h, /_watch, or
+// GET /<pkg>?host=h) is logged per package and host — only the packages in
+// the answer, so a manager asking for ?packages=a,b keeps just those alive.
+// Requests that don't name a host (curl from a laptop) are not counted, and
+// nor are names outside hosts.json — ?host= is not authenticated, so only a
+// cluster host's name can keep a package alive. The log is buffered in
+// memory and flushed to the store every fetchFlushInterval; a flush that
+// fails is dropped rather than retried, so one bad batch cannot stop the
+// fetch log for good.
+//
+// GET /_stale?days=N (default 30) lists the packages no host fetched in N
+// days that were not published in that time either; DELETE /<pkg>?days=N
+// removes one of them — heads, history and fetch log — signed by a publisher
+// like a publish (action "delete", no channel or store path), but in its own
+// namespace so a publish signature can never delete. A package that is not
+// stale by the same measure is refused, whatever this replica has heard from
+// hosts since it started.
+
+const (
+	deleteNamespace    = "fort-overlay-delete"
+	defaultStaleDays   = 30
+	fetchFlushInterval = time.Minute
+)
+
+// deleteRequest is the DELETE /<package> body, signed over the package,
+// action "delete" and the timestamp
+type deleteRequest struct {
+	Publisher string `json:"publisher"`
+	Timestamp int64  `json:"timestamp"`
+	Signature string `json:"signature"`
+}
+
+// StalePackage is one entry of GET /_stale
+type StalePackage struct {
+	Package       string   `json:"package"`
+	LastPublished int64    `json:"lastPublished"`
+	LastFetched   int64    `json:"lastFetched,omitempty"` // 0: no host fetched it since fetches were logged
+	Hosts         []string `json:"hosts,omitempty"`       // hosts that ever fetched it
+}
+
+// fetchLog buffers fetches until the next flush
+type fetchLog struct {
+	mu      sync.Mutex
+	pending map[string]map[string]int64 // package -> host -> last fetch
+}
+
+func newFetchLog() *fetchLog {
+	return &fetchLog{pending: make(map[string]map[string]int64)}
+}
+
+// mergeFetches folds from into into, keeping the later time per host
+func mergeFetches(into, from map[string]map[string]int64) {
+	for name, hosts := range from {
+		if into[name] == nil {
+			into[name] = make(map[string]int64)
+		}
+		for host, at := range hosts {
+			into[name][host] = max(into[name][host], at)
+		}
+	}
+}
+
+// hostnameRe is a cluster host name, for registries without hosts.json
+var hostnameRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// recordFetch logs that host was answered with listing, if host names a
+// cluster host
+func (r *Registry) recordFetch(host string, listing map[string]Entry) {
+	if len(r.hostKeys) > 0 {
+		if _, ok := r.hostKeys[host]; !ok {
+			return
+		}
+	} else if !hostnameRe.MatchString(host) {
+		return
+	}
+	r.fetches.record(host, listing, time.Now())
+}
+
+// record logs that host was answered with listing
+func (l *fetchLog) record(host string, listing map[string]Entry, now time.Time) {
+	if host == "" || len(listing) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for name := range listing {
+		if l.pending[name] == nil {
+			l.pending[name] = make(map[string]int64)
+		}
+		l.pending[name][host] = now.Unix()
+	}
+}
+
+// snapshot returns the buffered fetches
+func (l *fetchLog) snapshot() map[string]map[string]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make(map[string]map[string]int64, len(l.pending))
+	mergeFetches(out, l.pending)
+	return out
+}
+
+// flush writes the buffered fetches to the store; on failure they are
+// dropped, the next listings logging the hosts again
+func (r *Registry) flushFetches() {
+	r.fetches.mu.Lock()
+	pending := r.fetches.pending
+	r.fetches.pending = make(map[string]map[string]int64)
+	r.fetches.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	if err := r.store.RecordFetches(pending); err != nil {
+		log.Printf("fetch log: dropping %d package(s) of fetches: %v", len(pending), err)
+	}
+}
+
+// flushLoop flushes the fetch log for as long as the registry runs
+func (r *Registry) flushLoop() {
+	for range time.Tick(fetchFlushInterval) {
+		r.flushFetches()
+	}
+}
+
+// staleness is when a package was last published and fetched, and by whom
+func staleness(name string, pkg *Package, fetches map[string]map[string]int64) StalePackage {
+	s := StalePackage{Package: name}
+	for _, entry := range pkg.Channels {
+		s.LastPublished = max(s.LastPublished, entry.UpdatedAt)
+	}
+	for _, h := range pkg.History {
+		s.LastPublished = max(s.LastPublished, h.UpdatedAt)
+	}
+	for host, at := range fetches[name] {
+		s.LastFetched = max(s.LastFetched, at)
+		s.Hosts = append(s.Hosts, host)
+	}
+	sort.Strings(s.Hosts)
+	return s
+}
+
+// isStale reports whether s was neither fetched nor published since cutoff
+func (s StalePackage) isStale(cutoff time.Time) bool {
+	return max(s.LastPublished, s.LastFetched) < cutoff.Unix()
+}
+
+// stale lists the packages neither fetched nor published since cutoff; the
+// caller holds the read lock
+func (r *Registry) stale(fetches map[string]map[string]int64, cutoff time.Time) []StalePackage {
+	out := []StalePackage{}
+	for name, pkg := range r.packages {
+		if s := staleness(name, pkg, fetches); s.isStale(cutoff) {
+			out = append(out, s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Package < out[j].Package })
+	return out
+}
+
+// staleCutoff is the ?days=N of a request (default defaultStaleDays) as a
+// time
+func staleCutoff(req *http.Request) (time.Time, error) {
+	days := defaultStaleDays
+	if s := req.URL.Query().Get("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return time.Time{}, fmt.Errorf("days must be a positive number")
+		}
+		days = n
+	}
+	return time.Now().AddDate(0, 0, -days), nil
+}
+
+// allFetches is the stored fetch log with the fetches not yet flushed
+func (r *Registry) allFetches() (map[string]map[string]int64, error) {
+	fetches, err := r.store.Fetches()
+	if err != nil {
+		return nil, err
+	}
+	mergeFetches(fetches, r.fetches.snapshot())
+	return fetches, nil
+}
+
+// serveStale handles GET /_stale
+func (r *Registry) serveStale(w http.ResponseWriter, req *http.Request) {
+	cutoff, err := staleCutoff(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fetches, err := r.allFetches()
+	if err != nil {
+		log.Printf("fetch log: %v", err)
+		http.Error(w, "fetch log unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.stale(fetches, cutoff))
+}
+
+// deletePackage handles DELETE /<pkg>. A package with a rollout in progress,
+// fetched or published within the request's days, or that a host last
+// reported following, is kept.
+func (r *Registry) deletePackage(w http.ResponseWriter, req *http.Request, name string) {
+	var body deleteRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Publisher == "" || body.Signature == "" {
+		http.Error(w, "publisher and signature required", http.StatusUnauthorized)
+		return
+	}
+	cutoff, err := staleCutoff(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fetches, err := r.allFetches()
+	if err != nil {
+		log.Printf("fetch log: %v", err)
+		http.Error(w, "fetch log unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	r.lock()
+	defer r.mu.Unlock()
+	pkg, ok := r.packages[name]
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err := verifyDelete(r.publishers, name, body, latestTimestamp(pkg), time.Now()); err != nil {
+		log.Printf("rejected delete of %s from %q: %v", name, body.Publisher, err)
+		http.Error(w, "signature verification failed: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if len(pkg.Rollouts) > 0 {
+		http.Error(w, "a rollout is in progress; abort it first", http.StatusConflict)
+		return
+	}
+	if s := staleness(name, pkg, fetches); !s.isStale(cutoff) {
+		http.Error(w, fmt.Sprintf("not stale: last published %s, last fetched %s (by %v)",
+			unixTime(s.LastPublished), unixTime(s.LastFetched), s.Hosts), http.StatusConflict)
+		return
+	}
+	var followers []string
+	for host := range r.reports {
+		for channel := range pkg.Channels {
+			if ov := r.status(host, name, channel); ov != nil && ov.Enabled {
+				followers = append(followers, host)
+				break
+			}
+		}
+	}
+	if len(followers) > 0 {
+		sort.Strings(followers)
+		http.Error(w, fmt.Sprintf("still followed by %v", followers), http.StatusConflict)
+		return
+	}
+
+	delete(r.packages, name)
+	if err := r.save(); err != nil {
+		saveFailed(w, err)
+		return
+	}
+	r.fetches.mu.Lock()
+	delete(r.fetches.pending, name)
+	r.fetches.mu.Unlock()
+	log.Printf("deleted %s (publisher %s)", name, body.Publisher)
+	fmt.Fprintf(w, `{"ok":true}`)
+}
+
+// unixTime formats a unix time for an error message; 0 is never
+func unixTime(at int64) string {
+	if at == 0 {
+		return "never"
+	}
+	return time.Unix(at, 0).UTC().Format(time.RFC3339)
+}
+
+// latestTimestamp is the newest signed timestamp on a package: a delete
+// must be newer, so an old signature cannot be replayed
+func latestTimestamp(pkg *Package) int64 {
+	var latest int64
+	for _, entry := range pkg.Channels {
+		latest = max(latest, entry.Timestamp)
+	}
+	for _, h := range pkg.History {
+		latest = max(latest, h.Timestamp)
+	}
+	return latest
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// publisherKey creates an SSH key and returns its private key path and
+// public key
+func publisherKey(t *testing.T) (string, string) {
+	t.Helper()
+	keyPath := filepath.Join(t.TempDir(), "publisher")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", keyPath).CombinedOutput(); err != nil {
+		t.Skipf("ssh-keygen unavailable: %v %s", err, out)
+	}
+	pub, err := os.ReadFile(keyPath + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(string(pub))
+	return keyPath, fields[0] + " " + fields[1]
+}
+
+func TestDeleteRequiresAStalePackage(t *testing.T) {
+	keyPath, pubkey := publisherKey(t)
+	store := &jsonStore{path: filepath.Join(t.TempDir(), "registry.json")}
+	old := time.Now().AddDate(0, 0, -90).Unix()
+	packages := map[string]*Package{"infra/coffer": {
+		Channels: map[string]Entry{"stable": entry("/nix/store/aaa-coffer", old)},
+		History:  []HistoryEntry{{Entry: entry("/nix/store/aaa-coffer", old), Channel: "stable"}},
+	}}
+	if _, err := store.Save(packages, 0); err != nil {
+		t.Fatal(err)
+	}
+	// A host fetched it last week; this replica has heard no report since
+	store.RecordFetches(map[string]map[string]int64{"infra/coffer": {"joker": time.Now().AddDate(0, 0, -7).Unix()}})
+	r, err := NewRegistry(store, map[string]string{"ci": pubkey}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	del := func(query string) *httptest.ResponseRecorder {
+		t.Helper()
+		timestamp := time.Now().Unix()
+		sig, err := sign(keyPath, deleteNamespace, canonicalEntry("infra/coffer", "", "delete", "", timestamp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := json.Marshal(deleteRequest{Publisher: "ci", Timestamp: timestamp, Signature: sig})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/infra/coffer"+query, strings.NewReader(string(body))))
+		return w
+	}
+
+	if w := del(""); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "not stale") {
+		t.Errorf("delete of a package fetched last week: %d %s", w.Code, w.Body)
+	}
+	if w := del("?days=3"); w.Code != http.StatusOK {
+		t.Fatalf("delete stale within 3 days: %d %s", w.Code, w.Body)
+	}
+	if _, ok := r.packages["infra/coffer"]; ok {
+		t.Error("package not deleted")
+	}
+	if fetches, _ := store.Fetches(); len(fetches) != 0 {
+		t.Errorf("fetch log kept for a deleted package: %v", fetches)
+	}
+}
+
+func TestRecordFetchOnlyCountsClusterHosts(t *testing.T) {
+	listing := map[string]Entry{"infra/coffer": entry("/nix/store/aaa-coffer", 100)}
+
+	r := &Registry{fetches: newFetchLog(), hostKeys: map[string]string{"joker": "ssh-ed25519 AAAA"}}
+	for _, host := range []string{"joker", "ursula", "", "joker\x00"} {
+		r.recordFetch(host, listing)
+	}
+	if got := r.fetches.snapshot(); len(got["infra/coffer"]) != 1 || got["infra/coffer"]["joker"] == 0 {
+		t.Errorf("with hosts.json: logged %v", got)
+	}
+
+	r = &Registry{fetches: newFetchLog(), hostKeys: map[string]string{}}
+	for _, host := range []string{"joker", "joker.fort.example", "jo'ker", "a\x00b", "-x"} {
+		r.recordFetch(host, listing)
+	}
+	if got := r.fetches.snapshot(); len(got["infra/coffer"]) != 1 || got["infra/coffer"]["joker"] == 0 {
+		t.Errorf("without hosts.json: logged %v", got)
+	}
+}
+
+// failingStore is a store whose fetch log cannot be written
+type failingStore struct{ *jsonStore }
+
+func (failingStore) RecordFetches(map[string]map[string]int64) error {
+	return errors.New("disk full")
+}
+
+func TestFlushDropsABatchItCannotWrite(t *testing.T) {
+	r := &Registry{fetches: newFetchLog(), store: failingStore{&jsonStore{path: filepath.Join(t.TempDir(), "registry.json")}}, hostKeys: map[string]string{}}
+	r.recordFetch("joker", map[string]Entry{"infra/coffer": entry("/nix/store/aaa-coffer", 100)})
+	r.flushFetches()
+	if got := r.fetches.snapshot(); len(got) != 0 {
+		t.Errorf("failed batch kept for a retry: %v", got)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,107 +13,479 @@ import (
 	"time"
 )
 
+// defaultChannel is what a publish without a channel, and a host without a
+// subscription, use — the single entry per package of older registries
+const defaultChannel = "stable"
+
 type Entry struct {
 	StorePath string `json:"storePath"`
 	UpdatedAt int64  `json:"updatedAt"`
+	Action    string `json:"action,omitempty"` // signed: "publish", "promote" or "rollout"
+	Publisher string `json:"publisher,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"` // signed publish time
+	Signature string `json:"signature,omitempty"`
+}
+
+// HistoryEntry is one append-only record of a channel moving
+type HistoryEntry struct {
+	Entry
+	Channel string `json:"channel"`
+	From    string `json:"from,omitempty"` // source channel of a promotion
+}
+
+// Package is everything the registry knows about one package: the head of
+// each channel and the timeline that got them there
+type Package struct {
+	Channels map[string]Entry    `json:"channels"`
+	History  []HistoryEntry      `json:"history"`
+	Rollouts map[string]*Rollout `json:"rollouts,omitempty"` // by channel (rollout.go)
+}
+
+// publishRequest is the POST /<package> body
+type publishRequest struct {
+	StorePath string `json:"storePath"`
+	Channel   string `json:"channel,omitempty"`
+	Publisher string `json:"publisher"`
+	Timestamp int64  `json:"timestamp"`
+	Signature string `json:"signature"`
+}
+
+// promoteRequest is the POST /<package>/promote body. StorePath must be the
+// head of From: the publisher signs the exact path being promoted, so a
+// channel that moved after they looked cannot be promoted by accident.
+type promoteRequest struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	StorePath string `json:"storePath"`
+	Publisher string `json:"publisher"`
+	Timestamp int64  `json:"timestamp"`
+	Signature string `json:"signature"`
 }
 
 type Registry struct {
-	mu       sync.RWMutex
-	entries  map[string]Entry
-	dataFile string
+	mu         sync.RWMutex
+	packages   map[string]*Package
+	store      Store             // (store.go)
+	generation int64             // of the store, as packages were loaded or saved
+	publishers map[string]string // publisher -> SSH public key
+	hostKeys   map[string]string // host -> SSH public key, for reports
+	reports    map[string]*HostReport
+	fetches    *fetchLog     // not yet flushed to the store (gc.go)
+	changed    chan struct{} // closed and replaced on every change (watch.go)
+}
+
+func NewRegistry(store Store, publishers, hostKeys map[string]string) (*Registry, error) {
+	packages, generation, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	return &Registry{
+		packages:   packages,
+		store:      store,
+		generation: generation,
+		publishers: publishers,
+		hostKeys:   hostKeys,
+		reports:    make(map[string]*HostReport),
+		fetches:    newFetchLog(),
+		changed:    make(chan struct{}),
+	}, nil
 }
 
-func NewRegistry(dataFile string) (*Registry, error) {
-	r := &Registry{entries: make(map[string]Entry), dataFile: dataFile}
-	if data, err := os.ReadFile(dataFile); err == nil {
-		if err := json.Unmarshal(data, &r.entries); err != nil {
-			return nil, fmt.Errorf("parse %s: %w", dataFile, err)
+// parseData reads registry.json, migrating the original package -> Entry
+// format: each entry becomes the stable head and the first history record.
+func parseData(data []byte) (map[string]*Package, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	packages := make(map[string]*Package, len(raw))
+	for name, msg := range raw {
+		var probe struct {
+			Channels json.RawMessage `json:"channels"`
+		}
+		if err := json.Unmarshal(msg, &probe); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if probe.Channels != nil {
+			var pkg Package
+			if err := json.Unmarshal(msg, &pkg); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			if pkg.Channels == nil {
+				pkg.Channels = make(map[string]Entry)
+			}
+			packages[name] = &pkg
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(msg, &entry); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		entry.Action = "publish"
+		packages[name] = &Package{
+			Channels: map[string]Entry{defaultChannel: entry},
+			History:  []HistoryEntry{{Entry: entry, Channel: defaultChannel}},
 		}
 	}
-	return r, nil
+	return packages, nil
 }
 
+// save writes the packages through to the store. If another writer saved
+// first, the registry takes on their packages and the change is lost:
+// callers report errConflict and the client retries.
 func (r *Registry) save() error {
-	data, err := json.MarshalIndent(r.entries, "", "  ")
-	if err != nil {
+	generation, err := r.store.Save(r.packages, r.generation)
+	if err == errConflict {
+		r.refresh()
 		return err
 	}
-	tmp := r.dataFile + ".tmp"
-	if err := os.WriteFile(tmp, data, 0644); err != nil {
+	if err != nil {
 		return err
 	}
-	return os.Rename(tmp, r.dataFile)
+	r.generation = generation
+	r.notify()
+	return nil
+}
+
+// refresh takes on the stored packages if another writer changed them,
+// reporting whether it did; the caller holds the write lock
+func (r *Registry) refresh() bool {
+	generation, err := r.store.Generation()
+	if err != nil {
+		log.Printf("store: %v", err)
+		return false
+	}
+	if generation == r.generation {
+		return false
+	}
+	packages, generation, err := r.store.Load()
+	if err != nil {
+		log.Printf("store: %v", err)
+		return false
+	}
+	r.packages, r.generation = packages, generation
+	r.notify()
+	return true
+}
+
+// lock takes the write lock on the latest stored packages, for a change
+func (r *Registry) lock() {
+	r.mu.Lock()
+	r.refresh()
 }
 
+// follow picks up other writers' changes for as long as the registry runs
+func (r *Registry) follow() {
+	for range time.Tick(refreshInterval) {
+		r.mu.Lock()
+		r.refresh()
+		r.mu.Unlock()
+	}
+}
+
+// saveFailed answers a change that could not be saved
+func saveFailed(w http.ResponseWriter, err error) {
+	log.Printf("save error: %v", err)
+	if err == errConflict {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	http.Error(w, "save failed", http.StatusInternalServerError)
+}
+
+// listing is the head of channel for every package that has one: the
+// package -> Entry map managers poll. For a host admitted to a rollout the
+// rollout's entry stands in for the head.
+func (r *Registry) listing(channel, host string) map[string]Entry {
+	out := make(map[string]Entry, len(r.packages))
+	for name, pkg := range r.packages {
+		if ro := pkg.Rollouts[channel]; ro != nil && host != "" && ro.admitted(host) {
+			out[name] = ro.Entry
+		} else if entry, ok := pkg.Channels[channel]; ok {
+			out[name] = entry
+		}
+	}
+	return out
+}
+
+// record moves channel to entry and appends the move to the history. The
+// caller holds the write lock and saves.
+func (r *Registry) record(name, channel string, entry Entry, from string) {
+	pkg, ok := r.packages[name]
+	if !ok {
+		pkg = &Package{Channels: make(map[string]Entry)}
+		r.packages[name] = pkg
+	}
+	pkg.Channels[channel] = entry
+	pkg.History = append(pkg.History, HistoryEntry{Entry: entry, Channel: channel, From: from})
+}
+
+// head returns channel's current entry for name, if any
+func (r *Registry) head(name, channel string) *Entry {
+	if pkg, ok := r.packages[name]; ok {
+		if entry, ok := pkg.Channels[channel]; ok {
+			return &entry
+		}
+	}
+	return nil
+}
+
+// Routes, with package names that may themselves contain slashes
+// (infra/knockout):
+//
+//	GET  /[?channel=c][&host=h][&packages=a,b][&prefix=p]
+//	                                channel heads of those packages (all by default), as h sees them (ETag)
+//	GET  /_watch[?...]              long-poll until that listing changes (watch.go)
+//	GET  /_stale[?days=n]           packages no host fetched or anyone published in n days (gc.go)
+//	GET  /<pkg>[?channel=c][&host=h] one channel head
+//	GET  /<pkg>/history             append-only timeline, oldest first
+//	GET  /<pkg>/rollout[?channel=c] rollout progress
+//	POST /<pkg>                     publishRequest
+//	POST /<pkg>/promote             promoteRequest
+//	POST /<pkg>/rollout             rolloutRequest
+//	POST /<pkg>/rollout/resume      controlRequest
+//	POST /<pkg>/rollout/abort       controlRequest
+//	POST /_report/<host>            host-signed status report
+//	DELETE /<pkg>[?days=n]          deleteRequest; only a package stale by /_stale (gc.go)
 func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	path := strings.TrimPrefix(req.URL.Path, "/")
+	channel := channelOf(req.URL.Query().Get("channel"))
+
+	// Long-polls must not hold the read lock while they wait
+	if req.Method == http.MethodGet && path == "_watch" {
+		r.watch(w, req)
+		return
+	}
+	if req.Method == http.MethodGet && path == "_stale" {
+		r.serveStale(w, req)
+		return
+	}
 
 	switch req.Method {
 	case http.MethodGet:
 		r.mu.RLock()
 		defer r.mu.RUnlock()
 		w.Header().Set("Content-Type", "application/json")
-		if path == "" {
-			json.NewEncoder(w).Encode(r.entries)
-		} else {
-			entry, ok := r.entries[path]
+		switch {
+		case path == "":
+			query := req.URL.Query()
+			listing := filterListing(r.listing(channel, query.Get("host")), query.Get("packages"), query.Get("prefix"))
+			r.recordFetch(query.Get("host"), listing)
+			serveListing(w, req, listing)
+		case strings.HasSuffix(path, "/history"):
+			pkg, ok := r.packages[strings.TrimSuffix(path, "/history")]
 			if !ok {
 				http.Error(w, "not found", http.StatusNotFound)
 				return
 			}
+			json.NewEncoder(w).Encode(pkg.History)
+		case strings.HasSuffix(path, "/rollout"):
+			r.rolloutStatus(w, strings.TrimSuffix(path, "/rollout"), channel)
+		default:
+			entry := r.head(path, channel)
+			if entry == nil {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			r.recordFetch(req.URL.Query().Get("host"), map[string]Entry{path: *entry})
 			json.NewEncoder(w).Encode(entry)
 		}
 
 	case http.MethodPost:
+		switch {
+		case strings.HasPrefix(path, "_report/"):
+			r.report(w, req, strings.TrimPrefix(path, "_report/"))
+			return
+		case strings.HasSuffix(path, "/promote"):
+			r.promote(w, req, strings.TrimSuffix(path, "/promote"))
+			return
+		case strings.HasSuffix(path, "/rollout/resume"):
+			r.controlRollout(w, req, strings.TrimSuffix(path, "/rollout/resume"), "resume")
+			return
+		case strings.HasSuffix(path, "/rollout/abort"):
+			r.controlRollout(w, req, strings.TrimSuffix(path, "/rollout/abort"), "abort")
+			return
+		case strings.HasSuffix(path, "/rollout"):
+			r.startRollout(w, req, strings.TrimSuffix(path, "/rollout"))
+			return
+		}
 		if path == "" {
 			http.Error(w, "package name required", http.StatusBadRequest)
 			return
 		}
-		var body struct {
-			StorePath string `json:"storePath"`
-		}
+		var body publishRequest
 		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.StorePath == "" {
 			http.Error(w, "storePath required", http.StatusBadRequest)
 			return
 		}
-		r.mu.Lock()
-		r.entries[path] = Entry{StorePath: body.StorePath, UpdatedAt: time.Now().Unix()}
+		if body.Publisher == "" || body.Signature == "" {
+			http.Error(w, "publisher and signature required", http.StatusUnauthorized)
+			return
+		}
+		if body.Channel == "" {
+			body.Channel = defaultChannel
+		}
+		entry := Entry{
+			StorePath: body.StorePath,
+			UpdatedAt: time.Now().Unix(),
+			Action:    "publish",
+			Publisher: body.Publisher,
+			Timestamp: body.Timestamp,
+			Signature: body.Signature,
+		}
+		r.lock()
+		defer r.mu.Unlock()
+		if r.rollout(path, body.Channel) != nil {
+			http.Error(w, "a rollout is in progress on "+body.Channel+"; abort it first", http.StatusConflict)
+			return
+		}
+		if err := verifyPublish(r.publishers, path, body.Channel, entry, r.head(path, body.Channel), time.Now()); err != nil {
+			log.Printf("rejected %s from %q: %v", path, body.Publisher, err)
+			http.Error(w, "signature verification failed: "+err.Error(), http.StatusForbidden)
+			return
+		}
+		r.record(path, body.Channel, entry, "")
 		if err := r.save(); err != nil {
-			r.mu.Unlock()
-			log.Printf("save error: %v", err)
-			http.Error(w, "save failed", http.StatusInternalServerError)
+			saveFailed(w, err)
 			return
 		}
-		r.mu.Unlock()
-		log.Printf("updated %s -> %s", path, body.StorePath)
+		log.Printf("updated %s@%s -> %s (publisher %s)", path, body.Channel, body.StorePath, body.Publisher)
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, `{"ok":true}`)
 
+	case http.MethodDelete:
+		if path == "" {
+			http.Error(w, "package name required", http.StatusBadRequest)
+			return
+		}
+		r.deletePackage(w, req, path)
+
 	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+// promote points one channel at another's current head, e.g. canary to
+// stable once the canary hosts are happy
+func (r *Registry) promote(w http.ResponseWriter, req *http.Request, name string) {
+	var body promoteRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.From == "" || body.To == "" || body.StorePath == "" {
+		http.Error(w, "from, to and storePath required", http.StatusBadRequest)
+		return
+	}
+	if body.From == body.To {
+		http.Error(w, "from and to are the same channel", http.StatusBadRequest)
+		return
+	}
+	if body.Publisher == "" || body.Signature == "" {
+		http.Error(w, "publisher and signature required", http.StatusUnauthorized)
+		return
+	}
+
+	r.lock()
+	defer r.mu.Unlock()
+	if err := r.checkPromotion(name, body); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	entry := Entry{
+		StorePath: body.StorePath,
+		UpdatedAt: time.Now().Unix(),
+		Action:    "promote",
+		Publisher: body.Publisher,
+		Timestamp: body.Timestamp,
+		Signature: body.Signature,
+	}
+	if err := verifyPublish(r.publishers, name, body.To, entry, r.head(name, body.To), time.Now()); err != nil {
+		log.Printf("rejected promotion of %s from %q: %v", name, body.Publisher, err)
+		http.Error(w, "signature verification failed: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	r.record(name, body.To, entry, body.From)
+	if err := r.save(); err != nil {
+		saveFailed(w, err)
+		return
+	}
+	log.Printf("promoted %s %s -> %s: %s (publisher %s)", name, body.From, body.To, body.StorePath, body.Publisher)
+	fmt.Fprintf(w, `{"ok":true}`)
+}
+
+// checkPromotion verifies the promoted path is still the head of its source
+func (r *Registry) checkPromotion(name string, body promoteRequest) error {
+	from := r.head(name, body.From)
+	if from == nil {
+		return fmt.Errorf("%s has no %s channel", name, body.From)
+	}
+	if from.StorePath != body.StorePath {
+		return errors.New("storePath is not the head of " + body.From)
+	}
+	if r.rollout(name, body.To) != nil {
+		return errors.New("a rollout is in progress on " + body.To + "; abort it first")
+	}
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		runSign(os.Args[2:])
+		return
+	}
+
 	dataFile := os.Getenv("REGISTRY_DATA_FILE")
 	if dataFile == "" {
 		dataFile = "/var/lib/overlay-registry/registry.json"
 	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			runExport(dataFile)
+			return
+		case "import":
+			runImport(dataFile, os.Args[2:])
+			return
+		}
+	}
 	if err := os.MkdirAll(filepath.Dir(dataFile), 0755); err != nil {
 		log.Fatal(err)
 	}
+	store, err := openStore(dataFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := importLegacy(store, dataFile); err != nil {
+		log.Fatalf("import %s: %v", dataFile, err)
+	}
 
 	listenAddr := os.Getenv("LISTEN_ADDR")
 	if listenAddr == "" {
 		listenAddr = "127.0.0.1:9480"
 	}
 
-	registry, err := NewRegistry(dataFile)
+	publishers, err := loadPublishers(os.Getenv("REGISTRY_PUBLISHERS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(publishers) == 0 {
+		log.Printf("no publishers configured (REGISTRY_PUBLISHERS); all writes will be rejected")
+	}
+
+	hostsFile := os.Getenv("REGISTRY_HOSTS")
+	if hostsFile == "" {
+		hostsFile = "/etc/fort/hosts.json"
+	}
+	hostKeys, err := loadHostKeys(hostsFile)
+	if err != nil {
+		log.Printf("%v; host status reports will be rejected", err)
+		hostKeys = map[string]string{}
+	}
+
+	registry, err := NewRegistry(store, publishers, hostKeys)
 	if err != nil {
 		log.Fatal(err)
 	}
+	go registry.follow()
+	go registry.flushLoop()
 
-	log.Printf("overlay-registry listening on %s (data: %s)", listenAddr, dataFile)
+	log.Printf("overlay-registry listening on %s (data: %s, %d publishers)", listenAddr, store, len(publishers))
 	log.Fatal(http.ListenAndServe(listenAddr, registry))
 }
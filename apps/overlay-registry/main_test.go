@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRegistry is an empty registry on a json store that trusts one
+// publisher, "ci"; it returns the publisher's private key path
+func testRegistry(t *testing.T) (*Registry, string) {
+	t.Helper()
+	keyPath, pubkey := publisherKey(t)
+	r, err := NewRegistry(&jsonStore{path: filepath.Join(t.TempDir(), "registry.json")}, map[string]string{"ci": pubkey}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, keyPath
+}
+
+// do sends a request with a JSON body, if any, through the registry
+func do(r *Registry, method, path string, body any) *httptest.ResponseRecorder {
+	var payload string
+	if body != nil {
+		data, _ := json.Marshal(body)
+		payload = string(data)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(payload)))
+	return w
+}
+
+func publish(t *testing.T, r *Registry, keyPath, name, channel, storePath string, timestamp int64) *httptest.ResponseRecorder {
+	t.Helper()
+	sig, err := signEntry(keyPath, name, channelOf(channel), "publish", storePath, timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return do(r, http.MethodPost, "/"+name, publishRequest{StorePath: storePath, Channel: channel, Publisher: "ci", Timestamp: timestamp, Signature: sig})
+}
+
+func promote(t *testing.T, r *Registry, keyPath, name, from, to, storePath string, timestamp int64) *httptest.ResponseRecorder {
+	t.Helper()
+	sig, err := signEntry(keyPath, name, to, "promote", storePath, timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return do(r, http.MethodPost, "/"+name+"/promote", promoteRequest{From: from, To: to, StorePath: storePath, Publisher: "ci", Timestamp: timestamp, Signature: sig})
+}
+
+// A rollout owns its channel's head until it completes or is aborted
+func TestWritesRefusedDuringRollout(t *testing.T) {
+	r, keyPath := testRegistry(t)
+	now := time.Now().Unix()
+	if w := publish(t, r, keyPath, "infra/coffer", "canary", "/nix/store/bbb-coffer", now); w.Code != http.StatusOK {
+		t.Fatalf("publish: %d %s", w.Code, w.Body)
+	}
+	r.packages["infra/coffer"].Rollouts = map[string]*Rollout{"stable": {
+		Channel: "stable", Entry: entry("/nix/store/aaa-coffer", now), Waves: []Wave{{Percent: 100}}, State: "running", StartedAt: now,
+	}}
+
+	if w := publish(t, r, keyPath, "infra/coffer", "", "/nix/store/ccc-coffer", now+1); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "rollout is in progress") {
+		t.Errorf("publish onto the rollout's channel: %d %s", w.Code, w.Body)
+	}
+	if w := promote(t, r, keyPath, "infra/coffer", "canary", "stable", "/nix/store/bbb-coffer", now+2); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "rollout is in progress") {
+		t.Errorf("promote onto the rollout's channel: %d %s", w.Code, w.Body)
+	}
+	if r.head("infra/coffer", "stable") != nil {
+		t.Errorf("stable head moved under a rollout: %+v", r.head("infra/coffer", "stable"))
+	}
+	if w := publish(t, r, keyPath, "infra/coffer", "canary", "/nix/store/ddd-coffer", now+3); w.Code != http.StatusOK {
+		t.Errorf("publish to another channel: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestPromoteAndHistory(t *testing.T) {
+	r, keyPath := testRegistry(t)
+	ts := time.Now().Unix()
+	if w := publish(t, r, keyPath, "infra/coffer", "", oldPath, ts); w.Code != http.StatusOK {
+		t.Fatalf("publish stable: %d %s", w.Code, w.Body)
+	}
+	if w := publish(t, r, keyPath, "infra/coffer", "canary", newPath, ts+1); w.Code != http.StatusOK {
+		t.Fatalf("publish canary: %d %s", w.Code, w.Body)
+	}
+
+	for _, tt := range []struct {
+		name           string
+		from, to, path string
+		code           int
+	}{
+		{"not the head of from", "canary", "stable", oldPath, http.StatusConflict},
+		{"no such channel", "beta", "stable", newPath, http.StatusConflict},
+		{"same channel", "canary", "canary", newPath, http.StatusBadRequest},
+		{"canary to stable", "canary", "stable", newPath, http.StatusOK},
+	} {
+		ts++
+		if w := promote(t, r, keyPath, "infra/coffer", tt.from, tt.to, tt.path, ts); w.Code != tt.code {
+			t.Errorf("%s: %d %s, want %d", tt.name, w.Code, w.Body, tt.code)
+		}
+	}
+	if w := do(r, http.MethodGet, "/infra/coffer", nil); !strings.Contains(w.Body.String(), newPath) {
+		t.Errorf("stable head after promote: %s", w.Body)
+	}
+
+	w := do(r, http.MethodGet, "/infra/coffer/history", nil)
+	var history []HistoryEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	var got []string
+	for _, h := range history {
+		got = append(got, h.Channel+" "+h.Action+" "+h.StorePath+" "+h.From)
+	}
+	want := []string{
+		"stable publish " + oldPath + " ",
+		"canary publish " + newPath + " ",
+		"stable promote " + newPath + " canary",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("history:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if w := do(r, http.MethodGet, "/infra/knockout/history", nil); w.Code != http.StatusNotFound {
+		t.Errorf("history of an unknown package: %d", w.Code)
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Staged rollouts. Without one, a publish reaches every subscriber within a
+// poll interval. A rollout instead holds the new entry aside and admits hosts
+// in waves — typically a canary host, then percentages of the channel's
+// subscribers. Admitted hosts see the new store path in their listing
+// (GET /?host=<name>), everyone else the channel head. A wave is done once
+// every admitted host reports the path permanent and out of its bake; the
+// rollout pauses by itself if an admitted host reports that path rolled back
+// or failed, or if an admitted host has not reported at all reportTimeout
+// after its wave was admitted (a listed host that is down or gone would
+// otherwise hold the rollout forever). After the last wave the entry
+// becomes the channel head. While a rollout runs, publishes and promotions
+// to its channel are refused: abort it first.
+//
+// Hosts report with POST /_report/<host>: the manager's `status --json`,
+// signed with the host's SSH key like a fort-provider request (own
+// namespace) and verified against /etc/fort/hosts.json. Reports are kept in
+// memory only; after a restart rollouts wait for the next round of reports.
+
+const (
+	reportNamespace = "fort-overlay-report"
+	reportTimeout   = 30 * time.Minute
+)
+
+// Wave admits explicit hosts and/or a percentage of the channel's subscribers
+// (sorted by name, so each wave is a superset of the previous)
+type Wave struct {
+	Hosts   []string `json:"hosts,omitempty"`
+	Percent int      `json:"percent,omitempty"`
+}
+
+type Rollout struct {
+	Channel       string   `json:"channel"`
+	Entry         Entry    `json:"entry"`
+	Waves         []Wave   `json:"waves"`
+	WavesAdmitted int      `json:"wavesAdmitted"`
+	WaveAt        int64    `json:"waveAt,omitempty"` // when the last wave was admitted
+	Admitted      []string `json:"admitted"`
+	State         string   `json:"state"` // running, paused
+	Reason        string   `json:"reason,omitempty"`
+	StartedAt     int64    `json:"startedAt"`
+	ResumedAt     int64    `json:"resumedAt,omitempty"`
+	LastControl   int64    `json:"lastControl,omitempty"` // signed timestamp of the last resume/abort
+}
+
+// rolloutRequest is the POST /<package>/rollout body; signed like a publish,
+// with action "rollout"
+type rolloutRequest struct {
+	Channel   string `json:"channel,omitempty"`
+	StorePath string `json:"storePath"`
+	Waves     []Wave `json:"waves"`
+	Publisher string `json:"publisher"`
+	Timestamp int64  `json:"timestamp"`
+	Signature string `json:"signature"`
+}
+
+// controlRequest is the POST /<package>/rollout/{resume,abort} body, signed
+// over the rollout's channel and store path with action "resume" or "abort"
+type controlRequest struct {
+	Channel   string `json:"channel,omitempty"`
+	StorePath string `json:"storePath"`
+	Publisher string `json:"publisher"`
+	Timestamp int64  `json:"timestamp"`
+	Signature string `json:"signature"`
+}
+
+// HostReport is a host's last status report
+type HostReport struct {
+	ReceivedAt int64           `json:"receivedAt"`
+	Overlays   []OverlayStatus `json:"overlays"`
+}
+
+// OverlayStatus is the part of a manager status entry rollouts read
+type OverlayStatus struct {
+	Name    string `json:"name"`
+	Package string `json:"package"`
+	Channel string `json:"channel"`
+	State   string `json:"state"`
+	Enabled bool   `json:"enabled"`
+	Current *struct {
+		StorePath string `json:"storePath"`
+	} `json:"current"`
+	LastAttempt *struct {
+		StorePath string `json:"storePath"`
+		State     string `json:"state"`
+		Reason    string `json:"reason"`
+		At        int64  `json:"at"`
+	} `json:"lastAttempt"`
+	Bake *struct {
+		StorePath string `json:"storePath"`
+	} `json:"bake"`
+}
+
+// HostProgress is one host's view of a rollout, for GET /<pkg>/rollout
+type HostProgress struct {
+	Host      string `json:"host"`
+	Admitted  bool   `json:"admitted"`
+	StorePath string `json:"storePath,omitempty"`
+	State     string `json:"state,omitempty"`
+	Done      bool   `json:"done"`
+	Waiting   string `json:"waiting,omitempty"` // why the wave waits on an admitted host
+}
+
+// loadHostKeys reads the fort-provider hosts.json: {"host": {"pubkey": ...}}
+func loadHostKeys(path string) (map[string]string, error) {
+	keys := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read hosts: %w", err)
+	}
+	var hosts map[string]struct {
+		Pubkey string `json:"pubkey"`
+	}
+	if err := json.Unmarshal(data, &hosts); err != nil {
+		return nil, fmt.Errorf("parse hosts: %w", err)
+	}
+	for name, h := range hosts {
+		keys[name] = h.Pubkey
+	}
+	return keys, nil
+}
+
+func channelOf(channel string) string {
+	if channel == "" {
+		return defaultChannel
+	}
+	return channel
+}
+
+// status returns host's last reported status for a package on channel
+func (r *Registry) status(host, name, channel string) *OverlayStatus {
+	report, ok := r.reports[host]
+	if !ok {
+		return nil
+	}
+	for i := range report.Overlays {
+		ov := &report.Overlays[i]
+		if ov.Package == name && channelOf(ov.Channel) == channel {
+			return ov
+		}
+	}
+	return nil
+}
+
+// subscribers lists hosts whose last report follows name on channel
+func (r *Registry) subscribers(name, channel string) []string {
+	var hosts []string
+	for host := range r.reports {
+		if ov := r.status(host, name, channel); ov != nil && ov.Enabled {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func (r *Registry) rollout(name, channel string) *Rollout {
+	if pkg, ok := r.packages[name]; ok {
+		return pkg.Rollouts[channel]
+	}
+	return nil
+}
+
+// admitted reports whether host is past the gate of a rollout on name
+func (ro *Rollout) admitted(host string) bool {
+	for _, h := range ro.Admitted {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// done reports whether host runs the rollout's path permanently, baked
+func (r *Registry) done(ro *Rollout, host, name string) bool {
+	return r.waitingFor(ro, host, name) == ""
+}
+
+// waitingFor is why the rollout waits on host, or "" once host is done
+func (r *Registry) waitingFor(ro *Rollout, host, name string) string {
+	ov := r.status(host, name, ro.Channel)
+	switch {
+	case ov == nil:
+		return "no report"
+	case ov.Current == nil || ov.Current.StorePath != ro.Entry.StorePath:
+		return "not running " + ro.Entry.StorePath + " yet"
+	case ov.State != "permanent":
+		return ov.State
+	case ov.Bake != nil && ov.Bake.StorePath == ro.Entry.StorePath:
+		return "baking"
+	}
+	return ""
+}
+
+// since is when a rollout last started moving: started, resumed or
+// a wave admitted
+func (ro *Rollout) since() int64 {
+	return max(ro.StartedAt, ro.ResumedAt, ro.WaveAt)
+}
+
+// advance moves a running rollout along: pause on a reported failure of its
+// path, admit the next wave once the admitted hosts are done, promote the
+// entry to channel head after the last. Returns whether anything changed.
+func (r *Registry) advance(name string, ro *Rollout) bool {
+	if ro.State != "running" {
+		return false
+	}
+	since := max(ro.StartedAt, ro.ResumedAt)
+	for _, host := range ro.Admitted {
+		ov := r.status(host, name, ro.Channel)
+		if ov == nil || ov.LastAttempt == nil || ov.LastAttempt.StorePath != ro.Entry.StorePath || ov.LastAttempt.At < since {
+			continue
+		}
+		if ov.LastAttempt.State == "rolled-back" || ov.LastAttempt.State == "failed" {
+			ro.State = "paused"
+			ro.Reason = fmt.Sprintf("%s %s: %s", host, ov.LastAttempt.State, ov.LastAttempt.Reason)
+			log.Printf("rollout %s@%s paused: %s", name, ro.Channel, ro.Reason)
+			return true
+		}
+	}
+
+	if time.Since(time.Unix(ro.since(), 0)) > reportTimeout {
+		for _, host := range ro.Admitted {
+			report, ok := r.reports[host]
+			if !ok || report.ReceivedAt < ro.since() || r.status(host, name, ro.Channel) == nil {
+				ro.State = "paused"
+				ro.Reason = fmt.Sprintf("%s has not reported %s@%s within %s", host, name, ro.Channel, reportTimeout)
+				log.Printf("rollout %s@%s paused: %s", name, ro.Channel, ro.Reason)
+				return true
+			}
+		}
+	}
+
+	changed := false
+	for {
+		for _, host := range ro.Admitted {
+			if !r.done(ro, host, name) {
+				return changed
+			}
+		}
+		if ro.WavesAdmitted == len(ro.Waves) {
+			r.record(name, ro.Channel, ro.Entry, "")
+			delete(r.packages[name].Rollouts, ro.Channel)
+			log.Printf("rollout %s@%s complete: %s", name, ro.Channel, ro.Entry.StorePath)
+			return true
+		}
+		r.admitWave(name, ro)
+		changed = true
+	}
+}
+
+func (r *Registry) admitWave(name string, ro *Rollout) {
+	wave := ro.Waves[ro.WavesAdmitted]
+	ro.WavesAdmitted++
+	ro.WaveAt = time.Now().Unix()
+	candidates := append([]string(nil), wave.Hosts...)
+	if wave.Percent > 0 {
+		subs := r.subscribers(name, ro.Channel)
+		n := (len(subs)*wave.Percent + 99) / 100
+		candidates = append(candidates, subs[:min(n, len(subs))]...)
+	}
+	for _, host := range candidates {
+		if !ro.admitted(host) {
+			ro.Admitted = append(ro.Admitted, host)
+		}
+	}
+	log.Printf("rollout %s@%s: wave %d/%d, admitted %v", name, ro.Channel, ro.WavesAdmitted, len(ro.Waves), ro.Admitted)
+}
+
+// advanceAll re-evaluates every rollout after a report; caller holds the lock
+func (r *Registry) advanceAll() bool {
+	changed := false
+	for name, pkg := range r.packages {
+		for _, ro := range pkg.Rollouts {
+			if r.advance(name, ro) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+func validateWaves(waves []Wave) error {
+	if len(waves) == 0 {
+		return errors.New("at least one wave required")
+	}
+	for i, w := range waves {
+		if len(w.Hosts) == 0 && w.Percent <= 0 {
+			return fmt.Errorf("wave %d admits nobody", i+1)
+		}
+		if w.Percent > 100 {
+			return fmt.Errorf("wave %d: percent %d over 100", i+1, w.Percent)
+		}
+	}
+	return nil
+}
+
+// startRollout handles POST /<pkg>/rollout
+func (r *Registry) startRollout(w http.ResponseWriter, req *http.Request, name string) {
+	var body rolloutRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.StorePath == "" {
+		http.Error(w, "storePath required", http.StatusBadRequest)
+		return
+	}
+	if err := validateWaves(body.Waves); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Publisher == "" || body.Signature == "" {
+		http.Error(w, "publisher and signature required", http.StatusUnauthorized)
+		return
+	}
+	channel := channelOf(body.Channel)
+
+	r.lock()
+	defer r.mu.Unlock()
+	if r.rollout(name, channel) != nil {
+		http.Error(w, "a rollout is already in progress on "+channel+"; abort it first", http.StatusConflict)
+		return
+	}
+	for _, wave := range body.Waves {
+		for _, host := range wave.Hosts {
+			if r.status(host, name, channel) == nil {
+				http.Error(w, fmt.Sprintf("%s has not reported a subscription to %s@%s", host, name, channel), http.StatusConflict)
+				return
+			}
+		}
+	}
+	entry := Entry{
+		StorePath: body.StorePath,
+		UpdatedAt: time.Now().Unix(),
+		Action:    "rollout",
+		Publisher: body.Publisher,
+		Timestamp: body.Timestamp,
+		Signature: body.Signature,
+	}
+	if err := verifyPublish(r.publishers, name, channel, entry, r.head(name, channel), time.Now()); err != nil {
+		log.Printf("rejected rollout of %s from %q: %v", name, body.Publisher, err)
+		http.Error(w, "signature verification failed: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	pkg, ok := r.packages[name]
+	if !ok {
+		pkg = &Package{Channels: make(map[string]Entry)}
+		r.packages[name] = pkg
+	}
+	if pkg.Rollouts == nil {
+		pkg.Rollouts = make(map[string]*Rollout)
+	}
+	ro := &Rollout{Channel: channel, Entry: entry, Waves: body.Waves, State: "running", StartedAt: time.Now().Unix()}
+	pkg.Rollouts[channel] = ro
+	r.advance(name, ro)
+	if err := r.save(); err != nil {
+		saveFailed(w, err)
+		return
+	}
+	log.Printf("rollout %s@%s started: %s (publisher %s)", name, channel, body.StorePath, body.Publisher)
+	fmt.Fprintf(w, `{"ok":true}`)
+}
+
+// controlRollout handles POST /<pkg>/rollout/resume and /abort. Aborting
+// drops the held entry: admitted hosts see the channel head again, but
+// managers refuse an entry older than one they accepted, so hosts already
+// on the rolled-out path stay there until the next publish or a rollback.
+func (r *Registry) controlRollout(w http.ResponseWriter, req *http.Request, name, action string) {
+	var body controlRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.StorePath == "" {
+		http.Error(w, "storePath required", http.StatusBadRequest)
+		return
+	}
+	if body.Publisher == "" || body.Signature == "" {
+		http.Error(w, "publisher and signature required", http.StatusUnauthorized)
+		return
+	}
+	channel := channelOf(body.Channel)
+
+	r.lock()
+	defer r.mu.Unlock()
+	ro := r.rollout(name, channel)
+	if ro == nil || ro.Entry.StorePath != body.StorePath {
+		http.Error(w, "no rollout of that storePath on "+channel, http.StatusConflict)
+		return
+	}
+	entry := Entry{StorePath: body.StorePath, Action: action, Publisher: body.Publisher, Timestamp: body.Timestamp, Signature: body.Signature}
+	prev := &Entry{Timestamp: max(ro.Entry.Timestamp, ro.LastControl)}
+	if err := verifyPublish(r.publishers, name, channel, entry, prev, time.Now()); err != nil {
+		http.Error(w, "signature verification failed: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	ro.LastControl = body.Timestamp
+
+	switch action {
+	case "resume":
+		ro.State = "running"
+		ro.Reason = ""
+		ro.ResumedAt = time.Now().Unix()
+		r.advance(name, ro)
+	case "abort":
+		delete(r.packages[name].Rollouts, channel)
+	}
+	if err := r.save(); err != nil {
+		saveFailed(w, err)
+		return
+	}
+	log.Printf("rollout %s@%s %s by %s", name, channel, action, body.Publisher)
+	fmt.Fprintf(w, `{"ok":true}`)
+}
+
+// rolloutStatus handles GET /<pkg>/rollout
+func (r *Registry) rolloutStatus(w http.ResponseWriter, name, channel string) {
+	ro := r.rollout(name, channel)
+	if ro == nil {
+		http.Error(w, "no rollout in progress", http.StatusNotFound)
+		return
+	}
+	hosts := r.subscribers(name, channel)
+	for _, host := range ro.Admitted {
+		if r.status(host, name, channel) == nil {
+			hosts = append(hosts, host)
+		}
+	}
+	progress := make([]HostProgress, 0, len(hosts))
+	for _, host := range hosts {
+		p := HostProgress{Host: host, Admitted: ro.admitted(host), Done: r.done(ro, host, name)}
+		if p.Admitted && !p.Done {
+			p.Waiting = r.waitingFor(ro, host, name)
+		}
+		if ov := r.status(host, name, channel); ov != nil {
+			p.State = ov.State
+			if ov.Current != nil {
+				p.StorePath = ov.Current.StorePath
+			}
+		}
+		progress = append(progress, p)
+	}
+	json.NewEncoder(w).Encode(struct {
+		*Rollout
+		Hosts []HostProgress `json:"hosts"`
+	}{ro, progress})
+}
+
+// report handles POST /_report/<host>
+func (r *Registry) report(w http.ResponseWriter, req *http.Request, host string) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "read body", http.StatusBadRequest)
+		return
+	}
+	if err := r.verifyReport(req, host, body); err != nil {
+		log.Printf("rejected report from %s: %v", host, err)
+		http.Error(w, "authentication failed: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var overlays []OverlayStatus
+	if err := json.Unmarshal(body, &overlays); err != nil {
+		http.Error(w, "invalid status: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.lock()
+	defer r.mu.Unlock()
+	r.reports[host] = &HostReport{ReceivedAt: time.Now().Unix(), Overlays: overlays}
+	if r.advanceAll() {
+		if err := r.save(); err != nil {
+			log.Printf("save error: %v", err)
+		}
+	}
+	fmt.Fprintf(w, `{"ok":true}`)
+}
+
+// verifyReport checks a report's X-Fort-* headers against the host's key
+func (r *Registry) verifyReport(req *http.Request, host string, body []byte) error {
+	if origin := req.Header.Get("X-Fort-Origin"); origin != host {
+		return fmt.Errorf("origin %q does not match %q", origin, host)
+	}
+	pubkey, ok := r.hostKeys[host]
+	if !ok {
+		return fmt.Errorf("unknown host %q", host)
+	}
+	timestamp := req.Header.Get("X-Fort-Timestamp")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+	if d := time.Since(time.Unix(ts, 0)); d > maxClockSkew || d < -maxClockSkew {
+		return errors.New("timestamp outside allowed window")
+	}
+	return verifySignature(canonicalReport(req.Method, req.URL.Path, timestamp, body), reportNamespace, req.Header.Get("X-Fort-Signature"), host, pubkey)
+}
+
+// canonicalReport is fort-provider's canonical request string
+func canonicalReport(method, path, timestamp string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return fmt.Sprintf("%s\n%s\n%s\n%s", method, path, timestamp, hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	oldPath = "/nix/store/aaa-coffer"
+	newPath = "/nix/store/bbb-coffer"
+)
+
+// reported is a host report following infra/coffer@stable; status holds
+// the remaining fields of its status entry, as the manager writes them
+func reported(t *testing.T, status string) *HostReport {
+	t.Helper()
+	var overlays []OverlayStatus
+	doc := `[{"name":"coffer","package":"infra/coffer","channel":"stable","enabled":true` + status + `}]`
+	if err := json.Unmarshal([]byte(doc), &overlays); err != nil {
+		t.Fatal(err)
+	}
+	return &HostReport{ReceivedAt: time.Now().Unix(), Overlays: overlays}
+}
+
+// running is the status of a host on path, permanent and baked
+func running(t *testing.T, path string) *HostReport {
+	return reported(t, `,"state":"permanent","current":{"storePath":"`+path+`"}`)
+}
+
+// rolloutRegistry holds a rollout of newPath to infra/coffer@stable, whose
+// head is oldPath
+func rolloutRegistry(ro *Rollout, reports map[string]*HostReport) *Registry {
+	ro.Channel, ro.Entry = "stable", entry(newPath, 200)
+	if ro.State == "" {
+		ro.State = "running"
+	}
+	if ro.StartedAt == 0 {
+		ro.StartedAt = time.Now().Unix()
+	}
+	return &Registry{
+		packages: map[string]*Package{"infra/coffer": {
+			Channels: map[string]Entry{"stable": entry(oldPath, 100)},
+			History:  []HistoryEntry{{Entry: entry(oldPath, 100), Channel: "stable"}},
+			Rollouts: map[string]*Rollout{"stable": ro},
+		}},
+		reports: reports,
+	}
+}
+
+func TestAdmitWave(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		admitted []string
+		wave     Wave
+		want     []string
+	}{
+		{"explicit hosts", nil, Wave{Hosts: []string{"ursula"}}, []string{"ursula"}},
+		{"percent rounds up", nil, Wave{Percent: 25}, []string{"joker"}},
+		{"percent of sorted subscribers", nil, Wave{Percent: 50}, []string{"joker", "lordhenry"}},
+		{"hosts and percent", nil, Wave{Hosts: []string{"ursula"}, Percent: 50}, []string{"ursula", "joker", "lordhenry"}},
+		{"superset of earlier waves", []string{"ursula"}, Wave{Percent: 100}, []string{"ursula", "joker", "lordhenry", "minos"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reports := map[string]*HostReport{}
+			for _, host := range []string{"minos", "joker", "ursula", "lordhenry"} {
+				reports[host] = running(t, oldPath)
+			}
+			ro := &Rollout{Waves: []Wave{tt.wave}, Admitted: tt.admitted}
+			r := rolloutRegistry(ro, reports)
+			r.admitWave("infra/coffer", ro)
+			if !reflect.DeepEqual(ro.Admitted, tt.want) {
+				t.Errorf("admitted %v, want %v", ro.Admitted, tt.want)
+			}
+			if ro.WavesAdmitted != 1 || ro.WaveAt == 0 {
+				t.Errorf("wave not counted: %+v", ro)
+			}
+		})
+	}
+}
+
+func TestRolloutDone(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		status  string // "" for no report
+		waiting string
+	}{
+		{"no report", "", "no report"},
+		{"still on the old path", `,"state":"permanent","current":{"storePath":"` + oldPath + `"}`, "not running " + newPath + " yet"},
+		{"on trial", `,"state":"trial","current":{"storePath":"` + newPath + `"}`, "trial"},
+		{"baking", `,"state":"permanent","current":{"storePath":"` + newPath + `"},"bake":{"storePath":"` + newPath + `"}`, "baking"},
+		{"done", `,"state":"permanent","current":{"storePath":"` + newPath + `"}`, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reports := map[string]*HostReport{}
+			if tt.status != "" {
+				reports["joker"] = reported(t, tt.status)
+			}
+			ro := &Rollout{}
+			r := rolloutRegistry(ro, reports)
+			if got := r.waitingFor(ro, "joker", "infra/coffer"); got != tt.waiting {
+				t.Errorf("waiting for %q, want %q", got, tt.waiting)
+			}
+			if done := r.done(ro, "joker", "infra/coffer"); done != (tt.waiting == "") {
+				t.Errorf("done = %v", done)
+			}
+		})
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	now := time.Now().Unix()
+	long := time.Now().Add(-2 * reportTimeout).Unix()
+	failed := func(at int64) string {
+		return `,"state":"permanent","current":{"storePath":"` + oldPath + `"},"lastAttempt":{"storePath":"` + newPath + `","state":"rolled-back","reason":"health check failed","at":` + strconv.FormatInt(at, 10) + `}`
+	}
+	for _, tt := range []struct {
+		name      string
+		rollout   Rollout
+		reports   map[string]string // host -> status fields; "-" for a stale report
+		changed   bool
+		state     string // "" once promoted
+		reason    string
+		admitted  []string
+		waveCount int
+	}{
+		{
+			name:      "waits on an admitted host",
+			rollout:   Rollout{Waves: []Wave{{Hosts: []string{"joker"}}, {Percent: 100}}, WavesAdmitted: 1, WaveAt: now, Admitted: []string{"joker"}},
+			reports:   map[string]string{"joker": `,"state":"trial","current":{"storePath":"` + newPath + `"}`, "ursula": ""},
+			state:     "running",
+			admitted:  []string{"joker"},
+			waveCount: 1,
+		},
+		{
+			name:      "admits the next wave",
+			rollout:   Rollout{Waves: []Wave{{Hosts: []string{"joker"}}, {Percent: 100}}, WavesAdmitted: 1, WaveAt: now, Admitted: []string{"joker"}},
+			reports:   map[string]string{"joker": "done", "ursula": ""},
+			changed:   true,
+			state:     "running",
+			admitted:  []string{"joker", "ursula"},
+			waveCount: 2,
+		},
+		{
+			name:    "promotes after the last wave",
+			rollout: Rollout{Waves: []Wave{{Hosts: []string{"joker"}}, {Percent: 100}}, WavesAdmitted: 2, WaveAt: now, Admitted: []string{"joker", "ursula"}},
+			reports: map[string]string{"joker": "done", "ursula": "done"},
+			changed: true,
+		},
+		{
+			name:      "pauses on a failure",
+			rollout:   Rollout{Waves: []Wave{{Hosts: []string{"joker"}}, {Percent: 100}}, WavesAdmitted: 1, WaveAt: now, Admitted: []string{"joker"}},
+			reports:   map[string]string{"joker": failed(now), "ursula": ""},
+			changed:   true,
+			state:     "paused",
+			reason:    "joker rolled-back: health check failed",
+			admitted:  []string{"joker"},
+			waveCount: 1,
+		},
+		{
+			name:      "ignores a failure from before a resume",
+			rollout:   Rollout{Waves: []Wave{{Hosts: []string{"joker"}}}, WavesAdmitted: 1, StartedAt: long, ResumedAt: now, Admitted: []string{"joker"}},
+			reports:   map[string]string{"joker": failed(long)},
+			state:     "running",
+			admitted:  []string{"joker"},
+			waveCount: 1,
+		},
+		{
+			name:      "a silent listed host within the timeout",
+			rollout:   Rollout{Waves: []Wave{{Hosts: []string{"ursula"}}}, WavesAdmitted: 1, WaveAt: now, Admitted: []string{"ursula"}},
+			reports:   map[string]string{"joker": "done", "ursula": "-"},
+			state:     "running",
+			admitted:  []string{"ursula"},
+			waveCount: 1,
+		},
+		{
+			name:      "pauses on a silent listed host",
+			rollout:   Rollout{Waves: []Wave{{Hosts: []string{"ursula"}}}, WavesAdmitted: 1, StartedAt: long, WaveAt: long, Admitted: []string{"ursula"}},
+			reports:   map[string]string{"joker": "done", "ursula": "-"},
+			changed:   true,
+			state:     "paused",
+			reason:    "ursula has not reported infra/coffer@stable within 30m0s",
+			admitted:  []string{"ursula"},
+			waveCount: 1,
+		},
+		{
+			name:      "pauses on a host that was never heard from",
+			rollout:   Rollout{Waves: []Wave{{Hosts: []string{"minos"}}}, WavesAdmitted: 1, StartedAt: long, WaveAt: long, Admitted: []string{"minos"}},
+			reports:   map[string]string{"joker": "done"},
+			changed:   true,
+			state:     "paused",
+			reason:    "minos has not reported infra/coffer@stable within 30m0s",
+			admitted:  []string{"minos"},
+			waveCount: 1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reports := map[string]*HostReport{}
+			for host, status := range tt.reports {
+				switch status {
+				case "done":
+					reports[host] = running(t, newPath)
+				case "-":
+					reports[host] = running(t, oldPath)
+					reports[host].ReceivedAt = time.Now().Add(-3 * reportTimeout).Unix()
+				default:
+					reports[host] = reported(t, status)
+				}
+			}
+			ro := tt.rollout
+			r := rolloutRegistry(&ro, reports)
+			if changed := r.advance("infra/coffer", &ro); changed != tt.changed {
+				t.Errorf("changed = %v, want %v", changed, tt.changed)
+			}
+			pkg := r.packages["infra/coffer"]
+			if tt.state == "" {
+				if _, ok := pkg.Rollouts["stable"]; ok {
+					t.Error("rollout kept after its last wave")
+				}
+				if head := pkg.Channels["stable"]; head.StorePath != newPath {
+					t.Errorf("head = %s, want %s", head.StorePath, newPath)
+				}
+				if h := pkg.History; len(h) != 2 || h[1].StorePath != newPath {
+					t.Errorf("history = %+v", h)
+				}
+				return
+			}
+			if head := pkg.Channels["stable"]; head.StorePath != oldPath {
+				t.Errorf("head moved to %s before the rollout finished", head.StorePath)
+			}
+			if ro.State != tt.state || ro.Reason != tt.reason {
+				t.Errorf("state %q (%q), want %q (%q)", ro.State, ro.Reason, tt.state, tt.reason)
+			}
+			if !reflect.DeepEqual(ro.Admitted, tt.admitted) || ro.WavesAdmitted != tt.waveCount {
+				t.Errorf("admitted %v after %d waves, want %v after %d", ro.Admitted, ro.WavesAdmitted, tt.admitted, tt.waveCount)
+			}
+		})
+	}
+}
+
+// GET /<pkg>/rollout says why a wave is not done
+func TestRolloutStatusShowsWhatItWaitsOn(t *testing.T) {
+	ro := &Rollout{Waves: []Wave{{Hosts: []string{"joker", "ursula"}}}, WavesAdmitted: 1, WaveAt: time.Now().Unix(), Admitted: []string{"joker", "ursula"}}
+	r := rolloutRegistry(ro, map[string]*HostReport{"joker": running(t, newPath)})
+
+	w := do(r, http.MethodGet, "/infra/coffer/rollout", nil)
+	var got struct {
+		Hosts []HostProgress `json:"hosts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	want := []HostProgress{
+		{Host: "joker", Admitted: true, StorePath: newPath, State: "permanent", Done: true},
+		{Host: "ursula", Admitted: true, Waiting: "no report"},
+	}
+	if !reflect.DeepEqual(got.Hosts, want) {
+		t.Errorf("hosts = %+v, want %+v", got.Hosts, want)
+	}
+}
+
+func TestVerifyReport(t *testing.T) {
+	jokerKey, jokerPub := publisherKey(t)
+	otherKey, _ := publisherKey(t)
+	r := &Registry{hostKeys: map[string]string{"joker": jokerPub}}
+	body := []byte(`[]`)
+	now := time.Now().Unix()
+
+	for _, tt := range []struct {
+		name      string
+		host      string
+		origin    string
+		key       string
+		timestamp int64
+		signed    []byte // body the signature covers
+		err       string
+	}{
+		{"valid", "joker", "joker", jokerKey, now, body, ""},
+		{"origin is another host", "joker", "ursula", jokerKey, now, body, "does not match"},
+		{"host not in hosts.json", "ursula", "ursula", jokerKey, now, body, "unknown host"},
+		{"stale timestamp", "joker", "joker", jokerKey, now - 600, body, "outside allowed window"},
+		{"signed by another key", "joker", "joker", otherKey, now, body, "ssh-keygen verify"},
+		{"body changed after signing", "joker", "joker", jokerKey, now, []byte(`[{}]`), "ssh-keygen verify"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := "/_report/" + tt.host
+			timestamp := strconv.FormatInt(tt.timestamp, 10)
+			sig, err := sign(tt.key, reportNamespace, canonicalReport(http.MethodPost, path, timestamp, tt.signed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(string(body)))
+			req.Header.Set("X-Fort-Origin", tt.origin)
+			req.Header.Set("X-Fort-Timestamp", timestamp)
+			req.Header.Set("X-Fort-Signature", sig)
+			err = r.verifyReport(req, tt.host, body)
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entries are signed by their publisher over package, channel, action, store
+// path and timestamp, SSH signatures as in fort-provider but in their own
+// namespace so a control-plane request signature can never be replayed as a
+// publish. Signing the channel and action keeps a captured canary publish
+// from landing on stable, and a publish body from steering a rollout. The
+// signature doubles as write authentication and travels with the entry, so
+// fort-overlay-manager verifies the publisher — and the channel it follows —
+// itself rather than trusting whoever served the registry.
+const signatureNamespace = "fort-overlay"
+
+// maxClockSkew bounds how old (or how far ahead) a publish timestamp may be
+const maxClockSkew = 5 * time.Minute
+
+// canonicalEntry is the signed message
+func canonicalEntry(pkg, channel, action, storePath string, timestamp int64) string {
+	return fmt.Sprintf("%s\n%s\n%s\n%s\n%d", pkg, channel, action, storePath, timestamp)
+}
+
+// loadPublishers reads the publisher -> SSH public key map
+func loadPublishers(path string) (map[string]string, error) {
+	publishers := make(map[string]string)
+	if path == "" {
+		return publishers, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read publishers: %w", err)
+	}
+	if err := json.Unmarshal(data, &publishers); err != nil {
+		return nil, fmt.Errorf("parse publishers: %w", err)
+	}
+	return publishers, nil
+}
+
+// verifyPublish checks a signed write of e.Action to pkg's channel. prev is
+// the current entry, if any: a timestamp that does not advance on it is a
+// replay.
+func verifyPublish(publishers map[string]string, pkg, channel string, e Entry, prev *Entry, now time.Time) error {
+	pubkey, ok := publishers[e.Publisher]
+	if !ok {
+		return fmt.Errorf("unknown publisher %q", e.Publisher)
+	}
+	ts := time.Unix(e.Timestamp, 0)
+	if ts.Before(now.Add(-maxClockSkew)) || ts.After(now.Add(maxClockSkew)) {
+		return errors.New("timestamp outside allowed window")
+	}
+	if prev != nil && e.Timestamp <= prev.Timestamp {
+		return errors.New("timestamp does not advance on the current entry")
+	}
+	return verifySignature(canonicalEntry(pkg, channel, e.Action, e.StorePath, e.Timestamp), signatureNamespace, e.Signature, e.Publisher, pubkey)
+}
+
+// verifyDelete checks a DELETE /<pkg> request; latest is the newest
+// timestamp on the package
+func verifyDelete(publishers map[string]string, pkg string, body deleteRequest, latest int64, now time.Time) error {
+	pubkey, ok := publishers[body.Publisher]
+	if !ok {
+		return fmt.Errorf("unknown publisher %q", body.Publisher)
+	}
+	ts := time.Unix(body.Timestamp, 0)
+	if ts.Before(now.Add(-maxClockSkew)) || ts.After(now.Add(maxClockSkew)) {
+		return errors.New("timestamp outside allowed window")
+	}
+	if body.Timestamp <= latest {
+		return errors.New("timestamp does not advance on the package's entries")
+	}
+	return verifySignature(canonicalEntry(pkg, "", "delete", "", body.Timestamp), deleteNamespace, body.Signature, body.Publisher, pubkey)
+}
+
+// verifySignature checks a base64 SSH signature over message with ssh-keygen
+func verifySignature(message, namespace, signatureB64, principal, pubkey string) error {
+	sigBytes, err := base64.StdEncoding.DecodeString(signatureB64)
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "overlay-registry-verify-")
+	if err != nil {
+		return fmt.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	allowedSignersPath := filepath.Join(tmpDir, "allowed_signers")
+	if err := os.WriteFile(allowedSignersPath, []byte(fmt.Sprintf("%s %s\n", principal, pubkey)), 0600); err != nil {
+		return fmt.Errorf("write allowed_signers: %w", err)
+	}
+	sigPath := filepath.Join(tmpDir, "signature")
+	if err := os.WriteFile(sigPath, []byte(armorSignature(sigBytes)), 0600); err != nil {
+		return fmt.Errorf("write signature: %w", err)
+	}
+
+	cmd := exec.Command("ssh-keygen", "-Y", "verify",
+		"-f", allowedSignersPath,
+		"-n", namespace,
+		"-I", principal,
+		"-s", sigPath,
+	)
+	cmd.Stdin = strings.NewReader(message)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ssh-keygen verify: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func armorSignature(sig []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(sig)
+	var b strings.Builder
+	b.WriteString("-----BEGIN SSH SIGNATURE-----\n")
+	for len(encoded) > 70 {
+		b.WriteString(encoded[:70] + "\n")
+		encoded = encoded[70:]
+	}
+	b.WriteString(encoded + "\n")
+	b.WriteString("-----END SSH SIGNATURE-----\n")
+	return b.String()
+}
+
+// signEntry signs an action on pkg's channel with the publisher's SSH
+// private key
+func signEntry(keyPath, pkg, channel, action, storePath string, timestamp int64) (string, error) {
+	return sign(keyPath, signatureNamespace, canonicalEntry(pkg, channel, action, storePath, timestamp))
+}
+
+func sign(keyPath, namespace, message string) (string, error) {
+	cmd := exec.Command("ssh-keygen", "-Y", "sign", "-f", keyPath, "-n", namespace, "-q")
+	cmd.Stdin = strings.NewReader(message)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("ssh-keygen sign: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var b64 strings.Builder
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "-----") {
+			continue
+		}
+		b64.WriteString(strings.TrimSpace(line))
+	}
+	return b64.String(), nil
+}
+
+// runSign is `overlay-registry sign`: prints the JSON body for a publish, for
+// CI to POST to /<package> — or, with --from, for a promotion to POST to
+// /<package>/promote (--store-path then being the head of --from), or, with
+// --waves, for a staged rollout to POST to /<package>/rollout, or, with
+// --resume or --abort, for /<package>/rollout/resume or /abort (--store-path
+// being the rollout's). With --delete (and no --store-path) it is the body
+// for DELETE /<package>. Each body is signed for its channel and action only.
+func runSign(args []string) {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	keyPath := fs.String("key", "", "publisher SSH private key")
+	publisher := fs.String("publisher", "", "publisher name (as in the registry's publisher list)")
+	pkg := fs.String("package", "", "package name")
+	storePath := fs.String("store-path", "", "store path to publish")
+	channel := fs.String("channel", "", "channel to publish or promote to (default stable)")
+	from := fs.String("from", "", "promote from this channel instead of publishing")
+	waves := fs.String("waves", "", "roll out in waves instead of publishing: comma-separated hosts and percentages, e.g. ratched,25,100")
+	resume := fs.Bool("resume", false, "resume the rollout of --store-path instead of publishing")
+	abort := fs.Bool("abort", false, "abort the rollout of --store-path instead of publishing")
+	del := fs.Bool("delete", false, "delete the package instead of publishing")
+	fs.Parse(args)
+	if *keyPath == "" || *publisher == "" || *pkg == "" || (*storePath == "") != *del || (*resume && *abort) {
+		fmt.Fprintln(os.Stderr, "Usage: overlay-registry sign --key <path> --publisher <name> --package <pkg> --store-path <path> [--channel <c>] [--from <c> | --waves <w> | --resume | --abort]")
+		fmt.Fprintln(os.Stderr, "       overlay-registry sign --key <path> --publisher <name> --package <pkg> --delete")
+		os.Exit(2)
+	}
+
+	timestamp := time.Now().Unix()
+	if *del {
+		sig, err := sign(*keyPath, deleteNamespace, canonicalEntry(*pkg, "", "delete", "", timestamp))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		json.NewEncoder(os.Stdout).Encode(deleteRequest{Publisher: *publisher, Timestamp: timestamp, Signature: sig})
+		return
+	}
+	action := "publish"
+	switch {
+	case *resume:
+		action = "resume"
+	case *abort:
+		action = "abort"
+	case *waves != "":
+		action = "rollout"
+	case *from != "":
+		action = "promote"
+	}
+	sig, err := signEntry(*keyPath, *pkg, channelOf(*channel), action, *storePath, timestamp)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	switch action {
+	case "resume", "abort":
+		json.NewEncoder(os.Stdout).Encode(controlRequest{
+			Channel:   *channel,
+			StorePath: *storePath,
+			Publisher: *publisher,
+			Timestamp: timestamp,
+			Signature: sig,
+		})
+		return
+	case "rollout":
+		json.NewEncoder(os.Stdout).Encode(rolloutRequest{
+			Channel:   *channel,
+			StorePath: *storePath,
+			Waves:     parseWaves(*waves),
+			Publisher: *publisher,
+			Timestamp: timestamp,
+			Signature: sig,
+		})
+		return
+	case "promote":
+		json.NewEncoder(os.Stdout).Encode(promoteRequest{
+			From:      *from,
+			To:        channelOf(*channel),
+			StorePath: *storePath,
+			Publisher: *publisher,
+			Timestamp: timestamp,
+			Signature: sig,
+		})
+		return
+	}
+	json.NewEncoder(os.Stdout).Encode(publishRequest{
+		StorePath: *storePath,
+		Channel:   *channel,
+		Publisher: *publisher,
+		Timestamp: timestamp,
+		Signature: sig,
+	})
+}
+
+// parseWaves reads --waves: each comma-separated item is a percentage or a
+// host name, and is a wave of its own
+func parseWaves(spec string) []Wave {
+	var waves []Wave
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if percent, err := strconv.Atoi(strings.TrimSuffix(item, "%")); err == nil {
+			waves = append(waves, Wave{Percent: percent})
+		} else {
+			waves = append(waves, Wave{Hosts: []string{item}})
+		}
+	}
+	return waves
+}
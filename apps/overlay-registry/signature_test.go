@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyPublish(t *testing.T) {
+	keyPath, pubkey := publisherKey(t)
+	otherKey, _ := publisherKey(t)
+	publishers := map[string]string{"ci": pubkey}
+	now := time.Now()
+	ts := now.Unix()
+	prev := entry(oldPath, ts-10)
+
+	for _, tt := range []struct {
+		name      string
+		publisher string
+		key       string
+		signed    string // channel the signature covers
+		channel   string // channel published to
+		timestamp int64
+		prev      *Entry
+		err       string
+	}{
+		{"valid", "ci", keyPath, "stable", "stable", ts, &prev, ""},
+		{"first publish", "ci", keyPath, "stable", "stable", ts, nil, ""},
+		{"unknown publisher", "mallory", keyPath, "stable", "stable", ts, nil, "unknown publisher"},
+		{"signed by another key", "ci", otherKey, "stable", "stable", ts, nil, "ssh-keygen verify"},
+		{"canary signature replayed on stable", "ci", keyPath, "canary", "stable", ts, nil, "ssh-keygen verify"},
+		{"replayed timestamp", "ci", keyPath, "stable", "stable", prev.Timestamp, &prev, "does not advance"},
+		{"stale timestamp", "ci", keyPath, "stable", "stable", ts - 600, nil, "outside allowed window"},
+		{"future timestamp", "ci", keyPath, "stable", "stable", ts + 600, nil, "outside allowed window"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sig, err := signEntry(tt.key, "infra/coffer", tt.signed, "publish", newPath, tt.timestamp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := Entry{StorePath: newPath, Action: "publish", Publisher: tt.publisher, Timestamp: tt.timestamp, Signature: sig}
+			err = verifyPublish(publishers, "infra/coffer", tt.channel, e, tt.prev, now)
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// A publish signature cannot be replayed as another action
+func TestVerifyPublishBindsTheAction(t *testing.T) {
+	keyPath, pubkey := publisherKey(t)
+	ts := time.Now().Unix()
+	sig, err := signEntry(keyPath, "infra/coffer", "stable", "publish", newPath, ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := Entry{StorePath: newPath, Action: "rollout", Publisher: "ci", Timestamp: ts, Signature: sig}
+	if err := verifyPublish(map[string]string{"ci": pubkey}, "infra/coffer", "stable", e, nil, time.Now()); err == nil {
+		t.Error("publish signature accepted for a rollout")
+	}
+}
+
+// The registry refuses a captured publish sent again, and a forged one
+func TestPublishRejectsReplaysAndForgeries(t *testing.T) {
+	r, keyPath := testRegistry(t)
+	ts := time.Now().Unix()
+	sig, err := signEntry(keyPath, "infra/coffer", "stable", "publish", newPath, ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := publishRequest{StorePath: newPath, Publisher: "ci", Timestamp: ts, Signature: sig}
+	if w := do(r, http.MethodPost, "/infra/coffer", body); w.Code != http.StatusOK {
+		t.Fatalf("publish: %d %s", w.Code, w.Body)
+	}
+	if w := do(r, http.MethodPost, "/infra/coffer", body); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "does not advance") {
+		t.Errorf("replay: %d %s", w.Code, w.Body)
+	}
+
+	forged := body
+	forged.StorePath, forged.Timestamp = "/nix/store/evil-coffer", ts+1
+	if w := do(r, http.MethodPost, "/infra/coffer", forged); w.Code != http.StatusForbidden {
+		t.Errorf("forged store path: %d %s", w.Code, w.Body)
+	}
+	if head := r.head("infra/coffer", "stable"); head == nil || head.StorePath != newPath {
+		t.Errorf("head = %+v", head)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SQLite store, through the sqlite3 command line shell (REGISTRY_SQLITE3,
+// default sqlite3 on PATH) so the registry stays free of cgo. Every load is
+// one SELECT and every save one IMMEDIATE transaction, which rolls back
+// unless the generation row still holds the generation the save was based
+// on. Rollouts are kept as JSON: they are only ever read whole.
+//
+// Writes never put data into the SQL they pipe to the shell: the rows go
+// into a JSON file beside the database, which the script reads with
+// readfile() and unpacks with json_each, so the statements are fixed text
+// whatever a package, channel or host name contains.
+//
+// The schema is versioned with PRAGMA user_version; migrations run at
+// startup, each in its own transaction. Append new ones, never edit old
+// ones.
+
+var migrations = []string{
+	// 1: channel heads and the history that got them there
+	`CREATE TABLE generation (id INTEGER PRIMARY KEY CHECK (id = 1), value INTEGER NOT NULL);
+INSERT INTO generation VALUES (1, 0);
+CREATE TABLE channels (
+  package TEXT NOT NULL,
+  channel TEXT NOT NULL,
+  store_path TEXT NOT NULL,
+  updated_at INTEGER NOT NULL,
+  publisher TEXT NOT NULL DEFAULT '',
+  timestamp INTEGER NOT NULL DEFAULT 0,
+  signature TEXT NOT NULL DEFAULT '',
+  PRIMARY KEY (package, channel)
+);
+CREATE TABLE history (
+  package TEXT NOT NULL,
+  seq INTEGER NOT NULL,
+  channel TEXT NOT NULL,
+  action TEXT NOT NULL,
+  from_channel TEXT NOT NULL DEFAULT '',
+  store_path TEXT NOT NULL,
+  updated_at INTEGER NOT NULL,
+  publisher TEXT NOT NULL DEFAULT '',
+  timestamp INTEGER NOT NULL DEFAULT 0,
+  signature TEXT NOT NULL DEFAULT '',
+  PRIMARY KEY (package, seq)
+);`,
+	// 2: staged rollouts (rollout.go)
+	`CREATE TABLE rollouts (
+  package TEXT NOT NULL,
+  channel TEXT NOT NULL,
+  rollout TEXT NOT NULL,
+  PRIMARY KEY (package, channel)
+);`,
+	// 3: which hosts fetched which packages, and when (gc.go)
+	`CREATE TABLE fetches (
+  package TEXT NOT NULL,
+  host TEXT NOT NULL,
+  last_fetched INTEGER NOT NULL,
+  PRIMARY KEY (package, host)
+);`,
+	// 4: the signed action of each channel head (signature.go)
+	`ALTER TABLE channels ADD COLUMN action TEXT NOT NULL DEFAULT '';`,
+}
+
+// busyTimeout is how long a statement waits for another writer's lock (ms)
+const busyTimeout = 5000
+
+type sqliteStore struct {
+	path   string
+	sqlite string
+
+	mu      sync.Mutex
+	history map[string][]HistoryEntry // rows per package as of the last load or save
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	s := &sqliteStore{path: path, sqlite: os.Getenv("REGISTRY_SQLITE3"), history: map[string][]HistoryEntry{}}
+	if s.sqlite == "" {
+		s.sqlite = "sqlite3"
+	}
+	if err := s.migrate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *sqliteStore) String() string { return s.path }
+
+// exec runs a script, returning what it prints
+func (s *sqliteStore) exec(script string) (string, error) {
+	cmd := exec.Command(s.sqlite, "-batch", "-bail", s.path)
+	cmd.Stdin = strings.NewReader(fmt.Sprintf(".timeout %d\n%s\n", busyTimeout, script))
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("sqlite3: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+func (s *sqliteStore) schemaVersion() (int, error) {
+	out, err := s.exec("PRAGMA user_version;")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(out))
+}
+
+// migrate brings the schema up to date. Two replicas starting together may
+// race on a migration; the loser finds the schema moved on and carries on
+// from there.
+func (s *sqliteStore) migrate() error {
+	if _, err := s.exec("PRAGMA journal_mode = WAL;"); err != nil {
+		return err
+	}
+	for {
+		version, err := s.schemaVersion()
+		if err != nil {
+			return err
+		}
+		if version > len(migrations) {
+			return fmt.Errorf("schema version %d is newer than this registry (%d)", version, len(migrations))
+		}
+		if version == len(migrations) {
+			return nil
+		}
+		_, err = s.exec(fmt.Sprintf("BEGIN IMMEDIATE;\n%s\nPRAGMA user_version = %d;\nCOMMIT;", migrations[version], version+1))
+		if err != nil {
+			if now, verr := s.schemaVersion(); verr == nil && now > version {
+				continue
+			}
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+	}
+}
+
+// quote is a SQL string literal
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+const loadQuery = `SELECT json_object(
+  'generation', (SELECT value FROM generation),
+  'channels', (SELECT json_group_array(json_object('package', package, 'channel', channel,
+    'storePath', store_path, 'updatedAt', updated_at, 'action', action, 'publisher', publisher,
+    'timestamp', timestamp, 'signature', signature)) FROM channels),
+  'history', (SELECT json_group_array(json_object('package', package, 'seq', seq, 'channel', channel,
+    'action', action, 'from', from_channel, 'storePath', store_path, 'updatedAt', updated_at,
+    'publisher', publisher, 'timestamp', timestamp, 'signature', signature))
+    FROM (SELECT * FROM history ORDER BY package, seq)),
+  'rollouts', (SELECT json_group_array(json_object('package', package, 'channel', channel,
+    'rollout', json(rollout))) FROM rollouts)
+);`
+
+type sqliteRow struct {
+	Package string `json:"package"`
+	Seq     int    `json:"seq"`
+	HistoryEntry
+	Rollout *Rollout `json:"rollout"`
+}
+
+func (s *sqliteStore) Load() (map[string]*Package, int64, error) {
+	out, err := s.exec(loadQuery)
+	if err != nil {
+		return nil, 0, err
+	}
+	var snapshot struct {
+		Generation int64       `json:"generation"`
+		Channels   []sqliteRow `json:"channels"`
+		History    []sqliteRow `json:"history"`
+		Rollouts   []sqliteRow `json:"rollouts"`
+	}
+	if err := json.Unmarshal([]byte(out), &snapshot); err != nil {
+		return nil, 0, fmt.Errorf("parse snapshot: %w", err)
+	}
+
+	packages := make(map[string]*Package)
+	pkg := func(name string) *Package {
+		if packages[name] == nil {
+			packages[name] = &Package{Channels: make(map[string]Entry)}
+		}
+		return packages[name]
+	}
+	for _, row := range snapshot.Channels {
+		pkg(row.Package).Channels[row.Channel] = row.Entry
+	}
+	for _, row := range snapshot.History {
+		p := pkg(row.Package)
+		p.History = append(p.History, row.HistoryEntry)
+	}
+	for _, row := range snapshot.Rollouts {
+		p := pkg(row.Package)
+		if p.Rollouts == nil {
+			p.Rollouts = make(map[string]*Rollout)
+		}
+		p.Rollouts[row.Channel] = row.Rollout
+	}
+
+	s.mu.Lock()
+	s.remember(packages)
+	s.mu.Unlock()
+	return packages, snapshot.Generation, nil
+}
+
+func (s *sqliteStore) Generation() (int64, error) {
+	out, err := s.exec("SELECT value FROM generation;")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+}
+
+// remember notes the history rows the database holds; callers hold s.mu
+func (s *sqliteStore) remember(packages map[string]*Package) {
+	s.history = map[string][]HistoryEntry{}
+	for name, p := range packages {
+		s.history[name] = append([]HistoryEntry(nil), p.History...)
+	}
+}
+
+// extends reports whether history begins with the rows stored
+func extends(history, stored []HistoryEntry) bool {
+	if len(history) < len(stored) {
+		return false
+	}
+	for i := range stored {
+		if history[i] != stored[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sqliteBatch is the data of one write, read by its script from a file
+type sqliteBatch struct {
+	Keep     []string         `json:"keep,omitempty"`     // every package saved
+	Rewrite  []string         `json:"rewrite,omitempty"`  // packages whose history is rewritten whole
+	Channels []sqliteRow      `json:"channels,omitempty"` // heads, with package and channel
+	History  []sqliteRow      `json:"history,omitempty"`  // rows to insert, with package and seq
+	Rollouts []sqliteRow      `json:"rollouts,omitempty"`
+	Fetches  []sqliteFetchRow `json:"fetches,omitempty"`
+}
+
+type sqliteFetchRow struct {
+	Package string `json:"package"`
+	Host    string `json:"host"`
+	At      int64  `json:"at"`
+}
+
+// execBatch runs script with batch readable as the temp table batch (one
+// row, column doc)
+func (s *sqliteStore) execBatch(script string, batch sqliteBatch) (string, error) {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), ".batch-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, werr := f.Write(data)
+	if cerr := f.Close(); werr == nil {
+		werr = cerr
+	}
+	if werr != nil {
+		return "", werr
+	}
+	// The file name is ours; CAST, since a BLOB would be read as JSONB
+	return s.exec(fmt.Sprintf("CREATE TEMP TABLE batch AS SELECT CAST(readfile(%s) AS TEXT) AS doc;\n%s", quote(f.Name()), script))
+}
+
+const saveScript = `BEGIN IMMEDIATE;
+CREATE TEMP TABLE guard (unchanged_since_load INTEGER CHECK (unchanged_since_load));
+INSERT INTO guard SELECT value = %d FROM generation;
+DELETE FROM channels;
+DELETE FROM rollouts;
+DELETE FROM history WHERE package NOT IN (SELECT value FROM json_each((SELECT doc FROM batch), '$.keep'))
+  OR package IN (SELECT value FROM json_each((SELECT doc FROM batch), '$.rewrite'));
+DELETE FROM fetches WHERE package NOT IN (SELECT value FROM json_each((SELECT doc FROM batch), '$.keep'));
+INSERT INTO channels (package, channel, store_path, updated_at, publisher, timestamp, signature, action)
+  SELECT value ->> 'package', value ->> 'channel', value ->> 'storePath', value ->> 'updatedAt',
+    coalesce(value ->> 'publisher', ''), coalesce(value ->> 'timestamp', 0), coalesce(value ->> 'signature', ''), coalesce(value ->> 'action', '')
+  FROM json_each((SELECT doc FROM batch), '$.channels');
+INSERT INTO history (package, seq, channel, action, from_channel, store_path, updated_at, publisher, timestamp, signature)
+  SELECT value ->> 'package', value ->> 'seq', value ->> 'channel', coalesce(value ->> 'action', ''), coalesce(value ->> 'from', ''),
+    value ->> 'storePath', value ->> 'updatedAt', coalesce(value ->> 'publisher', ''), coalesce(value ->> 'timestamp', 0), coalesce(value ->> 'signature', '')
+  FROM json_each((SELECT doc FROM batch), '$.history');
+INSERT INTO rollouts (package, channel, rollout)
+  SELECT value ->> 'package', value ->> 'channel', value -> 'rollout'
+  FROM json_each((SELECT doc FROM batch), '$.rollouts');
+UPDATE generation SET value = value + 1;
+COMMIT;`
+
+// Save rewrites the channel heads and rollouts and appends the history rows
+// added since the last load or save; the generation check guarantees the
+// rows already stored are the ones that were loaded. A history that does
+// not extend the stored one (an import --replace) replaces it.
+func (s *sqliteStore) Save(packages map[string]*Package, generation int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var batch sqliteBatch
+	for _, name := range sortedKeys(packages) {
+		p := packages[name]
+		batch.Keep = append(batch.Keep, name)
+		for _, channel := range sortedKeys(p.Channels) {
+			batch.Channels = append(batch.Channels, sqliteRow{Package: name, HistoryEntry: HistoryEntry{Entry: p.Channels[channel], Channel: channel}})
+		}
+		stored := len(s.history[name])
+		if !extends(p.History, s.history[name]) {
+			batch.Rewrite = append(batch.Rewrite, name)
+			stored = 0
+		}
+		for seq := stored; seq < len(p.History); seq++ {
+			batch.History = append(batch.History, sqliteRow{Package: name, Seq: seq, HistoryEntry: p.History[seq]})
+		}
+		for _, channel := range sortedKeys(p.Rollouts) {
+			batch.Rollouts = append(batch.Rollouts, sqliteRow{Package: name, HistoryEntry: HistoryEntry{Channel: channel}, Rollout: p.Rollouts[channel]})
+		}
+	}
+
+	if _, err := s.execBatch(fmt.Sprintf(saveScript, generation), batch); err != nil {
+		if strings.Contains(err.Error(), "unchanged_since_load") {
+			return 0, errConflict
+		}
+		return 0, err
+	}
+	s.remember(packages)
+	return generation + 1, nil
+}
+
+const recordFetchesScript = `BEGIN IMMEDIATE;
+INSERT INTO fetches (package, host, last_fetched)
+  SELECT value ->> 'package', value ->> 'host', value ->> 'at'
+  FROM json_each((SELECT doc FROM batch), '$.fetches') WHERE true
+  ON CONFLICT (package, host) DO UPDATE SET last_fetched = max(last_fetched, excluded.last_fetched);
+COMMIT;`
+
+func (s *sqliteStore) RecordFetches(fetches map[string]map[string]int64) error {
+	if len(fetches) == 0 {
+		return nil
+	}
+	var batch sqliteBatch
+	for _, name := range sortedKeys(fetches) {
+		for _, host := range sortedKeys(fetches[name]) {
+			batch.Fetches = append(batch.Fetches, sqliteFetchRow{Package: name, Host: host, At: fetches[name][host]})
+		}
+	}
+	_, err := s.execBatch(recordFetchesScript, batch)
+	return err
+}
+
+func (s *sqliteStore) Fetches() (map[string]map[string]int64, error) {
+	out, err := s.exec("SELECT json_group_array(json_object('package', package, 'host', host, 'at', last_fetched)) FROM fetches;")
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		Package string `json:"package"`
+		Host    string `json:"host"`
+		At      int64  `json:"at"`
+	}
+	if err := json.Unmarshal([]byte(out), &rows); err != nil {
+		return nil, fmt.Errorf("parse fetches: %w", err)
+	}
+	fetches := make(map[string]map[string]int64)
+	for _, row := range rows {
+		mergeFetches(fetches, map[string]map[string]int64{row.Package: {row.Host: row.At}})
+	}
+	return fetches, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
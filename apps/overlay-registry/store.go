@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Storage. The registry keeps its packages in memory and writes them through
+// a Store after every change: registry.json (the original single file) or a
+// SQLite database (sqlite.go), chosen with REGISTRY_STORE. Both carry a
+// generation that changes with every save. A change is made against the
+// latest stored packages and saved only if nobody else saved since, so
+// several registry replicas can share one store: the loser of a race gets a
+// 409 and the publisher retries. Replicas pick up each other's changes
+// within refreshInterval, and wake their watches when they do.
+//
+// Host status reports stay in each replica's memory, as before: with
+// replicas, a rollout advances on the reports of the replica hosts report to.
+//
+// `overlay-registry export` prints the store in the registry.json format;
+// `overlay-registry import <file>` loads such a file — either format
+// parseData reads — into the configured store.
+
+// Store persists the registry's packages
+type Store interface {
+	// Load returns the stored packages and their generation
+	Load() (map[string]*Package, int64, error)
+	// Save stores packages if the store is still at generation, returning
+	// the new generation; errConflict if it moved on
+	Save(packages map[string]*Package, generation int64) (int64, error)
+	// Generation is the current generation, without loading the packages
+	Generation() (int64, error)
+	// RecordFetches merges package -> host -> last fetch times into the
+	// fetch log (gc.go); it does not change the generation. A Save drops
+	// the fetch log of every package it does not carry.
+	RecordFetches(fetches map[string]map[string]int64) error
+	// Fetches returns the fetch log
+	Fetches() (map[string]map[string]int64, error)
+	String() string
+}
+
+// errConflict is a save racing another writer's
+var errConflict = errors.New("registry changed concurrently; retry")
+
+// refreshInterval is how often a registry looks for other writers' changes
+const refreshInterval = 2 * time.Second
+
+// openStore returns the store REGISTRY_STORE selects: "json" (the default)
+// for dataFile itself, "sqlite" for REGISTRY_DB
+func openStore(dataFile string) (Store, error) {
+	switch backend := os.Getenv("REGISTRY_STORE"); backend {
+	case "", "json":
+		return &jsonStore{path: dataFile}, nil
+	case "sqlite":
+		db := os.Getenv("REGISTRY_DB")
+		if db == "" {
+			db = filepath.Join(filepath.Dir(dataFile), "registry.db")
+		}
+		return openSQLiteStore(db)
+	default:
+		return nil, fmt.Errorf("unknown REGISTRY_STORE %q (json or sqlite)", backend)
+	}
+}
+
+// jsonStore is registry.json. Its generation is derived from the file's
+// contents; saves take an flock next to it, so replicas on one host (or on a
+// filesystem with working locks) can share it.
+type jsonStore struct {
+	path string
+}
+
+func (s *jsonStore) String() string { return s.path }
+
+func (s *jsonStore) read() ([]byte, int64, error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	sum := sha256.Sum256(data)
+	return data, int64(binary.BigEndian.Uint64(sum[:8]) >> 1), nil
+}
+
+func (s *jsonStore) Load() (map[string]*Package, int64, error) {
+	data, generation, err := s.read()
+	if err != nil || data == nil {
+		return make(map[string]*Package), generation, err
+	}
+	packages, err := parseData(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("parse %s: %w", s.path, err)
+	}
+	return packages, generation, nil
+}
+
+func (s *jsonStore) Generation() (int64, error) {
+	_, generation, err := s.read()
+	return generation, err
+}
+
+// Save writes a temporary file, syncs it and renames it over the data file:
+// a crash leaves either the old or the new registry.json, at worst with a
+// stale .tmp beside it that the next save overwrites
+func (s *jsonStore) Save(packages map[string]*Package, generation int64) (int64, error) {
+	lock, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return 0, err
+	}
+
+	if current, err := s.Generation(); err != nil {
+		return 0, err
+	} else if current != generation {
+		return 0, errConflict
+	}
+	data, err := json.MarshalIndent(packages, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return 0, err
+	}
+	if err := s.pruneFetches(packages); err != nil {
+		return 0, err
+	}
+	return s.Generation()
+}
+
+// fetchesPath is where the fetch log lives beside registry.json
+func (s *jsonStore) fetchesPath() string {
+	return strings.TrimSuffix(s.path, ".json") + "-fetches.json"
+}
+
+func (s *jsonStore) Fetches() (map[string]map[string]int64, error) {
+	fetches := make(map[string]map[string]int64)
+	data, err := os.ReadFile(s.fetchesPath())
+	if os.IsNotExist(err) {
+		return fetches, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &fetches); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", s.fetchesPath(), err)
+	}
+	return fetches, nil
+}
+
+func (s *jsonStore) RecordFetches(fetches map[string]map[string]int64) error {
+	lock, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+
+	all, err := s.Fetches()
+	if err != nil {
+		return err
+	}
+	mergeFetches(all, fetches)
+	return s.writeFetches(all)
+}
+
+// pruneFetches drops the fetch log of packages no longer stored; the caller
+// holds the lock
+func (s *jsonStore) pruneFetches(packages map[string]*Package) error {
+	all, err := s.Fetches()
+	if err != nil {
+		return err
+	}
+	pruned := false
+	for name := range all {
+		if _, ok := packages[name]; !ok {
+			delete(all, name)
+			pruned = true
+		}
+	}
+	if !pruned {
+		return nil
+	}
+	return s.writeFetches(all)
+}
+
+func (s *jsonStore) writeFetches(all map[string]map[string]int64) error {
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.fetchesPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.fetchesPath())
+}
+
+// runExport is `overlay-registry export`: the configured store as
+// registry.json, on stdout
+func runExport(dataFile string) {
+	store, err := openStore(dataFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	packages, _, err := store.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	data, err := json.MarshalIndent(packages, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(append(data, '\n'))
+}
+
+// runImport is `overlay-registry import [--replace] <file>`
+func runImport(dataFile string, args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	replace := fs.Bool("replace", false, "replace a store that already has packages")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: overlay-registry import [--replace] <registry.json>")
+		os.Exit(2)
+	}
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	packages, err := parseData(data)
+	if err != nil {
+		log.Fatalf("parse %s: %v", fs.Arg(0), err)
+	}
+
+	store, err := openStore(dataFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	existing, generation, err := store.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(existing) > 0 && !*replace {
+		log.Fatalf("%s already has %d packages; --replace to overwrite them", store, len(existing))
+	}
+	if _, err := store.Save(packages, generation); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("imported %d packages into %s", len(packages), store)
+}
+
+// importLegacy seeds an empty store from registry.json, when switching a
+// single-file deployment to another backend
+func importLegacy(store Store, dataFile string) error {
+	if js, ok := store.(*jsonStore); ok && js.path == dataFile {
+		return nil
+	}
+	existing, generation, err := store.Load()
+	if err != nil || len(existing) > 0 {
+		return err
+	}
+	packages, _, err := (&jsonStore{path: dataFile}).Load()
+	if err != nil || len(packages) == 0 {
+		return err
+	}
+	if _, err := store.Save(packages, generation); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(packages))
+	for name := range packages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.Printf("imported %s into %s: %v", dataFile, store, names)
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testStores opens an empty store of each backend; sqlite is skipped when
+// the sqlite3 shell is missing
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	stores := map[string]Store{"json": &jsonStore{path: filepath.Join(t.TempDir(), "registry.json")}}
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Logf("sqlite3 unavailable, testing the json store only: %v", err)
+		return stores
+	}
+	db, err := openSQLiteStore(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores["sqlite"] = db
+	return stores
+}
+
+func entry(storePath string, at int64) Entry {
+	return Entry{StorePath: storePath, UpdatedAt: at, Action: "publish", Publisher: "ci", Timestamp: at, Signature: "sig-" + storePath}
+}
+
+func samplePackages() map[string]*Package {
+	return map[string]*Package{
+		"infra/coffer": {
+			Channels: map[string]Entry{"stable": entry("/nix/store/aaa-coffer", 100), "canary": entry("/nix/store/bbb-coffer", 200)},
+			History: []HistoryEntry{
+				{Entry: entry("/nix/store/aaa-coffer", 100), Channel: "stable"},
+				{Entry: entry("/nix/store/bbb-coffer", 200), Channel: "canary"},
+			},
+			Rollouts: map[string]*Rollout{},
+		},
+		"infra/knockout": {
+			Channels: map[string]Entry{"stable": entry("/nix/store/ccc-knockout", 300)},
+			History:  []HistoryEntry{{Entry: entry("/nix/store/ccc-knockout", 300), Channel: "stable"}},
+		},
+	}
+}
+
+// normalize drops the empty-versus-nil differences the backends do not keep
+func normalize(packages map[string]*Package) map[string]*Package {
+	for _, p := range packages {
+		if len(p.Rollouts) == 0 {
+			p.Rollouts = nil
+		}
+	}
+	return packages
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	for backend, store := range testStores(t) {
+		_, generation, err := store.Load()
+		if err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		want := samplePackages()
+		if _, err := store.Save(want, generation); err != nil {
+			t.Fatalf("%s: save: %v", backend, err)
+		}
+		got, _, err := store.Load()
+		if err != nil {
+			t.Fatalf("%s: load: %v", backend, err)
+		}
+		if !reflect.DeepEqual(normalize(got), normalize(samplePackages())) {
+			t.Errorf("%s: loaded %+v", backend, got)
+		}
+
+		// Appending to one package's history keeps the rest as it was
+		got["infra/coffer"].History = append(got["infra/coffer"].History, HistoryEntry{Entry: entry("/nix/store/bbb-coffer", 400), Channel: "stable", From: "canary"})
+		got["infra/coffer"].Channels["stable"] = entry("/nix/store/bbb-coffer", 400)
+		_, generation, _ = store.Load()
+		if _, err := store.Save(got, generation); err != nil {
+			t.Fatalf("%s: save: %v", backend, err)
+		}
+		again, _, _ := store.Load()
+		if h := again["infra/coffer"].History; len(h) != 3 || h[2].From != "canary" || h[0] != got["infra/coffer"].History[0] {
+			t.Errorf("%s: history after append = %+v", backend, h)
+		}
+	}
+}
+
+func TestStoreSaveConflicts(t *testing.T) {
+	for backend, store := range testStores(t) {
+		_, generation, _ := store.Load()
+		next, err := store.Save(samplePackages(), generation)
+		if err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		if next == generation {
+			t.Errorf("%s: generation did not move", backend)
+		}
+		if _, err := store.Save(samplePackages(), generation); err != errConflict {
+			t.Errorf("%s: save from a stale generation: err = %v, want errConflict", backend, err)
+		}
+		if current, _ := store.Generation(); current != next {
+			t.Errorf("%s: generation %d after a refused save, want %d", backend, current, next)
+		}
+	}
+}
+
+// An import --replace hands Save a history that shares nothing with the
+// stored one; it must replace it, not be appended to it
+func TestStoreSaveReplacesUnrelatedHistory(t *testing.T) {
+	for backend, store := range testStores(t) {
+		_, generation, _ := store.Load()
+		if _, err := store.Save(samplePackages(), generation); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+
+		replacement := map[string]*Package{"infra/coffer": {
+			Channels: map[string]Entry{"stable": entry("/nix/store/zzz-coffer", 900)},
+			History: []HistoryEntry{
+				{Entry: entry("/nix/store/yyy-coffer", 800), Channel: "stable"},
+				{Entry: entry("/nix/store/zzz-coffer", 900), Channel: "stable"},
+				{Entry: entry("/nix/store/zzz-coffer", 900), Channel: "canary"},
+			},
+		}}
+		_, generation, _ = store.Load()
+		if _, err := store.Save(replacement, generation); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		got, _, _ := store.Load()
+		if !reflect.DeepEqual(got["infra/coffer"].History, replacement["infra/coffer"].History) {
+			t.Errorf("%s: history = %+v", backend, got["infra/coffer"].History)
+		}
+		if _, ok := got["infra/knockout"]; ok {
+			t.Errorf("%s: replaced package kept", backend)
+		}
+	}
+}
+
+func TestImportLegacySeedsAnEmptyStore(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skipf("sqlite3 unavailable: %v", err)
+	}
+	dataFile := filepath.Join(t.TempDir(), "registry.json")
+	legacy := &jsonStore{path: dataFile}
+	if _, err := legacy.Save(samplePackages(), 0); err != nil {
+		t.Fatal(err)
+	}
+	db, err := openSQLiteStore(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := importLegacy(db, dataFile); err != nil {
+		t.Fatal(err)
+	}
+	got, _, _ := db.Load()
+	if !reflect.DeepEqual(normalize(got), normalize(samplePackages())) {
+		t.Errorf("imported %+v", got)
+	}
+}
+
+func TestStoreFetches(t *testing.T) {
+	for backend, store := range testStores(t) {
+		if err := store.RecordFetches(map[string]map[string]int64{"infra/coffer": {"joker": 100}}); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		// An older report never moves a fetch back
+		store.RecordFetches(map[string]map[string]int64{"infra/coffer": {"joker": 50, "ursula": 70}})
+		got, err := store.Fetches()
+		if err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		want := map[string]map[string]int64{"infra/coffer": {"joker": 100, "ursula": 70}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: fetches = %v, want %v", backend, got, want)
+		}
+	}
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skipf("sqlite3 unavailable: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "registry.db")
+
+	// A database left at schema 3 by an older registry
+	old := &sqliteStore{path: path, sqlite: "sqlite3"}
+	for version, migration := range migrations[:3] {
+		if _, err := old.exec(fmt.Sprintf("BEGIN;\n%s\nPRAGMA user_version = %d;\nCOMMIT;", migration, version+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := old.exec("INSERT INTO channels (package, channel, store_path, updated_at) VALUES ('infra/coffer', 'stable', '/nix/store/aaa-coffer', 100);"); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := store.schemaVersion(); version != len(migrations) {
+		t.Errorf("schema version %d, want %d", version, len(migrations))
+	}
+	got, _, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := got["infra/coffer"].Channels["stable"]; e.StorePath != "/nix/store/aaa-coffer" || e.Action != "" {
+		t.Errorf("migrated entry = %+v", e)
+	}
+
+	// Reopening is a no-op, and a schema from a newer registry is refused
+	if _, err := openSQLiteStore(path); err != nil {
+		t.Errorf("reopen: %v", err)
+	}
+	store.exec("PRAGMA user_version = 99;")
+	if _, err := openSQLiteStore(path); err == nil || !strings.Contains(err.Error(), "newer than this registry") {
+		t.Errorf("newer schema: err = %v", err)
+	}
+}
+
+func TestStoreSaveDropsFetchesOfDeletedPackages(t *testing.T) {
+	for backend, store := range testStores(t) {
+		_, generation, _ := store.Load()
+		if _, err := store.Save(samplePackages(), generation); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		store.RecordFetches(map[string]map[string]int64{"infra/coffer": {"joker": 100}, "infra/knockout": {"joker": 100}})
+
+		packages, generation, _ := store.Load()
+		delete(packages, "infra/knockout")
+		if _, err := store.Save(packages, generation); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		if got, _ := store.Fetches(); !reflect.DeepEqual(got, map[string]map[string]int64{"infra/coffer": {"joker": 100}}) {
+			t.Errorf("%s: fetches after delete = %v", backend, got)
+		}
+
+		_, generation, _ = store.Load()
+		if _, err := store.Save(map[string]*Package{}, generation); err != nil {
+			t.Fatalf("%s: %v", backend, err)
+		}
+		if got, _ := store.Fetches(); len(got) != 0 {
+			t.Errorf("%s: fetches of an empty store = %v", backend, got)
+		}
+	}
+}
+
+// Names come from requests; none of them may break a write
+func TestStoreKeepsHostileNames(t *testing.T) {
+	for backend, store := range testStores(t) {
+		name := "infra/it's\x00; DROP TABLE channels; --"
+		packages := map[string]*Package{name: {
+			Channels: map[string]Entry{"o'clock": entry("/nix/store/aaa-coffer", 100)},
+			History:  []HistoryEntry{{Entry: entry("/nix/store/aaa-coffer", 100), Channel: "o'clock"}},
+		}}
+		_, generation, _ := store.Load()
+		if _, err := store.Save(packages, generation); err != nil {
+			t.Fatalf("%s: save: %v", backend, err)
+		}
+		if err := store.RecordFetches(map[string]map[string]int64{name: {"jo'ker\x00": 100}}); err != nil {
+			t.Errorf("%s: record fetches: %v", backend, err)
+		}
+		got, _, err := store.Load()
+		if err != nil {
+			t.Fatalf("%s: load: %v", backend, err)
+		}
+		if len(got) != 1 {
+			t.Errorf("%s: loaded %d packages, want 1", backend, len(got))
+		}
+		if err := store.RecordFetches(map[string]map[string]int64{"infra/coffer": {"joker": 100}}); err != nil {
+			t.Errorf("%s: fetch log stuck after a hostile name: %v", backend, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Change notification. Managers used to poll the full listing on a timer;
+// now the listing carries an ETag (a hash of its body, so identical listings
+// share one) and GET /_watch long-polls: it answers as soon as the caller's
+// view differs from the ETag it sent in If-None-Match, or with 304 after the
+// timeout. The default timeout stays under nginx's 60s proxy_read_timeout.
+
+const (
+	defaultWatchTimeout = 50 * time.Second
+	maxWatchTimeout     = 5 * time.Minute
+)
+
+// notify wakes every pending watch; callers hold the write lock
+func (r *Registry) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// encodeListing returns the listing body and its ETag
+func encodeListing(listing map[string]Entry) ([]byte, string) {
+	body, _ := json.Marshal(listing) // map keys are sorted: stable bytes
+	body = append(body, '\n')
+	sum := sha256.Sum256(body)
+	return body, `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// filterListing narrows a listing to the comma-separated packages and to
+// names starting with prefix, if given
+func filterListing(listing map[string]Entry, packages, prefix string) map[string]Entry {
+	if packages == "" && prefix == "" {
+		return listing
+	}
+	out := make(map[string]Entry)
+	if packages != "" {
+		for _, name := range strings.Split(packages, ",") {
+			if entry, ok := listing[name]; ok && strings.HasPrefix(name, prefix) {
+				out[name] = entry
+			}
+		}
+		return out
+	}
+	for name, entry := range listing {
+		if strings.HasPrefix(name, prefix) {
+			out[name] = entry
+		}
+	}
+	return out
+}
+
+// serveListing writes a listing with its ETag, or 304 when it matches
+// If-None-Match
+func serveListing(w http.ResponseWriter, req *http.Request, listing map[string]Entry) {
+	body, etag := encodeListing(listing)
+	w.Header().Set("ETag", etag)
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// watch handles GET /_watch?channel=c&host=h&packages=a,b&prefix=p&timeout=s
+func (r *Registry) watch(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	channel := channelOf(query.Get("channel"))
+	timeout := defaultWatchTimeout
+	if s, err := strconv.Atoi(query.Get("timeout")); err == nil && s > 0 {
+		timeout = min(time.Duration(s)*time.Second, maxWatchTimeout)
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for first := true; ; first = false {
+		r.mu.RLock()
+		listing := filterListing(r.listing(channel, query.Get("host")), query.Get("packages"), query.Get("prefix"))
+		changed := r.changed
+		r.mu.RUnlock()
+		if first {
+			r.recordFetch(query.Get("host"), listing)
+		}
+
+		body, etag := encodeListing(listing)
+		if etag != req.Header.Get("If-None-Match") {
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+			return
+		}
+
+		select {
+		case <-changed:
+			// Something moved; it may not be in this caller's view
+		case <-deadline.C:
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
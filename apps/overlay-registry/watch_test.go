@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func get(r *Registry, path, etag string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestListingETag(t *testing.T) {
+	r, keyPath := testRegistry(t)
+	if w := publish(t, r, keyPath, "infra/coffer", "", oldPath, time.Now().Unix()); w.Code != http.StatusOK {
+		t.Fatalf("publish: %d %s", w.Code, w.Body)
+	}
+
+	w := get(r, "/", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || !strings.Contains(w.Body.String(), oldPath) {
+		t.Fatalf("listing: %d %q %s", w.Code, etag, w.Body)
+	}
+	if w := get(r, "/", etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+		t.Errorf("unchanged listing: %d %q %s", w.Code, w.Header().Get("ETag"), w.Body)
+	}
+	// Another view of the same registry has its own ETag
+	if w := get(r, "/?channel=canary", etag); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("canary listing: %d %q", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestWatch(t *testing.T) {
+	r, keyPath := testRegistry(t)
+	ts := time.Now().Unix()
+	if w := publish(t, r, keyPath, "infra/coffer", "", oldPath, ts); w.Code != http.StatusOK {
+		t.Fatalf("publish: %d %s", w.Code, w.Body)
+	}
+	etag := get(r, "/", "").Header().Get("ETag")
+
+	// A stale ETag is answered at once
+	if w := get(r, "/_watch", `"stale"`); w.Code != http.StatusOK || w.Header().Get("ETag") != etag {
+		t.Errorf("stale ETag: %d %q", w.Code, w.Header().Get("ETag"))
+	}
+
+	// A current one times out with 304
+	start := time.Now()
+	if w := get(r, "/_watch?timeout=1", etag); w.Code != http.StatusNotModified || w.Header().Get("ETag") != etag {
+		t.Errorf("timeout: %d %q", w.Code, w.Header().Get("ETag"))
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Errorf("answered after %s, before the timeout", waited)
+	}
+
+	// A change outside the watched packages does not wake the caller; one
+	// inside does
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- get(r, "/_watch?timeout=10&packages=infra/coffer", etag) }()
+	time.Sleep(100 * time.Millisecond)
+	if w := publish(t, r, keyPath, "infra/knockout", "", "/nix/store/ccc-knockout", ts+1); w.Code != http.StatusOK {
+		t.Fatalf("publish: %d %s", w.Code, w.Body)
+	}
+	select {
+	case w := <-done:
+		t.Fatalf("woken by another package: %d %s", w.Code, w.Body)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if w := publish(t, r, keyPath, "infra/coffer", "", newPath, ts+2); w.Code != http.StatusOK {
+		t.Fatalf("publish: %d %s", w.Code, w.Body)
+	}
+	select {
+	case w := <-done:
+		if w.Code != http.StatusOK || w.Header().Get("ETag") == etag || !strings.Contains(w.Body.String(), newPath) {
+			t.Errorf("after a publish: %d %q %s", w.Code, w.Header().Get("ETag"), w.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch not woken by a publish")
+	}
+}
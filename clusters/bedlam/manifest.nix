@@ -18,6 +18,7 @@ rec {
       #   - root: SSH as root to all hosts
       #   - dev-sandbox: SSH as dev user on sandbox hosts
       #   - secrets: Can decrypt secrets on main branch
+      #   - overlay-publish: Can publish overlay registry entries (signs with agentKey)
       principals = {
         admin = {
           description = "Admin user - full access";
@@ -49,7 +50,7 @@ rec {
           # Age key stored in Forgejo secrets (CI_AGE_KEY) for secret re-keying
           # SSH key for control plane auth (refresh capability)
           agentKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAICBy4EkPwAF50uYBRNWj3pRUH9/gyWuOmVquZyqz6SD/ ci-agent";
-          roles = [ "secrets" ];
+          roles = [ "secrets" "overlay-publish" ];
         };
       };
     };
@@ -35,6 +35,18 @@
                   description = "If set, serve static files from this path instead of proxying to a port.";
                 };
 
+                upstream = lib.mkOption {
+                  type = nullOr str;
+                  default = null;
+                  description = ''
+                    If set, proxy to this nginx upstream block instead of
+                    127.0.0.1:port. Used by blue/green overlays, whose live
+                    port is switched at runtime through the upstream's
+                    included server list. Only nginx's own proxy_pass honours
+                    it: the oauth2-proxy modes still dial 127.0.0.1:port.
+                  '';
+                };
+
                 inEgressNamespace = lib.mkOption {
                   type = bool;
                   default = false;
@@ -52,7 +52,19 @@ let
 
   hostsJson = builtins.listToAttrs (hostEntries ++ principalEntries);
 
+  # Hosts running the control plane dashboard sign as themselves
+  dashboardHosts = builtins.filter
+    (h: builtins.elem "fort-dashboard" (allHostManifests.${h}.apps or []))
+    (builtins.attrNames allHostManifests);
+
   fcgiSocket = "/run/fort/fcgi.sock";
+
+  # Transport client authentication for fort-provider: off, optional or
+  # require. Cluster-wide, since every host is both client and server. When
+  # enabled, each host mints a TLS client cert wrapping its SSH host key and
+  # the fort CLI presents it; providers pin it against hosts.json.
+  clientAuth = rootManifest.fortConfig.settings.controlPlane.clientAuth or "off";
+  clientAuthEnabled = clientAuth != "off";
   # Mandatory capability handlers (always present on all hosts) — split out
   # to common/fort/control-plane/handlers.nix (q-1f08acd9).
   mandatoryHandlers = import ./control-plane/handlers.nix {
@@ -61,17 +73,18 @@ let
 
   # Mandatory capabilities config (all RPC - synchronous request-response)
   mandatoryCapabilities = {
-    status = { mode = "rpc"; };
-    manifest = { mode = "rpc"; };
-    needs = { mode = "rpc"; };
+    status = { mode = "rpc"; description = "Return host status JSON"; };
+    manifest = { mode = "rpc"; description = "Return host manifest and capabilities"; };
+    needs = { mode = "rpc"; description = "List declared needs (queried by provider GC)"; };
     # Debug capabilities - restricted to dev-sandbox principal
-    journal = { mode = "rpc"; allowed = [ "dev-sandbox" ]; };
-    systemd = { mode = "rpc"; allowed = [ "dev-sandbox" ]; };
-    force-nag = { mode = "rpc"; allowed = [ "dev-sandbox" ]; };
-    read-file = { mode = "rpc"; allowed = [ "dev-sandbox" ]; };
+    journal = { mode = "rpc"; allowed = [ "dev-sandbox" ]; description = "Fetch log output for a unit"; };
+    systemd = { mode = "rpc"; allowed = [ "dev-sandbox" ]; description = "Inspect or restart a unit"; };
+    force-nag = { mode = "rpc"; allowed = [ "dev-sandbox" ]; description = "Reset fulfillment state to force need retries"; };
+    read-file = { mode = "rpc"; allowed = [ "dev-sandbox" ]; description = "Read a file from the host"; };
     # Refresh capability - triggers re-delivery to subscribers
-    # Allowed for ci (CI-triggered) and dev-sandbox (manual testing)
-    refresh = { mode = "rpc"; allowed = [ "ci" "dev-sandbox" ]; };
+    # Allowed for ci (CI-triggered), dev-sandbox (manual testing) and hosts
+    # running the fort-dashboard app (its refresh buttons)
+    refresh = { mode = "rpc"; allowed = [ "ci" "dev-sandbox" ] ++ dashboardHosts; description = "Re-run a capability handler and re-deliver to subscribers"; };
   };
 
   # Helper to derive needsGC and ttl from mode
@@ -91,11 +104,13 @@ let
       cacheResponse = cfg.cacheResponse or false;
       triggers = cfg.triggers or { initialize = false; systemd = []; };
       format = cfg.format or "legacy";
+      description = cfg.description or "";
     } // lib.optionalAttrs (cfg ? allowed) { inherit (cfg) allowed; }
   ) mandatoryCapabilities // lib.mapAttrs (name: cfg:
     (modeToGcConfig cfg.mode) // {
-      inherit (cfg) mode cacheResponse triggers format;
+      inherit (cfg) mode cacheResponse triggers format description;
     } // lib.optionalAttrs (cfg.allowed != null) { inherit (cfg) allowed; }
+      // lib.optionalAttrs (cfg.requestSchema != null) { inherit (cfg) requestSchema; }
   ) config.fort.host.capabilities;
 
   # All hosts AND principals with agentKeys allowed to call mandatory endpoints
@@ -207,6 +222,15 @@ let
       install -Dm0644 "$_new_caps" /etc/fort/capabilities.json
     fi
 
+    ${lib.optionalString clientAuthEnabled ''
+      # TLS client cert wrapping the host key, re-minted every activation so
+      # it tracks host key rotation
+      install -d -m0700 /var/lib/fort/tls
+      ${fortProvider}/bin/fort-provider client-cert \
+        --ssh-key /etc/ssh/ssh_host_ed25519_key --origin ${hostName} \
+        --cert /var/lib/fort/tls/client-cert.pem --key /var/lib/fort/tls/client-key.pem
+    ''}
+
     ${lib.optionalString isDarwin ''
       # Darwin: ensure state directories exist
       install -d -m0755 /var/lib/fort
@@ -362,7 +386,7 @@ in
 
         serviceConfig = {
           Type = "simple";
-          ExecStart = "${fortProvider}/bin/fort-provider";
+          ExecStart = "${fortProvider}/bin/fort-provider --client-auth ${clientAuth}";
           StandardInput = "socket";
           StandardOutput = "socket";
           StandardError = "journal";
@@ -388,6 +412,10 @@ in
 
       # Control plane endpoint - VPN-only access for cluster-internal communication
       services.nginx.virtualHosts."${hostName}.fort.${domain}" = {
+        # Ask for (don't chain-verify) a client cert; fort-provider pins it
+        extraConfig = lib.optionalString clientAuthEnabled ''
+          ssl_verify_client optional_no_ca;
+        '';
         locations."/fort/" = {
           extraConfig = ''
             if ($is_vpn = 0) {
@@ -406,6 +434,10 @@ in
             fastcgi_param HTTP_X_FORT_ORIGIN $http_x_fort_origin;
             fastcgi_param HTTP_X_FORT_TIMESTAMP $http_x_fort_timestamp;
             fastcgi_param HTTP_X_FORT_SIGNATURE $http_x_fort_signature;
+          '' + lib.optionalString clientAuthEnabled ''
+
+            # Client certificate for transport authentication
+            fastcgi_param SSL_CLIENT_CERT $ssl_client_escaped_cert;
           '';
         };
       };
@@ -424,6 +456,10 @@ in
             "--listen" (if config.fort.cluster.services != [] then "127.0.0.1:8444" else "0.0.0.0:443")
             "--tls-cert" "/var/lib/fort/tls/cert.pem"
             "--tls-key" "/var/lib/fort/tls/key.pem"
+            "--client-auth" clientAuth
+          ] ++ lib.optionals (config.fort.cluster.services != [ ]) [
+            # nginx terminates TLS and forwards the client cert
+            "--behind-proxy"
           ];
           # Anchor relative paths (state/handles) regardless of launchd's
           # default cwd. Also: any plist change makes nix-darwin re-bootstrap
@@ -12,12 +12,20 @@ pkgs.writeShellScript "fort-fulfill" ''
     set -euo pipefail
 
     NEEDS_FILE="/etc/fort/needs.json"
+    # Needs registered at runtime (e.g. by fort-overlay-manager for exposed
+    # overlays), same schema as needs.json
+    RUNTIME_NEEDS_DIR="/run/fort/needs.d"
     FULFILLMENT_STATE_FILE="/var/lib/fort/fulfillment-state.json"
 
     log() { echo "[fort-fulfill] $*"; }
 
+    shopt -s nullglob
+    needs_files=()
+    [ -f "$NEEDS_FILE" ] && needs_files+=("$NEEDS_FILE")
+    needs_files+=("$RUNTIME_NEEDS_DIR"/*.json)
+
     # Exit early if no needs file
-    if [ ! -f "$NEEDS_FILE" ]; then
+    if [ ''${#needs_files[@]} -eq 0 ]; then
       log "No needs.json found, nothing to fulfill"
       exit 0
     fi
@@ -31,8 +39,8 @@ pkgs.writeShellScript "fort-fulfill" ''
 
     now=$(${pkgs.coreutils}/bin/date +%s)
 
-    # Read needs.json and process each need
-    needs=$(${pkgs.jq}/bin/jq -c '.[]' "$NEEDS_FILE")
+    # Read needs.json and the runtime needs and process each need
+    needs=$(${pkgs.jq}/bin/jq -c '.[]' "''${needs_files[@]}")
 
     while IFS= read -r need; do
       [ -z "$need" ] && continue
@@ -122,8 +130,9 @@ pkgs.writeShellScript "fort-fulfill" ''
         elif [ "$status" -ge 200 ] && [ "$status" -lt 300 ]; then
           log "[$id] Success from $from (HTTP $status)"
 
-          # Invoke handler with response body on stdin
-          if echo "$body" | "$handler"; then
+          # Invoke handler with response body on stdin; runtime needs
+          # without one are side-effect-only
+          if [ -z "$handler" ] || echo "$body" | "$handler"; then
             log "[$id] Handler completed successfully"
 
             # Mark satisfied in state
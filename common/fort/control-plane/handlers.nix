@@ -84,6 +84,45 @@ let
         response["continuation"] = "Request fewer lines, narrower since/unit/identifier filters, add grep to filter, or pass larger max_chars/max_line_chars if you need omitted content."
     print(json.dumps(response))
   '';
+
+  # Per-entry detail for the control plane dashboard: which provider entries
+  # last changed when and whether their callback landed, and each declared
+  # need joined with its fulfillment state. Appended to $base_status.
+  statusDetail = ''
+    if [ -f /var/lib/fort/provider-state.json ]; then
+      provider_detail=$(${pkgs.jq}/bin/jq 'map_values(map_values({
+          updated_at,
+          fulfilled: (.response != null),
+          callback_at: (.callback_at // null),
+          callback_error: (.callback_error // null)
+        }))' /var/lib/fort/provider-state.json)
+      base_status=$(echo "$base_status" | ${pkgs.jq}/bin/jq --argjson pd "$provider_detail" '. + {provider_detail: $pd}')
+    fi
+
+    # needs.json plus the needs registered at runtime
+    needs_files=()
+    [ -f /etc/fort/needs.json ] && needs_files+=(/etc/fort/needs.json)
+    for f in /run/fort/needs.d/*.json; do
+      [ -f "$f" ] && needs_files+=("$f")
+    done
+    if [ ''${#needs_files[@]} -gt 0 ]; then
+      fulfillment='{}'
+      if [ -f /var/lib/fort/fulfillment-state.json ]; then
+        fulfillment=$(${pkgs.coreutils}/bin/cat /var/lib/fort/fulfillment-state.json)
+      fi
+      consumer_detail=$(${pkgs.jq}/bin/jq -s --argjson fs "$fulfillment" 'add | map({
+          key: .id,
+          value: {
+            capability,
+            from,
+            nag_seconds,
+            satisfied: ($fs[.id].satisfied // false),
+            last_sought: ($fs[.id].last_sought // null)
+          }
+        }) | from_entries' "''${needs_files[@]}")
+      base_status=$(echo "$base_status" | ${pkgs.jq}/bin/jq --argjson cd "$consumer_detail" '. + {consumer_detail: $cd}')
+    fi
+  '';
 in
 {
     # Return host status (generated by host-status aspect timer)
@@ -118,6 +157,8 @@ in
         base_status=$(echo "$base_status" | ${pkgs.jq}/bin/jq --argjson cs "$consumer_summary" '. + {consumer_state: $cs}')
       fi
 
+      ${statusDetail}
+
       echo "$base_status"
     '' else ''
       # Get base status
@@ -147,6 +188,8 @@ in
         base_status=$(echo "$base_status" | ${pkgs.jq}/bin/jq --argjson cs "$consumer_summary" '. + {consumer_state: $cs}')
       fi
 
+      ${statusDetail}
+
       echo "$base_status"
     '');
 
@@ -164,7 +207,16 @@ in
       ) config.fort.host.needs);
       needsListJson = builtins.toJSON needsList;
     in pkgs.writeShellScript "handler-needs" ''
-      echo '{"needs":${needsListJson}}'
+      # Plus the needs registered at runtime (/run/fort/needs.d), so
+      # provider GC does not reap what they were granted
+      shopt -s nullglob
+      runtime=(/run/fort/needs.d/*.json)
+      if [ ''${#runtime[@]} -eq 0 ]; then
+        echo '{"needs":${needsListJson}}'
+        exit 0
+      fi
+      ${pkgs.jq}/bin/jq -cs --argjson static '${needsListJson}' \
+        '{needs: ($static + [.[][] | "\(.capability)/\(.name)"] | unique)}' "''${runtime[@]}"
     '';
 
     # Fetch log output for a unit or syslog identifier (debug capability)
@@ -143,6 +143,20 @@
       description = "Human-readable description of the capability";
     };
 
+    requestSchema = lib.mkOption {
+      type = lib.types.nullOr (lib.types.attrsOf lib.types.anything);
+      default = null;
+      description = ''
+        Optional JSON Schema for the request body. Not enforced by the
+        provider; published via the built-in `capabilities` route so the
+        fort CLI and cluster tooling can validate and complete requests.
+      '';
+      example = {
+        type = "object";
+        properties.access = { type = "string"; enum = [ "ro" "rw" ]; };
+      };
+    };
+
     allowed = lib.mkOption {
       type = lib.types.nullOr (lib.types.listOf lib.types.str);
       default = null;
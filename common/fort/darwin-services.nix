@@ -37,6 +37,7 @@ let
   vpnIpv4Prefix = rootManifest.fortConfig.settings.vpn.ipv4Prefix;
   lanIpv4Prefix = rootManifest.fortConfig.settings.lan.ipv4Prefix;
   hostName = config.networking.hostName;
+  clientAuthEnabled = (rootManifest.fortConfig.settings.controlPlane.clientAuth or "off") != "off";
 
   inherit (import ./service-lib.nix) subdomainOf;
 
@@ -210,6 +211,7 @@ let
 
         ssl_certificate /var/lib/fort/tls/cert.pem;
         ssl_certificate_key /var/lib/fort/tls/key.pem;
+        ${lib.optionalString clientAuthEnabled "ssl_verify_client optional_no_ca;"}
 
         location /fort/ {
           if ($fort_allowed = 0) {
@@ -222,6 +224,8 @@ let
           proxy_set_header X-Fort-Origin $http_x_fort_origin;
           proxy_set_header X-Fort-Timestamp $http_x_fort_timestamp;
           proxy_set_header X-Fort-Signature $http_x_fort_signature;
+          proxy_set_header X-Fort-Channel-Binding $http_x_fort_channel_binding;
+          proxy_set_header X-Fort-Client-Cert $ssl_client_escaped_cert;
         }
 
         location / {
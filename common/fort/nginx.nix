@@ -91,7 +91,10 @@ in
               isTokenMode = svc.sso.mode == "token";
               isIdentityMode = svc.sso.mode == "identity";
               anyBypass = svc.sso.vpnBypass || svc.sso.localBypass;
-              directBackend = lib.optionalString (!isStatic) "http://${if svc.inEgressNamespace then "10.200.0.2" else "127.0.0.1"}:${toString svc.port}";
+              directBackend = lib.optionalString (!isStatic) (
+                if svc.upstream != null then "http://${svc.upstream}"
+                else "http://${if svc.inEgressNamespace then "10.200.0.2" else "127.0.0.1"}:${toString svc.port}"
+              );
               authProxySocket = "http://unix:/run/fort-auth/${svc.name}.sock";
             in
             {
@@ -1,7 +1,7 @@
 # Fort Overlays Module
 #
 # Runtime-deferred service composition. Each project ships an overlay.nix
-# alongside its binary. The overlay manager polls a registry, fetches new
+# alongside its binary. The overlay manager watches a registry, fetches new
 # versions from Attic, evaluates overlay.nix with host-provided config,
 # generates systemd units, and manages health checks with rollback.
 #
@@ -10,7 +10,11 @@
 #   overlays = {
 #     knockout = {
 #       package = "infra/knockout";
+#       channel = "canary";          # optional; registry channel to follow (default stable)
 #       config = { port = "19876"; };
+#       updateWindows = [ "02:00-05:00" ];  # optional; when updates may land (local time)
+#       pinnedStorePath = null;      # optional; run this version instead of the registry's
+#       sandbox = "none";            # optional; opt every service out of the default sandbox profile
 #       expose = {
 #         port = 19876;
 #         visibility = "public";
@@ -19,6 +23,28 @@
 #     };
 #   };
 #
+# expose.blueGreen = true routes the vhost through an nginx upstream whose
+# server list (/run/overlays/upstreams/<name>.conf) the manager rewrites when
+# a blue/green overlay switches slots. Until the first switch it points at
+# expose.port.
+#
+# Overlay services run under a default sandbox profile (ProtectSystem=full,
+# NoNewPrivileges, private /tmp, ...; pkgs/fort-overlay-manager/sandbox.go)
+# unless their overlay.nix sets sandbox = "none". This applies to overlays
+# deployed before the profile existed as well, from their next activation
+# on — an overlay that writes outside its state directory or needs setuid
+# helpers should either ship a manifest that says so or be opted out here
+# with sandbox = "none". The manager logs every service it puts on the
+# profile without its manifest asking for it.
+#
+# An overlay can also publish itself: expose entries in its overlay.nix
+# become nginx vhosts under /run/overlays/nginx and DNS/proxy needs in
+# /run/fort/needs.d when a version is activated, no deploy involved
+# (pkgs/fort-overlay-manager/expose.go). That runs nginx and opens 80/443,
+# so a host opts in with overlayRuntimeExpose = true in its manifest (or a
+# cluster with settings.overlays.runtimeExpose); elsewhere the manager
+# refuses versions that want to expose themselves.
+#
 { rootManifest, hostManifest, cluster, ... }:
 {
   config,
@@ -42,6 +68,17 @@ let
   in
     if hosts != [] then (builtins.head hosts).hostName else null;
 
+  # Providers of the discovery needs for runtime-exposed overlays, found the
+  # way fort/services.nix finds them
+  hostWithRole = role: let
+    hosts = builtins.filter (h: builtins.elem role (h.roles or []))
+      (builtins.attrValues allHostManifests);
+  in if hosts != [] then (builtins.head hosts).hostName else null;
+  beaconHost = hostWithRole "beacon";
+  forgeHost = hostWithRole "forge";
+
+  inherit (import ./service-lib.nix) subdomainOf;
+
   registryUrl =
     if registryHost != null
     then "https://overlay-registry.${domain}"
@@ -49,17 +86,27 @@ let
 
   hasOverlays = overlays != {} && registryUrl != null;
 
+  runtimeExpose = hostManifest.overlayRuntimeExpose
+    or rootManifest.fortConfig.settings.overlays.runtimeExpose or false;
+
   fort-overlay-manager = import ../../pkgs/fort-overlay-manager { inherit pkgs; };
 
   # Normalize overlay config: fill in defaults
   normalizeOverlay = name: ov: {
     package = ov.package;
+    channel = ov.channel or "";
     config = ov.config or {};
     secrets = ov.secrets or {};
     paths = ov.paths or {};
     secretOwners = ov.secretOwners or {};
     expose = ov.expose or null;
     enabled = ov.enabled or true;
+    # Update policy (pkgs/fort-overlay-manager/policy.go): a pinned store
+    # path replaces the registry's version; update windows ("[DAYS ]HH:MM-HH:MM",
+    # e.g. "Sat,Sun 02:00-05:00", or a cron expression open in every minute
+    # it matches, e.g. "* 2-4 * * 6,0") confine when a check cycle may change it
+    pinnedStorePath = ov.pinnedStorePath or null;
+    updateWindows = ov.updateWindows or [];
     # Declared inter-overlay dependencies (q-1e0a32ed): each entry must be
     # another overlay on this host. The manager orders activation and adds
     # After=/Wants= on the generated units so dependencies start first.
@@ -67,26 +114,81 @@ let
       if builtins.hasAttr dep overlays then dep
       else throw "fort-nix: overlay '${name}' dependsOn '${dep}', which is not declared on this host"
     ) (ov.dependsOn or []);
+    # Restart this overlay whenever a dependency's running version changes
+    restartWithDependencies = ov.restartWithDependencies or false;
+    sandbox = ov.sandbox or null;
   };
 
   normalizedOverlays = builtins.mapAttrs normalizeOverlay overlays;
 
+  # Publishers whose registry signatures the manager accepts — the same
+  # "overlay-publish" principals the registry admits writes from
+  trustedKeys = lib.mapAttrs (_: p: p.agentKey or p.publicKey) (lib.filterAttrs
+    (_: p: builtins.elem "overlay-publish" (p.roles or [ ]))
+    rootManifest.fortConfig.settings.principals);
+
+  # Opt-out of publisher verification, for clusters that have not set up
+  # overlay-publish principals yet: without it the manager refuses every
+  # entry it cannot verify. Logged on every use.
+  allowUnsigned = rootManifest.fortConfig.settings.overlays.allowUnsigned or false;
+
+  # Principals allowed to change what a host's overlays run (overlay-admin)
+  adminPrincipals = rootManifest.fortConfig.settings.overlays.adminPrincipals or [ "dev-sandbox" ];
+
   # Build the config JSON that the manager reads
   overlayConfigs = builtins.mapAttrs (name: ov: {
     package = ov.package;
+    channel = ov.channel;
+    # Secrets are referenced by name; overlay.nix sees their file path, the
+    # services that ask for them get them as systemd credentials, and the
+    # value never reaches nix eval
     config = ov.config // (builtins.mapAttrs (secretName: _:
-      "%SECRET:/run/secrets/overlay-${name}-${secretName}%"
+      "%SECRET:overlay-${name}-${secretName}%"
     ) ov.secrets);
     enabled = ov.enabled;
     dependsOn = ov.dependsOn;
+    pinnedStorePath = if ov.pinnedStorePath != null then ov.pinnedStorePath else "";
+    updateWindows = ov.updateWindows;
+    restartWithDependencies = ov.restartWithDependencies;
+    sandbox = if ov.sandbox != null then ov.sandbox else "";
   }) normalizedOverlays;
 
   managerConfig = {
+    # The name reports, rollout waves and fetch logs know this host by
+    hostname = config.networking.hostName;
     registryUrl = registryUrl;
     pollInterval = "5m";
     stateDir = "/var/lib/fort-overlay-manager";
     binDir = "/run/overlays/bin";
     overlays = overlayConfigs;
+    inherit trustedKeys allowUnsigned;
+    # Recent versions per overlay kept GC-rooted for `rollback --to`
+    retainVersions = 5;
+    # Closures are prefetched in the background; new versions must be
+    # signed by the attic cache, whose key and URL gitops fetches at runtime.
+    # Until it has, nothing is fetched.
+    fetch = {
+      concurrency = 2;
+      cacheConfFile = "/var/lib/fort/nix/attic-cache.conf";
+    };
+    # Runtime exposure: vhosts from overlay manifests, with the same needs
+    # fort/services.nix declares for fort.cluster.services. token and
+    # identity SSO only where nginx.nix and auth.nix already run their
+    # backends; the oauth2-proxy modes need a deploy. Left out on hosts that
+    # have not opted in.
+  } // lib.optionalAttrs runtimeExpose {
+    expose = {
+      inherit domain;
+      nginxDir = "/run/overlays/nginx";
+      needsFile = "/run/fort/needs.d/overlays.json";
+      ssoModes = [ "none" ]
+        ++ lib.optional (builtins.any (svc: svc.sso.mode == "token") config.fort.cluster.services) "token"
+        ++ lib.optional (builtins.any (svc: svc.sso.mode == "identity") config.fort.cluster.services) "identity";
+      reservedSubdomains = map subdomainOf config.fort.cluster.services;
+      proxyFrom = if beaconHost != config.networking.hostName then beaconHost else null;
+      dnsFrom = beaconHost;
+      lanDnsFrom = forgeHost;
+    };
   };
 
   configFile = pkgs.writeText "overlays.json" (builtins.toJSON managerConfig);
@@ -99,6 +201,8 @@ let
         sopsFile = secretPath;
         format = "binary";
         path = "/run/secrets/overlay-${name}-${secretName}";
+        # A rotated secret restarts the overlay's services onto the new value
+        restartUnits = [ "fort-overlay-manager-secrets.service" ];
       } // (ov.secretOwners.${secretName} or {});
     }) ov.secrets)
   ) {} normalizedOverlays;
@@ -114,16 +218,49 @@ let
         lanDirect = ov.expose.lanDirect or false;
         maxBodySize = ov.expose.maxBodySize or null;
         sso = ov.expose.sso or {};
+        upstream = if ov.expose.blueGreen or false then "overlay-${name}" else null;
       }]
     else acc
   ) [] normalizedOverlays;
 
+  blueGreenOverlays = lib.filterAttrs
+    (_: ov: ov.expose != null && (ov.expose.blueGreen or false))
+    normalizedOverlays;
+
 in
 {
   config = lib.mkIf hasOverlays (lib.mkMerge [
     # Service exposure from overlay declarations
     { fort.cluster.services = exposedServices; }
 
+    # Switchable upstreams for blue/green overlays. tmpfiles "f" only writes
+    # the initial server when the file is missing, so a switched slot
+    # survives nixos-rebuild; /run is wiped on reboot and cmdBoot rewrites it.
+    (lib.mkIf (blueGreenOverlays != {}) {
+      services.nginx.upstreams = lib.mapAttrs' (name: _: {
+        name = "overlay-${name}";
+        value.extraConfig = "include /run/overlays/upstreams/${name}.conf;";
+      }) blueGreenOverlays;
+      systemd.tmpfiles.rules = [ "d /run/overlays/upstreams 0755 root root -" ]
+        ++ lib.mapAttrsToList (name: ov:
+          "f /run/overlays/upstreams/${name}.conf 0644 root root - server 127.0.0.1:${toString ov.expose.port};"
+        ) blueGreenOverlays;
+    })
+
+    # Runtime vhosts: nginx includes whatever the manager writes (an empty
+    # glob is fine), on hosts that opted in
+    (lib.mkIf runtimeExpose {
+      services.nginx.enable = true;
+      services.nginx.appendHttpConfig = ''
+        include /run/overlays/nginx/*.conf;
+      '';
+      networking.firewall.allowedTCPPorts = [ 80 443 ];
+      systemd.tmpfiles.rules = [
+        "d /run/overlays/nginx 0755 root root -"
+        "d /run/fort/needs.d 0755 root root -"
+      ];
+    })
+
     # Secrets from overlay declarations
     (lib.mkIf (allSecrets != {}) {
       sops.secrets = allSecrets;
@@ -152,29 +289,50 @@ in
       };
     }
 
-    # Overlay status capability — lets CI (and agents) observe what a host
-    # is actually running. `refresh` is deliberately fire-and-forget, so it
-    # returns before activation completes; this is the read side that makes
-    # the outcome of that activation observable.
+    # Overlay capability — lets CI and operators observe what a host is
+    # actually running (`refresh` is deliberately fire-and-forget, so this
+    # is the read side that makes its outcome observable)
     {
       fort.host.capabilities.overlay = {
         handler = pkgs.writeShellScript "handle-overlay" ''
-          set -euo pipefail
-          input=$(${pkgs.coreutils}/bin/cat)
-          overlay=$(echo "$input" | ${pkgs.jq}/bin/jq -r '.overlay // empty')
-          status=$(${fort-overlay-manager}/bin/fort-overlay-manager status --json)
-          if [ -n "$overlay" ]; then
-            echo "$status" | ${pkgs.jq}/bin/jq --arg n "$overlay" \
-              'map(select(.name == $n)) | if length == 0
-                 then {error: "overlay not found", overlay: $n}
-                 else .[0] end'
-          else
-            echo "$status"
-          fi
+          exec ${fort-overlay-manager}/bin/fort-overlay-manager capability
         '';
         mode = "rpc";
-        description = "Report overlay activation state and live store paths";
+        description = "Report overlay activation status";
         allowed = [ "ci" "dev-sandbox" ];
+        requestSchema = {
+          type = "object";
+          properties = {
+            action = { type = "string"; enum = [ "status" ]; default = "status"; };
+            overlay = { type = "string"; };
+          };
+        };
+      };
+    }
+
+    # Overlay admin capability — drives what a host runs: activate a signed
+    # or retained version, roll back, pin, unpin, hold and release.
+    # Restricted like deploy; settings.overlays.adminPrincipals grants it to
+    # more principals (e.g. ci) explicitly. Writes run detached on the host
+    # and are reflected in the overlay capability's status.
+    {
+      fort.host.capabilities.overlay-admin = {
+        handler = pkgs.writeShellScript "handle-overlay-admin" ''
+          exec ${fort-overlay-manager}/bin/fort-overlay-manager capability --admin
+        '';
+        mode = "rpc";
+        description = "Control overlay activation: activate, rollback, pin, unpin, hold, release";
+        allowed = adminPrincipals;
+        requestSchema = {
+          type = "object";
+          required = [ "action" "overlay" ];
+          properties = {
+            action = { type = "string"; enum = [ "status" "activate" "rollback" "pin" "unpin" "hold" "release" ]; };
+            overlay = { type = "string"; };
+            storePath = { type = "string"; description = "activate, pin: a signed registry entry or retained version"; };
+            to = { type = "string"; description = "rollback: a retained version (default: the previous one)"; };
+          };
+        };
       };
     }
 
@@ -195,7 +353,8 @@ in
       systemd.services.fort-overlay-manager-boot = {
         description = "Fort overlay manager - regenerate units on boot";
         after = [ "local-fs.target" ];
-        before = [ "multi-user.target" ];
+        # Rewrites the runtime vhosts nginx includes
+        before = [ "multi-user.target" "nginx.service" ];
         wantedBy = [ "multi-user.target" ];
 
         serviceConfig = {
@@ -206,7 +365,13 @@ in
       };
     }
 
-    # Timer-driven check service
+    # Manager daemon: long-polls the registry and runs a check cycle as soon
+    # as a subscribed package moves, falling back to a check every
+    # pollInterval while the registry cannot be watched. It owns overlay
+    # state while it runs: the subcommands (and the oneshot services below)
+    # hand their work to it over /run/fort-overlay-manager.sock, and only
+    # run in-process when it is down. The oneshot check service stays for
+    # running a cycle by hand.
     {
       systemd.services.fort-overlay-manager-check = {
         description = "Fort overlay manager - check for updates";
@@ -219,15 +384,58 @@ in
         };
       };
 
-      systemd.timers.fort-overlay-manager-check = {
-        description = "Fort overlay manager - periodic check";
+      systemd.services.fort-overlay-manager = {
+        description = "Fort overlay manager daemon";
+        after = [ "network-online.target" "tailscaled.service" "fort-overlay-manager-boot.service" ];
+        wants = [ "network-online.target" "tailscaled.service" ];
+        wantedBy = [ "multi-user.target" ];
+        restartTriggers = [ configFile ];
+
+        serviceConfig = {
+          ExecStart = "${fort-overlay-manager}/bin/fort-overlay-manager daemon";
+          Restart = "always";
+          RestartSec = "10s";
+        };
+      };
+    }
+
+    # Secret rotation: restarts the services of any overlay whose secrets
+    # changed since it started. sops-nix triggers it when a secret is
+    # updated; check cycles run the same pass.
+    {
+      systemd.services.fort-overlay-manager-secrets = {
+        description = "Fort overlay manager - apply rotated secrets";
+        after = [ "fort-overlay-manager-boot.service" ];
+
+        serviceConfig = {
+          Type = "oneshot";
+          ExecStart = "${fort-overlay-manager}/bin/fort-overlay-manager secrets";
+        };
+      };
+    }
+
+    # Post-activation watchdog: probes overlays still inside their
+    # health.bake period and rolls back one that degrades. A no-op read of
+    # the state dir when nothing is baking.
+    {
+      systemd.services.fort-overlay-manager-watchdog = {
+        description = "Fort overlay manager - post-activation watchdog";
+        after = [ "fort-overlay-manager-boot.service" ];
+
+        serviceConfig = {
+          Type = "oneshot";
+          ExecStart = "${fort-overlay-manager}/bin/fort-overlay-manager watchdog";
+        };
+      };
+
+      systemd.timers.fort-overlay-manager-watchdog = {
+        description = "Fort overlay manager - watchdog tick";
         wantedBy = [ "timers.target" ];
         after = [ "fort-overlay-manager-boot.service" ];
 
         timerConfig = {
           OnBootSec = "1m";
-          OnUnitActiveSec = "5m";
-          RandomizedDelaySec = "30s";
+          OnUnitActiveSec = "30s";
         };
       };
     }
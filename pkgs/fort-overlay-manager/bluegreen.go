@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Blue/green activation. By default an upgrade stops the old services before
+// starting the new ones, so every upgrade is an outage for startup plus the
+// health-check grace. An overlay that opts in with
+//
+//	activation = {
+//	  strategy = "blue-green";
+//	  ports = { blue = 19877; green = 19878; };      # and/or
+//	  socket = "/run/overlays/knockout/knockout.sock";
+//	  drainSeconds = 10;
+//	};
+//
+// instead runs each version in one of two slots. The new version starts in
+// the idle slot next to the live one, is health-checked there, and only then
+// receives traffic: with ports, /run/overlays/upstreams/<name>.conf is
+// rewritten to the slot's port and nginx reloaded (the overlay's expose needs
+// blueGreen = true so its vhost proxies through that upstream); with a
+// socket, the stable socket path is an atomically swapped symlink to
+// <socket>.<slot>. The old slot is drained and stopped last. If the new slot
+// fails to start or fails health checks it is stopped and the old one simply
+// keeps serving.
+//
+// Slot services get OVERLAY_SLOT, OVERLAY_PORT and OVERLAY_SOCKET in their
+// environment, and %SLOT%, %PORT% and %SOCKET% are substituted in exec,
+// drain, environment and the health endpoint. Both versions run at once for
+// the length of the health checks, so they must tolerate sharing state.
+
+const strategyBlueGreen = "blue-green"
+
+var upstreamDir = "/run/overlays/upstreams"
+
+// ActivationConfig selects how a new version replaces the running one
+type ActivationConfig struct {
+	Strategy     string         `json:"strategy"` // "replace" (default) or "blue-green"
+	Ports        map[string]int `json:"ports"`    // slot -> port, switched via the nginx upstream
+	Socket       string         `json:"socket"`   // stable socket path, switched via symlink
+	DrainSeconds int            `json:"drainSeconds"`
+}
+
+func (m *OverlayManifest) blueGreen() bool {
+	return m.Activation != nil && m.Activation.Strategy == strategyBlueGreen
+}
+
+func validateActivation(a *ActivationConfig) error {
+	if a == nil {
+		return nil
+	}
+	switch a.Strategy {
+	case "", "replace":
+		return nil
+	case strategyBlueGreen:
+	default:
+		return fmt.Errorf("unknown strategy %q", a.Strategy)
+	}
+	if len(a.Ports) == 0 && a.Socket == "" {
+		return errors.New("blue-green needs ports or socket to switch traffic")
+	}
+	if len(a.Ports) > 0 {
+		blue, green := a.Ports["blue"], a.Ports["green"]
+		if blue <= 0 || green <= 0 {
+			return errors.New("blue-green ports must set both blue and green")
+		}
+		if blue == green {
+			return fmt.Errorf("blue and green share port %d", blue)
+		}
+	}
+	if a.Socket != "" && !filepath.IsAbs(a.Socket) {
+		return fmt.Errorf("socket %q is not an absolute path", a.Socket)
+	}
+	return nil
+}
+
+// otherSlot is the slot a new version starts in: whichever one is not live.
+// A version replaced in place (no slot) hands over to blue.
+func otherSlot(live string) string {
+	if live == "blue" {
+		return "green"
+	}
+	return "blue"
+}
+
+func slotSocket(socket, slot string) string {
+	return socket + "." + slot
+}
+
+func slotTargetName(overlay, slot string) string {
+	return fmt.Sprintf("overlay-%s@%s.target", overlay, slot)
+}
+
+// slotUnitName is serviceUnitName with the slot as instance, e.g.
+// overlay-knockout@green.service
+func slotUnitName(overlay, service, slot string) string {
+	return strings.TrimSuffix(serviceUnitName(overlay, service), ".service") + "@" + slot + ".service"
+}
+
+// forSlot returns the manifest as it runs in slot: placeholders substituted
+// and the slot's coordinates added to every service's environment
+func (m *OverlayManifest) forSlot(slot string) *OverlayManifest {
+	var port, socket string
+	if p, ok := m.Activation.Ports[slot]; ok {
+		port = strconv.Itoa(p)
+	}
+	if m.Activation.Socket != "" {
+		socket = slotSocket(m.Activation.Socket, slot)
+	}
+	r := strings.NewReplacer("%SLOT%", slot, "%PORT%", port, "%SOCKET%", socket)
+
+	out := *m
+	out.Services = make(map[string]ServiceDef, len(m.Services))
+	for svcName, svc := range m.Services {
+		svc.Exec = r.Replace(svc.Exec)
+		svc.Drain = r.Replace(svc.Drain)
+		env := []string{"OVERLAY_SLOT=" + slot}
+		if port != "" {
+			env = append(env, "OVERLAY_PORT="+port)
+		}
+		if socket != "" {
+			env = append(env, "OVERLAY_SOCKET="+socket)
+		}
+		for _, e := range svc.Environment {
+			env = append(env, r.Replace(e))
+		}
+		svc.Environment = env
+		out.Services[svcName] = svc
+	}
+	if m.Health != nil {
+		health := *m.Health
+		health.Endpoint = r.Replace(health.Endpoint)
+		health.Checks = make([]HealthCheck, len(m.Health.Checks))
+		for i, c := range m.Health.Checks {
+			c.Endpoint = r.Replace(c.Endpoint)
+			c.Socket = r.Replace(c.Socket)
+			health.Checks[i] = c
+		}
+		out.Health = &health
+	}
+	return &out
+}
+
+// generateSlotUnits writes overlay-<name>@<slot>.target and the slot's
+// service units. The slot target is PartOf the overlay target, so stopping
+// the overlay stops whichever slot is running.
+func generateSlotUnits(name, slot string, manifest *OverlayManifest, dependsOn []string) error {
+	targetName := slotTargetName(name, slot)
+	targetContent := fmt.Sprintf(`[Unit]
+Description=Overlay target for %s (%s slot)
+PartOf=overlay-%s.target
+`, name, slot, name)
+	for _, dep := range dependsOn {
+		targetContent += fmt.Sprintf("Wants=overlay-%s.target\nAfter=overlay-%s.target\n", dep, dep)
+	}
+	if err := os.WriteFile(filepath.Join(unitDir, targetName), []byte(targetContent), 0644); err != nil {
+		return fmt.Errorf("write target: %w", err)
+	}
+
+	// Rebuilt from scratch: the slot last held some other version, whose
+	// service set may differ
+	wantsDir := filepath.Join(unitDir, targetName+".wants")
+	os.RemoveAll(wantsDir)
+	os.MkdirAll(wantsDir, 0755)
+	for svcName, svc := range manifest.Services {
+		unitName := slotUnitName(name, svcName, slot)
+		if err := writeServiceUnit(name, svcName+" ("+slot+")", unitName, targetName, svc, dependsOn); err != nil {
+			return err
+		}
+		os.Symlink(filepath.Join(unitDir, unitName), filepath.Join(wantsDir, unitName))
+	}
+	return nil
+}
+
+// stopWanted synchronously stops every service a target wants through its
+// .wants dir — the units that exist, rather than the ones a manifest names
+func stopWanted(name, targetName string) {
+	entries, _ := os.ReadDir(filepath.Join(unitDir, targetName+".wants"))
+	for _, entry := range entries {
+		log.Printf("[%s] stopping %s", name, entry.Name())
+		if err := exec.Command("systemctl", "stop", entry.Name()).Run(); err != nil {
+			log.Printf("[%s] stop %s: %v (may not have been running)", name, entry.Name(), err)
+		}
+	}
+}
+
+func stopSlot(name, slot string) {
+	stopWanted(name, slotTargetName(name, slot))
+	exec.Command("systemctl", "stop", slotTargetName(name, slot)).Run()
+}
+
+func startSlot(name, slot string) error {
+	return exec.Command("systemctl", "start", slotTargetName(name, slot)).Run()
+}
+
+// switchTraffic points the overlay's stable address at slot
+func switchTraffic(name string, a *ActivationConfig, slot string) error {
+	if port, ok := a.Ports[slot]; ok {
+		if err := writeUpstream(filepath.Join(upstreamDir, name+".conf"), port); err != nil {
+			return err
+		}
+		// try-: before nginx is up (boot) the file is simply read on start
+		if err := exec.Command("systemctl", "try-reload-or-restart", "nginx.service").Run(); err != nil {
+			return fmt.Errorf("nginx reload: %w", err)
+		}
+	}
+	if a.Socket != "" {
+		if err := swapSocket(a.Socket, slot); err != nil {
+			return err
+		}
+	}
+	log.Printf("[%s] traffic switched to %s slot", name, slot)
+	return nil
+}
+
+// writeUpstream atomically replaces the server list nginx includes into the
+// overlay's upstream block
+func writeUpstream(path string, port int) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("upstream dir: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("server 127.0.0.1:%d;\n", port)), 0644); err != nil {
+		return fmt.Errorf("write upstream: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("write upstream: %w", err)
+	}
+	return nil
+}
+
+// swapSocket repoints the stable socket path at the slot's socket. rename(2)
+// over the old link is atomic, so clients connecting mid-swap get one slot
+// or the other, never a missing path.
+func swapSocket(socket, slot string) error {
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		return fmt.Errorf("socket dir: %w", err)
+	}
+	tmp := socket + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(slotSocket(socket, slot), tmp); err != nil {
+		return fmt.Errorf("socket link: %w", err)
+	}
+	if err := os.Rename(tmp, socket); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("socket link: %w", err)
+	}
+	return nil
+}
+
+// cutover moves an overlay from the live slot ("" for a version replaced in
+// place) to slot, running storePath. The old instance keeps serving until the new one is up —
+// and, with checkHealth, healthy — so an error return means traffic never
+// left it.
+func cutover(stateDir, name, storePath string, ov OverlayConfig, manifest *OverlayManifest, live, slot string, checkHealth bool) error {
+	slotManifest := manifest.forSlot(slot)
+	slotManifest.Health = slotManifest.Health.resolve(name, slot)
+
+	// Leftovers from an earlier attempt that never went live
+	stopSlot(name, slot)
+	if err := generateSlotUnits(name, slot, slotManifest, ov.DependsOn); err != nil {
+		return fmt.Errorf("unit generation failed: %w", err)
+	}
+	if err := daemonReload(); err != nil {
+		return fmt.Errorf("daemon-reload failed: %w", err)
+	}
+
+	log.Printf("[%s] starting %s slot alongside the running version", name, slot)
+	if err := startSlot(name, slot); err != nil {
+		stopSlot(name, slot)
+		return fmt.Errorf("start failed: %w", err)
+	}
+
+	if checkHealth && slotManifest.Health.enabled() {
+		transition(stateDir, "provisional", storePath, "")
+		if !runHealthChecks(name, slotManifest.Health) {
+			stopSlot(name, slot)
+			return errors.New("health checks failed")
+		}
+	}
+
+	transition(stateDir, "switching", storePath, "")
+	if err := switchTraffic(name, manifest.Activation, slot); err != nil {
+		// Put back whatever half of the switch already happened
+		if live != "" {
+			switchTraffic(name, manifest.Activation, live)
+		}
+		stopSlot(name, slot)
+		return fmt.Errorf("traffic switch failed: %w", err)
+	}
+
+	transition(stateDir, "draining", storePath, "")
+	if d := manifest.Activation.DrainSeconds; d > 0 {
+		log.Printf("[%s] draining old instance for %ds", name, d)
+		time.Sleep(time.Duration(d) * time.Second)
+	}
+	stopWanted(name, fmt.Sprintf("overlay-%s.target", name))
+	if live != "" && live != slot {
+		stopSlot(name, live)
+	}
+
+	if err := writeOverlayTarget(name, ov.DependsOn, slot); err != nil {
+		log.Printf("[%s] %v", name, err)
+	}
+	daemonReload()
+	startTarget(name)
+	return nil
+}
+
+// activateBlueGreen is cmdActivate from PROVISIONING on for a blue/green
+// overlay. A failure before the switch leaves the committed version serving
+// untouched, so it ends "rolled-back" without calling rollbackOverlay.
+func activateBlueGreen(cfg Config, name, storePath string, manifest *OverlayManifest) {
+	ov := cfg.Overlays[name]
+	stateDir := filepath.Join(cfg.StateDir, name)
+	current := loadCurrentState(cfg.StateDir, name)
+	live := ""
+	if current != nil {
+		live = current.Slot
+	}
+	slot := otherSlot(live)
+
+	if err := cutover(stateDir, name, storePath, ov, manifest, live, slot, true); err != nil {
+		if current == nil {
+			failActivation(stateDir, name, storePath, "%v", err)
+			return
+		}
+		log.Printf("[%s] %v; %s keeps serving", name, err, current.StorePath)
+		recordAttempt(stateDir, storePath, "rolled-back", err.Error())
+		transition(stateDir, "rolling-back", storePath, err.Error())
+		transition(stateDir, "rolled-back", current.StorePath, err.Error())
+		return
+	}
+
+	// PERMANENT
+	transition(stateDir, "permanent", storePath, "")
+	rotatePrevious(stateDir)
+	saveCurrentState(stateDir, OverlayState{
+		StorePath:   storePath,
+		ActivatedAt: time.Now().Unix(),
+		Slot:        slot,
+		Ports:       manifest.declaredPorts(),
+		Expose:      manifest.exposures(name),
+	})
+	updateGCRoot(stateDir, "gc-root-current", storePath)
+	retainVersions(cfg, stateDir)
+	updateBinSymlinks(cfg.BinDir, manifest.Bins)
+	clearAttempt(stateDir)
+	slotManifest := manifest.forSlot(slot)
+	slotManifest.Health = slotManifest.Health.resolve(name, slot)
+	recordSecrets(stateDir, ov.Config, manifest, serviceUnits(name, manifest, slot))
+	startBake(stateDir, name, storePath, slotManifest.Health, serviceUnits(name, slotManifest, slot))
+
+	log.Printf("[%s] activated %s in %s slot", name, storePath, slot)
+	if err := syncExposure(cfg); err != nil {
+		log.Printf("[%s] expose: %v", name, err)
+	}
+	restartDependents(cfg, name)
+}
+
+// restoreSlot regenerates a committed blue/green overlay's units at boot and
+// points traffic back at its live slot
+func restoreSlot(name string, ov OverlayConfig, manifest *OverlayManifest, slot string) error {
+	if err := generateSlotUnits(name, slot, manifest.forSlot(slot), ov.DependsOn); err != nil {
+		return err
+	}
+	if err := writeOverlayTarget(name, ov.DependsOn, slot); err != nil {
+		return err
+	}
+	return switchTraffic(name, manifest.Activation, slot)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func blueGreenManifest() *OverlayManifest {
+	return &OverlayManifest{
+		Services: map[string]ServiceDef{
+			"knockout": {
+				Exec:        "/nix/store/aaa-knockout/bin/knockout --listen 127.0.0.1:%PORT%",
+				Drain:       "/nix/store/aaa-knockout/bin/knockout drain --slot %SLOT%",
+				Environment: []string{"SOCKET=%SOCKET%"},
+			},
+		},
+		Health: &HealthConfig{Type: "http", Endpoint: "http://127.0.0.1:%PORT%/health"},
+		Activation: &ActivationConfig{
+			Strategy: strategyBlueGreen,
+			Ports:    map[string]int{"blue": 19877, "green": 19878},
+			Socket:   "/run/overlays/knockout/knockout.sock",
+		},
+	}
+}
+
+func TestValidateActivation(t *testing.T) {
+	cases := []struct {
+		name    string
+		a       *ActivationConfig
+		wantErr bool
+	}{
+		{"absent", nil, false},
+		{"replace", &ActivationConfig{Strategy: "replace"}, false},
+		{"unknown strategy", &ActivationConfig{Strategy: "canary"}, true},
+		{"nothing to switch", &ActivationConfig{Strategy: strategyBlueGreen}, true},
+		{"one port", &ActivationConfig{Strategy: strategyBlueGreen, Ports: map[string]int{"blue": 1}}, true},
+		{"shared port", &ActivationConfig{Strategy: strategyBlueGreen, Ports: map[string]int{"blue": 1, "green": 1}}, true},
+		{"relative socket", &ActivationConfig{Strategy: strategyBlueGreen, Socket: "knockout.sock"}, true},
+		{"ports", &ActivationConfig{Strategy: strategyBlueGreen, Ports: map[string]int{"blue": 1, "green": 2}}, false},
+		{"socket", &ActivationConfig{Strategy: strategyBlueGreen, Socket: "/run/k.sock"}, false},
+	}
+	for _, tc := range cases {
+		if err := validateActivation(tc.a); (err != nil) != tc.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+// A new version always lands in the slot that is not serving; one replaced in
+// place hands over to blue.
+func TestOtherSlotAlternates(t *testing.T) {
+	for live, want := range map[string]string{"": "blue", "blue": "green", "green": "blue"} {
+		if got := otherSlot(live); got != want {
+			t.Errorf("otherSlot(%q) = %q, want %q", live, got, want)
+		}
+	}
+}
+
+func TestForSlotSubstitutesSlotCoordinates(t *testing.T) {
+	m := blueGreenManifest()
+	green := m.forSlot("green")
+
+	svc := green.Services["knockout"]
+	if want := "/nix/store/aaa-knockout/bin/knockout --listen 127.0.0.1:19878"; svc.Exec != want {
+		t.Errorf("Exec = %q, want %q", svc.Exec, want)
+	}
+	if !strings.HasSuffix(svc.Drain, "--slot green") {
+		t.Errorf("Drain = %q, slot not substituted", svc.Drain)
+	}
+	env := strings.Join(svc.Environment, " ")
+	for _, want := range []string{
+		"OVERLAY_SLOT=green",
+		"OVERLAY_PORT=19878",
+		"OVERLAY_SOCKET=/run/overlays/knockout/knockout.sock.green",
+		"SOCKET=/run/overlays/knockout/knockout.sock.green",
+	} {
+		if !strings.Contains(env, want) {
+			t.Errorf("environment %q missing %s", env, want)
+		}
+	}
+	if green.Health.Endpoint != "http://127.0.0.1:19878/health" {
+		t.Errorf("health endpoint = %q, want the green port", green.Health.Endpoint)
+	}
+
+	// The committed manifest must not be rewritten in place
+	if m.Services["knockout"].Exec == svc.Exec || m.Health.Endpoint == green.Health.Endpoint {
+		t.Error("forSlot modified the original manifest")
+	}
+}
+
+func TestGenerateSlotUnitsLeaveLiveSlotAlone(t *testing.T) {
+	unitDir = t.TempDir()
+	defer func() { unitDir = "/run/systemd/system" }()
+
+	m := blueGreenManifest()
+	if err := generateSlotUnits("knockout", "blue", m.forSlot("blue"), []string{"coffer"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeOverlayTarget("knockout", []string{"coffer"}, "blue"); err != nil {
+		t.Fatal(err)
+	}
+	if err := generateSlotUnits("knockout", "green", m.forSlot("green"), []string{"coffer"}); err != nil {
+		t.Fatal(err)
+	}
+
+	blue, err := os.ReadFile(filepath.Join(unitDir, "overlay-knockout@blue.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(blue), "127.0.0.1:19877") || !strings.Contains(string(blue), "PartOf=overlay-knockout@blue.target") {
+		t.Errorf("blue unit rewritten by green generation:\n%s", blue)
+	}
+	green, err := os.ReadFile(filepath.Join(unitDir, "overlay-knockout@green.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(green), "After=network.target overlay-coffer.target") {
+		t.Errorf("green unit not ordered after dependency:\n%s", green)
+	}
+	if _, err := os.Lstat(filepath.Join(unitDir, "overlay-knockout@green.target.wants", "overlay-knockout@green.service")); err != nil {
+		t.Errorf("green target does not want its service: %v", err)
+	}
+
+	// Until the switch, the overlay target still stands for blue
+	target, _ := os.ReadFile(filepath.Join(unitDir, "overlay-knockout.target"))
+	if !strings.Contains(string(target), "Wants=overlay-knockout@blue.target") || strings.Contains(string(target), "green") {
+		t.Errorf("overlay target:\n%s", target)
+	}
+}
+
+func TestWriteUpstreamPointsAtSlotPort(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upstreams", "knockout.conf")
+	if err := writeUpstream(path, 19877); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeUpstream(path, 19878); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "server 127.0.0.1:19878;\n" {
+		t.Errorf("upstream = %q", data)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary upstream file left behind")
+	}
+}
+
+func TestSwapSocketRepointsStablePath(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "knockout", "knockout.sock")
+	for _, slot := range []string{"blue", "green"} {
+		if err := swapSocket(socket, slot); err != nil {
+			t.Fatal(err)
+		}
+		target, err := os.Readlink(socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != socket+"."+slot {
+			t.Errorf("after switch to %s: %s -> %s", slot, socket, target)
+		}
+	}
+}
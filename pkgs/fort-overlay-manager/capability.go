@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The `overlay` fort capability (common/fort/overlays.nix) runs
+// `fort-overlay-manager capability`, and `overlay-admin` runs
+// `fort-overlay-manager capability --admin`: a JSON request on stdin, a JSON
+// answer on stdout, the calling principal in FORT_ORIGIN. fort-provider's
+// RBAC decides who may call each at all; `overlay` only reports status, the
+// actions that change what a host runs need `overlay-admin`.
+//
+//	{"action": "status", "overlay": "coffer"}          overlay optional
+//	{"action": "activate", "overlay": "coffer", "storePath": "/nix/store/…"}
+//	{"action": "rollback", "overlay": "coffer", "to": "/nix/store/…"}   to optional
+//	{"action": "pin", "overlay": "coffer", "storePath": "/nix/store/…"} storePath optional
+//	{"action": "unpin", "overlay": "coffer"}
+//	{"action": "hold", "overlay": "coffer"}            release lifts it
+//
+// A remote caller can only activate (or pin to) a version this host would
+// accept anyway: the registry's signed entry for the overlay's package, or
+// one of its retained versions. activate, rollback and a pin that has to
+// activate answer "accepted" and run detached, like deploy, so they survive
+// a fort-provider restart; status shows the outcome.
+
+type CapabilityRequest struct {
+	Action    string `json:"action"`
+	Overlay   string `json:"overlay"`
+	StorePath string `json:"storePath"`
+	To        string `json:"to"`
+}
+
+var storePathRe = regexp.MustCompile(`^/nix/store/[0-9a-z]{32}-[A-Za-z0-9+._?=-]+$`)
+
+// detach runs the manager with args in a transient systemd unit; overridden
+// in tests
+var detach = func(unit string, args ...string) error {
+	self := os.Args[0]
+	if !filepath.IsAbs(self) {
+		self, _ = os.Executable()
+	}
+	cmdArgs := append([]string{"--unit=" + unit, "--collect", "--no-block", self}, args...)
+	out, err := exec.Command("systemd-run", cmdArgs...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemd-run: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func cmdCapability(cfg Config, admin bool, in io.Reader, out io.Writer) {
+	var req CapabilityRequest
+	data, _ := io.ReadAll(in)
+	if len(strings.TrimSpace(string(data))) > 0 {
+		if err := json.Unmarshal(data, &req); err != nil {
+			writeJSON(out, map[string]string{"error": "invalid request: " + err.Error()})
+			return
+		}
+	}
+	resp, err := handleCapability(cfg, req, os.Getenv("FORT_ORIGIN"), admin)
+	if err != nil {
+		resp = map[string]string{"error": err.Error(), "overlay": req.Overlay}
+	}
+	writeJSON(out, resp)
+}
+
+func writeJSON(out io.Writer, v any) {
+	data, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Fprintln(out, string(data))
+}
+
+// handleCapability answers a request; admin is whether it came through
+// overlay-admin, which write actions require
+func handleCapability(cfg Config, req CapabilityRequest, origin string, admin bool) (any, error) {
+	if req.Action == "" || req.Action == "status" {
+		entries := statusEntries(cfg)
+		if req.Overlay == "" {
+			return entries, nil
+		}
+		for _, e := range entries {
+			if e.Name == req.Overlay {
+				return e, nil
+			}
+		}
+		return nil, fmt.Errorf("overlay not found")
+	}
+
+	if !admin {
+		return nil, fmt.Errorf("%s needs the overlay-admin capability", req.Action)
+	}
+	if _, ok := cfg.Overlays[req.Overlay]; !ok {
+		return nil, fmt.Errorf("overlay not found")
+	}
+	name := req.Overlay
+	stateDir := filepath.Join(cfg.StateDir, name)
+	accepted := func(extra map[string]string) map[string]string {
+		resp := map[string]string{"status": "accepted", "overlay": name}
+		for k, v := range extra {
+			resp[k] = v
+		}
+		return resp
+	}
+
+	switch req.Action {
+	case "activate":
+		if err := authorizeStorePath(cfg, name, req.StorePath); err != nil {
+			return nil, err
+		}
+		log.Printf("[%s] activation of %s requested by %s", name, req.StorePath, origin)
+		if err := detach("fort-overlay-activate-"+name, "activate", name, "--store-path", req.StorePath); err != nil {
+			return nil, err
+		}
+		return accepted(map[string]string{"storePath": req.StorePath}), nil
+
+	case "rollback":
+		if req.To != "" {
+			if !storePathRe.MatchString(req.To) || !isRetained(cfg, stateDir, req.To) {
+				return nil, fmt.Errorf("%s is not a retained version", req.To)
+			}
+		} else if loadPreviousState(cfg.StateDir, name) == nil {
+			return nil, fmt.Errorf("no previous version to roll back to")
+		}
+		log.Printf("[%s] rollback requested by %s", name, origin)
+		args := []string{"rollback", name}
+		if req.To != "" {
+			args = append(args, "--to", req.To)
+		}
+		if err := detach("fort-overlay-rollback-"+name, args...); err != nil {
+			return nil, err
+		}
+		return accepted(map[string]string{"to": req.To}), nil
+
+	case "pin":
+		if req.StorePath != "" {
+			if err := authorizeStorePath(cfg, name, req.StorePath); err != nil {
+				return nil, err
+			}
+			current := loadCurrentState(cfg.StateDir, name)
+			if current == nil || current.StorePath != req.StorePath {
+				// Pinning activates first: run it detached like activate
+				args := []string{"pin", name, "--store-path", req.StorePath}
+				if origin != "" {
+					args = append(args, "--by", origin)
+				}
+				if err := detach("fort-overlay-pin-"+name, args...); err != nil {
+					return nil, err
+				}
+				return accepted(map[string]string{"storePath": req.StorePath}), nil
+			}
+		}
+		query := url.Values{"name": {name}, "storePath": nonEmpty(req.StorePath), "by": nonEmpty(origin)}
+		if err := viaDaemon(cfg, "/pin", query, func() error {
+			return cmdPin(cfg, name, req.StorePath, origin)
+		}); err != nil {
+			return nil, err
+		}
+		return map[string]any{"status": "pinned", "overlay": name, "pin": loadPin(stateDir)}, nil
+
+	case "unpin":
+		if err := viaDaemon(cfg, "/unpin", url.Values{"name": {name}}, func() error {
+			return cmdUnpin(cfg, name)
+		}); err != nil {
+			return nil, err
+		}
+		return map[string]string{"status": "unpinned", "overlay": name}, nil
+
+	case "hold":
+		if err := viaDaemon(cfg, "/hold", url.Values{"name": {name}, "by": nonEmpty(origin)}, func() error {
+			return cmdHold(cfg, name, origin)
+		}); err != nil {
+			return nil, err
+		}
+		return map[string]any{"status": "held", "overlay": name, "pin": loadPin(stateDir)}, nil
+
+	case "release":
+		if err := viaDaemon(cfg, "/release", url.Values{"name": {name}}, func() error {
+			return cmdRelease(cfg, name)
+		}); err != nil {
+			return nil, err
+		}
+		return map[string]string{"status": "released", "overlay": name}, nil
+	}
+	return nil, fmt.Errorf("unknown action %q (status, activate, rollback, pin, unpin, hold, release)", req.Action)
+}
+
+// authorizeStorePath accepts a version a remote caller asks for only if the
+// host would run it anyway: a retained version, or the overlay's current
+// signed registry entry
+func authorizeStorePath(cfg Config, name, storePath string) error {
+	if !storePathRe.MatchString(storePath) {
+		return fmt.Errorf("invalid storePath %q", storePath)
+	}
+	if isRetained(cfg, filepath.Join(cfg.StateDir, name), storePath) {
+		return nil
+	}
+	ov := cfg.Overlays[name]
+	host, err := hostName(cfg)
+	if err != nil {
+		return err
+	}
+	registry := fetchRegistry(cfg.RegistryUrl, ov.Channel, host, []string{ov.Package})
+	entry, ok := registry[ov.Package]
+	if !ok || entry.StorePath != storePath {
+		return fmt.Errorf("%s is neither the registry's version of %s nor a retained version", storePath, ov.Package)
+	}
+	if err := verifyEntry(cfg, ov.Package, ov.Channel, entry); err != nil {
+		return fmt.Errorf("registry entry rejected: %v", err)
+	}
+	if err := verifyFresh(filepath.Join(cfg.StateDir, name), ov.Package, ov.Channel, entry); err != nil {
+		return fmt.Errorf("registry entry rejected: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCapabilityActions(t *testing.T) {
+	oldSocket := controlSocket
+	controlSocket = filepath.Join(t.TempDir(), "control.sock") // no daemon: direct mode
+	defer func() { controlSocket = oldSocket }()
+
+	var detached [][]string
+	oldDetach := detach
+	detach = func(unit string, args ...string) error {
+		detached = append(detached, append([]string{unit}, args...))
+		return nil
+	}
+	defer func() { detach = oldDetach }()
+
+	cfg := Config{StateDir: t.TempDir(), Overlays: map[string]OverlayConfig{
+		"coffer": {Package: "infra/coffer", Enabled: true},
+	}}
+	stateDir := filepath.Join(cfg.StateDir, "coffer")
+	os.MkdirAll(stateDir, 0755)
+	retained := "/nix/store/" + strings.Repeat("a", 32) + "-coffer"
+	transition(stateDir, "permanent", retained, "")
+	saveCurrentState(stateDir, OverlayState{StorePath: retained})
+
+	call := func(req string) map[string]any {
+		t.Helper()
+		var out bytes.Buffer
+		cmdCapability(cfg, true, strings.NewReader(req), &out)
+		var resp map[string]any
+		if err := json.Unmarshal(out.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v\n%s", req, err, out.String())
+		}
+		return resp
+	}
+
+	if resp := call(`{"overlay": "coffer"}`); resp["name"] != "coffer" || resp["state"] != "permanent" {
+		t.Errorf("status = %v", resp)
+	}
+	if resp := call(`{"action": "status", "overlay": "nope"}`); resp["error"] != "overlay not found" {
+		t.Errorf("unknown overlay = %v", resp)
+	}
+
+	if resp := call(`{"action": "activate", "overlay": "coffer", "storePath": "/nix/store/` + strings.Repeat("b", 32) + `-coffer"}`); resp["error"] == nil {
+		t.Errorf("activated a version neither signed nor retained: %v", resp)
+	}
+	if resp := call(`{"action": "activate", "overlay": "coffer", "storePath": "/tmp/evil"}`); resp["error"] == nil {
+		t.Errorf("activated a path outside the store: %v", resp)
+	}
+	if resp := call(`{"action": "activate", "overlay": "coffer", "storePath": "` + retained + `"}`); resp["status"] != "accepted" {
+		t.Errorf("activate retained = %v", resp)
+	}
+	want := [][]string{{"fort-overlay-activate-coffer", "activate", "coffer", "--store-path", retained}}
+	if !reflect.DeepEqual(detached, want) {
+		t.Errorf("detached %v, want %v", detached, want)
+	}
+
+	if resp := call(`{"action": "rollback", "overlay": "coffer"}`); resp["error"] == nil {
+		t.Errorf("rollback with no previous version = %v", resp)
+	}
+
+	os.Setenv("FORT_ORIGIN", "ci")
+	defer os.Unsetenv("FORT_ORIGIN")
+	if resp := call(`{"action": "pin", "overlay": "coffer"}`); resp["status"] != "pinned" {
+		t.Errorf("pin = %v", resp)
+	}
+	if pin := loadPin(stateDir); pin == nil || pin.By != "ci" || pin.StorePath != retained {
+		t.Errorf("pin = %+v, want the running version pinned by ci", pin)
+	}
+	if resp := call(`{"action": "unpin", "overlay": "coffer"}`); resp["status"] != "unpinned" || loadPin(stateDir) != nil {
+		t.Errorf("unpin = %v", resp)
+	}
+	if resp := call(`{"action": "hold", "overlay": "coffer"}`); resp["status"] != "held" {
+		t.Errorf("hold = %v", resp)
+	}
+	if resp := call(`{"action": "release", "overlay": "coffer"}`); resp["status"] != "released" || loadPin(stateDir) != nil {
+		t.Errorf("release = %v", resp)
+	}
+
+	if resp := call(`{"action": "reboot", "overlay": "coffer"}`); resp["error"] == nil {
+		t.Errorf("unknown action = %v", resp)
+	}
+}
+
+func TestCapabilityWithoutAdminOnlyReportsStatus(t *testing.T) {
+	var detached int
+	oldDetach := detach
+	detach = func(unit string, args ...string) error {
+		detached++
+		return nil
+	}
+	defer func() { detach = oldDetach }()
+
+	cfg := Config{StateDir: t.TempDir(), Overlays: map[string]OverlayConfig{
+		"coffer": {Package: "infra/coffer", Enabled: true},
+	}}
+	stateDir := filepath.Join(cfg.StateDir, "coffer")
+	os.MkdirAll(stateDir, 0755)
+	retained := "/nix/store/" + strings.Repeat("a", 32) + "-coffer"
+	transition(stateDir, "permanent", retained, "")
+
+	if _, err := handleCapability(cfg, CapabilityRequest{Action: "status"}, "ci", false); err != nil {
+		t.Errorf("status refused: %v", err)
+	}
+	for _, action := range []string{"activate", "rollback", "pin", "unpin"} {
+		_, err := handleCapability(cfg, CapabilityRequest{Action: action, Overlay: "coffer", StorePath: retained}, "ci", false)
+		if err == nil || !strings.Contains(err.Error(), "overlay-admin") {
+			t.Errorf("%s without admin: err = %v", action, err)
+		}
+	}
+	if detached != 0 || loadPin(stateDir) != nil {
+		t.Error("a write action ran without admin")
+	}
+}
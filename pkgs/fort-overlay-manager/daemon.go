@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Daemon mode. `fort-overlay-manager daemon` is the long-running manager:
+// it watches the registry (watch.go) and serves a control API on a unix
+// socket, and it is the only thing that moves overlay state while it runs.
+// check, activate, rollback, boot, watchdog, secrets, pin, unpin, hold and
+// release (pin.go) become thin clients of the socket that print the daemon's
+// log of the operation as it happens; status asks the daemon too.
+// Operations run one at a time, in the order they reach the daemon.
+//
+// Without a daemon the subcommands run in-process as before. Either way the
+// process moving state holds an flock on <stateDir>/manager.lock — the
+// daemon for its whole life — so two managers never race on an overlay.
+//
+//	GET  /status[?json=1]
+//	GET  /logs?name=<overlay>          follow an overlay's log lines
+//	POST /check[?overlay=<name>]
+//	POST /activate?name=&storePath=
+//	POST /rollback?name=[&to=]
+//	POST /pin?name=[&storePath=][&by=]   POST /unpin?name=
+//	POST /hold?name=[&by=]               POST /release?name=
+//	POST /boot  POST /watchdog  POST /secrets
+
+var controlSocket = "/run/fort-overlay-manager.sock"
+
+// stateLock takes the manager lock, or reports that another process holds it
+func stateLock(cfg Config, wait bool) (*os.File, error) {
+	os.MkdirAll(cfg.StateDir, 0755)
+	f, err := os.OpenFile(filepath.Join(cfg.StateDir, "manager.lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// logHub copies log output to stderr and to every follower whose overlay
+// the line is about ("" follows everything)
+type logHub struct {
+	mu        sync.Mutex
+	followers map[chan string]string
+}
+
+func newLogHub() *logHub {
+	return &logHub{followers: map[chan string]string{}}
+}
+
+func (h *logHub) Write(p []byte) (int, error) {
+	os.Stderr.Write(p)
+	line := string(p)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch, name := range h.followers {
+		if name != "" && !strings.Contains(line, "["+name+"]") {
+			continue
+		}
+		select {
+		case ch <- line:
+		default: // a slow follower loses lines rather than stalling the manager
+		}
+	}
+	return len(p), nil
+}
+
+func (h *logHub) follow(name string) chan string {
+	ch := make(chan string, 256)
+	h.mu.Lock()
+	h.followers[ch] = name
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *logHub) unfollow(ch chan string) {
+	h.mu.Lock()
+	delete(h.followers, ch)
+	h.mu.Unlock()
+}
+
+type daemon struct {
+	cfg  Config
+	logs *logHub
+	ops  sync.Mutex // held for every state-moving operation
+}
+
+func cmdDaemon(cfg Config) {
+	lock, err := stateLock(cfg, false)
+	if err != nil {
+		log.Fatalf("state lock: %v (another manager is running)", err)
+	}
+	defer lock.Close()
+
+	d := &daemon{cfg: cfg, logs: newLogHub()}
+	log.SetOutput(d.logs)
+
+	os.Remove(controlSocket)
+	l, err := net.Listen("unix", controlSocket)
+	if err != nil {
+		log.Fatalf("control socket: %v", err)
+	}
+	os.Chmod(controlSocket, 0600)
+	go func() {
+		log.Fatal(http.Serve(l, d.handler()))
+	}()
+	log.Printf("listening on %s", controlSocket)
+
+	// New versions are fetched in the background and checked again once
+	// their closure is present (prefetch.go)
+	backgroundFetch = newPrefetcher(cfg, func(name string) {
+		d.ops.Lock()
+		defer d.ops.Unlock()
+		log.Printf("[%s] closure fetched, checking", name)
+		cmdCheck(cfg, name)
+	})
+
+	cmdWatch(cfg, &d.ops)
+}
+
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		cmdStatus(w, d.cfg, r.URL.Query().Get("json") != "")
+	})
+	mux.HandleFunc("GET /logs", d.serveLogs)
+
+	mux.HandleFunc("POST /check", func(w http.ResponseWriter, r *http.Request) {
+		overlay := r.URL.Query().Get("overlay")
+		d.run(w, overlay, func() error {
+			cmdCheck(d.cfg, overlay)
+			return nil
+		})
+	})
+	mux.HandleFunc("POST /activate", func(w http.ResponseWriter, r *http.Request) {
+		name, storePath := r.URL.Query().Get("name"), r.URL.Query().Get("storePath")
+		if !d.known(w, name) {
+			return
+		}
+		if storePath == "" {
+			http.Error(w, "storePath required", http.StatusBadRequest)
+			return
+		}
+		d.run(w, name, func() error {
+			cmdActivate(d.cfg, name, storePath)
+			reportStatus(d.cfg)
+			return nil
+		})
+	})
+	mux.HandleFunc("POST /rollback", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if !d.known(w, name) {
+			return
+		}
+		d.run(w, name, func() error {
+			if err := cmdRollback(d.cfg, name, r.URL.Query().Get("to")); err != nil {
+				return err
+			}
+			reportStatus(d.cfg)
+			return nil
+		})
+	})
+	mux.HandleFunc("POST /pin", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		name := q.Get("name")
+		if !d.known(w, name) {
+			return
+		}
+		d.run(w, name, func() error {
+			return cmdPin(d.cfg, name, q.Get("storePath"), q.Get("by"))
+		})
+	})
+	mux.HandleFunc("POST /unpin", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if !d.known(w, name) {
+			return
+		}
+		d.run(w, name, func() error {
+			return cmdUnpin(d.cfg, name)
+		})
+	})
+	mux.HandleFunc("POST /hold", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		name := q.Get("name")
+		if !d.known(w, name) {
+			return
+		}
+		d.run(w, name, func() error {
+			return cmdHold(d.cfg, name, q.Get("by"))
+		})
+	})
+	mux.HandleFunc("POST /release", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if !d.known(w, name) {
+			return
+		}
+		d.run(w, name, func() error {
+			return cmdRelease(d.cfg, name)
+		})
+	})
+	mux.HandleFunc("POST /boot", func(w http.ResponseWriter, r *http.Request) {
+		d.run(w, "", func() error {
+			cmdBoot(d.cfg)
+			return nil
+		})
+	})
+	mux.HandleFunc("POST /watchdog", func(w http.ResponseWriter, r *http.Request) {
+		d.run(w, "", func() error {
+			if cmdWatchdog(d.cfg) {
+				reportStatus(d.cfg)
+			}
+			return nil
+		})
+	})
+	mux.HandleFunc("POST /secrets", func(w http.ResponseWriter, r *http.Request) {
+		d.run(w, "", func() error {
+			cmdSecrets(d.cfg)
+			return nil
+		})
+	})
+	return mux
+}
+
+func (d *daemon) known(w http.ResponseWriter, name string) bool {
+	if _, ok := d.cfg.Overlays[name]; !ok {
+		http.Error(w, fmt.Sprintf("[%s] not in config", name), http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// run waits its turn, then runs op while streaming the log lines about name
+// to the client. op keeps running if the client goes away: an activation is
+// never abandoned halfway.
+func (d *daemon) run(w http.ResponseWriter, name string, op func() error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	flusher, _ := w.(http.Flusher)
+	if !d.ops.TryLock() {
+		fmt.Fprintln(w, "waiting for the operation in progress")
+		if flusher != nil {
+			flusher.Flush()
+		}
+		d.ops.Lock()
+	}
+
+	lines := d.logs.follow(name)
+	done := make(chan error, 1)
+	go func() {
+		defer d.ops.Unlock()
+		defer d.logs.unfollow(lines)
+		done <- op()
+	}()
+
+	for {
+		select {
+		case line := <-lines:
+			io.WriteString(w, line)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case err := <-done:
+		drain:
+			for {
+				select {
+				case line := <-lines:
+					io.WriteString(w, line)
+				default:
+					break drain
+				}
+			}
+			if err != nil {
+				fmt.Fprintf(w, "error: %v\n", err)
+			}
+			return
+		}
+	}
+}
+
+// serveLogs follows an overlay's log lines until the client hangs up
+func (d *daemon) serveLogs(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if !d.known(w, name) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	flusher, _ := w.(http.Flusher)
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	lines := d.logs.follow(name)
+	defer d.logs.unfollow(lines)
+	for {
+		select {
+		case line := <-lines:
+			io.WriteString(w, line)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// controlClient talks HTTP over the control socket
+func controlClient() *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", controlSocket)
+		},
+	}}
+}
+
+// errNoDaemon means nothing is listening on the control socket
+var errNoDaemon = errors.New("daemon not running")
+
+// callDaemon sends one request to the daemon and copies its answer to out.
+// An operation's failure is reported on the answer's last line.
+func callDaemon(method, path string, query url.Values, out io.Writer) error {
+	u := "http://fort-overlay-manager" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := controlClient().Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return errNoDaemon
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return errors.New(strings.TrimSpace(string(body)))
+	}
+
+	var failed error
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if msg, ok := strings.CutPrefix(line, "error: "); ok {
+			failed = errors.New(msg)
+			continue
+		}
+		fmt.Fprintln(out, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return failed
+}
+
+// viaDaemon runs a state-moving command through the daemon when one is
+// running, and in-process under the state lock otherwise
+func viaDaemon(cfg Config, path string, query url.Values, direct func() error) error {
+	waiting := false
+	for {
+		err := callDaemon("POST", path, query, os.Stderr)
+		if err != errNoDaemon {
+			return err
+		}
+		lock, lerr := stateLock(cfg, false)
+		if lerr == nil {
+			defer lock.Close()
+			return direct()
+		}
+		// Locked but not listening: a daemon starting up, or another
+		// in-process command
+		if !waiting {
+			log.Printf("state lock held by another manager, waiting")
+			waiting = true
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serveDaemon runs a daemon's control API on a temporary socket
+func serveDaemon(t *testing.T, cfg Config) *daemon {
+	t.Helper()
+	old := controlSocket
+	controlSocket = filepath.Join(t.TempDir(), "control.sock")
+	t.Cleanup(func() { controlSocket = old })
+
+	d := &daemon{cfg: cfg, logs: newLogHub()}
+	oldOut := log.Writer()
+	log.SetOutput(d.logs)
+	t.Cleanup(func() { log.SetOutput(oldOut) })
+
+	l, err := net.Listen("unix", controlSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: d.handler()}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return d
+}
+
+func TestDaemonRunsCommandsAndStreamsTheirLog(t *testing.T) {
+	cfg := Config{StateDir: t.TempDir(), Overlays: map[string]OverlayConfig{
+		"coffer": {Package: "infra/coffer", Enabled: true},
+	}}
+	serveDaemon(t, cfg)
+
+	var out bytes.Buffer
+	if err := callDaemon("POST", "/hold", url.Values{"name": {"coffer"}}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "[coffer] held") {
+		t.Errorf("client saw %q, want the operation's log", out.String())
+	}
+	if loadPin(filepath.Join(cfg.StateDir, "coffer")) == nil {
+		t.Error("hold not applied")
+	}
+
+	out.Reset()
+	if err := callDaemon("GET", "/status", nil, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "held") {
+		t.Errorf("status does not show the hold:\n%s", out.String())
+	}
+
+	if err := callDaemon("POST", "/rollback", url.Values{"name": {"nope"}}, &out); err == nil || !strings.Contains(err.Error(), "not in config") {
+		t.Errorf("unknown overlay: err = %v", err)
+	}
+	err := callDaemon("POST", "/rollback", url.Values{"name": {"coffer"}, "to": {"/nix/store/aaa-coffer"}}, &out)
+	if err == nil || !strings.Contains(err.Error(), "not a retained version") {
+		t.Errorf("rollback to an unretained version: err = %v", err)
+	}
+}
+
+func TestViaDaemonFallsBackToDirectMode(t *testing.T) {
+	old := controlSocket
+	controlSocket = filepath.Join(t.TempDir(), "control.sock")
+	defer func() { controlSocket = old }()
+
+	if err := callDaemon("GET", "/status", nil, &bytes.Buffer{}); err != errNoDaemon {
+		t.Fatalf("err = %v, want errNoDaemon", err)
+	}
+
+	cfg := Config{StateDir: t.TempDir()}
+	ran := false
+	err := viaDaemon(cfg, "/check", nil, func() error {
+		ran = true
+		// The in-process command holds the state lock while it runs
+		if _, err := stateLock(cfg, false); err == nil {
+			t.Error("state lock not held in direct mode")
+		}
+		return nil
+	})
+	if err != nil || !ran {
+		t.Errorf("direct mode: ran=%v err=%v", ran, err)
+	}
+	if lock, err := stateLock(cfg, false); err != nil {
+		t.Errorf("state lock not released: %v", err)
+	} else {
+		lock.Close()
+	}
+}
+
+func TestCheckRecordsWhyAHeldOverlayIsNotUpdated(t *testing.T) {
+	srv := http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"infra/coffer": {"storePath": "/nix/store/bbb-coffer"}}`))
+	})}
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go srv.Serve(l)
+	defer srv.Close()
+
+	// The unsigned entry is let through so the hold is what stops it
+	cfg := Config{StateDir: t.TempDir(), RegistryUrl: "http://" + l.Addr().String(), AllowUnsigned: true, Overlays: map[string]OverlayConfig{
+		"coffer": {Package: "infra/coffer", Enabled: true},
+	}}
+	if err := cmdHold(cfg, "coffer", "ci"); err != nil {
+		t.Fatal(err)
+	}
+	cmdCheck(cfg, "")
+
+	stateDir := filepath.Join(cfg.StateDir, "coffer")
+	pending := loadPending(stateDir)
+	if pending == nil || pending.StorePath != "/nix/store/bbb-coffer" || pending.Reason != "held by ci" {
+		t.Errorf("pending = %+v", pending)
+	}
+	if loadAttempt(cfg.StateDir, "coffer") != nil {
+		t.Error("a held overlay was activated")
+	}
+}
@@ -10,6 +10,6 @@ pkgs.buildGoModule {
 
   postInstall = ''
     wrapProgram $out/bin/fort-overlay-manager \
-      --prefix PATH : ${pkgs.lib.makeBinPath [ pkgs.nix pkgs.systemd ]}
+      --prefix PATH : ${pkgs.lib.makeBinPath [ pkgs.nix pkgs.systemd pkgs.openssh pkgs.grpc-health-probe ]}
   '';
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Dependencies between overlays (dependsOn). Beyond activation order
+// (orderedOverlays) and the After=/Wants= on generated units:
+//
+//   - a check cycle does not update an overlay while one of its dependencies
+//     is failed or rolled back — it would be wired to a version that was
+//     just rejected; status shows it as a pending update held back
+//   - an overlay with restartWithDependencies is restarted whenever the
+//     version a dependency runs changes (activated or rolled back), and so
+//     are its own dependents that ask for it
+//   - a dependency cycle is a config error: status reports it on every
+//     overlay in the cycle and check cycles leave them alone
+
+// dependencyCycles maps each overlay on a dependsOn cycle to the cycle,
+// e.g. "a -> b -> a"
+func dependencyCycles(overlays map[string]OverlayConfig) map[string]string {
+	cycles := map[string]string{}
+	state := map[string]int{} // 0 = unvisited, 1 = on the path, 2 = done
+	var path []string
+	var visit func(string)
+	visit = func(name string) {
+		switch state[name] {
+		case 1:
+			start := 0
+			for i, n := range path {
+				if n == name {
+					start = i
+				}
+			}
+			cycle := strings.Join(append(append([]string(nil), path[start:]...), name), " -> ")
+			for _, n := range path[start:] {
+				if _, seen := cycles[n]; !seen {
+					cycles[n] = cycle
+				}
+			}
+			return
+		case 2:
+			return
+		}
+		state[name] = 1
+		path = append(path, name)
+		deps := append([]string(nil), overlays[name].DependsOn...)
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if _, ok := overlays[dep]; ok {
+				visit(dep)
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = 2
+	}
+	for _, name := range sortedKeys(overlays) {
+		visit(name)
+	}
+	return cycles
+}
+
+// dependencyError is what is wrong with an overlay's declared dependencies,
+// or ""
+func dependencyError(cfg Config, name string) string {
+	if cycle, ok := dependencyCycles(cfg.Overlays)[name]; ok {
+		return "dependency cycle: " + cycle
+	}
+	for _, dep := range cfg.Overlays[name].DependsOn {
+		if _, ok := cfg.Overlays[dep]; !ok {
+			return fmt.Sprintf("depends on %s, which is not configured", dep)
+		}
+	}
+	return ""
+}
+
+// dependencyBlocked returns why name may not be updated because of its
+// dependencies, or ""
+func dependencyBlocked(cfg Config, name string) string {
+	if err := dependencyError(cfg, name); err != "" {
+		return err
+	}
+	for _, dep := range cfg.Overlays[name].DependsOn {
+		switch state := readState(filepath.Join(cfg.StateDir, dep)); state {
+		case "failed", "rolled-back":
+			return fmt.Sprintf("dependency %s is %s", dep, state)
+		}
+	}
+	return ""
+}
+
+// restartDependents restarts the running overlays that asked to follow
+// name's changes, dependents before their own dependents
+func restartDependents(cfg Config, name string) {
+	changed := map[string]bool{name: true}
+	for _, dep := range orderedOverlays(cfg.Overlays) {
+		ov := cfg.Overlays[dep]
+		if !ov.Enabled || !ov.RestartWithDependencies || changed[dep] {
+			continue
+		}
+		trigger := ""
+		for _, d := range ov.DependsOn {
+			if changed[d] {
+				trigger = d
+				break
+			}
+		}
+		if trigger == "" {
+			continue
+		}
+		switch readState(filepath.Join(cfg.StateDir, dep)) {
+		case "permanent", "rolled-back":
+		default:
+			continue // not running, or mid-transition
+		}
+		changed[dep] = true
+		log.Printf("[%s] restarting: dependency %s changed", dep, trigger)
+		if err := exec.Command("systemctl", "try-restart", fmt.Sprintf("overlay-%s.target", dep)).Run(); err != nil {
+			log.Printf("[%s] restart: %v", dep, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDependencyCycles(t *testing.T) {
+	overlays := map[string]OverlayConfig{
+		"attic":    {},
+		"coffer":   {DependsOn: []string{"attic"}},
+		"knockout": {DependsOn: []string{"grotto"}},
+		"grotto":   {DependsOn: []string{"joker"}},
+		"joker":    {DependsOn: []string{"knockout", "coffer"}},
+		"loop":     {DependsOn: []string{"loop"}},
+	}
+	want := map[string]string{
+		"grotto":   "grotto -> joker -> knockout -> grotto",
+		"joker":    "grotto -> joker -> knockout -> grotto",
+		"knockout": "grotto -> joker -> knockout -> grotto",
+		"loop":     "loop -> loop",
+	}
+	if got := dependencyCycles(overlays); !reflect.DeepEqual(got, want) {
+		t.Errorf("cycles = %v, want %v", got, want)
+	}
+
+	// Still a total order, for boot
+	if got := orderedOverlays(overlays); len(got) != len(overlays) {
+		t.Errorf("order = %v", got)
+	}
+}
+
+func TestDependencyBlocksUpdates(t *testing.T) {
+	cfg := Config{StateDir: t.TempDir(), Overlays: map[string]OverlayConfig{
+		"coffer": {},
+		"joker":  {DependsOn: []string{"coffer"}},
+		"a":      {DependsOn: []string{"b"}},
+		"b":      {DependsOn: []string{"a"}},
+		"orphan": {DependsOn: []string{"gone"}},
+	}}
+	coffer := filepath.Join(cfg.StateDir, "coffer")
+
+	if reason := dependencyBlocked(cfg, "joker"); reason != "" {
+		t.Errorf("dependency idle: blocked by %q", reason)
+	}
+	for state, want := range map[string]string{
+		"permanent":   "",
+		"failed":      "dependency coffer is failed",
+		"rolled-back": "dependency coffer is rolled-back",
+	} {
+		writeState(coffer, state)
+		if got := dependencyBlocked(cfg, "joker"); got != want {
+			t.Errorf("dependency %s: blocked by %q, want %q", state, got, want)
+		}
+	}
+
+	if got := dependencyBlocked(cfg, "a"); got != "dependency cycle: a -> b -> a" {
+		t.Errorf("cycle: %q", got)
+	}
+	if got := dependencyError(cfg, "orphan"); got != "depends on gone, which is not configured" {
+		t.Errorf("unknown dependency: %q", got)
+	}
+
+	entries := statusEntries(cfg)
+	for _, e := range entries {
+		if (e.DependencyError != "") != (e.Name == "a" || e.Name == "b" || e.Name == "orphan") {
+			t.Errorf("%s: dependencyError = %q", e.Name, e.DependencyError)
+		}
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Runtime exposure. A manifest's expose entries publish overlay services the
+// way fort.cluster.services publishes NixOS-declared ones, without a deploy:
+//
+//	expose = [{
+//	  name = "coffer";          # default: the overlay name
+//	  subdomain = "vault";      # default: name
+//	  port = 19876;             # or socket = "/run/coffer/http.sock"
+//	  visibility = "public";    # vpn (default), local or public
+//	  sso = { mode = "identity"; groups = [ "admins" ]; };
+//	  maxBodySize = "100m";
+//	}];
+//
+// The manager keeps one nginx include per overlay in expose.nginxDir (the
+// http block includes the directory, see common/fort/overlays.nix) and
+// reloads nginx whenever the exposures of the running versions change: on
+// activation, rollback, boot and every check cycle. The discovery needs the
+// NixOS side would declare — proxy and headscale DNS from the beacon,
+// CoreDNS from the forge for non-vpn services — go to expose.needsFile,
+// which the fort consumer fulfills alongside /etc/fort/needs.json. The
+// wildcard certificate the vhosts use is already a need of every nginx host.
+//
+// SSO modes backed by a per-service oauth2-proxy (oidc, headers, basicauth,
+// gatekeeper) need a NixOS deploy. token and identity work when the host
+// already runs their backends, which the config lists in expose.ssoModes.
+//
+// A blue/green overlay with ports may leave port and socket unset: its vhost
+// then proxies through the upstream the manager switches between slots.
+
+// ExposeConfig is the host side of runtime exposure; an empty domain turns
+// it off
+type ExposeConfig struct {
+	Domain             string   `json:"domain"`
+	NginxDir           string   `json:"nginxDir"`
+	NeedsFile          string   `json:"needsFile"`
+	SSLDir             string   `json:"sslDir"`
+	SSOModes           []string `json:"ssoModes"`           // modes this host has backends for
+	ReservedSubdomains []string `json:"reservedSubdomains"` // served by the host's NixOS config
+	ProxyFrom          string   `json:"proxyFrom"`          // public proxy provider; empty on the beacon itself
+	DNSFrom            string   `json:"dnsFrom"`            // headscale DNS provider
+	LANDNSFrom         string   `json:"lanDnsFrom"`         // CoreDNS provider
+}
+
+type ExposeDef struct {
+	Name        string    `json:"name"`
+	Subdomain   string    `json:"subdomain"`
+	Port        int       `json:"port,omitempty"`
+	Socket      string    `json:"socket,omitempty"`
+	Visibility  string    `json:"visibility"`
+	SSO         ExposeSSO `json:"sso"`
+	MaxBodySize string    `json:"maxBodySize,omitempty"`
+}
+
+type ExposeSSO struct {
+	Mode        string   `json:"mode"`
+	Groups      []string `json:"groups,omitempty"`
+	VPNBypass   bool     `json:"vpnBypass,omitempty"`
+	LocalBypass bool     `json:"localBypass,omitempty"`
+}
+
+var (
+	exposeNameRe    = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+	subdomainRe     = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]*[a-z0-9])?$`)
+	maxBodySizeRe   = regexp.MustCompile(`^[0-9]+[kKmMgG]?$`)
+	validVisibility = map[string]bool{"vpn": true, "local": true, "public": true}
+	validSSOModes   = map[string]bool{
+		"none": true, "oidc": true, "headers": true, "basicauth": true,
+		"gatekeeper": true, "token": true, "identity": true,
+	}
+)
+
+// reloadNginx applies a changed include; overridden in tests. try-: before
+// nginx is up (boot) the includes are simply read on start
+var reloadNginx = func() error {
+	out, err := exec.Command("systemctl", "try-reload-or-restart", "nginx.service").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// fulfillNeeds asks the fort consumer to act on changed needs now rather
+// than on its next retry; overridden in tests
+var fulfillNeeds = func() {
+	exec.Command("systemctl", "start", "--no-block", "fort-consumer-retry.service").Run()
+}
+
+// exposures returns the manifest's expose entries with defaults filled in
+func (m *OverlayManifest) exposures(overlay string) []ExposeDef {
+	out := make([]ExposeDef, len(m.Expose))
+	for i, e := range m.Expose {
+		if e.Name == "" {
+			e.Name = overlay
+		}
+		if e.Subdomain == "" {
+			e.Subdomain = e.Name
+		}
+		if e.Visibility == "" {
+			e.Visibility = "vpn"
+		}
+		if e.SSO.Mode == "" {
+			e.SSO.Mode = "none"
+		}
+		out[i] = e
+	}
+	return out
+}
+
+// validateExpose checks a manifest's expose entries on their own
+func validateExpose(overlay string, m *OverlayManifest) error {
+	names, subdomains := map[string]bool{}, map[string]bool{}
+	for _, e := range m.exposures(overlay) {
+		if !exposeNameRe.MatchString(e.Name) {
+			return fmt.Errorf("invalid name %q", e.Name)
+		}
+		if !subdomainRe.MatchString(e.Subdomain) {
+			return fmt.Errorf("%s: invalid subdomain %q", e.Name, e.Subdomain)
+		}
+		if names[e.Name] {
+			return fmt.Errorf("%s: name used twice", e.Name)
+		}
+		if subdomains[e.Subdomain] {
+			return fmt.Errorf("%s: subdomain %s used twice", e.Name, e.Subdomain)
+		}
+		names[e.Name], subdomains[e.Subdomain] = true, true
+
+		switch {
+		case e.Port != 0 && e.Socket != "":
+			return fmt.Errorf("%s: set port or socket, not both", e.Name)
+		case e.Port == 0 && e.Socket == "":
+			if !m.blueGreen() || len(m.Activation.Ports) == 0 {
+				return fmt.Errorf("%s: port or socket required", e.Name)
+			}
+		case e.Port < 0 || e.Port > 65535:
+			return fmt.Errorf("%s: invalid port %d", e.Name, e.Port)
+		case e.Socket != "" && (!filepath.IsAbs(e.Socket) || strings.ContainsAny(e.Socket, " ;{}\n\r")):
+			return fmt.Errorf("%s: invalid socket %q", e.Name, e.Socket)
+		}
+		if !validVisibility[e.Visibility] {
+			return fmt.Errorf("%s: invalid visibility %q", e.Name, e.Visibility)
+		}
+		if !validSSOModes[e.SSO.Mode] {
+			return fmt.Errorf("%s: invalid sso mode %q", e.Name, e.SSO.Mode)
+		}
+		for _, g := range e.SSO.Groups {
+			if g == "" || strings.ContainsAny(g, ",\"\n\r") {
+				return fmt.Errorf("%s: invalid sso group %q", e.Name, g)
+			}
+		}
+		if e.MaxBodySize != "" && !maxBodySizeRe.MatchString(e.MaxBodySize) {
+			return fmt.Errorf("%s: invalid maxBodySize %q", e.Name, e.MaxBodySize)
+		}
+	}
+	return nil
+}
+
+// exposureProblems checks a manifest's expose entries against this host: the
+// SSO backends it runs and the names already taken
+func exposureProblems(cfg Config, name string, m *OverlayManifest) []string {
+	exposes := m.exposures(name)
+	if len(exposes) == 0 {
+		return nil
+	}
+	x := cfg.Expose
+	if x.Domain == "" {
+		return []string{"expose: runtime exposure is not configured on this host (overlayRuntimeExpose)"}
+	}
+
+	takenName, takenSubdomain := map[string]string{}, map[string]string{}
+	for _, sub := range x.ReservedSubdomains {
+		takenSubdomain[sub] = "this host's NixOS config"
+	}
+	for _, other := range sortedKeys(cfg.Overlays) {
+		if other == name || !cfg.Overlays[other].Enabled {
+			continue
+		}
+		if current := loadCurrentState(cfg.StateDir, other); current != nil {
+			for _, e := range current.Expose {
+				takenName[e.Name] = "overlay " + other
+				takenSubdomain[e.Subdomain] = "overlay " + other
+			}
+		}
+	}
+
+	var problems []string
+	for _, e := range exposes {
+		if e.SSO.Mode != "none" && !contains(x.SSOModes, e.SSO.Mode) {
+			problems = append(problems, fmt.Sprintf("expose %s: sso mode %s is not available on this host without a deploy", e.Name, e.SSO.Mode))
+		}
+		if by, ok := takenName[e.Name]; ok {
+			problems = append(problems, fmt.Sprintf("expose %s: name is already used by %s", e.Name, by))
+		}
+		if by, ok := takenSubdomain[e.Subdomain]; ok {
+			problems = append(problems, fmt.Sprintf("expose %s: %s.%s is already served by %s", e.Name, e.Subdomain, x.Domain, by))
+		}
+	}
+	return problems
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// syncExposure brings the nginx includes and the runtime needs in line with
+// the exposures of the enabled overlays' running versions
+func syncExposure(cfg Config) error {
+	x := cfg.Expose
+	if x.Domain == "" {
+		return nil
+	}
+	includes := map[string]string{}
+	var needs []runtimeNeed
+	for _, name := range sortedKeys(cfg.Overlays) {
+		if !cfg.Overlays[name].Enabled {
+			continue
+		}
+		current := loadCurrentState(cfg.StateDir, name)
+		if current == nil || len(current.Expose) == 0 {
+			continue
+		}
+		includes[name+".conf"] = nginxInclude(x, name, current.Expose)
+		needs = append(needs, exposureNeeds(x, current.Expose)...)
+	}
+
+	// Needs go out even if nginx refuses the vhosts: the names should
+	// resolve once whatever is wrong is fixed
+	nginxErr := writeNginxIncludes(x.NginxDir, includes)
+	if err := writeNeeds(x.NeedsFile, needs); err != nil {
+		return errors.Join(nginxErr, err)
+	}
+	return nginxErr
+}
+
+// writeNginxIncludes replaces the include directory's contents and reloads
+// nginx if anything changed. Should nginx reject the result, the previous
+// includes are put back so a later restart does not fail on them.
+func writeNginxIncludes(dir string, want map[string]string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	have := map[string]string{}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.conf"))
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		have[filepath.Base(path)] = string(data)
+	}
+	if mapsEqual(have, want) {
+		return nil
+	}
+
+	if err := replaceIncludes(dir, have, want); err != nil {
+		return err
+	}
+	if err := reloadNginx(); err != nil {
+		if rerr := replaceIncludes(dir, want, have); rerr != nil {
+			return fmt.Errorf("nginx reload: %v; restoring previous vhosts: %v", err, rerr)
+		}
+		reloadNginx()
+		return fmt.Errorf("nginx rejected the overlay vhosts, kept the previous ones: %v", err)
+	}
+	return nil
+}
+
+func replaceIncludes(dir string, have, want map[string]string) error {
+	for file, content := range want {
+		if have[file] == content {
+			continue
+		}
+		tmp := filepath.Join(dir, "."+file+".tmp")
+		if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, file)); err != nil {
+			return err
+		}
+	}
+	for file := range have {
+		if _, ok := want[file]; !ok {
+			if err := os.Remove(filepath.Join(dir, file)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func mapsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// nginxInclude renders an overlay's vhosts the way common/fort/nginx.nix
+// renders fort.cluster.services
+func nginxInclude(x ExposeConfig, overlay string, exposes []ExposeDef) string {
+	sslDir := x.SSLDir
+	if sslDir == "" {
+		sslDir = filepath.Join("/var/lib/fort/ssl", x.Domain)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "# overlay %s; generated by fort-overlay-manager\n", overlay)
+	upstream := ""
+	for _, e := range exposes {
+		fqdn := e.Subdomain + "." + x.Domain
+		backend := "http://127.0.0.1:" + fmt.Sprint(e.Port)
+		switch {
+		case e.Socket != "":
+			backend = "http://unix:" + e.Socket + ":"
+		case e.Port == 0:
+			if upstream == "" {
+				upstream = "overlay-runtime-" + overlay
+				fmt.Fprintf(&b, "\nupstream %s {\n  include %s;\n}\n", upstream, filepath.Join(upstreamDir, overlay+".conf"))
+			}
+			backend = "http://" + upstream
+		}
+
+		fmt.Fprintf(&b, `
+server {
+  listen 0.0.0.0:80;
+  listen [::]:80;
+  server_name %[1]s;
+  location / {
+    return 301 https://$host$request_uri;
+  }
+}
+
+server {
+  listen 0.0.0.0:443 ssl;
+  listen [::]:443 ssl;
+  server_name %[1]s;
+  ssl_certificate %[2]s/fullchain.pem;
+  ssl_certificate_key %[2]s/key.pem;
+  add_header Content-Security-Policy "frame-ancestors 'self' https://*.%[3]s" always;
+
+  location / {
+    proxy_set_header Cookie $http_cookie;
+`, fqdn, sslDir, x.Domain)
+		if e.Visibility == "vpn" {
+			b.WriteString("    if ($is_vpn = 0) {\n      return 444;\n    }\n")
+		}
+		if e.MaxBodySize != "" {
+			fmt.Fprintf(&b, "    client_max_body_size %s;\n", e.MaxBodySize)
+		}
+		switch e.SSO.Mode {
+		case "token":
+			b.WriteString("    auth_request /_fort_validate_token;\n")
+		case "identity":
+			b.WriteString(`    auth_request /_identity/validate;
+    auth_request_set $identity_user $upstream_http_x_identity_user;
+    auth_request_set $identity_email $upstream_http_x_identity_email;
+    auth_request_set $identity_groups $upstream_http_x_identity_groups;
+    proxy_set_header X-Forwarded-User $identity_user;
+    proxy_set_header X-Forwarded-Email $identity_email;
+    proxy_set_header X-Forwarded-Groups $identity_groups;
+    error_page 401 = @identity_login;
+`)
+		}
+		fmt.Fprintf(&b, `    proxy_pass %s;
+    proxy_http_version 1.1;
+    proxy_set_header Upgrade $http_upgrade;
+    proxy_set_header Connection $connection_upgrade;
+    proxy_set_header Host $host;
+    proxy_set_header X-Real-IP $remote_addr;
+    proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+    proxy_set_header X-Forwarded-Proto $scheme;
+    proxy_set_header X-Forwarded-Host $host;
+    proxy_set_header X-Forwarded-Server $host;
+  }
+`, backend)
+
+		switch e.SSO.Mode {
+		case "token":
+			fmt.Fprintf(&b, `
+  location /_fort_validate_token {
+    internal;
+    set $token_vpn_bypass %d;
+    set $token_local_bypass %d;
+    js_content token_validator.validate;
+  }
+`, boolInt(e.SSO.VPNBypass), boolInt(e.SSO.LocalBypass))
+		case "identity":
+			fmt.Fprintf(&b, `
+  location = /_identity/validate {
+    internal;
+    client_max_body_size 0;
+    proxy_pass http://unix:/run/identity-proxy/identity-proxy.sock;
+    proxy_pass_request_body off;
+    proxy_set_header Content-Length "";
+    proxy_set_header X-Original-URI $request_uri;
+    proxy_set_header X-Original-Host $host;
+    proxy_set_header X-Real-IP $remote_addr;
+    proxy_set_header X-Identity-Required-Groups "%s";
+  }
+
+  location @identity_login {
+    return 302 https://$host/_identity/login?rd=$scheme://$host$request_uri;
+  }
+
+  location /_identity/ {
+    proxy_pass http://unix:/run/identity-proxy/identity-proxy.sock;
+    proxy_set_header Host $host;
+    proxy_set_header X-Original-Host $host;
+    proxy_set_header X-Real-IP $remote_addr;
+  }
+`, strings.Join(e.SSO.Groups, ","))
+		}
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// runtimeNeed is a needs.json entry; name is the id's part after the
+// capability, as the provider's GC enumerates needs by capability/name
+type runtimeNeed struct {
+	ID         string            `json:"id"`
+	Capability string            `json:"capability"`
+	Name       string            `json:"name"`
+	From       string            `json:"from"`
+	Request    map[string]string `json:"request"`
+	Handler    string            `json:"handler"` // empty: side-effect-only
+	NagSeconds int               `json:"nag_seconds"`
+}
+
+// exposureNeeds mirrors the discovery needs common/fort/services.nix
+// declares for a fort.cluster.services entry
+func exposureNeeds(x ExposeConfig, exposes []ExposeDef) []runtimeNeed {
+	var needs []runtimeNeed
+	add := func(capability, from string, e ExposeDef) {
+		name := "overlay-" + e.Name
+		needs = append(needs, runtimeNeed{
+			ID:         capability + "-" + name,
+			Capability: capability,
+			Name:       name,
+			From:       from,
+			Request:    map[string]string{"fqdn": e.Subdomain + "." + x.Domain},
+			NagSeconds: 3600,
+		})
+	}
+	for _, e := range exposes {
+		if e.Visibility == "public" && x.ProxyFrom != "" {
+			add("proxy", x.ProxyFrom, e)
+		}
+		if x.DNSFrom != "" {
+			add("dns-headscale", x.DNSFrom, e)
+		}
+		if e.Visibility != "vpn" && x.LANDNSFrom != "" {
+			add("dns-coredns", x.LANDNSFrom, e)
+		}
+	}
+	sort.Slice(needs, func(i, j int) bool { return needs[i].ID < needs[j].ID })
+	return needs
+}
+
+// writeNeeds replaces the runtime needs file and has the consumer fulfill a
+// change right away. Needs that disappear are left to the providers' GC.
+func writeNeeds(path string, needs []runtimeNeed) error {
+	if path == "" {
+		return nil
+	}
+	old, _ := os.ReadFile(path)
+	if len(needs) == 0 {
+		if len(old) > 0 {
+			return os.Remove(path)
+		}
+		return nil
+	}
+	data, _ := json.MarshalIndent(needs, "", "  ")
+	if bytes.Equal(old, data) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	fulfillNeeds()
+	return nil
+}
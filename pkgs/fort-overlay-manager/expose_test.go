@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func exposedManifest() *OverlayManifest {
+	return &OverlayManifest{
+		Services: map[string]ServiceDef{"coffer": {Exec: "/nix/store/aaa-coffer/bin/cofferd"}},
+		Expose: []ExposeDef{
+			{Port: 19876, Visibility: "public"},
+			{Name: "coffer-admin", Socket: "/run/coffer/admin.sock", SSO: ExposeSSO{Mode: "identity", Groups: []string{"admins"}}},
+		},
+	}
+}
+
+func TestValidateExpose(t *testing.T) {
+	if err := validateExpose("coffer", exposedManifest()); err != nil {
+		t.Fatalf("valid manifest rejected: %v", err)
+	}
+	got := exposedManifest().exposures("coffer")
+	if got[0].Name != "coffer" || got[0].Subdomain != "coffer" || got[1].Visibility != "vpn" || got[0].SSO.Mode != "none" {
+		t.Errorf("defaults not filled in: %+v", got)
+	}
+
+	cases := map[string]func(m *OverlayManifest){
+		"port and socket":   func(m *OverlayManifest) { m.Expose[0].Socket = "/run/coffer.sock" },
+		"neither":           func(m *OverlayManifest) { m.Expose[0].Port = 0 },
+		"relative socket":   func(m *OverlayManifest) { m.Expose[1].Socket = "admin.sock" },
+		"bad visibility":    func(m *OverlayManifest) { m.Expose[0].Visibility = "internet" },
+		"bad sso mode":      func(m *OverlayManifest) { m.Expose[0].SSO.Mode = "magic" },
+		"duplicate name":    func(m *OverlayManifest) { m.Expose[1].Name = "coffer" },
+		"duplicate domain":  func(m *OverlayManifest) { m.Expose[1].Subdomain = "coffer" },
+		"bad subdomain":     func(m *OverlayManifest) { m.Expose[0].Subdomain = "coffer;" },
+		"bad maxBodySize":   func(m *OverlayManifest) { m.Expose[0].MaxBodySize = "1 GB" },
+		"group with quotes": func(m *OverlayManifest) { m.Expose[1].SSO.Groups = []string{`a"b`} },
+	}
+	for name, mutate := range cases {
+		m := exposedManifest()
+		mutate(m)
+		if err := validateExpose("coffer", m); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	// A blue/green overlay with ports can proxy through its upstream
+	m := exposedManifest()
+	m.Expose[0].Port = 0
+	m.Activation = &ActivationConfig{Strategy: strategyBlueGreen, Ports: map[string]int{"blue": 1, "green": 2}}
+	if err := validateExpose("coffer", m); err != nil {
+		t.Errorf("blue/green upstream rejected: %v", err)
+	}
+}
+
+func TestExposureProblems(t *testing.T) {
+	cfg := Config{StateDir: t.TempDir(), Overlays: map[string]OverlayConfig{
+		"coffer": {Enabled: true},
+		"joker":  {Enabled: true},
+	}}
+	if got := exposureProblems(cfg, "coffer", exposedManifest()); len(got) != 1 || !strings.Contains(got[0], "not configured") {
+		t.Errorf("without a domain: %q", got)
+	}
+
+	cfg.Expose = ExposeConfig{Domain: "fort.example", SSOModes: []string{"none"}, ReservedSubdomains: []string{"coffer"}}
+	stateDir := filepath.Join(cfg.StateDir, "joker")
+	os.MkdirAll(stateDir, 0755)
+	saveCurrentState(stateDir, OverlayState{StorePath: "/nix/store/aaa-joker", Expose: []ExposeDef{{Name: "coffer-admin", Subdomain: "joker"}}})
+
+	got := exposureProblems(cfg, "coffer", exposedManifest())
+	want := []string{
+		"expose coffer: coffer.fort.example is already served by this host's NixOS config",
+		"expose coffer-admin: sso mode identity is not available on this host without a deploy",
+		"expose coffer-admin: name is already used by overlay joker",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("problems = %q, want %q", got, want)
+	}
+}
+
+func TestNginxInclude(t *testing.T) {
+	x := ExposeConfig{Domain: "fort.example"}
+	m := exposedManifest()
+	m.Expose = append(m.Expose, ExposeDef{Name: "coffer-bg", MaxBodySize: "100m", SSO: ExposeSSO{Mode: "token", VPNBypass: true}})
+	conf := nginxInclude(x, "coffer", m.exposures("coffer"))
+
+	for _, want := range []string{
+		"server_name coffer.fort.example;",
+		"proxy_pass http://127.0.0.1:19876;",
+		"ssl_certificate /var/lib/fort/ssl/fort.example/fullchain.pem;",
+		"server_name coffer-admin.fort.example;",
+		"proxy_pass http://unix:/run/coffer/admin.sock:;",
+		`proxy_set_header X-Identity-Required-Groups "admins";`,
+		"upstream overlay-runtime-coffer {\n  include /run/overlays/upstreams/coffer.conf;\n}",
+		"proxy_pass http://overlay-runtime-coffer;",
+		"client_max_body_size 100m;",
+		"set $token_vpn_bypass 1;",
+	} {
+		if !strings.Contains(conf, want) {
+			t.Errorf("include lacks %q:\n%s", want, conf)
+		}
+	}
+	// Only vpn-visible vhosts turn away other clients
+	if n := strings.Count(conf, "if ($is_vpn = 0)"); n != 2 {
+		t.Errorf("%d vpn gates, want 2", n)
+	}
+}
+
+func TestExposureNeeds(t *testing.T) {
+	x := ExposeConfig{Domain: "fort.example", ProxyFrom: "beacon", DNSFrom: "beacon", LANDNSFrom: "forge"}
+	m := exposedManifest()
+	m.Expose[1].Visibility = "local"
+	var ids []string
+	for _, need := range exposureNeeds(x, m.exposures("coffer")) {
+		ids = append(ids, need.ID+"@"+need.From+":"+need.Request["fqdn"])
+	}
+	want := []string{
+		"dns-coredns-overlay-coffer@forge:coffer.fort.example",
+		"dns-coredns-overlay-coffer-admin@forge:coffer-admin.fort.example",
+		"dns-headscale-overlay-coffer@beacon:coffer.fort.example",
+		"dns-headscale-overlay-coffer-admin@beacon:coffer-admin.fort.example",
+		"proxy-overlay-coffer@beacon:coffer.fort.example",
+	}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("needs = %q, want %q", ids, want)
+	}
+}
+
+func TestSyncExposure(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{StateDir: filepath.Join(dir, "state"), Overlays: map[string]OverlayConfig{
+		"coffer":   {Enabled: true},
+		"disabled": {},
+	}}
+	cfg.Expose = ExposeConfig{Domain: "fort.example", NginxDir: filepath.Join(dir, "nginx"), NeedsFile: filepath.Join(dir, "needs.d", "overlays.json"), DNSFrom: "beacon"}
+	for name := range cfg.Overlays {
+		stateDir := filepath.Join(cfg.StateDir, name)
+		os.MkdirAll(stateDir, 0755)
+		saveCurrentState(stateDir, OverlayState{StorePath: "/nix/store/aaa-" + name, Expose: exposedManifest().exposures(name)[:1]})
+	}
+	os.MkdirAll(cfg.Expose.NginxDir, 0755)
+	os.WriteFile(filepath.Join(cfg.Expose.NginxDir, "gone.conf"), []byte("# removed overlay\n"), 0644)
+
+	savedReload, savedFulfill := reloadNginx, fulfillNeeds
+	defer func() { reloadNginx, fulfillNeeds = savedReload, savedFulfill }()
+	reloads, fulfills := 0, 0
+	reloadNginx = func() error { reloads++; return nil }
+	fulfillNeeds = func() { fulfills++ }
+
+	if err := syncExposure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(cfg.Expose.NginxDir, "*.conf"))
+	if len(files) != 1 || filepath.Base(files[0]) != "coffer.conf" {
+		t.Errorf("includes = %v", files)
+	}
+	var needs []runtimeNeed
+	data, _ := os.ReadFile(cfg.Expose.NeedsFile)
+	json.Unmarshal(data, &needs)
+	if len(needs) != 1 || needs[0].Capability != "dns-headscale" || needs[0].Name != "overlay-coffer" {
+		t.Errorf("needs = %+v", needs)
+	}
+	if reloads != 1 || fulfills != 1 {
+		t.Errorf("%d reloads, %d fulfills after a change", reloads, fulfills)
+	}
+
+	// Nothing changed: nothing to reload
+	if err := syncExposure(cfg); err != nil || reloads != 1 || fulfills != 1 {
+		t.Errorf("unchanged sync: err %v, %d reloads, %d fulfills", err, reloads, fulfills)
+	}
+
+	// nginx refuses a change: the previous includes come back
+	before, _ := os.ReadFile(files[0])
+	saveCurrentState(filepath.Join(cfg.StateDir, "coffer"), OverlayState{StorePath: "/nix/store/bbb-coffer", Expose: []ExposeDef{{Name: "coffer", Subdomain: "vault", Port: 1}}})
+	reloadNginx = func() error { reloads++; return errors.New("emerg") }
+	if err := syncExposure(cfg); err == nil || !strings.Contains(err.Error(), "kept the previous ones") {
+		t.Errorf("err = %v", err)
+	}
+	if after, _ := os.ReadFile(files[0]); string(after) != string(before) {
+		t.Errorf("include not restored:\n%s", after)
+	}
+
+	// Unexposed: include and needs file go away
+	saveCurrentState(filepath.Join(cfg.StateDir, "coffer"), OverlayState{StorePath: "/nix/store/ccc-coffer"})
+	reloadNginx = func() error { return nil }
+	if err := syncExposure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(cfg.Expose.NginxDir, "*.conf")); len(files) != 0 {
+		t.Errorf("includes left: %v", files)
+	}
+	if _, err := os.Stat(cfg.Expose.NeedsFile); !os.IsNotExist(err) {
+		t.Errorf("needs file left: %v", err)
+	}
+}
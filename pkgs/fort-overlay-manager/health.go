@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Health checks. A manifest's health either names one check inline (type +
+// endpoint, the original form) or lists several under checks, combined with
+// mode = "all" (the default: every check must pass) or "any". Check types:
+//
+//	http   GET endpoint; status (default any 2xx), body regex, json
+//	       assertions (dotted path -> expected value) and request headers.
+//	       With socket, the request goes over that unix socket.
+//	tcp    connect to endpoint (host:port)
+//	exec   sh -c endpoint exits 0
+//	grpc   grpc.health.v1 Check against endpoint (host:port), optionally
+//	       for grpcService, via grpc-health-probe
+//	notify the manifest service named by service has signalled readiness
+//	       (sd_notify READY=1); the service must be type = "notify"
+//
+// Every check has its own timeout (seconds, default 5).
+
+const defaultCheckTimeout = 5 * time.Second
+
+// grpcHealthProbe is the grpc-health-probe binary; overridden in tests
+var grpcHealthProbe = "grpc-health-probe"
+
+var validCheckTypes = map[string]bool{"http": true, "tcp": true, "exec": true, "grpc": true, "notify": true}
+
+type HealthCheck struct {
+	Type        string            `json:"type"`
+	Endpoint    string            `json:"endpoint"`
+	Timeout     int               `json:"timeout"`        // seconds; 0 for the default
+	Socket      string            `json:"socket"`         // http: unix socket to send the request over
+	Status      []int             `json:"status"`         // http: accepted status codes; empty accepts any 2xx
+	Headers     map[string]string `json:"headers"`        // http: request headers
+	Body        string            `json:"body"`           // http: regex the body must match
+	JSON        map[string]string `json:"json"`           // http: dotted path -> expected value
+	GRPCService string            `json:"grpcService"`    // grpc: service to ask about; empty for the server
+	Service     string            `json:"service"`        // notify: manifest service
+	Unit        string            `json:"unit,omitempty"` // notify: resolved by the manager
+}
+
+// checks returns the configured checks, the inline form as a one-check list
+func (h *HealthConfig) checks() []HealthCheck {
+	if h == nil {
+		return nil
+	}
+	if len(h.Checks) > 0 {
+		return h.Checks
+	}
+	if h.Type == "" || h.Type == "none" {
+		return nil
+	}
+	return []HealthCheck{{Type: h.Type, Endpoint: h.Endpoint}}
+}
+
+// enabled reports whether there is anything to probe
+func (h *HealthConfig) enabled() bool {
+	return len(h.checks()) > 0
+}
+
+// resolve returns a copy of h with notify checks pointed at the units of
+// overlay name (in slot, for blue/green)
+func (h *HealthConfig) resolve(name, slot string) *HealthConfig {
+	if h == nil {
+		return nil
+	}
+	out := *h
+	out.Checks = make([]HealthCheck, len(h.Checks))
+	copy(out.Checks, h.Checks)
+	for i, c := range out.Checks {
+		if c.Type != "notify" {
+			continue
+		}
+		if slot != "" {
+			out.Checks[i].Unit = slotUnitName(name, c.Service, slot)
+		} else {
+			out.Checks[i].Unit = serviceUnitName(name, c.Service)
+		}
+	}
+	return &out
+}
+
+// validateHealth checks a manifest's health config against its services
+func validateHealth(m *OverlayManifest) error {
+	h := m.Health
+	if h == nil {
+		return nil
+	}
+	if len(h.Checks) > 0 && h.Type != "" {
+		return errors.New("set either type or checks, not both")
+	}
+	if h.Mode != "" && h.Mode != "all" && h.Mode != "any" {
+		return fmt.Errorf("invalid mode %q", h.Mode)
+	}
+	if h.Type != "" && h.Type != "none" && !validCheckTypes[h.Type] {
+		return fmt.Errorf("unknown check type %q", h.Type)
+	}
+	for i, c := range h.checks() {
+		if err := validateCheck(m, c); err != nil {
+			return fmt.Errorf("check %d (%s): %w", i, c.Type, err)
+		}
+	}
+	return nil
+}
+
+func validateCheck(m *OverlayManifest, c HealthCheck) error {
+	if !validCheckTypes[c.Type] {
+		return errors.New("unknown check type")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %d", c.Timeout)
+	}
+	if c.Type != "notify" && strings.TrimSpace(c.Endpoint) == "" {
+		return errors.New("endpoint is empty")
+	}
+	if c.Type != "http" && (c.Socket != "" || len(c.Status) > 0 || len(c.Headers) > 0 || c.Body != "" || len(c.JSON) > 0) {
+		return errors.New("socket, status, headers, body and json only apply to http checks")
+	}
+	switch c.Type {
+	case "http":
+		if c.Socket != "" && !strings.HasPrefix(c.Socket, "/") {
+			return fmt.Errorf("socket %q is not absolute", c.Socket)
+		}
+		for _, code := range c.Status {
+			if code < 100 || code > 599 {
+				return fmt.Errorf("invalid status %d", code)
+			}
+		}
+		if _, err := regexp.Compile(c.Body); err != nil {
+			return fmt.Errorf("body: %w", err)
+		}
+	case "notify":
+		svc, ok := m.Services[c.Service]
+		if !ok {
+			return fmt.Errorf("no service %q", c.Service)
+		}
+		if svc.Type != "notify" {
+			return fmt.Errorf("service %s is not type = \"notify\"", c.Service)
+		}
+		if s, ok := m.Sockets[c.Service]; ok && s.Accept {
+			return fmt.Errorf("service %s runs per connection", c.Service)
+		}
+	}
+	return nil
+}
+
+func runHealthChecks(name string, health *HealthConfig) bool {
+	grace := time.Duration(health.Grace) * time.Second
+	interval := time.Duration(health.Interval) * time.Second
+	stabilize := time.Duration(health.Stabilize) * time.Second
+
+	log.Printf("[%s] health: waiting %s grace period", name, grace)
+	time.Sleep(grace)
+
+	consecutiveOK := time.Duration(0)
+	start := time.Now()
+	maxWait := stabilize + 60*time.Second // safety cap
+
+	for consecutiveOK < stabilize && time.Since(start) < maxWait {
+		if probeHealth(health) {
+			consecutiveOK += interval
+		} else {
+			consecutiveOK = 0
+		}
+
+		if consecutiveOK < stabilize {
+			time.Sleep(interval)
+		}
+	}
+
+	return consecutiveOK >= stabilize
+}
+
+// probeHealth runs every check once and combines the results per mode
+func probeHealth(health *HealthConfig) bool {
+	checks := health.checks()
+	if len(checks) == 0 {
+		return false
+	}
+	anyMode := health.Mode == "any"
+	for _, c := range checks {
+		err := probeCheck(c)
+		if err != nil {
+			log.Printf("health: %s %s: %v", c.Type, checkTarget(c), err)
+		}
+		if anyMode && err == nil {
+			return true
+		}
+		if !anyMode && err != nil {
+			return false
+		}
+	}
+	return !anyMode
+}
+
+func checkTarget(c HealthCheck) string {
+	if c.Type == "notify" {
+		return c.Unit
+	}
+	return c.Endpoint
+}
+
+// probeCheck runs one check, returning why it failed
+func probeCheck(c HealthCheck) error {
+	timeout := defaultCheckTimeout
+	if c.Timeout > 0 {
+		timeout = time.Duration(c.Timeout) * time.Second
+	}
+	switch c.Type {
+	case "http":
+		return checkHTTP(c, timeout)
+	case "tcp":
+		return checkTCP(c.Endpoint, timeout)
+	case "exec":
+		return checkExec(c.Endpoint, timeout)
+	case "grpc":
+		return checkGRPC(c.Endpoint, c.GRPCService, timeout)
+	case "notify":
+		return checkReady(c.Unit, timeout)
+	}
+	return fmt.Errorf("unknown check type %q", c.Type)
+}
+
+func checkHTTP(c HealthCheck, timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+	if c.Socket != "" {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", c.Socket)
+			},
+		}
+	}
+	req, err := http.NewRequest("GET", c.Endpoint, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range c.Headers {
+		if strings.EqualFold(k, "Host") {
+			req.Host = v
+		} else {
+			req.Header.Set(k, v)
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if !statusAccepted(resp.StatusCode, c.Status) {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if c.Body != "" {
+		re, err := regexp.Compile(c.Body)
+		if err != nil {
+			return err
+		}
+		if !re.Match(body) {
+			return fmt.Errorf("body does not match %q", c.Body)
+		}
+	}
+	if len(c.JSON) > 0 {
+		var doc any
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return fmt.Errorf("body is not JSON: %w", err)
+		}
+		for _, path := range sortedKeys(c.JSON) {
+			got, ok := jsonPath(doc, path)
+			if !ok {
+				return fmt.Errorf("%s: missing", path)
+			}
+			if got != c.JSON[path] {
+				return fmt.Errorf("%s = %s, want %s", path, got, c.JSON[path])
+			}
+		}
+	}
+	return nil
+}
+
+func statusAccepted(code int, accepted []int) bool {
+	if len(accepted) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, c := range accepted {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonPath looks up a dotted path (array elements by index, e.g.
+// "checks.0.status") and renders the value for comparison: strings as-is,
+// anything else as JSON
+func jsonPath(doc any, path string) (string, bool) {
+	cur := doc
+	for _, part := range strings.Split(path, ".") {
+		switch v := cur.(type) {
+		case map[string]any:
+			next, ok := v[part]
+			if !ok {
+				return "", false
+			}
+			cur = next
+		case []any:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return "", false
+			}
+			cur = v[i]
+		default:
+			return "", false
+		}
+	}
+	if s, ok := cur.(string); ok {
+		return s, true
+	}
+	data, _ := json.Marshal(cur)
+	return string(data), true
+}
+
+func checkTCP(endpoint string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", endpoint, timeout)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+func checkExec(command string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return exec.CommandContext(ctx, "sh", "-c", command).Run()
+}
+
+func checkGRPC(endpoint, service string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+time.Second)
+	defer cancel()
+	args := []string{
+		"-addr=" + endpoint,
+		"-connect-timeout=" + timeout.String(),
+		"-rpc-timeout=" + timeout.String(),
+	}
+	if service != "" {
+		args = append(args, "-service="+service)
+	}
+	out, err := exec.CommandContext(ctx, grpcHealthProbe, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// checkReady passes once systemd has the unit active: a notify service stays
+// activating until it sends READY=1
+func checkReady(unit string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, _ := exec.CommandContext(ctx, "systemctl", "is-active", unit).Output()
+	if state := strings.TrimSpace(string(out)); state != "active" {
+		return fmt.Errorf("%s is %s", unit, state)
+	}
+	return nil
+}
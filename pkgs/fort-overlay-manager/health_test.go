@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHTTPCheckAssertions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer probe" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"status":"ok","db":{"connected":true},"workers":[{"state":"idle"}]}`))
+	}))
+	defer srv.Close()
+
+	auth := map[string]string{"Authorization": "Bearer probe"}
+	cases := []struct {
+		name  string
+		check HealthCheck
+		ok    bool
+	}{
+		{"2xx", HealthCheck{Headers: auth}, true},
+		{"no header", HealthCheck{}, false},
+		{"expected 401", HealthCheck{Status: []int{401}}, true},
+		{"body matches", HealthCheck{Headers: auth, Body: `"status":\s*"ok"`}, true},
+		{"body differs", HealthCheck{Headers: auth, Body: `degraded`}, false},
+		{"json", HealthCheck{Headers: auth, JSON: map[string]string{"status": "ok", "db.connected": "true", "workers.0.state": "idle"}}, true},
+		{"json mismatch", HealthCheck{Headers: auth, JSON: map[string]string{"db.connected": "false"}}, false},
+		{"json missing", HealthCheck{Headers: auth, JSON: map[string]string{"workers.3.state": "idle"}}, false},
+	}
+	for _, tc := range cases {
+		tc.check.Type = "http"
+		tc.check.Endpoint = srv.URL + "/health"
+		if err := probeCheck(tc.check); (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestHTTPCheckOverUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "api.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ready"))
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	c := HealthCheck{Type: "http", Endpoint: "http://localhost/health", Socket: sock, Body: "^ready$"}
+	if err := probeCheck(c); err != nil {
+		t.Errorf("unix socket check: %v", err)
+	}
+}
+
+func TestExecCheckTimeout(t *testing.T) {
+	if err := probeCheck(HealthCheck{Type: "exec", Endpoint: "sleep 5", Timeout: 1}); err == nil {
+		t.Error("exec check outlived its timeout")
+	}
+}
+
+func TestGRPCCheckRunsProbe(t *testing.T) {
+	dir := t.TempDir()
+	args := filepath.Join(dir, "args")
+	probe := filepath.Join(dir, "probe")
+	os.WriteFile(probe, []byte("#!/bin/sh\necho \"$@\" > "+args+"\n"), 0755)
+	old := grpcHealthProbe
+	grpcHealthProbe = probe
+	defer func() { grpcHealthProbe = old }()
+
+	if err := probeCheck(HealthCheck{Type: "grpc", Endpoint: "127.0.0.1:9090", GRPCService: "api.v1.Store", Timeout: 2}); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(args)
+	for _, want := range []string{"-addr=127.0.0.1:9090", "-service=api.v1.Store", "-rpc-timeout=2s"} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("probe args %q lack %s", got, want)
+		}
+	}
+}
+
+func TestProbeHealthModes(t *testing.T) {
+	pass := HealthCheck{Type: "exec", Endpoint: "true"}
+	fail := HealthCheck{Type: "exec", Endpoint: "false"}
+
+	if !probeHealth(&HealthConfig{Checks: []HealthCheck{pass, pass}}) {
+		t.Error("all: every check passed")
+	}
+	if probeHealth(&HealthConfig{Checks: []HealthCheck{pass, fail}}) {
+		t.Error("all: one check failed")
+	}
+	if !probeHealth(&HealthConfig{Mode: "any", Checks: []HealthCheck{fail, pass}}) {
+		t.Error("any: one check passed")
+	}
+	if probeHealth(&HealthConfig{Mode: "any", Checks: []HealthCheck{fail, fail}}) {
+		t.Error("any: every check failed")
+	}
+	if !probeHealth(&HealthConfig{Type: "exec", Endpoint: "true"}) {
+		t.Error("inline check ignored")
+	}
+	if (&HealthConfig{Type: "none", Bake: 60}).enabled() {
+		t.Error("type none has checks")
+	}
+}
+
+func TestValidateHealth(t *testing.T) {
+	services := map[string]ServiceDef{
+		"api":    {Exec: "/bin/api", Type: "notify"},
+		"worker": {Exec: "/bin/worker"},
+	}
+	cases := map[string]struct {
+		health *HealthConfig
+		ok     bool
+	}{
+		"inline":          {&HealthConfig{Type: "http", Endpoint: "http://127.0.0.1/health"}, true},
+		"none":            {&HealthConfig{Type: "none"}, true},
+		"both forms":      {&HealthConfig{Type: "tcp", Endpoint: "x:1", Checks: []HealthCheck{{Type: "tcp", Endpoint: "x:1"}}}, false},
+		"bad mode":        {&HealthConfig{Mode: "most", Checks: []HealthCheck{{Type: "tcp", Endpoint: "x:1"}}}, false},
+		"unknown type":    {&HealthConfig{Checks: []HealthCheck{{Type: "icmp", Endpoint: "x"}}}, false},
+		"bad regex":       {&HealthConfig{Checks: []HealthCheck{{Type: "http", Endpoint: "http://x/", Body: "("}}}, false},
+		"relative socket": {&HealthConfig{Checks: []HealthCheck{{Type: "http", Endpoint: "http://x/", Socket: "api.sock"}}}, false},
+		"body on tcp":     {&HealthConfig{Checks: []HealthCheck{{Type: "tcp", Endpoint: "x:1", Body: "ok"}}}, false},
+		"notify":          {&HealthConfig{Checks: []HealthCheck{{Type: "notify", Service: "api"}}}, true},
+		"notify simple":   {&HealthConfig{Checks: []HealthCheck{{Type: "notify", Service: "worker"}}}, false},
+		"notify missing":  {&HealthConfig{Checks: []HealthCheck{{Type: "notify", Service: "nope"}}}, false},
+	}
+	for name, tc := range cases {
+		err := validateHealth(&OverlayManifest{Services: services, Health: tc.health})
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v, want ok=%v", name, err, tc.ok)
+		}
+	}
+}
+
+func TestResolveNotifyUnits(t *testing.T) {
+	h := &HealthConfig{Checks: []HealthCheck{{Type: "notify", Service: "api"}, {Type: "tcp", Endpoint: "x:1"}}}
+	if got := h.resolve("coffer", "").Checks[0].Unit; got != "overlay-coffer-api.service" {
+		t.Errorf("unit = %q", got)
+	}
+	if got := h.resolve("coffer", "green").Checks[0].Unit; got != "overlay-coffer-api@green.service" {
+		t.Errorf("slot unit = %q", got)
+	}
+	if h.Checks[0].Unit != "" {
+		t.Error("resolve modified the manifest's health")
+	}
+}
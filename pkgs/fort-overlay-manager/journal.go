@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Activation history. state, current.json, previous.json and
+// last-attempt.json only describe the present; every state-machine
+// transition is also appended to journal.jsonl in the overlay's state dir,
+// so what a host ran at any point is answerable after the fact
+// (`fort-overlay-manager history <name>`). The versions that most recently
+// went permanent are retained — GC-rooted under gc-roots/ — and any of them
+// can be rolled back to, not just previous.json.
+
+const (
+	journalMaxEntries     = 2000 // oldest entries are dropped past this
+	defaultRetainVersions = 5
+)
+
+// JournalEntry is one state-machine transition
+type JournalEntry struct {
+	At        int64  `json:"at"`
+	State     string `json:"state"`
+	StorePath string `json:"storePath,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// transition moves an overlay to state and journals the move
+func transition(stateDir, state, storePath, reason string) {
+	writeState(stateDir, state)
+	appendJournal(stateDir, JournalEntry{
+		At:        time.Now().Unix(),
+		State:     state,
+		StorePath: storePath,
+		Reason:    reason,
+	})
+}
+
+func appendJournal(stateDir string, entry JournalEntry) {
+	path := filepath.Join(stateDir, "journal.jsonl")
+	line, _ := json.Marshal(entry)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("journal: %v", err)
+		return
+	}
+	f.Write(append(line, '\n'))
+	f.Close()
+
+	if journal := loadJournal(stateDir); len(journal) > journalMaxEntries {
+		writeJournal(path, journal[len(journal)-journalMaxEntries:])
+	}
+}
+
+// writeJournal replaces the journal atomically
+func writeJournal(path string, journal []JournalEntry) {
+	var b strings.Builder
+	for _, entry := range journal {
+		line, _ := json.Marshal(entry)
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		log.Printf("journal: %v", err)
+		return
+	}
+	os.Rename(tmp, path)
+}
+
+// loadJournal returns the journal oldest first; unreadable lines (a write
+// cut short) are skipped
+func loadJournal(stateDir string) []JournalEntry {
+	f, err := os.Open(filepath.Join(stateDir, "journal.jsonl"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var journal []JournalEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			journal = append(journal, entry)
+		}
+	}
+	return journal
+}
+
+// retainedVersions lists the last n distinct store paths that were running
+// permanently — activated, or restored by a rollback (a rolled-back entry
+// names the version it restored) — newest first
+func retainedVersions(journal []JournalEntry, n int) []string {
+	var versions []string
+	seen := map[string]bool{}
+	for i := len(journal) - 1; i >= 0 && len(versions) < n; i-- {
+		entry := journal[i]
+		if entry.StorePath == "" || seen[entry.StorePath] {
+			continue
+		}
+		if entry.State == "permanent" || entry.State == "rolled-back" {
+			seen[entry.StorePath] = true
+			versions = append(versions, entry.StorePath)
+		}
+	}
+	return versions
+}
+
+func retainCount(cfg Config) int {
+	if cfg.RetainVersions > 0 {
+		return cfg.RetainVersions
+	}
+	return defaultRetainVersions
+}
+
+// retainVersions keeps a GC root per retained version under gc-roots/ and
+// drops the roots of versions that fell out of the window
+func retainVersions(cfg Config, stateDir string) {
+	rootDir := filepath.Join(stateDir, "gc-roots")
+	os.MkdirAll(rootDir, 0755)
+
+	keep := map[string]bool{}
+	for _, storePath := range retainedVersions(loadJournal(stateDir), retainCount(cfg)) {
+		root := filepath.Base(storePath)
+		keep[root] = true
+		if _, err := os.Lstat(filepath.Join(rootDir, root)); err != nil {
+			updateGCRoot(rootDir, root, storePath)
+		}
+	}
+	entries, _ := os.ReadDir(rootDir)
+	for _, e := range entries {
+		if !keep[e.Name()] {
+			os.Remove(filepath.Join(rootDir, e.Name()))
+		}
+	}
+}
+
+// isRetained reports whether storePath is one of the overlay's retained
+// versions
+func isRetained(cfg Config, stateDir, storePath string) bool {
+	for _, v := range retainedVersions(loadJournal(stateDir), retainCount(cfg)) {
+		if v == storePath {
+			return true
+		}
+	}
+	return false
+}
+
+func cmdHistory(cfg Config, name string, jsonOutput bool) {
+	if _, ok := cfg.Overlays[name]; !ok {
+		log.Fatalf("[%s] not in config", name)
+	}
+	stateDir := filepath.Join(cfg.StateDir, name)
+	journal := loadJournal(stateDir)
+	retained := retainedVersions(journal, retainCount(cfg))
+
+	if jsonOutput {
+		data, _ := json.MarshalIndent(struct {
+			Journal  []JournalEntry `json:"journal"`
+			Retained []string       `json:"retained"`
+		}{journal, retained}, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	for _, e := range journal {
+		line := fmt.Sprintf("%s  %-12s %s", time.Unix(e.At, 0).Format(time.RFC3339), e.State, e.StorePath)
+		if e.Reason != "" {
+			line += " (" + e.Reason + ")"
+		}
+		fmt.Println(line)
+	}
+	if len(retained) > 0 {
+		current := loadCurrentState(cfg.StateDir, name)
+		fmt.Println("\nretained versions (rollback --to <path>):")
+		for _, v := range retained {
+			marker := " "
+			if current != nil && current.StorePath == v {
+				marker = "*"
+			}
+			fmt.Printf("  %s %s\n", marker, v)
+		}
+	}
+}
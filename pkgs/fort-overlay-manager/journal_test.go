@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTransitionJournalsEveryStep(t *testing.T) {
+	dir := t.TempDir()
+	for _, state := range []string{"fetching", "validating", "provisioning", "provisional"} {
+		transition(dir, state, "/nix/store/bbb-coffer", "")
+	}
+	transition(dir, "rolling-back", "/nix/store/bbb-coffer", "health checks failed")
+	transition(dir, "rolled-back", "/nix/store/aaa-coffer", "health checks failed")
+
+	if got := readState(dir); got != "rolled-back" {
+		t.Errorf("state = %q, want rolled-back", got)
+	}
+	journal := loadJournal(dir)
+	if len(journal) != 6 {
+		t.Fatalf("journal has %d entries, want 6: %+v", len(journal), journal)
+	}
+	if e := journal[4]; e.State != "rolling-back" || e.StorePath != "/nix/store/bbb-coffer" || e.Reason != "health checks failed" || e.At == 0 {
+		t.Errorf("rolling-back entry = %+v", e)
+	}
+}
+
+func TestJournalIsTrimmed(t *testing.T) {
+	dir := t.TempDir()
+	full := make([]JournalEntry, journalMaxEntries)
+	for i := range full {
+		full[i] = JournalEntry{At: int64(i), State: "permanent"}
+	}
+	writeJournal(filepath.Join(dir, "journal.jsonl"), full)
+	for i := 0; i < 10; i++ {
+		appendJournal(dir, JournalEntry{At: int64(journalMaxEntries + i), State: "permanent"})
+	}
+	journal := loadJournal(dir)
+	if len(journal) != journalMaxEntries || journal[0].At != 10 {
+		t.Errorf("journal kept %d entries from %d, want %d from 10", len(journal), journal[0].At, journalMaxEntries)
+	}
+}
+
+// Retained versions are what ran, newest first: a version that failed
+// provisional never ran, and one that a rollback restored counts again.
+func TestRetainedVersions(t *testing.T) {
+	journal := []JournalEntry{
+		{State: "permanent", StorePath: "/nix/store/aaa"},
+		{State: "permanent", StorePath: "/nix/store/bbb"},
+		{State: "provisional", StorePath: "/nix/store/ccc"},
+		{State: "rolling-back", StorePath: "/nix/store/ccc"},
+		{State: "rolled-back", StorePath: "/nix/store/bbb"},
+		{State: "failed", StorePath: "/nix/store/ddd"},
+		{State: "permanent", StorePath: "/nix/store/eee"},
+		{State: "rolling-back", StorePath: "/nix/store/eee"},
+		{State: "rolled-back", StorePath: "/nix/store/aaa"},
+	}
+	if got, want := retainedVersions(journal, 5), []string{"/nix/store/aaa", "/nix/store/eee", "/nix/store/bbb"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("retainedVersions = %v, want %v", got, want)
+	}
+	if got, want := retainedVersions(journal, 2), []string{"/nix/store/aaa", "/nix/store/eee"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("retainedVersions(2) = %v, want %v", got, want)
+	}
+}
+
+func TestRetainVersionsDropsRootsOutsideWindow(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{RetainVersions: 2}
+	for _, sp := range []string{"/nix/store/aaa-coffer", "/nix/store/bbb-coffer", "/nix/store/ccc-coffer"} {
+		transition(dir, "permanent", sp, "")
+		retainVersions(cfg, dir)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "gc-roots"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var roots []string
+	for _, e := range entries {
+		roots = append(roots, e.Name())
+	}
+	if want := []string{"bbb-coffer", "ccc-coffer"}; !reflect.DeepEqual(roots, want) {
+		t.Errorf("gc roots = %v, want %v", roots, want)
+	}
+	if !isRetained(cfg, dir, "/nix/store/bbb-coffer") || isRetained(cfg, dir, "/nix/store/aaa-coffer") {
+		t.Error("isRetained disagrees with the retention window")
+	}
+}
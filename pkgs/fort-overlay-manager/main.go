@@ -5,8 +5,8 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -17,31 +17,51 @@ import (
 
 // Config loaded from /etc/fort/overlays.json
 type Config struct {
-	RegistryUrl  string                   `json:"registryUrl"`
-	PollInterval string                   `json:"pollInterval"`
-	StateDir     string                   `json:"stateDir"`
-	BinDir       string                   `json:"binDir"`
-	Overlays     map[string]OverlayConfig `json:"overlays"`
+	Hostname       string                   `json:"hostname"` // this host's cluster name (networking.hostName); see hostName
+	RegistryUrl    string                   `json:"registryUrl"`
+	PollInterval   string                   `json:"pollInterval"`
+	StateDir       string                   `json:"stateDir"`
+	BinDir         string                   `json:"binDir"`
+	Overlays       map[string]OverlayConfig `json:"overlays"`
+	TrustedKeys    map[string]string        `json:"trustedKeys"`    // publisher -> SSH public key (verify.go)
+	AllowUnsigned  bool                     `json:"allowUnsigned"`  // accept entries that can't be verified, loudly (verify.go)
+	RetainVersions int                      `json:"retainVersions"` // versions kept GC-rooted per overlay (journal.go); 0 for the default
+	Expose         ExposeConfig             `json:"expose"`         // runtime vhosts and discovery needs (expose.go)
+	Fetch          FetchConfig              `json:"fetch"`          // closure prefetch (prefetch.go)
 }
 
 type OverlayConfig struct {
-	Package   string            `json:"package"`
-	Config    map[string]string `json:"config"`
-	Enabled   bool              `json:"enabled"`
-	DependsOn []string          `json:"dependsOn"`
+	Package         string            `json:"package"`
+	Channel         string            `json:"channel"` // registry channel; empty follows the registry default (stable)
+	Config          map[string]string `json:"config"`
+	Enabled         bool              `json:"enabled"`
+	DependsOn       []string          `json:"dependsOn"`
+	PinnedStorePath string            `json:"pinnedStorePath"` // run this instead of the registry's version (policy.go)
+	UpdateWindows   []string          `json:"updateWindows"`   // when check cycles may change the overlay (policy.go)
+
+	RestartWithDependencies bool `json:"restartWithDependencies"` // restart when a dependency's version changes (deps.go)
+
+	Sandbox string `json:"sandbox"` // "none" opts every service out of the default sandbox profile (sandbox.go)
 }
 
 // Registry entry from the overlay-registry service
 type RegistryEntry struct {
 	StorePath string `json:"storePath"`
 	UpdatedAt int64  `json:"updatedAt"`
+	Action    string `json:"action"` // signed with the entry (verify.go)
+	Publisher string `json:"publisher"`
+	Timestamp int64  `json:"timestamp"`
+	Signature string `json:"signature"`
 }
 
 // Persisted state per overlay
 type OverlayState struct {
-	StorePath    string `json:"storePath"`
-	ActivatedAt  int64  `json:"activatedAt"`
-	ManifestHash string `json:"manifestHash"`
+	StorePath    string      `json:"storePath"`
+	ActivatedAt  int64       `json:"activatedAt"`
+	ManifestHash string      `json:"manifestHash"`
+	Slot         string      `json:"slot,omitempty"`   // live blue/green slot; empty when replaced in place
+	Ports        []int       `json:"ports,omitempty"`  // declared ports, checked against other overlays
+	Expose       []ExposeDef `json:"expose,omitempty"` // what this version publishes (expose.go)
 }
 
 // AttemptRecord is the last activation attempt for an overlay that did not
@@ -58,9 +78,14 @@ type AttemptRecord struct {
 
 // Evaluated overlay manifest (output of overlay.nix)
 type OverlayManifest struct {
-	Services map[string]ServiceDef `json:"services"`
-	Bins     []string              `json:"bins"`
-	Health   *HealthConfig         `json:"health"`
+	Services   map[string]ServiceDef `json:"services"`
+	Bins       []string              `json:"bins"`
+	Health     *HealthConfig         `json:"health"`
+	Activation *ActivationConfig     `json:"activation"`
+	Timers     map[string]TimerDef   `json:"timers"`  // by service name (triggers.go)
+	Sockets    map[string]SocketDef  `json:"sockets"` // by service name (triggers.go)
+	Ports      []int                 `json:"ports"`   // TCP ports the services listen on (validate.go)
+	Expose     []ExposeDef           `json:"expose"`  // vhosts published at runtime (expose.go)
 }
 
 type ServiceDef struct {
@@ -77,14 +102,40 @@ type ServiceDef struct {
 	Drain            string   `json:"drain"`
 	Environment      []string `json:"environment"`
 	EnvironmentFile  []string `json:"environmentFile"`
+	Type             string   `json:"type"` // simple (default), exec, notify, oneshot
+	ExecStartPre     []string `json:"execStartPre"`
+
+	// ENV_VAR -> secret config key, delivered in an EnvironmentFile, and
+	// secret config keys loaded as credentials besides those the service
+	// refers to as %d/<key> (secrets.go). Credentials and SecretEnvFile are
+	// filled in by the manager, never by the manifest.
+	SecretEnvironment map[string]string `json:"secretEnvironment"`
+	CredentialKeys    []string          `json:"credentials"`
+	Credentials       map[string]string `json:"-"`
+	SecretEnvFile     string            `json:"-"`
+
+	// Sandboxing and resource controls (sandbox.go)
+	Sandbox               string   `json:"sandbox"` // "default" profile, or "none"
+	ProtectSystem         string   `json:"protectSystem"`
+	PrivateTmp            *bool    `json:"privateTmp"`
+	NoNewPrivileges       *bool    `json:"noNewPrivileges"`
+	ReadWritePaths        []string `json:"readWritePaths"`
+	CapabilityBoundingSet []string `json:"capabilityBoundingSet"`
+	MemoryMax             string   `json:"memoryMax"`
+	CPUQuota              string   `json:"cpuQuota"`
+	TasksMax              string   `json:"tasksMax"`
+	LimitNOFILE           int      `json:"limitNOFILE"`
 }
 
 type HealthConfig struct {
-	Type      string `json:"type"`
-	Endpoint  string `json:"endpoint"`
-	Interval  int    `json:"interval"`
-	Grace     int    `json:"grace"`
-	Stabilize int    `json:"stabilize"`
+	Type      string        `json:"type"` // a single check inline; or see checks (health.go)
+	Endpoint  string        `json:"endpoint"`
+	Checks    []HealthCheck `json:"checks"`
+	Mode      string        `json:"mode"` // "all" (default) or "any" of checks
+	Interval  int           `json:"interval"`
+	Grace     int           `json:"grace"`
+	Stabilize int           `json:"stabilize"`
+	Bake      int           `json:"bake"` // seconds to keep watching after permanent (watchdog.go)
 }
 
 const configPath = "/etc/fort/overlays.json"
@@ -94,7 +145,7 @@ func main() {
 
 	if len(os.Args) < 2 {
 		fmt.Fprintf(os.Stderr, "Usage: fort-overlay-manager <command> [args]\n")
-		fmt.Fprintf(os.Stderr, "Commands: check, activate, rollback, status, boot\n")
+		fmt.Fprintf(os.Stderr, "Commands: daemon, check, activate, validate, rollback, hold, release, pin, unpin, status, logs, history, boot, watchdog, secrets, capability\n")
 		os.Exit(1)
 	}
 
@@ -108,7 +159,10 @@ func main() {
 				overlay = os.Args[i+3]
 			}
 		}
-		cmdCheck(cfg, overlay)
+		run(cfg, "/check", url.Values{"overlay": nonEmpty(overlay)}, func() error {
+			cmdCheck(cfg, overlay)
+			return nil
+		})
 	case "activate":
 		if len(os.Args) < 3 {
 			log.Fatal("Usage: fort-overlay-manager activate <name> --store-path <path>")
@@ -123,12 +177,92 @@ func main() {
 		if storePath == "" {
 			log.Fatal("--store-path required")
 		}
-		cmdActivate(cfg, name, storePath)
+		run(cfg, "/activate", url.Values{"name": {name}, "storePath": {storePath}}, func() error {
+			cmdActivate(cfg, name, storePath)
+			reportStatus(cfg)
+			return nil
+		})
+	case "validate":
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: fort-overlay-manager validate <name> --store-path <path>")
+		}
+		storePath := ""
+		for i, arg := range os.Args[3:] {
+			if arg == "--store-path" && i+1 < len(os.Args[3:]) {
+				storePath = os.Args[i+4]
+			}
+		}
+		if storePath == "" {
+			log.Fatal("--store-path required")
+		}
+		if err := cmdValidate(os.Stdout, cfg, os.Args[2], storePath); err != nil {
+			log.Fatal(err)
+		}
 	case "rollback":
 		if len(os.Args) < 3 {
-			log.Fatal("Usage: fort-overlay-manager rollback <name>")
+			log.Fatal("Usage: fort-overlay-manager rollback <name> [--to <store-path>]")
+		}
+		to := ""
+		for i, arg := range os.Args[3:] {
+			if arg == "--to" && i+1 < len(os.Args[3:]) {
+				to = os.Args[i+4]
+			}
+		}
+		run(cfg, "/rollback", url.Values{"name": {os.Args[2]}, "to": nonEmpty(to)}, func() error {
+			if err := cmdRollback(cfg, os.Args[2], to); err != nil {
+				return err
+			}
+			reportStatus(cfg)
+			return nil
+		})
+	case "pin":
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: fort-overlay-manager pin <name> [--store-path <path>]")
+		}
+		name := os.Args[2]
+		storePath, by := "", ""
+		for i, arg := range os.Args[3:] {
+			if i+1 >= len(os.Args[3:]) {
+				break
+			}
+			switch arg {
+			case "--store-path":
+				storePath = os.Args[i+4]
+			case "--by":
+				by = os.Args[i+4]
+			}
+		}
+		run(cfg, "/pin", url.Values{"name": {name}, "storePath": nonEmpty(storePath), "by": nonEmpty(by)}, func() error {
+			return cmdPin(cfg, name, storePath, by)
+		})
+	case "hold", "pause":
+		if len(os.Args) < 3 {
+			log.Fatalf("Usage: fort-overlay-manager %s <name>", os.Args[1])
+		}
+		name := os.Args[2]
+		by := ""
+		for i, arg := range os.Args[3:] {
+			if arg == "--by" && i+1 < len(os.Args[3:]) {
+				by = os.Args[i+4]
+			}
+		}
+		run(cfg, "/hold", url.Values{"name": {name}, "by": nonEmpty(by)}, func() error {
+			return cmdHold(cfg, name, by)
+		})
+	case "unpin":
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: fort-overlay-manager unpin <name>")
+		}
+		run(cfg, "/unpin", url.Values{"name": {os.Args[2]}}, func() error {
+			return cmdUnpin(cfg, os.Args[2])
+		})
+	case "release", "resume":
+		if len(os.Args) < 3 {
+			log.Fatalf("Usage: fort-overlay-manager %s <name>", os.Args[1])
 		}
-		cmdRollback(cfg, os.Args[2])
+		run(cfg, "/release", url.Values{"name": {os.Args[2]}}, func() error {
+			return cmdRelease(cfg, os.Args[2])
+		})
 	case "status":
 		jsonOutput := false
 		for _, arg := range os.Args[2:] {
@@ -136,14 +270,74 @@ func main() {
 				jsonOutput = true
 			}
 		}
-		cmdStatus(cfg, jsonOutput)
+		query := url.Values{}
+		if jsonOutput {
+			query.Set("json", "1")
+		}
+		if err := callDaemon("GET", "/status", query, os.Stdout); err == errNoDaemon {
+			cmdStatus(os.Stdout, cfg, jsonOutput)
+		} else if err != nil {
+			log.Fatal(err)
+		}
+	case "logs":
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: fort-overlay-manager logs <name>")
+		}
+		if err := callDaemon("GET", "/logs", url.Values{"name": {os.Args[2]}}, os.Stderr); err != nil {
+			log.Fatal(err)
+		}
+	case "history":
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: fort-overlay-manager history <name> [--json]")
+		}
+		jsonOutput := false
+		for _, arg := range os.Args[3:] {
+			if arg == "--json" {
+				jsonOutput = true
+			}
+		}
+		cmdHistory(cfg, os.Args[2], jsonOutput)
 	case "boot":
-		cmdBoot(cfg)
+		run(cfg, "/boot", nil, func() error {
+			cmdBoot(cfg)
+			return nil
+		})
+	case "capability":
+		cmdCapability(cfg, len(os.Args) > 2 && os.Args[2] == "--admin", os.Stdin, os.Stdout)
+	case "daemon", "watch":
+		cmdDaemon(cfg)
+	case "secrets":
+		run(cfg, "/secrets", nil, func() error {
+			cmdSecrets(cfg)
+			return nil
+		})
+	case "watchdog":
+		run(cfg, "/watchdog", nil, func() error {
+			if cmdWatchdog(cfg) {
+				reportStatus(cfg)
+			}
+			return nil
+		})
 	default:
 		log.Fatalf("Unknown command: %s", os.Args[1])
 	}
 }
 
+// run sends a command to the daemon, or runs it in-process when there is
+// none (daemon.go)
+func run(cfg Config, path string, query url.Values, direct func() error) {
+	if err := viaDaemon(cfg, path, query, direct); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
 func loadConfig() Config {
 	data, err := os.ReadFile(configPath)
 	if err != nil {
@@ -160,8 +354,8 @@ func loadConfig() Config {
 // their dependents, so a dependency activates before anything that needs it.
 // Deterministic (ties broken by name). Deps not declared on this host are
 // ignored here — the nix side rejects them at eval time. A dependency cycle
-// is broken deterministically with a logged warning rather than failing the
-// whole run.
+// is broken deterministically; it is reported by status and its members are
+// not updated (deps.go).
 func orderedOverlays(overlays map[string]OverlayConfig) []string {
 	names := make([]string, 0, len(overlays))
 	for name := range overlays {
@@ -174,10 +368,7 @@ func orderedOverlays(overlays map[string]OverlayConfig) []string {
 	var visit func(string)
 	visit = func(name string) {
 		switch state[name] {
-		case 1:
-			log.Printf("[%s] dependency cycle detected, activation order not guaranteed", name)
-			return
-		case 2:
+		case 1, 2:
 			return
 		}
 		state[name] = 1
@@ -199,10 +390,20 @@ func orderedOverlays(overlays map[string]OverlayConfig) []string {
 
 // cmdCheck polls the registry and activates new versions
 func cmdCheck(cfg Config, overlayFilter string) {
-	registry := fetchRegistry(cfg.RegistryUrl)
-	if registry == nil {
-		return
+	// Settle any bake first: a version rolled back here is then skipped
+	// below by its attempt backoff rather than reinstalled
+	cmdWatchdog(cfg)
+	cmdSecrets(cfg)
+
+	// One listing per subscribed channel, fetched on first use. The host
+	// name lets the registry hand out a staged rollout's entry to the hosts
+	// admitted to it.
+	listings := map[string]map[string]RegistryEntry{}
+	host, err := hostName(cfg)
+	if err != nil {
+		log.Printf("%v; following channel heads, outside any rollout", err)
 	}
+	subs := subscriptions(cfg)
 
 	// Dependency order: a new version of a dependency lands before its
 	// dependents are (re)activated in the same check cycle.
@@ -214,36 +415,94 @@ func cmdCheck(cfg Config, overlayFilter string) {
 		if overlayFilter != "" && name != overlayFilter {
 			continue
 		}
+		stateDir := filepath.Join(cfg.StateDir, name)
+
+		registry, fetched := listings[ov.Channel]
+		if !fetched {
+			registry = fetchRegistry(cfg.RegistryUrl, ov.Channel, host, subs[ov.Channel])
+			listings[ov.Channel] = registry
+		}
+		entry, listed := registry[ov.Package]
+		if registry != nil && !listed {
+			log.Printf("[%s] not found in registry (package: %s%s)", name, ov.Package, channelSuffix(ov.Channel))
+		}
 
-		entry, ok := registry[ov.Package]
-		if !ok {
-			log.Printf("[%s] not found in registry (package: %s)", name, ov.Package)
+		// The version to run: the registry's, unless the host config pins
+		// one (policy.go)
+		target := entry.StorePath
+		if ov.PinnedStorePath != "" {
+			if listed && entry.StorePath != ov.PinnedStorePath {
+				log.Printf("[%s] pinned to %s by config (registry has %s)", name, ov.PinnedStorePath, entry.StorePath)
+			}
+			target = ov.PinnedStorePath
+		}
+		if target == "" {
 			continue
 		}
 
 		current := loadCurrentState(cfg.StateDir, name)
-		if current != nil && current.StorePath == entry.StorePath {
+		if current != nil && current.StorePath == target {
 			if _, err := os.Stat(current.StorePath); err == nil {
-				log.Printf("[%s] up to date (%s)", name, entry.StorePath)
+				log.Printf("[%s] up to date (%s)", name, target)
+				// Seeds accepted.json on hosts that ran this entry before
+				// freshness was checked (verify.go)
+				if target == entry.StorePath && loadAccepted(stateDir) == nil && verifyEntry(cfg, ov.Package, ov.Channel, entry) == nil {
+					recordAccepted(stateDir, ov.Package, ov.Channel, entry)
+				}
+				clearPending(stateDir)
+				clearFetch(stateDir, target)
 				continue
 			}
 			log.Printf("[%s] store path missing, re-fetching: %s", name, current.StorePath)
 		}
 
-		// A store path that already failed activation is not retried on every
-		// poll: back off exponentially so a permanently broken version cannot
-		// thrash its services indefinitely. An explicit `activate` bypasses this.
-		if attempt := loadAttempt(cfg.StateDir, name); attempt != nil && attempt.StorePath == entry.StorePath {
-			if wait := backoffRemaining(attempt, cfg.PollInterval); wait > 0 {
-				log.Printf("[%s] skipping %s: %s after %d attempt(s) (%s); next retry in %s",
-					name, entry.StorePath, attempt.State, attempt.Attempts, attempt.Reason, wait.Round(time.Second))
+		// Verify before realising: an unverified path is never fetched, let
+		// alone activated. A config pin is part of the host's own config.
+		if target == entry.StorePath {
+			err := verifyEntry(cfg, ov.Package, ov.Channel, entry)
+			if err == nil {
+				err = verifyFresh(stateDir, ov.Package, ov.Channel, entry)
+			}
+			if err != nil {
+				log.Printf("[%s] rejecting %s: %v", name, entry.StorePath, err)
+				recordPending(stateDir, target, fmt.Sprintf("rejected: %v", err))
 				continue
 			}
+			recordAccepted(stateDir, ov.Package, ov.Channel, entry)
+		}
+
+		// Fetched as soon as it is seen, whether or not it may be applied
+		// yet (prefetch.go)
+		ready, fetching := closureReady(cfg, name, target)
+
+		// Holds, update windows and, for a store path that already failed
+		// activation, exponential backoff so a permanently broken version
+		// cannot thrash its services indefinitely. An explicit `activate`
+		// bypasses all of them.
+		if reason := updateBlocked(cfg, name, ov, target, time.Now()); reason != "" {
+			log.Printf("[%s] not applying %s: %s", name, target, reason)
+			recordPending(stateDir, target, reason)
+			continue
+		}
+		if !ready {
+			log.Printf("[%s] not applying %s yet: %s", name, target, fetching)
+			recordPending(stateDir, target, fetching)
+			continue
 		}
 
-		log.Printf("[%s] new version available: %s", name, entry.StorePath)
-		cmdActivate(cfg, name, entry.StorePath)
+		log.Printf("[%s] new version available: %s", name, target)
+		clearPending(stateDir)
+		cmdActivate(cfg, name, target)
+	}
+
+	// Also picks up overlays disabled or removed from the config since
+	if err := syncExposure(cfg); err != nil {
+		log.Printf("expose: %v", err)
 	}
+
+	// Every cycle, not just after changes: the report doubles as this
+	// host's subscription list for rollout waves
+	reportStatus(cfg)
 }
 
 // cmdActivate runs the activation state machine for one overlay
@@ -255,32 +514,49 @@ func cmdActivate(cfg Config, name, storePath string) {
 
 	stateDir := filepath.Join(cfg.StateDir, name)
 	os.MkdirAll(stateDir, 0755)
-	writeState(stateDir, "fetching")
 
-	// FETCHING: realize the store path
-	log.Printf("[%s] fetching %s", name, storePath)
-	if err := realiseStorePath(storePath); err != nil {
+	// The whole closure is present before the state machine starts: a check
+	// cycle waits for its prefetch, an explicit activate fetches here
+	if err := fetchClosure(cfg, name, storePath); err != nil {
 		failActivation(stateDir, name, storePath, "fetch failed: %v", err)
 		return
 	}
 
 	// VALIDATING: evaluate overlay.nix
-	writeState(stateDir, "validating")
+	transition(stateDir, "validating", storePath, "")
 	overlayNix := filepath.Join(storePath, "overlay.nix")
 	if _, err := os.Stat(overlayNix); err != nil {
 		failActivation(stateDir, name, storePath, "no overlay.nix at %s", overlayNix)
 		return
 	}
 
-	manifest, err := evalOverlay(storePath, ov.Config)
+	manifest, err := evalOverlay(storePath, ov)
 	if err != nil {
 		failActivation(stateDir, name, storePath, "eval failed: %v", err)
 		return
 	}
+	if err := validateManifest(name, manifest); err != nil {
+		failActivation(stateDir, name, storePath, "%v", err)
+		return
+	}
+	if problems := hostProblems(cfg, name, storePath, manifest); len(problems) > 0 {
+		failActivation(stateDir, name, storePath, "validation failed: %s", strings.Join(problems, "; "))
+		return
+	}
+	manifest.Health = manifest.Health.resolve(name, "")
+	noteDefaultSandbox(name, manifest)
+	if err := provideSecrets(name, ov.Config, manifest); err != nil {
+		failActivation(stateDir, name, storePath, "secrets: %v", err)
+		return
+	}
 
 	// PROVISIONING: generate and load systemd units
 	ensureDataDirOwnership(name, ov.Config, manifest)
-	writeState(stateDir, "provisioning")
+	transition(stateDir, "provisioning", storePath, "")
+	if manifest.blueGreen() {
+		activateBlueGreen(cfg, name, storePath, manifest)
+		return
+	}
 	if err := generateUnits(name, manifest, ov.DependsOn); err != nil {
 		failActivation(stateDir, name, storePath, "unit generation failed: %v", err)
 		return
@@ -294,85 +570,133 @@ func cmdActivate(cfg Config, name, storePath string) {
 	// Stop old services explicitly — systemctl stop on a service is
 	// synchronous (waits for drain + exit), whereas stopping the target
 	// only deactivates a grouping unit and propagates asynchronously.
+	// A blue/green version being replaced in place holds its ports in
+	// its live slot, not under the plain unit names.
+	if current := loadCurrentState(cfg.StateDir, name); current != nil && current.Slot != "" {
+		stopSlot(name, current.Slot)
+	}
 	stopServices(name, manifest)
 
 	// Start new target (brings up all wanted services)
 	if err := startTarget(name); err != nil {
 		log.Printf("[%s] start failed: %v", name, err)
-		writeState(stateDir, "rolling-back")
-		rollbackOverlay(cfg, name, storePath, fmt.Sprintf("start failed: %v", err))
+		reason := fmt.Sprintf("start failed: %v", err)
+		transition(stateDir, "rolling-back", storePath, reason)
+		rollbackOverlay(cfg, name, storePath, reason)
 		return
 	}
 
 	// PROVISIONAL: health check loop
-	writeState(stateDir, "provisional")
-	if manifest.Health != nil && manifest.Health.Type != "none" {
+	transition(stateDir, "provisional", storePath, "")
+	if manifest.Health.enabled() {
 		if !runHealthChecks(name, manifest.Health) {
 			log.Printf("[%s] health checks failed, rolling back", name)
-			writeState(stateDir, "rolling-back")
+			transition(stateDir, "rolling-back", storePath, "health checks failed")
 			rollbackOverlay(cfg, name, storePath, "health checks failed")
 			return
 		}
 	}
 
 	// PERMANENT: update state, rotate previous, update GC roots and bin symlinks
-	writeState(stateDir, "permanent")
+	transition(stateDir, "permanent", storePath, "")
 	rotatePrevious(stateDir)
 	saveCurrentState(stateDir, OverlayState{
 		StorePath:   storePath,
 		ActivatedAt: time.Now().Unix(),
+		Ports:       manifest.declaredPorts(),
+		Expose:      manifest.exposures(name),
 	})
 	updateGCRoot(stateDir, "gc-root-current", storePath)
+	retainVersions(cfg, stateDir)
 	updateBinSymlinks(cfg.BinDir, manifest.Bins)
 	clearAttempt(stateDir)
+	recordSecrets(stateDir, ov.Config, manifest, serviceUnits(name, manifest, ""))
+	startBake(stateDir, name, storePath, manifest.Health, serviceUnits(name, manifest, ""))
 
 	log.Printf("[%s] activated %s", name, storePath)
+	if err := syncExposure(cfg); err != nil {
+		log.Printf("[%s] expose: %v", name, err)
+	}
+	restartDependents(cfg, name)
 }
 
-// cmdRollback restores the previous version of an overlay
-func cmdRollback(cfg Config, name string) {
-	rollbackOverlay(cfg, name, "", "operator-initiated rollback")
-}
+// cmdRollback restores the previous version of an overlay, or with to any
+// of its retained versions
+func cmdRollback(cfg Config, name, to string) error {
+	if _, ok := cfg.Overlays[name]; !ok {
+		return fmt.Errorf("[%s] not in config", name)
+	}
+	stateDir := filepath.Join(cfg.StateDir, name)
+	current := loadCurrentState(cfg.StateDir, name)
+	reason := "operator-initiated rollback"
 
-// cmdStatus shows the state of all overlays
-func cmdStatus(cfg Config, jsonOutput bool) {
-	type StatusEntry struct {
-		Name        string         `json:"name"`
-		Package     string         `json:"package"`
-		State       string         `json:"state"`
-		Current     *OverlayState  `json:"current"`
-		Previous    *OverlayState  `json:"previous"`
-		LastAttempt *AttemptRecord `json:"lastAttempt"`
-		Enabled     bool           `json:"enabled"`
-	}
-
-	var entries []StatusEntry
-	for name, ov := range cfg.Overlays {
-		stateDir := filepath.Join(cfg.StateDir, name)
-		entry := StatusEntry{
-			Name:        name,
-			Package:     ov.Package,
-			State:       readState(stateDir),
-			Current:     loadCurrentState(cfg.StateDir, name),
-			Previous:    loadPreviousState(cfg.StateDir, name),
-			LastAttempt: loadAttempt(cfg.StateDir, name),
-			Enabled:     ov.Enabled,
+	if to != "" {
+		if current != nil && current.StorePath == to {
+			return fmt.Errorf("[%s] already running %s", name, to)
+		}
+		if !isRetained(cfg, stateDir, to) {
+			return fmt.Errorf("[%s] %s is not a retained version (see `fort-overlay-manager history %s`)", name, to, name)
 		}
-		entries = append(entries, entry)
+		if _, err := os.Stat(to); err != nil {
+			return fmt.Errorf("[%s] %s is no longer in the store", name, to)
+		}
+		// rollbackOverlay restores previous.json; point it at the target
+		data, _ := json.MarshalIndent(OverlayState{StorePath: to, ActivatedAt: time.Now().Unix()}, "", "  ")
+		os.WriteFile(filepath.Join(stateDir, "previous.json"), data, 0644)
+		updateGCRoot(stateDir, "gc-root-previous", to)
+		reason = "operator-initiated rollback to " + to
+	}
+
+	from := ""
+	if current != nil {
+		from = current.StorePath
 	}
+	transition(stateDir, "rolling-back", from, reason)
+	rollbackOverlay(cfg, name, "", reason)
+	return nil
+}
+
+// cmdStatus shows the state of all overlays
+func cmdStatus(w io.Writer, cfg Config, jsonOutput bool) {
+	entries := statusEntries(cfg)
 
 	if jsonOutput {
 		data, _ := json.MarshalIndent(entries, "", "  ")
-		fmt.Println(string(data))
+		fmt.Fprintln(w, string(data))
 	} else {
 		for _, e := range entries {
 			sp := "<none>"
 			if e.Current != nil {
 				sp = e.Current.StorePath
+				if e.Current.Slot != "" {
+					sp += " (" + e.Current.Slot + ")"
+				}
+			}
+			fmt.Fprintf(w, "%-20s %-12s %-10s %s\n", e.Name, e.State, enabledStr(e.Enabled), sp)
+			if e.DependencyError != "" {
+				fmt.Fprintf(w, "%-20s   error: %s\n", "", e.DependencyError)
+			}
+			if e.Pin != nil {
+				fmt.Fprintf(w, "%-20s   %s\n", "", e.Pin)
+			}
+			if p := e.Pending; p != nil {
+				fmt.Fprintf(w, "%-20s   update %s not applied: %s\n", "", p.StorePath, p.Reason)
+			}
+			if f := e.Fetch; f != nil && (f.State != "ready" || e.Current == nil || e.Current.StorePath != f.StorePath) {
+				fmt.Fprintf(w, "%-20s   %s\n", "", f)
+			} else if f != nil && f.ClosureSize > 0 {
+				fmt.Fprintf(w, "%-20s   closure %s\n", "", humanBytes(f.ClosureSize))
+			}
+			if e.Current != nil && cfg.Expose.Domain != "" {
+				for _, x := range e.Current.Expose {
+					fmt.Fprintf(w, "%-20s   exposed at https://%s.%s (%s)\n", "", x.Subdomain, cfg.Expose.Domain, x.Visibility)
+				}
+			}
+			if b := e.Bake; b != nil {
+				fmt.Fprintf(w, "%-20s   baking until %s\n", "", time.Unix(b.Until, 0).Format(time.RFC3339))
 			}
-			fmt.Printf("%-20s %-12s %-10s %s\n", e.Name, e.State, enabledStr(e.Enabled), sp)
 			if a := e.LastAttempt; a != nil {
-				fmt.Printf("%-20s   last attempt x%d %s: %s (%s)\n", "", a.Attempts, a.State, a.Reason, a.StorePath)
+				fmt.Fprintf(w, "%-20s   last attempt x%d %s: %s (%s)\n", "", a.Attempts, a.State, a.Reason, a.StorePath)
 			}
 		}
 	}
@@ -400,7 +724,10 @@ func cmdBoot(cfg Config) {
 			continue
 		}
 
-		manifest, err := evalOverlay(current.StorePath, ov.Config)
+		manifest, err := evalOverlay(current.StorePath, ov)
+		if err == nil {
+			err = provideSecrets(name, ov.Config, manifest)
+		}
 		if err != nil {
 			log.Printf("[%s] boot eval failed: %v", name, err)
 			continue
@@ -408,7 +735,14 @@ func cmdBoot(cfg Config) {
 
 		ensureDataDirOwnership(name, ov.Config, manifest)
 
-		if err := generateUnits(name, manifest, ov.DependsOn); err != nil {
+		if current.Slot != "" && manifest.blueGreen() {
+			// The upstream file and socket symlink live on tmpfs too, so
+			// traffic has to be pointed at the live slot again
+			if err := restoreSlot(name, ov, manifest, current.Slot); err != nil {
+				log.Printf("[%s] boot slot restore failed: %v", name, err)
+				continue
+			}
+		} else if err := generateUnits(name, manifest, ov.DependsOn); err != nil {
 			log.Printf("[%s] boot unit generation failed: %v", name, err)
 			continue
 		}
@@ -420,6 +754,11 @@ func cmdBoot(cfg Config) {
 	}
 
 	daemonReload()
+	// /run is empty after a reboot: vhosts and runtime needs are rewritten
+	// from the recorded exposures
+	if err := syncExposure(cfg); err != nil {
+		log.Printf("boot: expose: %v", err)
+	}
 
 	// Start all overlay targets, dependencies first (the generated After=
 	// ordering makes systemd enforce this too; starting in order keeps the
@@ -437,9 +776,25 @@ func cmdBoot(cfg Config) {
 
 // --- Helpers ---
 
-func fetchRegistry(url string) map[string]RegistryEntry {
+// fetchRegistry returns the registry's package -> entry listing for channel
+// ("" for the registry's default) as host sees it, narrowed to packages.
+// The registry logs which hosts fetch which packages to find dead ones.
+func fetchRegistry(registryUrl, channel, host string, packages []string) map[string]RegistryEntry {
+	query := url.Values{}
+	if channel != "" {
+		query.Set("channel", channel)
+	}
+	if host != "" {
+		query.Set("host", host)
+	}
+	if len(packages) > 0 {
+		query.Set("packages", strings.Join(packages, ","))
+	}
+	if len(query) > 0 {
+		registryUrl += "?" + query.Encode()
+	}
 	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Get(url)
+	resp, err := client.Get(registryUrl)
 	if err != nil {
 		log.Printf("registry fetch failed: %v", err)
 		return nil
@@ -459,27 +814,10 @@ func fetchRegistry(url string) map[string]RegistryEntry {
 	return entries
 }
 
-func realiseStorePath(storePath string) error {
-	cmd := exec.Command("nix-store", "--realise", storePath)
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
-}
-
-func resolveSecrets(config map[string]string) map[string]string {
-	resolved := make(map[string]string, len(config))
-	for k, v := range config {
-		if strings.HasPrefix(v, "%SECRET:") && strings.HasSuffix(v, "%") {
-			resolved[k] = v[len("%SECRET:") : len(v)-1]
-		} else {
-			resolved[k] = v
-		}
-	}
-	return resolved
-}
-
-func evalOverlay(storePath string, config map[string]string) (*OverlayManifest, error) {
-	config = resolveSecrets(config)
+// evalOverlay evaluates overlay.nix with the overlay's config and applies
+// the host's sandbox opt-out to the result
+func evalOverlay(storePath string, ov OverlayConfig) (*OverlayManifest, error) {
+	config := evalConfig(ov.Config)
 	// Build the apply expression with config as both top-level args and nested attrset:
 	// f { port = "19876"; storePath = "/nix/store/..."; config = { port = "19876"; }; }
 	// Top-level for backward compat, config attrset for overlays that prefer it.
@@ -508,6 +846,7 @@ func evalOverlay(storePath string, config map[string]string) (*OverlayManifest,
 	if err := json.Unmarshal([]byte(out.String()), &manifest); err != nil {
 		return nil, fmt.Errorf("parse manifest: %w", err)
 	}
+	applySandboxOptOut(ov, &manifest)
 	return &manifest, nil
 }
 
@@ -530,30 +869,24 @@ func legacyServiceUnitName(overlay, service string) string {
 	return fmt.Sprintf("overlay-%s-%s.service", overlay, service)
 }
 
-func generateUnits(name string, manifest *OverlayManifest, dependsOn []string) error {
-	unitDir := "/run/systemd/system"
+var unitDir = "/run/systemd/system"
 
-	// Generate target unit. Declared overlay dependencies become Wants= +
-	// After= on the target: starting this overlay pulls its dependencies in,
-	// and target units implicitly order After= their own Wants=, so a
-	// dependency's services have started before this target activates.
+func generateUnits(name string, manifest *OverlayManifest, dependsOn []string) error {
 	targetName := fmt.Sprintf("overlay-%s.target", name)
-	targetContent := fmt.Sprintf(`[Unit]
-Description=Overlay target for %s
-`, name)
-	for _, dep := range dependsOn {
-		targetContent += fmt.Sprintf("Wants=overlay-%s.target\nAfter=overlay-%s.target\n", dep, dep)
-	}
-
-	if err := os.WriteFile(filepath.Join(unitDir, targetName), []byte(targetContent), 0644); err != nil {
-		return fmt.Errorf("write target: %w", err)
+	if err := writeOverlayTarget(name, dependsOn, ""); err != nil {
+		return err
 	}
 
-	// Generate service units
+	// Generate service units; a service with a timer or socket is wanted
+	// through that instead
 	var wantedByTarget []string
 	for svcName, svc := range manifest.Services {
-		unitName := serviceUnitName(name, svcName)
-		wantedByTarget = append(wantedByTarget, unitName)
+		unitName := manifest.unitNameFor(name, svcName)
+		if trigger := manifest.triggerUnitName(name, svcName); trigger != "" {
+			wantedByTarget = append(wantedByTarget, trigger)
+		} else {
+			wantedByTarget = append(wantedByTarget, unitName)
+		}
 
 		// Migrate away from the pre-flattening unit name: a leftover unit
 		// file means an older manager version may still have that unit
@@ -569,87 +902,153 @@ Description=Overlay target for %s
 			}
 		}
 
-		after := "network.target"
-		if len(svc.After) > 0 {
-			after = strings.Join(svc.After, " ")
+		if err := writeServiceUnit(name, svcName, unitName, targetName, svc, dependsOn); err != nil {
+			return err
 		}
-		// Order each service after dependency targets too: a service's own
-		// start job is not ordered by its target's After=, only the target is.
-		for _, dep := range dependsOn {
-			after += fmt.Sprintf(" overlay-%s.target", dep)
+	}
+	for svcName, t := range manifest.Timers {
+		if err := writeTimerUnit(name, svcName, manifest.triggerUnitName(name, svcName), targetName, t); err != nil {
+			return err
 		}
-
-		restart := "on-failure"
-		if svc.Restart != "" {
-			restart = svc.Restart
+	}
+	for svcName, s := range manifest.Sockets {
+		if err := writeSocketUnit(name, svcName, manifest.triggerUnitName(name, svcName), targetName, s); err != nil {
+			return err
 		}
+	}
 
-		restartSec := 5
-		if svc.RestartSec > 0 {
-			restartSec = svc.RestartSec
+	// Update target to want its services. Rebuilt from scratch: the
+	// previous version may have wanted units (a timer, say) this one
+	// no longer has.
+	wantsDir := filepath.Join(unitDir, targetName+".wants")
+	os.RemoveAll(wantsDir)
+	if len(wantedByTarget) > 0 {
+		os.MkdirAll(wantsDir, 0755)
+		for _, unit := range wantedByTarget {
+			os.Symlink(filepath.Join(unitDir, unit), filepath.Join(wantsDir, unit))
 		}
+	}
 
-		var envLines string
-		for _, env := range svc.Environment {
-			envLines += fmt.Sprintf("Environment=%s\n", env)
-		}
-		for _, envFile := range svc.EnvironmentFile {
-			envLines += fmt.Sprintf("EnvironmentFile=%s\n", envFile)
-		}
+	return nil
+}
+
+// writeOverlayTarget writes overlay-<name>.target. Declared overlay
+// dependencies become Wants= + After= on the target: starting this overlay
+// pulls its dependencies in, and target units implicitly order After= their
+// own Wants=, so a dependency's services have started before this target
+// activates. For a blue/green overlay the target wants the live slot's
+// target instead of individual services, so dependents and boot keep
+// addressing the overlay by one name whichever slot is serving.
+func writeOverlayTarget(name string, dependsOn []string, slot string) error {
+	targetName := fmt.Sprintf("overlay-%s.target", name)
+	targetContent := fmt.Sprintf(`[Unit]
+Description=Overlay target for %s
+`, name)
+	for _, dep := range dependsOn {
+		targetContent += fmt.Sprintf("Wants=overlay-%s.target\nAfter=overlay-%s.target\n", dep, dep)
+	}
+	if slot != "" {
+		targetContent += fmt.Sprintf("Wants=%s\nAfter=%s\n", slotTargetName(name, slot), slotTargetName(name, slot))
+		// Services replaced in place were wanted through the .wants dir
+		os.RemoveAll(filepath.Join(unitDir, targetName+".wants"))
+	}
+
+	if err := os.WriteFile(filepath.Join(unitDir, targetName), []byte(targetContent), 0644); err != nil {
+		return fmt.Errorf("write target: %w", err)
+	}
+	return nil
+}
+
+// writeServiceUnit writes one overlay service unit, bound to partOf
+func writeServiceUnit(name, svcName, unitName, partOf string, svc ServiceDef, dependsOn []string) error {
+	after := "network.target"
+	if len(svc.After) > 0 {
+		after = strings.Join(svc.After, " ")
+	}
+	// Order each service after dependency targets too: a service's own
+	// start job is not ordered by its target's After=, only the target is.
+	for _, dep := range dependsOn {
+		after += fmt.Sprintf(" overlay-%s.target", dep)
+	}
+
+	restart := "on-failure"
+	if svc.Restart != "" {
+		restart = svc.Restart
+	}
+
+	svcType := "simple"
+	if svc.Type != "" {
+		svcType = svc.Type
+	}
 
-		content := fmt.Sprintf(`[Unit]
+	restartSec := 5
+	if svc.RestartSec > 0 {
+		restartSec = svc.RestartSec
+	}
+
+	var envLines string
+	for _, env := range svc.Environment {
+		envLines += fmt.Sprintf("Environment=%s\n", env)
+	}
+	for _, envFile := range svc.EnvironmentFile {
+		envLines += fmt.Sprintf("EnvironmentFile=%s\n", envFile)
+	}
+
+	content := fmt.Sprintf(`[Unit]
 Description=Overlay %s - %s
 After=%s
 PartOf=%s
 
 [Service]
-Type=simple
+Type=%s
 ExecStart=%s
 Restart=%s
 RestartSec=%d
-`, name, svcName, after, targetName, svc.Exec, restart, restartSec)
+`, name, svcName, after, partOf, svcType, svc.Exec, restart, restartSec)
 
-		if svc.TimeoutStopSec > 0 {
-			content += fmt.Sprintf("TimeoutStopSec=%d\n", svc.TimeoutStopSec)
-		}
-		if svc.DynamicUser {
-			content += "DynamicUser=true\n"
-		} else if svc.User != "" {
-			content += fmt.Sprintf("User=%s\n", svc.User)
-		}
-		if svc.Group != "" && !svc.DynamicUser {
-			content += fmt.Sprintf("Group=%s\n", svc.Group)
-		}
-		if svc.StateDirectory != "" {
-			content += fmt.Sprintf("StateDirectory=%s\n", svc.StateDirectory)
-		}
-		if svc.WorkingDirectory != "" {
-			content += fmt.Sprintf("WorkingDirectory=%s\n", svc.WorkingDirectory)
-		}
-		// Drain hook (q-9f7a3b5b): ExecStop runs the drain command while the
-		// service is still up; remaining processes are signalled only after
-		// it exits (bounded by TimeoutStopSec). The running unit file carries
-		// its own version's drain command, so replace and rollback both drain
-		// with the definition that matches the running binary.
-		if svc.Drain != "" {
-			content += fmt.Sprintf("ExecStop=%s\n", svc.Drain)
-		}
-		content += envLines
-
-		if err := os.WriteFile(filepath.Join(unitDir, unitName), []byte(content), 0644); err != nil {
-			return fmt.Errorf("write service %s: %w", unitName, err)
-		}
+	for _, pre := range svc.ExecStartPre {
+		content += fmt.Sprintf("ExecStartPre=%s\n", pre)
 	}
 
-	// Update target to want its services
-	if len(wantedByTarget) > 0 {
-		wantsDir := filepath.Join(unitDir, targetName+".wants")
-		os.MkdirAll(wantsDir, 0755)
-		for _, unit := range wantedByTarget {
-			os.Symlink(filepath.Join(unitDir, unit), filepath.Join(wantsDir, unit))
-		}
+	if svc.TimeoutStopSec > 0 {
+		content += fmt.Sprintf("TimeoutStopSec=%d\n", svc.TimeoutStopSec)
+	}
+	if svc.DynamicUser {
+		content += "DynamicUser=true\n"
+	} else if svc.User != "" {
+		content += fmt.Sprintf("User=%s\n", svc.User)
+	}
+	if svc.Group != "" && !svc.DynamicUser {
+		content += fmt.Sprintf("Group=%s\n", svc.Group)
+	}
+	if svc.StateDirectory != "" {
+		content += fmt.Sprintf("StateDirectory=%s\n", svc.StateDirectory)
+	}
+	if svc.WorkingDirectory != "" {
+		content += fmt.Sprintf("WorkingDirectory=%s\n", svc.WorkingDirectory)
+	}
+	// Drain hook (q-9f7a3b5b): ExecStop runs the drain command while the
+	// service is still up; remaining processes are signalled only after
+	// it exits (bounded by TimeoutStopSec). The running unit file carries
+	// its own version's drain command, so replace and rollback both drain
+	// with the definition that matches the running binary.
+	if svc.Drain != "" {
+		content += fmt.Sprintf("ExecStop=%s\n", svc.Drain)
 	}
+	content += envLines
+	// Secrets by reference only (secrets.go): the unit names the files,
+	// systemd reads them
+	for _, key := range sortedKeys(svc.Credentials) {
+		content += fmt.Sprintf("LoadCredential=%s:%s\n", key, svc.Credentials[key])
+	}
+	if svc.SecretEnvFile != "" {
+		content += fmt.Sprintf("EnvironmentFile=%s\n", svc.SecretEnvFile)
+	}
+	content += sandboxDirectives(svc)
 
+	if err := os.WriteFile(filepath.Join(unitDir, unitName), []byte(content), 0644); err != nil {
+		return fmt.Errorf("write service %s: %w", unitName, err)
+	}
 	return nil
 }
 
@@ -664,6 +1063,14 @@ func stopTarget(name string) {
 func stopServices(name string, manifest *OverlayManifest) {
 	for svcName := range manifest.Services {
 		units := []string{serviceUnitName(name, svcName)}
+		// The trigger first, so it cannot start the service again
+		if trigger := manifest.triggerUnitName(name, svcName); trigger != "" {
+			units = append([]string{trigger}, units...)
+		}
+		if unit := manifest.unitNameFor(name, svcName); unit != units[len(units)-1] {
+			// Per-connection instances of an accepting socket's template
+			units = append(units, strings.Replace(unit, "@.", "@*.", 1))
+		}
 		// Belt-and-braces: also stop the pre-flattening name in case a unit
 		// from an older manager version is still loaded.
 		if legacy := legacyServiceUnitName(name, svcName); legacy != units[0] {
@@ -684,68 +1091,6 @@ func startTarget(name string) error {
 	return exec.Command("systemctl", "start", fmt.Sprintf("overlay-%s.target", name)).Run()
 }
 
-func runHealthChecks(name string, health *HealthConfig) bool {
-	grace := time.Duration(health.Grace) * time.Second
-	interval := time.Duration(health.Interval) * time.Second
-	stabilize := time.Duration(health.Stabilize) * time.Second
-
-	log.Printf("[%s] health: waiting %s grace period", name, grace)
-	time.Sleep(grace)
-
-	consecutiveOK := time.Duration(0)
-	start := time.Now()
-	maxWait := stabilize + 60*time.Second // safety cap
-
-	for consecutiveOK < stabilize && time.Since(start) < maxWait {
-		ok := false
-		switch health.Type {
-		case "http":
-			ok = checkHTTP(health.Endpoint)
-		case "tcp":
-			ok = checkTCP(health.Endpoint)
-		case "exec":
-			ok = checkExec(health.Endpoint)
-		}
-
-		if ok {
-			consecutiveOK += interval
-		} else {
-			consecutiveOK = 0
-		}
-
-		if consecutiveOK < stabilize {
-			time.Sleep(interval)
-		}
-	}
-
-	return consecutiveOK >= stabilize
-}
-
-func checkHTTP(endpoint string) bool {
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Get(endpoint)
-	if err != nil {
-		return false
-	}
-	defer resp.Body.Close()
-	io.Copy(io.Discard, resp.Body)
-	return resp.StatusCode >= 200 && resp.StatusCode < 300
-}
-
-func checkTCP(endpoint string) bool {
-	conn, err := net.DialTimeout("tcp", endpoint, 5*time.Second)
-	if err != nil {
-		return false
-	}
-	conn.Close()
-	return true
-}
-
-func checkExec(command string) bool {
-	cmd := exec.Command("sh", "-c", command)
-	return cmd.Run() == nil
-}
-
 // ensureDataDirOwnership chowns the overlay's data directory tree to the
 // configured user:group. Prevents ownership drift when a deploy changes
 // the overlay's user/group (e.g. root → grotto) while files on disk retain
@@ -806,31 +1151,61 @@ func rollbackOverlay(cfg Config, name, failedPath, reason string) {
 		if failedPath != "" {
 			recordAttempt(stateDir, failedPath, "failed", reason+"; no previous version to roll back to")
 		}
-		writeState(stateDir, "failed")
+		transition(stateDir, "failed", failedPath, reason+"; no previous version to roll back to")
 		return
 	}
 
 	ov := cfg.Overlays[name]
 	log.Printf("[%s] rolling back to %s", name, previous.StorePath)
 
-	stopTarget(name)
-
-	manifest, err := evalOverlay(previous.StorePath, ov.Config)
+	// Evaluate before stopping anything: whether the previous version is
+	// blue/green decides whether the running one is stopped first at all.
+	manifest, err := evalOverlay(previous.StorePath, ov)
+	if err == nil {
+		err = provideSecrets(name, ov.Config, manifest)
+	}
 	if err != nil {
 		log.Printf("[%s] rollback eval failed: %v", name, err)
 		if failedPath != "" {
 			recordAttempt(stateDir, failedPath, "failed", fmt.Sprintf("%s; rollback eval failed: %v", reason, err))
 		}
-		writeState(stateDir, "failed")
+		transition(stateDir, "failed", failedPath, fmt.Sprintf("%s; rollback eval failed: %v", reason, err))
 		return
 	}
 
-	generateUnits(name, manifest, ov.DependsOn)
-	daemonReload()
-	startTarget(name)
+	live := ""
+	if current := loadCurrentState(cfg.StateDir, name); current != nil {
+		live = current.Slot
+	}
+	if manifest.blueGreen() {
+		// Units replaced in place (e.g. a failed in-place activation) hold
+		// the ports the slot is about to bind
+		stopWanted(name, fmt.Sprintf("overlay-%s.target", name))
+		slot := otherSlot(live)
+		if err := cutover(stateDir, name, previous.StorePath, ov, manifest, live, slot, false); err != nil {
+			log.Printf("[%s] rollback cutover failed: %v", name, err)
+			if failedPath != "" {
+				recordAttempt(stateDir, failedPath, "failed", fmt.Sprintf("%s; rollback cutover failed: %v", reason, err))
+			}
+			transition(stateDir, "failed", failedPath, fmt.Sprintf("%s; rollback cutover failed: %v", reason, err))
+			return
+		}
+		previous.Slot = slot
+	} else {
+		stopTarget(name)
+		if live != "" {
+			stopSlot(name, live)
+		}
+		previous.Slot = ""
+		generateUnits(name, manifest, ov.DependsOn)
+		daemonReload()
+		startTarget(name)
+	}
 	updateBinSymlinks(cfg.BinDir, manifest.Bins)
 
-	// Restore current to previous
+	// Restore current to previous. Its bake, if any, ended when it was
+	// replaced; a watch left on the rolled-back version would be stale.
+	clearBake(stateDir)
 	saveCurrentState(stateDir, *previous)
 	updateGCRoot(stateDir, "gc-root-current", previous.StorePath)
 	os.Remove(filepath.Join(stateDir, "previous.json"))
@@ -841,8 +1216,16 @@ func rollbackOverlay(cfg Config, name, failedPath, reason string) {
 	} else {
 		clearAttempt(stateDir)
 	}
-	writeState(stateDir, "rolled-back")
+	recordSecrets(stateDir, ov.Config, manifest, serviceUnits(name, manifest, previous.Slot))
+
+	// A rolled-back entry names the version now running
+	transition(stateDir, "rolled-back", previous.StorePath, reason)
+	retainVersions(cfg, stateDir)
 	log.Printf("[%s] rolled back to %s", name, previous.StorePath)
+	if err := syncExposure(cfg); err != nil {
+		log.Printf("[%s] expose: %v", name, err)
+	}
+	restartDependents(cfg, name)
 }
 
 func updateBinSymlinks(binDir string, bins []string) {
@@ -940,7 +1323,7 @@ func failActivation(stateDir, name, storePath, format string, args ...interface{
 	reason := fmt.Sprintf(format, args...)
 	log.Printf("[%s] %s", name, reason)
 	recordAttempt(stateDir, storePath, "failed", reason)
-	writeState(stateDir, "failed")
+	transition(stateDir, "failed", storePath, reason)
 }
 
 // recordAttempt persists the outcome of an activation that did not end
@@ -1018,12 +1401,7 @@ const maxRetryBackoff = 6 * time.Hour
 // instead of one every poll — while a transient failure still recovers on its
 // own without operator involvement.
 func backoffRemaining(attempt *AttemptRecord, pollInterval string) time.Duration {
-	base, err := time.ParseDuration(pollInterval)
-	if err != nil || base <= 0 {
-		base = 5 * time.Minute
-	}
-
-	delay := base
+	delay := pollDuration(pollInterval)
 	for i := 1; i < attempt.Attempts && delay < maxRetryBackoff; i++ {
 		delay *= 2
 	}
@@ -1038,6 +1416,22 @@ func backoffRemaining(attempt *AttemptRecord, pollInterval string) time.Duration
 	return delay - elapsed
 }
 
+// pollDuration parses Config.PollInterval, defaulting to five minutes
+func pollDuration(pollInterval string) time.Duration {
+	d, err := time.ParseDuration(pollInterval)
+	if err != nil || d <= 0 {
+		return 5 * time.Minute
+	}
+	return d
+}
+
+func channelSuffix(channel string) string {
+	if channel == "" {
+		return ""
+	}
+	return "@" + channel
+}
+
 func enabledStr(enabled bool) string {
 	if enabled {
 		return "enabled"
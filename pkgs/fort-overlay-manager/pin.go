@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Runtime holds and pins, one of them at a time in pin.json. A held or
+// pinned overlay stays where it is: check cycles leave it alone whatever the
+// registry offers (policy.go). `hold <name>` (or `pause`) stops updates
+// without naming a version, until `release` (or `resume`); `pin <name>
+// [--store-path <path>]` fixes the overlay to that version — the running
+// one when none is given — activating it first if it is not the one
+// running, until `unpin`. Each is lifted only by its own command, so a
+// release meant for someone's hold cannot drop someone else's pin.
+// Explicit activate and rollback still work on a held or pinned overlay. A
+// pin that belongs in the host config is pinnedStorePath instead.
+
+type Pin struct {
+	Hold      bool   `json:"hold,omitempty"`      // held: updates paused, no version fixed
+	StorePath string `json:"storePath,omitempty"` // pinned: the version to stay on
+	At        int64  `json:"at"`
+	By        string `json:"by,omitempty"` // the fort principal that set it, if remote
+}
+
+// held reports whether p is a hold rather than a pin; records written
+// before holds had their own state are pins without a store path
+func (p *Pin) held() bool {
+	return p.Hold || p.StorePath == ""
+}
+
+func (p *Pin) String() string {
+	s := "held"
+	if !p.held() {
+		s = "pinned to " + p.StorePath
+	}
+	if p.By != "" {
+		s += " by " + p.By
+	}
+	return s
+}
+
+func pinPath(stateDir string) string {
+	return filepath.Join(stateDir, "pin.json")
+}
+
+func loadPin(stateDir string) *Pin {
+	data, err := os.ReadFile(pinPath(stateDir))
+	if err != nil {
+		return nil
+	}
+	var pin Pin
+	if err := json.Unmarshal(data, &pin); err != nil {
+		return nil
+	}
+	return &pin
+}
+
+func writePin(stateDir string, pin Pin) error {
+	data, _ := json.MarshalIndent(pin, "", "  ")
+	os.MkdirAll(stateDir, 0755)
+	return os.WriteFile(pinPath(stateDir), data, 0644)
+}
+
+func cmdPin(cfg Config, name, storePath, by string) error {
+	if _, ok := cfg.Overlays[name]; !ok {
+		return fmt.Errorf("[%s] not in config", name)
+	}
+	stateDir := filepath.Join(cfg.StateDir, name)
+	current := loadCurrentState(cfg.StateDir, name)
+	if storePath == "" {
+		if current == nil {
+			return fmt.Errorf("[%s] nothing running to pin; give --store-path, or hold it", name)
+		}
+		storePath = current.StorePath
+	}
+	pin := Pin{StorePath: storePath, At: time.Now().Unix(), By: by}
+	if err := writePin(stateDir, pin); err != nil {
+		return err
+	}
+	log.Printf("[%s] %s", name, &pin)
+
+	if current == nil || current.StorePath != storePath {
+		cmdActivate(cfg, name, storePath)
+	}
+	return nil
+}
+
+func cmdUnpin(cfg Config, name string) error {
+	return liftPin(cfg, name, false)
+}
+
+func cmdHold(cfg Config, name, by string) error {
+	if _, ok := cfg.Overlays[name]; !ok {
+		return fmt.Errorf("[%s] not in config", name)
+	}
+	stateDir := filepath.Join(cfg.StateDir, name)
+	if pin := loadPin(stateDir); pin != nil && !pin.held() {
+		return fmt.Errorf("[%s] already %s; unpin it first", name, pin)
+	}
+	hold := Pin{Hold: true, At: time.Now().Unix(), By: by}
+	if err := writePin(stateDir, hold); err != nil {
+		return err
+	}
+	log.Printf("[%s] %s", name, &hold)
+	return nil
+}
+
+func cmdRelease(cfg Config, name string) error {
+	return liftPin(cfg, name, true)
+}
+
+// liftPin removes a hold (hold true) or a pin, refusing to lift the other
+func liftPin(cfg Config, name string, hold bool) error {
+	if _, ok := cfg.Overlays[name]; !ok {
+		return fmt.Errorf("[%s] not in config", name)
+	}
+	stateDir := filepath.Join(cfg.StateDir, name)
+	pin := loadPin(stateDir)
+	switch {
+	case pin != nil && pin.held() && !hold:
+		return fmt.Errorf("[%s] %s, not pinned; release it instead", name, pin)
+	case pin != nil && !pin.held() && hold:
+		return fmt.Errorf("[%s] %s, not held; unpin it instead", name, pin)
+	}
+	if err := os.Remove(pinPath(stateDir)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if hold {
+		log.Printf("[%s] released", name)
+	} else {
+		log.Printf("[%s] unpinned", name)
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Update policy. A check cycle applies an available version only when
+// nothing holds the overlay back:
+//
+//   - pinnedStorePath in the host config replaces the registry's version as
+//     the one to run
+//   - a runtime hold or pin (pin.go) keeps the overlay where it is
+//   - a failed or rolled-back dependency, or a dependency cycle (deps.go)
+//   - updateWindows, if set, confine automatic changes to those times
+//   - a version that failed recently waits out its backoff
+//
+// Whatever held an available version back is recorded in pending.json and
+// shown by status until the overlay is up to date. Explicit activate,
+// rollback and pin commands are not subject to the policy.
+//
+// An update window is "[DAYS ]HH:MM-HH:MM" in local time, e.g. "02:00-05:00"
+// or "Sat,Sun 00:00-06:00" or "Mon-Fri 22:00-02:00". DAYS is a comma list of
+// days or day ranges (Mon..Sun); a window that ends before it starts runs
+// past midnight and belongs to the day it opens on.
+//
+// A window can also be a five-field cron expression, "MIN HOUR DOM MONTH
+// DOW", open during every minute it matches: "* 2-4 * * *" is 02:00-05:00,
+// "* 2-4 1-7 * Sun" the first Sunday of the month (cron's rule: with both
+// DOM and DOW restricted, either may match). Fields take *, numbers, names
+// (jan, sun), ranges, lists and /steps.
+
+// PendingUpdate is an available version a check cycle did not apply
+type PendingUpdate struct {
+	StorePath string `json:"storePath"`
+	Reason    string `json:"reason"`
+	Since     int64  `json:"since"`
+}
+
+func recordPending(stateDir, storePath, reason string) {
+	pending := PendingUpdate{StorePath: storePath, Reason: reason, Since: time.Now().Unix()}
+	if prev := loadPending(stateDir); prev != nil && prev.StorePath == storePath {
+		pending.Since = prev.Since
+	}
+	data, _ := json.MarshalIndent(pending, "", "  ")
+	os.MkdirAll(stateDir, 0755)
+	os.WriteFile(filepath.Join(stateDir, "pending.json"), data, 0644)
+}
+
+func clearPending(stateDir string) {
+	os.Remove(filepath.Join(stateDir, "pending.json"))
+}
+
+func loadPending(stateDir string) *PendingUpdate {
+	data, err := os.ReadFile(filepath.Join(stateDir, "pending.json"))
+	if err != nil {
+		return nil
+	}
+	var pending PendingUpdate
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return nil
+	}
+	return &pending
+}
+
+// updateBlocked returns why target may not be applied to overlay name now,
+// or "" if it may
+func updateBlocked(cfg Config, name string, ov OverlayConfig, target string, now time.Time) string {
+	if pin := loadPin(filepath.Join(cfg.StateDir, name)); pin != nil {
+		return pin.String()
+	}
+	if reason := dependencyBlocked(cfg, name); reason != "" {
+		return reason
+	}
+	if len(ov.UpdateWindows) > 0 {
+		open, next, err := inUpdateWindow(ov.UpdateWindows, now)
+		if err != nil {
+			return fmt.Sprintf("invalid update window: %v", err)
+		}
+		if !open {
+			switch {
+			case next.IsZero():
+				return "outside update window (none opens within a year)"
+			case next.Sub(now) > 6*24*time.Hour:
+				return fmt.Sprintf("outside update window (next opens %s)", next.Format("Mon Jan 2 15:04"))
+			}
+			return fmt.Sprintf("outside update window (next opens %s)", next.Format("Mon 15:04"))
+		}
+	}
+	if attempt := loadAttempt(cfg.StateDir, name); attempt != nil && attempt.StorePath == target {
+		if wait := backoffRemaining(attempt, cfg.PollInterval); wait > 0 {
+			return fmt.Sprintf("in backoff: %s after %d attempt(s) (%s); next retry in %s",
+				attempt.State, attempt.Attempts, attempt.Reason, wait.Round(time.Second))
+		}
+	}
+	return ""
+}
+
+// updateWindow is one parsed window: the days it opens on and its span in
+// minutes since midnight
+type updateWindow struct {
+	days       [7]bool // by time.Weekday
+	start, end int
+	cron       *cronWindow // instead of the above, for a cron expression
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseUpdateWindow(spec string) (updateWindow, error) {
+	var w updateWindow
+	fields := strings.Fields(spec)
+	var span string
+	switch len(fields) {
+	case 1:
+		span = fields[0]
+		for d := range w.days {
+			w.days[d] = true
+		}
+	case 5:
+		cron, err := parseCronWindow(fields)
+		if err != nil {
+			return w, fmt.Errorf("%q: %v", spec, err)
+		}
+		w.cron = cron
+		return w, nil
+	case 2:
+		span = fields[1]
+		for _, part := range strings.Split(fields[0], ",") {
+			from, to, isRange := strings.Cut(part, "-")
+			first, ok := weekdays[strings.ToLower(from)]
+			if !ok {
+				return w, fmt.Errorf("%q: unknown day %q", spec, from)
+			}
+			last := first
+			if isRange {
+				if last, ok = weekdays[strings.ToLower(to)]; !ok {
+					return w, fmt.Errorf("%q: unknown day %q", spec, to)
+				}
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	default:
+		return w, fmt.Errorf("%q: want [DAYS ]HH:MM-HH:MM or MIN HOUR DOM MONTH DOW", spec)
+	}
+
+	from, to, ok := strings.Cut(span, "-")
+	if !ok {
+		return w, fmt.Errorf("%q: want [DAYS ]HH:MM-HH:MM", spec)
+	}
+	var err error
+	if w.start, err = parseClock(from); err != nil {
+		return w, fmt.Errorf("%q: %v", spec, err)
+	}
+	if w.end, err = parseClock(to); err != nil {
+		return w, fmt.Errorf("%q: %v", spec, err)
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("%q: window is empty", spec)
+	}
+	return w, nil
+}
+
+// parseClock reads HH:MM as minutes since midnight
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hour, herr := strconv.Atoi(h)
+	minute, merr := strconv.Atoi(m)
+	if !ok || herr != nil || merr != nil || hour < 0 || hour > 24 || minute < 0 || minute > 59 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// contains reports whether the window is open at t
+func (w updateWindow) contains(t time.Time) bool {
+	if w.cron != nil {
+		return w.cron.matches(t)
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.days[t.Weekday()] && minute >= w.start && minute < w.end
+	}
+	// Past midnight: open from start on a listed day, or until end on the
+	// day after one
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.days[t.Weekday()] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+// inUpdateWindow reports whether any window is open at now and, if none is,
+// when the next one opens
+func inUpdateWindow(specs []string, now time.Time) (bool, time.Time, error) {
+	windows := make([]updateWindow, 0, len(specs))
+	for _, spec := range specs {
+		w, err := parseUpdateWindow(spec)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+		windows = append(windows, w)
+	}
+	open := func(t time.Time) bool {
+		for _, w := range windows {
+			if w.contains(t) {
+				return true
+			}
+		}
+		return false
+	}
+	if open(now) {
+		return true, now, nil
+	}
+	// A year covers every cron window but a Feb 29th one
+	t := now.Truncate(time.Minute)
+	for i := 0; i < 366*24*60; i++ {
+		t = t.Add(time.Minute)
+		if open(t) {
+			return false, t, nil
+		}
+	}
+	return false, time.Time{}, nil
+}
+
+// cronWindow is a parsed cron expression; each field a bitmask of the
+// values it matches
+type cronWindow struct {
+	minutes, hours, doms, months, dows uint64
+	domAny, dowAny                     bool
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+func parseCronWindow(fields []string) (*cronWindow, error) {
+	dayNames := make(map[string]int, len(weekdays))
+	for name, d := range weekdays {
+		dayNames[name] = int(d)
+	}
+	var c cronWindow
+	var err error
+	if c.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if c.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if c.doms, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if c.months, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	if c.dows, err = parseCronField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	if c.dows&(1<<7) != 0 { // 7 is Sunday too
+		c.dows |= 1
+	}
+	c.domAny, c.dowAny = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+	return &c, nil
+}
+
+// parseCronField reads a comma list of *, N or N-M, each with an optional
+// /STEP, into a bitmask of values in [lo, hi]
+func parseCronField(field string, lo, hi int, names map[string]int) (uint64, error) {
+	value := func(s string) (int, error) {
+		if n, ok := names[strings.ToLower(s)]; ok {
+			return n, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < lo || n > hi {
+			return 0, fmt.Errorf("invalid value %q", s)
+		}
+		return n, nil
+	}
+	var mask uint64
+	for _, part := range strings.Split(field, ",") {
+		span, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+		first, last := lo, hi
+		if span != "*" {
+			from, to, isRange := strings.Cut(span, "-")
+			var err error
+			if first, err = value(from); err != nil {
+				return 0, err
+			}
+			last = first
+			if isRange {
+				if last, err = value(to); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				last = hi
+			}
+			if last < first {
+				return 0, fmt.Errorf("range %q runs backwards", span)
+			}
+		}
+		for v := first; v <= last; v += step {
+			mask |= 1 << v
+		}
+	}
+	return mask, nil
+}
+
+// matches reports whether t falls in a minute the expression names
+func (c *cronWindow) matches(t time.Time) bool {
+	if c.minutes&(1<<t.Minute()) == 0 || c.hours&(1<<t.Hour()) == 0 || c.months&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	dom, dow := c.doms&(1<<t.Day()) != 0, c.dows&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpdateWindows(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("Mon 2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	cases := []struct {
+		windows []string
+		now     string
+		open    bool
+		next    string
+	}{
+		{[]string{"02:00-05:00"}, "Tue 2026-10-20 03:30", true, ""},
+		{[]string{"02:00-05:00"}, "Tue 2026-10-20 05:00", false, "Wed 2026-10-21 02:00"},
+		{[]string{"Sat,Sun 00:00-06:00"}, "Fri 2026-10-23 01:00", false, "Sat 2026-10-24 00:00"},
+		{[]string{"Mon-Fri 22:00-02:00"}, "Sat 2026-10-24 01:00", true, ""}, // Friday's window
+		{[]string{"Mon-Fri 22:00-02:00"}, "Sun 2026-10-25 01:00", false, "Mon 2026-10-26 22:00"},
+		{[]string{"Fri-Mon 12:00-13:00"}, "Sun 2026-10-25 12:30", true, ""},
+		{[]string{"Sat 02:00-03:00", "Wed 02:00-03:00"}, "Mon 2026-10-19 12:00", false, "Wed 2026-10-21 02:00"},
+		// cron expressions: open during every minute they match
+		{[]string{"* 2-4 * * *"}, "Tue 2026-10-20 04:59", true, ""},
+		{[]string{"* 2-4 * * *"}, "Tue 2026-10-20 05:00", false, "Wed 2026-10-21 02:00"},
+		{[]string{"*/15 22,23 * * sat,7"}, "Sat 2026-10-24 22:31", false, "Sat 2026-10-24 22:45"},
+		{[]string{"0-29 3 * * 1-5"}, "Fri 2026-10-23 03:30", false, "Mon 2026-10-26 03:00"},
+		{[]string{"* 2-4 1-7 * Sun"}, "Mon 2026-10-19 12:00", false, "Sun 2026-10-25 02:00"}, // either day field matches
+		{[]string{"* 2-4 1 * *"}, "Mon 2026-10-19 12:00", false, "Sun 2026-11-01 02:00"},
+		{[]string{"* 2 * dec *", "Sat 02:00-03:00"}, "Mon 2026-10-19 12:00", false, "Sat 2026-10-24 02:00"},
+	}
+	for _, tc := range cases {
+		open, next, err := inUpdateWindow(tc.windows, at(tc.now))
+		if err != nil {
+			t.Fatalf("%v: %v", tc.windows, err)
+		}
+		if open != tc.open {
+			t.Errorf("%v at %s: open = %v", tc.windows, tc.now, open)
+		}
+		if !open && !next.Equal(at(tc.next)) {
+			t.Errorf("%v at %s: next = %s, want %s", tc.windows, tc.now, next, tc.next)
+		}
+	}
+
+	for _, bad := range []string{"", "2-5", "Funday 02:00-03:00", "25:00-26:00", "02:00-02:00", "Mon Tue 01:00-02:00",
+		"* 24 * * *", "* * 0 * *", "* 5-2 * * *", "*/0 * * * *", "* * * foo *", "* * * *"} {
+		if _, err := parseUpdateWindow(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestUpdateBlockedReasons(t *testing.T) {
+	cfg := Config{StateDir: t.TempDir(), PollInterval: "5m", Overlays: map[string]OverlayConfig{"coffer": {}}}
+	stateDir := filepath.Join(cfg.StateDir, "coffer")
+	monday := time.Date(2026, 10, 19, 12, 0, 0, 0, time.Local)
+
+	if reason := updateBlocked(cfg, "coffer", OverlayConfig{}, "/nix/store/bbb-coffer", monday); reason != "" {
+		t.Errorf("nothing set: blocked by %q", reason)
+	}
+
+	ov := OverlayConfig{UpdateWindows: []string{"02:00-05:00"}}
+	if reason := updateBlocked(cfg, "coffer", ov, "/nix/store/bbb-coffer", monday); !strings.HasPrefix(reason, "outside update window (next opens Tue 02:00)") {
+		t.Errorf("window: %q", reason)
+	}
+	monthly := OverlayConfig{UpdateWindows: []string{"* 2-4 1 * *"}}
+	if reason := updateBlocked(cfg, "coffer", monthly, "/nix/store/bbb-coffer", monday); reason != "outside update window (next opens Sun Nov 1 02:00)" {
+		t.Errorf("monthly window: %q", reason)
+	}
+	if reason := updateBlocked(cfg, "coffer", OverlayConfig{UpdateWindows: []string{"lunchtime"}}, "/nix/store/bbb-coffer", monday); !strings.HasPrefix(reason, "invalid update window") {
+		t.Errorf("bad window: %q", reason)
+	}
+
+	recordAttempt(stateDir, "/nix/store/bbb-coffer", "failed", "health checks failed")
+	if reason := updateBlocked(cfg, "coffer", OverlayConfig{}, "/nix/store/bbb-coffer", monday); !strings.HasPrefix(reason, "in backoff: failed after 1 attempt(s)") {
+		t.Errorf("backoff: %q", reason)
+	}
+
+	cmdHold(cfg, "coffer", "")
+	if reason := updateBlocked(cfg, "coffer", ov, "/nix/store/bbb-coffer", monday); reason != "held" {
+		t.Errorf("hold: %q, want it to win", reason)
+	}
+}
+
+func TestPendingKeepsItsStartTime(t *testing.T) {
+	dir := t.TempDir()
+	old := PendingUpdate{StorePath: "/nix/store/bbb-coffer", Reason: "held", Since: 1000}
+	data, _ := json.Marshal(old)
+	os.WriteFile(filepath.Join(dir, "pending.json"), data, 0644)
+
+	recordPending(dir, "/nix/store/bbb-coffer", "outside update window")
+	if got := loadPending(dir); got.Since != 1000 || got.Reason != "outside update window" {
+		t.Errorf("same version: pending = %+v", got)
+	}
+	recordPending(dir, "/nix/store/ccc-coffer", "held")
+	if got := loadPending(dir); got.StorePath != "/nix/store/ccc-coffer" || got.Since == 1000 {
+		t.Errorf("new version: pending = %+v", got)
+	}
+	clearPending(dir)
+	if loadPending(dir) != nil {
+		t.Error("pending not cleared")
+	}
+}
+
+func TestHoldAndPinAreLiftedByTheirOwnCommand(t *testing.T) {
+	cfg := Config{StateDir: t.TempDir(), Overlays: map[string]OverlayConfig{"coffer": {Package: "infra/coffer"}}}
+	stateDir := filepath.Join(cfg.StateDir, "coffer")
+	os.MkdirAll(stateDir, 0755)
+
+	if err := cmdPin(cfg, "coffer", "", ""); err == nil {
+		t.Error("pinned with nothing running and no store path")
+	}
+	saveCurrentState(stateDir, OverlayState{StorePath: "/nix/store/aaa-coffer"})
+
+	if err := cmdHold(cfg, "coffer", "ci"); err != nil {
+		t.Fatal(err)
+	}
+	if pin := loadPin(stateDir); pin == nil || !pin.Hold || pin.String() != "held by ci" {
+		t.Errorf("hold = %+v", pin)
+	}
+	if err := cmdUnpin(cfg, "coffer"); err == nil || loadPin(stateDir) == nil {
+		t.Errorf("unpin lifted a hold: err = %v", err)
+	}
+	if err := cmdRelease(cfg, "coffer"); err != nil || loadPin(stateDir) != nil {
+		t.Errorf("release: err = %v", err)
+	}
+
+	if err := cmdPin(cfg, "coffer", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if pin := loadPin(stateDir); pin == nil || pin.Hold || pin.String() != "pinned to /nix/store/aaa-coffer" {
+		t.Errorf("pin = %+v, want the running version", pin)
+	}
+	if err := cmdHold(cfg, "coffer", ""); err == nil {
+		t.Error("a hold replaced a pin")
+	}
+	if err := cmdRelease(cfg, "coffer"); err == nil || loadPin(stateDir) == nil {
+		t.Errorf("release lifted a pin: err = %v", err)
+	}
+
+	// A record written before holds had their own state is a hold
+	os.WriteFile(pinPath(stateDir), []byte(`{"at": 1000, "by": "ci"}`), 0644)
+	if err := cmdRelease(cfg, "coffer"); err != nil {
+		t.Errorf("release of a legacy hold: %v", err)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Closure prefetch. A new version's store closure is downloaded before the
+// activation state machine starts, so a slow cache leaves the overlay in its
+// running state rather than stuck in "fetching", and evaluation never sees a
+// partial closure. The daemon starts a fetch in the background as soon as a
+// check cycle sees a new version — held or outside its update window too, so
+// it is ready when the window opens — at most fetch.concurrency at a time,
+// and checks the overlay again when it lands. Without a daemon, and for an
+// explicit activate or validate, the fetch runs inline.
+//
+// With a cache public key configured, the version's store path must carry a
+// signature by that key in the cache before anything is downloaded. That
+// check covers the top path only, and deliberately: the rest of the closure
+// is mostly upstream paths (cache.nixos.org) the cache never holds, so a
+// --recursive verify against it would fail every version. Nix itself checks
+// each path it substitutes against its trusted-public-keys (require-sigs),
+// which include this key, so no unsigned path enters the closure either
+// way; the top-path check adds that this exact version was published
+// through this cache. A cacheConfFile that is configured but missing,
+// unreadable or without a key fails the fetch rather than turning the check
+// off. Paths already in the store (built here, or fetched before) are not
+// checked again.
+//
+// Progress is kept in <stateDir>/<name>/fetch.json and shown by status.
+
+// FetchConfig configures closure prefetch
+type FetchConfig struct {
+	Concurrency   int    `json:"concurrency"`   // closures fetched at once by the daemon; 0 for the default
+	DownloadSpeed int    `json:"downloadSpeed"` // KiB/s per download (nix download-speed); 0 for no limit
+	PublicKey     string `json:"publicKey"`     // cache key ("name:base64") new versions must be signed with
+	Substituter   string `json:"substituter"`   // cache the signature is checked in
+	// nix.conf fragment to read the key and substituter from when they are
+	// not set (the attic-cache.conf written by gitops)
+	CacheConfFile string `json:"cacheConfFile"`
+}
+
+const defaultFetchConcurrency = 2
+
+// FetchState is the progress of the latest closure fetch for an overlay
+type FetchState struct {
+	StorePath    string `json:"storePath"`
+	State        string `json:"state"` // queued, fetching, ready, failed
+	Paths        int    `json:"paths"` // store paths to download
+	Fetched      int    `json:"fetched"`
+	DownloadSize int64  `json:"downloadSize"` // bytes, as the cache reports them
+	ClosureSize  int64  `json:"closureSize"`  // bytes, once ready
+	Error        string `json:"error,omitempty"`
+	StartedAt    int64  `json:"startedAt"`
+	UpdatedAt    int64  `json:"updatedAt"`
+}
+
+func (f *FetchState) String() string {
+	switch f.State {
+	case "queued":
+		return fmt.Sprintf("fetch of %s queued", f.StorePath)
+	case "fetching":
+		if f.Paths == 0 {
+			return fmt.Sprintf("fetching %s", f.StorePath)
+		}
+		return fmt.Sprintf("fetching %s: %d/%d paths of %s", f.StorePath, f.Fetched, f.Paths, humanBytes(f.DownloadSize))
+	case "failed":
+		return fmt.Sprintf("fetch of %s failed: %s", f.StorePath, f.Error)
+	}
+	return fmt.Sprintf("fetched %s (closure %s)", f.StorePath, humanBytes(f.ClosureSize))
+}
+
+func saveFetch(stateDir string, f FetchState) {
+	f.UpdatedAt = time.Now().Unix()
+	data, _ := json.MarshalIndent(f, "", "  ")
+	os.MkdirAll(stateDir, 0755)
+	tmp := filepath.Join(stateDir, "fetch.json.tmp")
+	if err := os.WriteFile(tmp, data, 0644); err == nil {
+		os.Rename(tmp, filepath.Join(stateDir, "fetch.json"))
+	}
+}
+
+func loadFetch(stateDir string) *FetchState {
+	data, err := os.ReadFile(filepath.Join(stateDir, "fetch.json"))
+	if err != nil {
+		return nil
+	}
+	var f FetchState
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil
+	}
+	return &f
+}
+
+// storePathValid reports whether a store path is registered in the store;
+// nix keeps a valid path's references valid, so its whole closure is
+// present. Overridden in tests.
+var storePathValid = func(storePath string) bool {
+	return exec.Command("nix-store", "--check-validity", storePath).Run() == nil
+}
+
+// fetchPlan is what realising a store path would download
+type fetchPlan struct {
+	Paths        []string // substituted from a cache
+	Missing      []string // to be built, or unknown: not fetchable
+	DownloadSize int64
+}
+
+// planFetch asks nix what realising storePath would do; overridden in tests
+var planFetch = func(storePath string) (*fetchPlan, error) {
+	out, err := exec.Command("nix-store", "--realise", "--dry-run", storePath).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("nix-store --realise --dry-run: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return parseFetchPlan(string(out)), nil
+}
+
+var fetchedHeader = regexp.MustCompile(`will be fetched \(([\d.]+) (\w+) download`)
+
+// parseFetchPlan reads nix's dry-run report: headers ("these 3 paths will be
+// fetched (1.20 MiB download, 4.80 MiB unpacked):", "this derivation will be
+// built:", "don't know how to build these paths:") each followed by
+// indented store paths
+func parseFetchPlan(out string) *fetchPlan {
+	plan := &fetchPlan{}
+	var list *[]string
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if path := strings.TrimSpace(line); strings.HasPrefix(path, "/nix/store/") && line != path {
+			if list != nil {
+				*list = append(*list, path)
+			}
+			continue
+		}
+		list = nil
+		if m := fetchedHeader.FindStringSubmatch(line); m != nil {
+			plan.DownloadSize = parseSize(m[1], m[2])
+			list = &plan.Paths
+		} else if strings.HasSuffix(strings.TrimSpace(line), ":") {
+			list = &plan.Missing
+		}
+	}
+	return plan
+}
+
+var sizeUnits = map[string]float64{"B": 1, "KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30, "TiB": 1 << 40}
+
+func parseSize(value, unit string) int64 {
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || sizeUnits[unit] == 0 {
+		return 0
+	}
+	return int64(n * sizeUnits[unit])
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, i := float64(n)/unit, 0
+	for value >= unit && i < 3 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", value, []string{"KiB", "MiB", "GiB", "TiB"}[i])
+}
+
+// invalidPaths returns the paths not yet in the store; overridden in tests
+var invalidPaths = func(paths []string) []string {
+	out, _ := exec.Command("nix-store", append([]string{"--check-validity", "--print-invalid"}, paths...)...).Output()
+	return strings.Fields(string(out))
+}
+
+// realiseClosure downloads storePath's closure; overridden in tests
+var realiseClosure = func(storePath string, fc FetchConfig) error {
+	args := []string{"--realise", storePath}
+	if fc.DownloadSpeed > 0 {
+		args = append(args, "--option", "download-speed", strconv.Itoa(fc.DownloadSpeed))
+	}
+	cmd := exec.Command("nix-store", args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// verifyCacheSignature checks that the cache holds storePath signed by key;
+// overridden in tests
+var verifyCacheSignature = func(storePath, key, substituter string) error {
+	out, err := exec.Command("nix", "--option", "trusted-public-keys", key,
+		"store", "verify", "--store", substituter, "--no-contents", "--sigs-needed", "1", storePath,
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("not signed by %s in %s: %s", keyName(key), substituter, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// closureSize is the size of storePath's closure in bytes; overridden in
+// tests
+var closureSize = func(storePath string) (int64, error) {
+	out, err := exec.Command("nix", "path-info", "--closure-size", storePath).Output()
+	if err != nil {
+		return 0, fmt.Errorf("nix path-info: %w", err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("nix path-info: unexpected output %q", out)
+	}
+	return strconv.ParseInt(fields[len(fields)-1], 10, 64)
+}
+
+func keyName(key string) string {
+	name, _, _ := strings.Cut(key, ":")
+	return name
+}
+
+// cacheSource is the key new versions must be signed with and the cache to
+// check that in: set explicitly, or read from the cache nix.conf fragment.
+// With neither set verification is off; a fragment that is configured but
+// cannot be read, or names no key, is an error so the check fails closed.
+func cacheSource(fc FetchConfig) (key, substituter string, err error) {
+	key, substituter = fc.PublicKey, fc.Substituter
+	if fc.CacheConfFile == "" || (key != "" && substituter != "") {
+		return key, substituter, nil
+	}
+	data, err := os.ReadFile(fc.CacheConfFile)
+	if err != nil {
+		return "", "", fmt.Errorf("cache config: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		setting, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		first := ""
+		if values := strings.Fields(value); len(values) > 0 {
+			first = values[0]
+		}
+		switch strings.TrimSpace(setting) {
+		case "extra-trusted-public-keys", "trusted-public-keys":
+			if key == "" {
+				key = first
+			}
+		case "extra-substituters", "substituters":
+			if substituter == "" {
+				substituter = first
+			}
+		}
+	}
+	if key == "" {
+		return "", "", fmt.Errorf("cache config %s names no trusted public key", fc.CacheConfFile)
+	}
+	return key, substituter, nil
+}
+
+// fetchProgressInterval is how often a running fetch updates fetch.json
+var fetchProgressInterval = 5 * time.Second
+
+// fetchClosure makes storePath's closure present, recording progress for
+// overlay name
+func fetchClosure(cfg Config, name, storePath string) error {
+	stateDir := filepath.Join(cfg.StateDir, name)
+	if storePathValid(storePath) {
+		return nil
+	}
+
+	f := FetchState{StorePath: storePath, State: "fetching", StartedAt: time.Now().Unix()}
+	saveFetch(stateDir, f)
+	fail := func(err error) error {
+		f.State, f.Error = "failed", err.Error()
+		saveFetch(stateDir, f)
+		log.Printf("[%s] fetch of %s failed: %v", name, storePath, err)
+		return err
+	}
+
+	// Before anything is downloaded
+	key, substituter, err := cacheSource(cfg.Fetch)
+	if err != nil {
+		return fail(err)
+	}
+	if key != "" {
+		if substituter == "" {
+			return fail(fmt.Errorf("no cache to check the signature by %s in", keyName(key)))
+		}
+		if err := verifyCacheSignature(storePath, key, substituter); err != nil {
+			return fail(err)
+		}
+	}
+
+	plan, err := planFetch(storePath)
+	if err != nil {
+		return fail(err)
+	}
+	if len(plan.Missing) > 0 {
+		return fail(fmt.Errorf("%d paths are in no cache: %s", len(plan.Missing), strings.Join(plan.Missing, " ")))
+	}
+	f.Paths, f.DownloadSize = len(plan.Paths), plan.DownloadSize
+	saveFetch(stateDir, f)
+	log.Printf("[%s] fetching %s: %d paths, %s", name, storePath, f.Paths, humanBytes(f.DownloadSize))
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func(f FetchState) {
+		defer wg.Done()
+		ticker := time.NewTicker(fetchProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				f.Fetched = f.Paths - len(invalidPaths(plan.Paths))
+				saveFetch(stateDir, f)
+			}
+		}
+	}(f)
+	err = realiseClosure(storePath, cfg.Fetch)
+	close(done)
+	wg.Wait()
+	if err != nil {
+		return fail(err)
+	}
+
+	f.State, f.Fetched = "ready", f.Paths
+	if f.ClosureSize, err = closureSize(storePath); err != nil {
+		log.Printf("[%s] %v", name, err)
+	}
+	saveFetch(stateDir, f)
+	log.Printf("[%s] fetched %s (closure %s)", name, storePath, humanBytes(f.ClosureSize))
+	return nil
+}
+
+// prefetcher runs the daemon's background fetches
+type prefetcher struct {
+	cfg   Config
+	slots chan struct{}
+	ready func(name string) // called once a closure is present
+
+	mu     sync.Mutex
+	active map[string]bool // name + "\x00" + store path, queued or fetching
+}
+
+// backgroundFetch is the daemon's prefetcher; nil fetches inline
+var backgroundFetch *prefetcher
+
+func newPrefetcher(cfg Config, ready func(name string)) *prefetcher {
+	n := cfg.Fetch.Concurrency
+	if n <= 0 {
+		n = defaultFetchConcurrency
+	}
+	return &prefetcher{cfg: cfg, slots: make(chan struct{}, n), ready: ready, active: map[string]bool{}}
+}
+
+// start fetches storePath for overlay name unless that is already under
+// way, or failed less than a poll interval ago
+func (p *prefetcher) start(name, storePath string) {
+	stateDir := filepath.Join(p.cfg.StateDir, name)
+	if f := loadFetch(stateDir); f != nil && f.StorePath == storePath && f.State == "failed" &&
+		time.Since(time.Unix(f.UpdatedAt, 0)) < pollDuration(p.cfg.PollInterval) {
+		return
+	}
+	key := name + "\x00" + storePath
+	p.mu.Lock()
+	if p.active[key] {
+		p.mu.Unlock()
+		return
+	}
+	p.active[key] = true
+	p.mu.Unlock()
+
+	saveFetch(stateDir, FetchState{StorePath: storePath, State: "queued", StartedAt: time.Now().Unix()})
+	go func() {
+		p.slots <- struct{}{}
+		err := fetchClosure(p.cfg, name, storePath)
+		<-p.slots
+		p.mu.Lock()
+		delete(p.active, key)
+		p.mu.Unlock()
+		if err == nil {
+			p.ready(name)
+		}
+	}()
+}
+
+// closureReady reports whether target's closure is present, and otherwise
+// why the check cycle has to wait for it. The daemon fetches in the
+// background; without one the fetch runs here.
+func closureReady(cfg Config, name, target string) (bool, string) {
+	if storePathValid(target) {
+		return true, ""
+	}
+	if backgroundFetch == nil {
+		if err := fetchClosure(cfg, name, target); err != nil {
+			return false, fmt.Sprintf("fetch failed: %v", err)
+		}
+		return true, ""
+	}
+	backgroundFetch.start(name, target)
+	if f := loadFetch(filepath.Join(cfg.StateDir, name)); f != nil && f.StorePath == target && f.State == "failed" {
+		return false, "fetch failed: " + f.Error
+	}
+	return false, "closure not fetched yet"
+}
+
+// clearFetch forgets a fetch of anything but storePath, once the overlay
+// runs storePath
+func clearFetch(stateDir, storePath string) {
+	if f := loadFetch(stateDir); f != nil && f.StorePath != storePath {
+		os.Remove(filepath.Join(stateDir, "fetch.json"))
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseFetchPlan(t *testing.T) {
+	out := `these 2 paths will be fetched (1.50 MiB download, 6.00 MiB unpacked):
+  /nix/store/aaa-coffer
+  /nix/store/bbb-libfoo
+this derivation will be built:
+  /nix/store/ccc-thing.drv
+`
+	plan := parseFetchPlan(out)
+	if want := []string{"/nix/store/aaa-coffer", "/nix/store/bbb-libfoo"}; !reflect.DeepEqual(plan.Paths, want) {
+		t.Errorf("paths = %q", plan.Paths)
+	}
+	if want := []string{"/nix/store/ccc-thing.drv"}; !reflect.DeepEqual(plan.Missing, want) {
+		t.Errorf("missing = %q", plan.Missing)
+	}
+	if plan.DownloadSize != 1536*1024 {
+		t.Errorf("download size = %d", plan.DownloadSize)
+	}
+
+	plan = parseFetchPlan("this path will be fetched (0.02 KiB download, 0.10 KiB unpacked):\n  /nix/store/aaa-coffer\n")
+	if len(plan.Paths) != 1 || len(plan.Missing) != 0 || plan.DownloadSize != 20 {
+		t.Errorf("single path plan = %+v", plan)
+	}
+}
+
+func TestCacheSource(t *testing.T) {
+	conf := filepath.Join(t.TempDir(), "attic-cache.conf")
+	os.WriteFile(conf, []byte("extra-substituters = https://cache.fort.example/fort\nextra-trusted-public-keys = fort:AAAA\n"), 0644)
+
+	key, substituter, err := cacheSource(FetchConfig{CacheConfFile: conf})
+	if err != nil || key != "fort:AAAA" || substituter != "https://cache.fort.example/fort" {
+		t.Errorf("from conf: %q %q %v", key, substituter, err)
+	}
+	key, substituter, err = cacheSource(FetchConfig{PublicKey: "other:BBBB", CacheConfFile: conf})
+	if err != nil || key != "other:BBBB" || substituter != "https://cache.fort.example/fort" {
+		t.Errorf("explicit key: %q %q %v", key, substituter, err)
+	}
+	if key, _, err := cacheSource(FetchConfig{}); err != nil || key != "" {
+		t.Errorf("nothing configured: %q %v", key, err)
+	}
+
+	// A configured fragment that gives no key fails closed
+	keyless := filepath.Join(t.TempDir(), "attic-cache.conf")
+	os.WriteFile(keyless, []byte("extra-substituters = https://cache.fort.example/fort\n"), 0644)
+	for _, path := range []string{filepath.Join(t.TempDir(), "missing"), keyless} {
+		if key, _, err := cacheSource(FetchConfig{CacheConfFile: path}); err == nil {
+			t.Errorf("%s: key %q, want an error", path, key)
+		}
+	}
+}
+
+func TestFetchClosureRefusesWithoutACacheKey(t *testing.T) {
+	store := &fakeStore{valid: map[string]bool{}, plan: &fetchPlan{Paths: []string{"/nix/store/aaa-coffer"}}, signed: true}
+	store.install(t)
+	cfg := Config{StateDir: t.TempDir(), Fetch: FetchConfig{CacheConfFile: filepath.Join(t.TempDir(), "attic-cache.conf")}}
+
+	if err := fetchClosure(cfg, "coffer", "/nix/store/aaa-coffer"); err == nil {
+		t.Fatal("fetched with the cache config missing")
+	}
+	if len(store.realised) != 0 {
+		t.Errorf("realised %q", store.realised)
+	}
+	if f := loadFetch(filepath.Join(cfg.StateDir, "coffer")); f == nil || f.State != "failed" || !strings.Contains(f.Error, "cache config") {
+		t.Errorf("fetch state = %+v", f)
+	}
+}
+
+// fakeStore stands in for nix: paths become valid when realised
+type fakeStore struct {
+	mu        sync.Mutex
+	valid     map[string]bool
+	plan      *fetchPlan
+	signed    bool
+	realised  []string
+	realising chan struct{} // when set, realise waits for it
+}
+
+func (s *fakeStore) install(t *testing.T) {
+	saved := []interface{}{storePathValid, planFetch, invalidPaths, realiseClosure, verifyCacheSignature, closureSize}
+	t.Cleanup(func() {
+		storePathValid = saved[0].(func(string) bool)
+		planFetch = saved[1].(func(string) (*fetchPlan, error))
+		invalidPaths = saved[2].(func([]string) []string)
+		realiseClosure = saved[3].(func(string, FetchConfig) error)
+		verifyCacheSignature = saved[4].(func(string, string, string) error)
+		closureSize = saved[5].(func(string) (int64, error))
+	})
+	storePathValid = func(path string) bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.valid[path]
+	}
+	planFetch = func(string) (*fetchPlan, error) { return s.plan, nil }
+	invalidPaths = func(paths []string) []string { return paths }
+	realiseClosure = func(path string, _ FetchConfig) error {
+		if s.realising != nil {
+			<-s.realising
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.realised = append(s.realised, path)
+		s.valid[path] = true
+		return nil
+	}
+	verifyCacheSignature = func(string, string, string) error {
+		if !s.signed {
+			return errors.New("not signed by fort")
+		}
+		return nil
+	}
+	closureSize = func(string) (int64, error) { return 42 << 20, nil }
+}
+
+func TestFetchClosure(t *testing.T) {
+	store := &fakeStore{valid: map[string]bool{}, plan: &fetchPlan{Paths: []string{"/nix/store/aaa-coffer"}, DownloadSize: 1 << 20}}
+	store.install(t)
+	cfg := Config{StateDir: t.TempDir(), Fetch: FetchConfig{PublicKey: "fort:AAAA", Substituter: "https://cache.fort.example/fort"}}
+	stateDir := filepath.Join(cfg.StateDir, "coffer")
+
+	// An unsigned path is never downloaded
+	if err := fetchClosure(cfg, "coffer", "/nix/store/aaa-coffer"); err == nil {
+		t.Fatal("unsigned path fetched")
+	}
+	if f := loadFetch(stateDir); f == nil || f.State != "failed" || !strings.Contains(f.Error, "not signed") {
+		t.Errorf("fetch state = %+v", f)
+	}
+	if len(store.realised) != 0 {
+		t.Errorf("realised %q", store.realised)
+	}
+
+	store.signed = true
+	if err := fetchClosure(cfg, "coffer", "/nix/store/aaa-coffer"); err != nil {
+		t.Fatal(err)
+	}
+	f := loadFetch(stateDir)
+	if f.State != "ready" || f.Paths != 1 || f.Fetched != 1 || f.ClosureSize != 42<<20 {
+		t.Errorf("fetch state = %+v", f)
+	}
+	if got := f.String(); got != "fetched /nix/store/aaa-coffer (closure 42.0 MiB)" {
+		t.Errorf("String() = %q", got)
+	}
+
+	// Present already: nothing to do
+	if err := fetchClosure(cfg, "coffer", "/nix/store/aaa-coffer"); err != nil || len(store.realised) != 1 {
+		t.Errorf("refetched: err %v, realised %q", err, store.realised)
+	}
+
+	// Something to build is not something the manager can fetch
+	store.plan = &fetchPlan{Missing: []string{"/nix/store/bbb-coffer"}}
+	if err := fetchClosure(cfg, "coffer", "/nix/store/bbb-coffer"); err == nil || !strings.Contains(err.Error(), "in no cache") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestClosureReadyInline(t *testing.T) {
+	store := &fakeStore{valid: map[string]bool{}, plan: &fetchPlan{Paths: []string{"/nix/store/aaa-coffer"}}, signed: true}
+	store.install(t)
+	cfg := Config{StateDir: t.TempDir()}
+
+	if ready, reason := closureReady(cfg, "coffer", "/nix/store/aaa-coffer"); !ready || reason != "" {
+		t.Errorf("inline fetch: %v %q", ready, reason)
+	}
+}
+
+func TestPrefetcher(t *testing.T) {
+	store := &fakeStore{valid: map[string]bool{}, plan: &fetchPlan{Paths: []string{"/nix/store/aaa-coffer"}}, signed: true, realising: make(chan struct{})}
+	store.install(t)
+	cfg := Config{StateDir: t.TempDir(), Fetch: FetchConfig{Concurrency: 1}}
+
+	readied := make(chan string, 2)
+	saved := backgroundFetch
+	defer func() { backgroundFetch = saved }()
+	backgroundFetch = newPrefetcher(cfg, func(name string) { readied <- name })
+
+	ready, reason := closureReady(cfg, "coffer", "/nix/store/aaa-coffer")
+	if ready || reason != "closure not fetched yet" {
+		t.Errorf("first check: %v %q", ready, reason)
+	}
+	// Seen again while under way: not started twice
+	closureReady(cfg, "coffer", "/nix/store/aaa-coffer")
+	closureReady(cfg, "joker", "/nix/store/aaa-joker")
+	// One slot: whichever got it first, the other waits
+	states := func() string {
+		var s []string
+		for _, name := range []string{"coffer", "joker"} {
+			s = append(s, loadFetch(filepath.Join(cfg.StateDir, name)).State)
+		}
+		sort.Strings(s)
+		return strings.Join(s, " ")
+	}
+	for deadline := time.Now().Add(5 * time.Second); states() != "fetching queued"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("fetch states %q, want one fetching and one queued", states())
+		}
+	}
+
+	close(store.realising)
+	got := map[string]bool{}
+	for range 2 {
+		select {
+		case name := <-readied:
+			got[name] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("fetch never finished")
+		}
+	}
+	if !got["coffer"] || !got["joker"] || len(store.realised) != 2 {
+		t.Errorf("readied %v, realised %q", got, store.realised)
+	}
+	if ready, _ := closureReady(cfg, "coffer", "/nix/store/aaa-coffer"); !ready {
+		t.Error("not ready after the fetch")
+	}
+}
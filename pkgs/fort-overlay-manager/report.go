@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status reports feed the registry's staged rollouts (apps/overlay-registry
+// rollout.go): after each check cycle, activation or rollback the manager
+// POSTs its `status --json` to /_report/<host>. The request is signed with
+// the host's SSH key the way fort-provider signs peer calls, in its own
+// namespace, and the registry checks it against /etc/fort/hosts.json.
+// Reporting is best-effort: a registry that cannot be reached only holds a
+// rollout back.
+const reportNamespace = "fort-overlay-report"
+
+const hostKeyPath = "/etc/ssh/ssh_host_ed25519_key"
+
+// StatusEntry is one overlay in `status` output and in status reports
+type StatusEntry struct {
+	Name        string         `json:"name"`
+	Package     string         `json:"package"`
+	Channel     string         `json:"channel,omitempty"`
+	State       string         `json:"state"`
+	Current     *OverlayState  `json:"current"`
+	Previous    *OverlayState  `json:"previous"`
+	LastAttempt *AttemptRecord `json:"lastAttempt"`
+	Bake        *BakeState     `json:"bake,omitempty"`
+	Enabled     bool           `json:"enabled"`
+	Pin         *Pin           `json:"pin,omitempty"`
+	Pending     *PendingUpdate `json:"pending,omitempty"` // an available version not applied, and why (policy.go)
+	Fetch       *FetchState    `json:"fetch,omitempty"`   // the latest closure fetch (prefetch.go)
+
+	DependencyError string `json:"dependencyError,omitempty"` // a dependsOn cycle or unknown dependency (deps.go)
+}
+
+func statusEntries(cfg Config) []StatusEntry {
+	var entries []StatusEntry
+	for _, name := range orderedOverlays(cfg.Overlays) {
+		ov := cfg.Overlays[name]
+		stateDir := filepath.Join(cfg.StateDir, name)
+		entries = append(entries, StatusEntry{
+			Name:        name,
+			Package:     ov.Package,
+			Channel:     ov.Channel,
+			State:       readState(stateDir),
+			Current:     loadCurrentState(cfg.StateDir, name),
+			Previous:    loadPreviousState(cfg.StateDir, name),
+			LastAttempt: loadAttempt(cfg.StateDir, name),
+			Bake:        loadBake(stateDir),
+			Enabled:     ov.Enabled,
+			Pin:         loadPin(stateDir),
+			Pending:     loadPending(stateDir),
+			Fetch:       loadFetch(stateDir),
+
+			DependencyError: dependencyError(cfg, name),
+		})
+	}
+	return entries
+}
+
+// hostName is the name the cluster knows this host by — in hosts.json, in
+// rollout waves, in fetch logs: the config's, written from
+// networking.hostName, or else the kernel's without any domain, as
+// fort-provider derives its origin
+func hostName(cfg Config) (string, error) {
+	if cfg.Hostname != "" {
+		return cfg.Hostname, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("hostname: %w", err)
+	}
+	host, _, _ := strings.Cut(hostname, ".")
+	if host == "" {
+		return "", errors.New("hostname: empty")
+	}
+	return host, nil
+}
+
+// reportStatus sends this host's status to the registry
+func reportStatus(cfg Config) {
+	if cfg.RegistryUrl == "" {
+		return
+	}
+	host, err := hostName(cfg)
+	if err != nil {
+		log.Printf("status report: %v", err)
+		return
+	}
+	if err := postReport(strings.TrimSuffix(cfg.RegistryUrl, "/"), host, hostKeyPath, statusEntries(cfg)); err != nil {
+		log.Printf("status report failed: %v", err)
+	}
+}
+
+func postReport(registryUrl, host, keyPath string, entries []StatusEntry) error {
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	path := "/_report/" + host
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature, err := signReport(keyPath, "POST", path, timestamp, body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", registryUrl+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Fort-Origin", host)
+	req.Header.Set("X-Fort-Timestamp", timestamp)
+	req.Header.Set("X-Fort-Signature", signature)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// canonicalReport is fort-provider's canonical request string:
+// METHOD\nPATH\nTIMESTAMP\nSHA256(body)
+func canonicalReport(method, path, timestamp string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return fmt.Sprintf("%s\n%s\n%s\n%s", method, path, timestamp, hex.EncodeToString(sum[:]))
+}
+
+// signReport signs a report with the host key, armor stripped
+func signReport(keyPath, method, path, timestamp string, body []byte) (string, error) {
+	cmd := exec.Command("ssh-keygen", "-Y", "sign", "-f", keyPath, "-n", reportNamespace, "-q")
+	cmd.Stdin = strings.NewReader(canonicalReport(method, path, timestamp, body))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("ssh-keygen sign: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var b64 strings.Builder
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "-----") {
+			continue
+		}
+		b64.WriteString(strings.TrimSpace(line))
+	}
+	return b64.String(), nil
+}
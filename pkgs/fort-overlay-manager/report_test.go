@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// A report must verify the way the registry checks it: host key, report
+// namespace, fort-provider canonical request over the exact body sent.
+func TestPostReportIsSignedByHost(t *testing.T) {
+	keyPath, pubkey := publisherKey(t)
+	entries := []StatusEntry{{
+		Name:    "coffer",
+		Package: "infra/coffer",
+		State:   "permanent",
+		Current: &OverlayState{StorePath: "/nix/store/aaa-coffer"},
+		Enabled: true,
+	}}
+
+	var got []StatusEntry
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if req.URL.Path != "/_report/ratched" || req.Header.Get("X-Fort-Origin") != "ratched" {
+			t.Errorf("report sent to %s as %q", req.URL.Path, req.Header.Get("X-Fort-Origin"))
+		}
+		message := canonicalReport(req.Method, req.URL.Path, req.Header.Get("X-Fort-Timestamp"), body)
+		if err := verifySignature(message, reportNamespace, req.Header.Get("X-Fort-Signature"), "ratched", pubkey); err != nil {
+			t.Errorf("report signature: %v", err)
+		}
+		// Signed in its own namespace: not a valid registry entry signature
+		if err := verifySignature(message, registrySignatureNamespace, req.Header.Get("X-Fort-Signature"), "ratched", pubkey); err == nil {
+			t.Error("report signature verifies in the entry namespace")
+		}
+		json.Unmarshal(body, &got)
+	}))
+	defer srv.Close()
+
+	if err := postReport(srv.URL, "ratched", keyPath, entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Current == nil || got[0].Current.StorePath != "/nix/store/aaa-coffer" {
+		t.Errorf("registry received %+v", got)
+	}
+}
+
+func TestHostName(t *testing.T) {
+	if host, err := hostName(Config{Hostname: "joker"}); err != nil || host != "joker" {
+		t.Errorf("from config: %q %v", host, err)
+	}
+	kernel, err := os.Hostname()
+	if err != nil {
+		t.Skipf("no kernel hostname: %v", err)
+	}
+	want, _, _ := strings.Cut(kernel, ".")
+	if host, err := hostName(Config{}); err != nil || host != want || strings.Contains(host, ".") {
+		t.Errorf("from the kernel (%q): %q %v", kernel, host, err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// Overlay services run code fetched at runtime, so every unit gets a
+// sandbox unless the manifest opts out with sandbox = "none", or the host
+// does for the whole overlay (overlays.<name>.sandbox = "none" in the host
+// manifest) — the way out for an overlay that predates the profile and
+// writes outside its state directory or runs setuid helpers. Activating a
+// service onto the profile without its manifest asking for it is logged,
+// with that way out. The default
+// profile is what an ordinary network daemon tolerates: no privilege
+// escalation, a private /tmp, /usr, /boot and /etc read-only, no kernel
+// tunables or modules. Explicit fields override their default (privateTmp =
+// false; protectSystem = "strict" with readWritePaths); resource limits and
+// the capability bounding set are only emitted when set.
+//
+// Manifests are validated in VALIDATING, before any unit is written:
+// systemd would otherwise log and ignore a bad directive and run the service
+// less confined than declared, and a value with a newline in it could inject
+// directives of its own.
+
+const sandboxNone = "none"
+
+var (
+	validServiceTypes = map[string]bool{"simple": true, "exec": true, "notify": true, "oneshot": true}
+	validRestarts     = map[string]bool{"no": true, "on-success": true, "on-failure": true, "on-abnormal": true, "on-watchdog": true, "on-abort": true, "always": true}
+	validProtectSys   = map[string]bool{"true": true, "false": true, "full": true, "strict": true}
+
+	capabilityRe = regexp.MustCompile(`^~?CAP_[A-Z_]+$`)
+	memoryRe     = regexp.MustCompile(`^(infinity|[0-9]+[KMGT]?|[0-9]+%)$`)
+	cpuQuotaRe   = regexp.MustCompile(`^[0-9]+%$`)
+	tasksMaxRe   = regexp.MustCompile(`^(infinity|[0-9]+%?)$`)
+)
+
+// applySandboxOptOut drops the default profile from every service of an
+// overlay its host opted out; fields the manifest sets explicitly still
+// apply
+func applySandboxOptOut(ov OverlayConfig, manifest *OverlayManifest) {
+	if ov.Sandbox != sandboxNone {
+		return
+	}
+	for svcName, svc := range manifest.Services {
+		svc.Sandbox = sandboxNone
+		manifest.Services[svcName] = svc
+	}
+}
+
+// noteDefaultSandbox logs the services about to run under the default
+// profile only because their manifest names none
+func noteDefaultSandbox(name string, manifest *OverlayManifest) {
+	var implicit []string
+	for _, svcName := range sortedKeys(manifest.Services) {
+		if manifest.Services[svcName].Sandbox == "" {
+			implicit = append(implicit, svcName)
+		}
+	}
+	if len(implicit) > 0 {
+		log.Printf("[%s] default sandbox profile applied to %s (manifest sets no sandbox); overlays.%s.sandbox = \"none\" in the host manifest opts out",
+			name, strings.Join(implicit, ", "), name)
+	}
+}
+
+// validateServices checks every service of a manifest
+func validateServices(services map[string]ServiceDef) error {
+	for _, name := range sortedKeys(services) {
+		if err := validateService(services[name]); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func validateService(svc ServiceDef) error {
+	if strings.TrimSpace(svc.Exec) == "" {
+		return errors.New("exec is empty")
+	}
+	if err := noNewlines(svc); err != nil {
+		return err
+	}
+	if svc.Type != "" && !validServiceTypes[svc.Type] {
+		return fmt.Errorf("unsupported type %q", svc.Type)
+	}
+	if svc.Restart != "" && !validRestarts[svc.Restart] {
+		return fmt.Errorf("invalid restart %q", svc.Restart)
+	}
+	if svc.Type == "oneshot" && (svc.Restart == "always" || svc.Restart == "on-success") {
+		return fmt.Errorf("restart %q is not allowed for a oneshot service", svc.Restart)
+	}
+	for _, pre := range svc.ExecStartPre {
+		if strings.HasPrefix(pre, "+") || strings.HasPrefix(pre, "!") {
+			return fmt.Errorf("execStartPre %q would run outside the sandbox", pre)
+		}
+		if strings.TrimSpace(strings.TrimPrefix(pre, "-")) == "" {
+			return errors.New("execStartPre entry is empty")
+		}
+	}
+
+	if svc.Sandbox != "" && svc.Sandbox != "default" && svc.Sandbox != sandboxNone {
+		return fmt.Errorf("unknown sandbox profile %q", svc.Sandbox)
+	}
+	if svc.ProtectSystem != "" && !validProtectSys[svc.ProtectSystem] {
+		return fmt.Errorf("invalid protectSystem %q", svc.ProtectSystem)
+	}
+	for _, path := range svc.ReadWritePaths {
+		if !strings.HasPrefix(strings.TrimPrefix(path, "-"), "/") {
+			return fmt.Errorf("readWritePaths entry %q is not absolute", path)
+		}
+	}
+	for _, cap := range svc.CapabilityBoundingSet {
+		if !capabilityRe.MatchString(cap) {
+			return fmt.Errorf("invalid capability %q", cap)
+		}
+	}
+	if svc.MemoryMax != "" && !memoryRe.MatchString(svc.MemoryMax) {
+		return fmt.Errorf("invalid memoryMax %q", svc.MemoryMax)
+	}
+	if svc.CPUQuota != "" && !cpuQuotaRe.MatchString(svc.CPUQuota) {
+		return fmt.Errorf("invalid cpuQuota %q", svc.CPUQuota)
+	}
+	if svc.TasksMax != "" && !tasksMaxRe.MatchString(svc.TasksMax) {
+		return fmt.Errorf("invalid tasksMax %q", svc.TasksMax)
+	}
+	if svc.LimitNOFILE < 0 {
+		return fmt.Errorf("invalid limitNOFILE %d", svc.LimitNOFILE)
+	}
+	return nil
+}
+
+// noNewlines rejects any value that would break out of its unit file line
+func noNewlines(svc ServiceDef) error {
+	values := []string{svc.Exec, svc.User, svc.Group, svc.StateDirectory, svc.WorkingDirectory, svc.Drain,
+		svc.ProtectSystem, svc.MemoryMax, svc.CPUQuota, svc.TasksMax}
+	for _, list := range [][]string{svc.After, svc.Environment, svc.EnvironmentFile, svc.ExecStartPre, svc.ReadWritePaths, svc.CapabilityBoundingSet} {
+		values = append(values, list...)
+	}
+	for _, v := range values {
+		if strings.ContainsAny(v, "\n\r") {
+			return fmt.Errorf("value %q contains a newline", v)
+		}
+	}
+	return nil
+}
+
+// sandboxDirectives renders a service's sandbox and resource settings
+func sandboxDirectives(svc ServiceDef) string {
+	var b strings.Builder
+	set := func(key, value string) {
+		fmt.Fprintf(&b, "%s=%s\n", key, value)
+	}
+	boolean := func(key string, value *bool, def bool) {
+		switch {
+		case value != nil:
+			set(key, fmt.Sprint(*value))
+		case svc.Sandbox != sandboxNone:
+			set(key, fmt.Sprint(def))
+		}
+	}
+
+	boolean("NoNewPrivileges", svc.NoNewPrivileges, true)
+	boolean("PrivateTmp", svc.PrivateTmp, true)
+	if svc.ProtectSystem != "" {
+		set("ProtectSystem", svc.ProtectSystem)
+	} else if svc.Sandbox != sandboxNone {
+		set("ProtectSystem", "full")
+	}
+	if svc.Sandbox != sandboxNone {
+		set("ProtectKernelTunables", "true")
+		set("ProtectKernelModules", "true")
+		set("ProtectControlGroups", "true")
+		set("RestrictSUIDSGID", "true")
+		set("LockPersonality", "true")
+	}
+	if len(svc.ReadWritePaths) > 0 {
+		set("ReadWritePaths", strings.Join(svc.ReadWritePaths, " "))
+	}
+	if len(svc.CapabilityBoundingSet) > 0 {
+		set("CapabilityBoundingSet", strings.Join(svc.CapabilityBoundingSet, " "))
+	}
+
+	if svc.MemoryMax != "" {
+		set("MemoryMax", svc.MemoryMax)
+	}
+	if svc.CPUQuota != "" {
+		set("CPUQuota", svc.CPUQuota)
+	}
+	if svc.TasksMax != "" {
+		set("TasksMax", svc.TasksMax)
+	}
+	if svc.LimitNOFILE > 0 {
+		set("LimitNOFILE", fmt.Sprint(svc.LimitNOFILE))
+	}
+	return b.String()
+}
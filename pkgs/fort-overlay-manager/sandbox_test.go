@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateService(t *testing.T) {
+	exec := "/nix/store/aaa-coffer/bin/cofferd"
+	no := false
+	cases := []struct {
+		name    string
+		svc     ServiceDef
+		wantErr bool
+	}{
+		{"minimal", ServiceDef{Exec: exec}, false},
+		{"full", ServiceDef{
+			Exec: exec, Type: "notify", ExecStartPre: []string{"-" + exec + " migrate"},
+			ProtectSystem: "strict", ReadWritePaths: []string{"/var/lib/coffer", "-/run/coffer"},
+			PrivateTmp: &no, CapabilityBoundingSet: []string{"CAP_NET_BIND_SERVICE"},
+			MemoryMax: "512M", CPUQuota: "150%", TasksMax: "64", LimitNOFILE: 65536,
+		}, false},
+		{"oneshot", ServiceDef{Exec: exec, Type: "oneshot", Restart: "no"}, false},
+		{"empty exec", ServiceDef{Exec: " "}, true},
+		{"forking", ServiceDef{Exec: exec, Type: "forking"}, true},
+		{"oneshot always", ServiceDef{Exec: exec, Type: "oneshot", Restart: "always"}, true},
+		{"bad restart", ServiceDef{Exec: exec, Restart: "sometimes"}, true},
+		{"privileged pre", ServiceDef{Exec: exec, ExecStartPre: []string{"+/bin/chown x /etc"}}, true},
+		{"unknown profile", ServiceDef{Exec: exec, Sandbox: "lax"}, true},
+		{"bad protectSystem", ServiceDef{Exec: exec, ProtectSystem: "yes please"}, true},
+		{"relative rw path", ServiceDef{Exec: exec, ReadWritePaths: []string{"var/lib"}}, true},
+		{"bad capability", ServiceDef{Exec: exec, CapabilityBoundingSet: []string{"NET_ADMIN"}}, true},
+		{"bad memory", ServiceDef{Exec: exec, MemoryMax: "lots"}, true},
+		{"bad quota", ServiceDef{Exec: exec, CPUQuota: "1.5"}, true},
+		{"bad tasks", ServiceDef{Exec: exec, TasksMax: "-1"}, true},
+		{"directive injection", ServiceDef{Exec: exec, Environment: []string{"A=1\nExecStartPre=+/bin/sh"}}, true},
+	}
+	for _, tc := range cases {
+		if err := validateService(tc.svc); (err != nil) != tc.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestValidateServicesNamesTheService(t *testing.T) {
+	err := validateServices(map[string]ServiceDef{
+		"api":    {Exec: "/bin/api"},
+		"worker": {Exec: "/bin/worker", MemoryMax: "lots"},
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), "worker:") {
+		t.Errorf("err = %v, want it to name worker", err)
+	}
+}
+
+func TestSandboxDirectives(t *testing.T) {
+	def := sandboxDirectives(ServiceDef{Exec: "/bin/x"})
+	for _, want := range []string{"NoNewPrivileges=true\n", "PrivateTmp=true\n", "ProtectSystem=full\n", "ProtectKernelModules=true\n"} {
+		if !strings.Contains(def, want) {
+			t.Errorf("default profile missing %q:\n%s", want, def)
+		}
+	}
+	if strings.Contains(def, "MemoryMax") || strings.Contains(def, "CapabilityBoundingSet") {
+		t.Errorf("unset limits emitted:\n%s", def)
+	}
+
+	no := false
+	override := sandboxDirectives(ServiceDef{Exec: "/bin/x", PrivateTmp: &no, ProtectSystem: "strict", ReadWritePaths: []string{"/var/lib/x"}, MemoryMax: "1G"})
+	for _, want := range []string{"PrivateTmp=false\n", "ProtectSystem=strict\n", "ReadWritePaths=/var/lib/x\n", "MemoryMax=1G\n"} {
+		if !strings.Contains(override, want) {
+			t.Errorf("overrides missing %q:\n%s", want, override)
+		}
+	}
+
+	// Opting out keeps only what is set explicitly
+	none := sandboxDirectives(ServiceDef{Exec: "/bin/x", Sandbox: sandboxNone, TasksMax: "32"})
+	if none != "TasksMax=32\n" {
+		t.Errorf("sandbox none = %q", none)
+	}
+}
+
+func TestHostSandboxOptOut(t *testing.T) {
+	manifest := &OverlayManifest{Services: map[string]ServiceDef{
+		"web":    {Exec: "/bin/web"},
+		"worker": {Exec: "/bin/worker", MemoryMax: "1G"},
+	}}
+	applySandboxOptOut(OverlayConfig{}, manifest)
+	if manifest.Services["web"].Sandbox != "" {
+		t.Error("opt-out applied without the host asking for it")
+	}
+
+	applySandboxOptOut(OverlayConfig{Sandbox: sandboxNone}, manifest)
+	if got := sandboxDirectives(manifest.Services["web"]); got != "" {
+		t.Errorf("opted-out service still sandboxed:\n%s", got)
+	}
+	if got := sandboxDirectives(manifest.Services["worker"]); got != "MemoryMax=1G\n" {
+		t.Errorf("explicit limit lost: %q", got)
+	}
+}
+
+func TestWriteServiceUnitTypeAndPreStart(t *testing.T) {
+	unitDir = t.TempDir()
+	defer func() { unitDir = "/run/systemd/system" }()
+
+	svc := ServiceDef{Exec: "/bin/x", Type: "notify", ExecStartPre: []string{"/bin/x migrate"}}
+	if err := writeServiceUnit("coffer", "api", "overlay-coffer-api.service", "overlay-coffer.target", svc, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(unitDir, "overlay-coffer-api.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Type=notify\n", "ExecStartPre=/bin/x migrate\n", "NoNewPrivileges=true\n"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("unit missing %q:\n%s", want, data)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Secrets. A config value %SECRET:<name>% names a file in the secrets
+// directory (sops-decrypted, /run/secrets); an absolute path is accepted too.
+// The value itself never reaches nix eval, a command line or a unit file:
+// overlay.nix sees the config key as the secret file's path, as it always
+// has, which works anywhere — bins, generated config files, scripts — for a
+// reader allowed to open it. A service that cannot (a DynamicUser, or one
+// kept out of /run/secrets by its sandbox) reads the secret as a systemd
+// credential instead: it gets LoadCredential=<key>:<file> for each secret it
+// references as %d/<key> or $CREDENTIALS_DIRECTORY/<key> in its exec,
+// execStartPre or environment, or lists in credentials — and no others. A
+// service that needs one in its environment lists it in secretEnvironment
+// (ENV_VAR -> config key); the manager writes those to a 0600
+// EnvironmentFile under /run/overlays/secrets.
+//
+// Rotation: `fort-overlay-manager secrets` (run by sops-nix when a secret
+// changes, and on every check cycle) hashes each overlay's secret files and,
+// when the hash moved, rewrites the environment files and restarts the
+// services — credentials are re-read on start — without re-evaluating or
+// regenerating anything.
+
+const secretPrefix = "%SECRET:"
+
+var (
+	secretsDir   = "/run/secrets"
+	secretEnvDir = "/run/overlays/secrets"
+
+	credentialKeyRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	envVarRe        = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// secretRefs maps each secret config key to the file holding its value
+func secretRefs(config map[string]string) map[string]string {
+	refs := map[string]string{}
+	for k, v := range config {
+		if !strings.HasPrefix(v, secretPrefix) || !strings.HasSuffix(v, "%") || len(v) <= len(secretPrefix)+1 {
+			continue
+		}
+		ref := v[len(secretPrefix) : len(v)-1]
+		if !filepath.IsAbs(ref) {
+			ref = filepath.Join(secretsDir, ref)
+		}
+		refs[k] = ref
+	}
+	return refs
+}
+
+// evalConfig is config as overlay.nix sees it: secrets replaced by the path
+// of the file holding them
+func evalConfig(config map[string]string) map[string]string {
+	refs := secretRefs(config)
+	out := make(map[string]string, len(config))
+	for k, v := range config {
+		if path, ok := refs[k]; ok {
+			v = path
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// serviceCredentials picks the secrets a service loads as credentials: those
+// it names in credentials or refers to by credential path
+func serviceCredentials(svc ServiceDef, refs map[string]string) (map[string]string, error) {
+	creds := map[string]string{}
+	for _, key := range svc.CredentialKeys {
+		path, ok := refs[key]
+		if !ok {
+			return nil, fmt.Errorf("credentials refers to %q, which is not a secret", key)
+		}
+		creds[key] = path
+	}
+	text := strings.Join(append(append([]string{svc.Exec}, svc.ExecStartPre...), svc.Environment...), "\n")
+	for key, path := range refs {
+		if credentialRefRe(key).MatchString(text) {
+			creds[key] = path
+		}
+	}
+	return creds, nil
+}
+
+// credentialRefRe matches a reference to the credential key: %d/<key>, or
+// <key> under $CREDENTIALS_DIRECTORY
+func credentialRefRe(key string) *regexp.Regexp {
+	return regexp.MustCompile(`(%d|\$CREDENTIALS_DIRECTORY|\$\{CREDENTIALS_DIRECTORY\})/` + regexp.QuoteMeta(key) + `([^A-Za-z0-9_.-]|$)`)
+}
+
+// readSecret returns a secret's value without its trailing newline
+func readSecret(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// secretEnvFile is where a service's secretEnvironment is written
+func secretEnvFile(name, svcName string) string {
+	return filepath.Join(secretEnvDir, fmt.Sprintf("%s-%s.env", name, svcName))
+}
+
+// provideSecrets checks the overlay's secrets are readable, attaches them to
+// the services that read them as credentials, and writes the services'
+// environment files
+func provideSecrets(name string, config map[string]string, manifest *OverlayManifest) error {
+	refs := secretRefs(config)
+	for key, path := range refs {
+		if !credentialKeyRe.MatchString(key) {
+			return fmt.Errorf("secret key %q cannot be a credential name", key)
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("secret %s: %w", key, err)
+		}
+	}
+
+	for svcName, svc := range manifest.Services {
+		creds, err := serviceCredentials(svc, refs)
+		if err != nil {
+			return fmt.Errorf("%s: %w", svcName, err)
+		}
+		svc.Credentials = creds
+		svc.SecretEnvFile = ""
+		if len(svc.SecretEnvironment) > 0 {
+			for envVar, key := range svc.SecretEnvironment {
+				if !envVarRe.MatchString(envVar) {
+					return fmt.Errorf("%s: invalid environment variable %q", svcName, envVar)
+				}
+				if _, ok := refs[key]; !ok {
+					return fmt.Errorf("%s: secretEnvironment %s refers to %q, which is not a secret", svcName, envVar, key)
+				}
+			}
+			svc.SecretEnvFile = secretEnvFile(name, svcName)
+			if err := writeSecretEnv(svc.SecretEnvFile, svc.SecretEnvironment, refs); err != nil {
+				return err
+			}
+		}
+		manifest.Services[svcName] = svc
+	}
+	return nil
+}
+
+// writeSecretEnv writes an EnvironmentFile, 0600 from the start
+func writeSecretEnv(path string, env map[string]string, refs map[string]string) error {
+	var b strings.Builder
+	for _, envVar := range sortedKeys(env) {
+		value, err := readSecret(refs[env[envVar]])
+		if err != nil {
+			return fmt.Errorf("secret %s: %w", env[envVar], err)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("secret %s spans several lines; read it as a credential instead", env[envVar])
+		}
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+		fmt.Fprintf(&b, "%s=\"%s\"\n", envVar, value)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("secret env dir: %w", err)
+	}
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	_, werr := f.WriteString(b.String())
+	if cerr := f.Close(); werr == nil {
+		werr = cerr
+	}
+	if werr != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write %s: %w", path, werr)
+	}
+	return os.Rename(tmp, path)
+}
+
+// secretsHash fingerprints the current values of refs
+func secretsHash(refs map[string]string) (string, error) {
+	h := sha256.New()
+	for _, key := range sortedKeys(refs) {
+		data, err := os.ReadFile(refs[key])
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %w", key, err)
+		}
+		sum := sha256.Sum256(data)
+		fmt.Fprintf(h, "%s %x\n", key, sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// SecretState is what rotation needs to know about the running version:
+// the hash of the secrets it started with, the units reading them and the
+// environment files to rewrite
+type SecretState struct {
+	Hash  string                       `json:"hash"`
+	Units []string                     `json:"units"`
+	Env   map[string]map[string]string `json:"env,omitempty"` // file -> ENV_VAR -> config key
+}
+
+// recordSecrets notes the secrets a freshly committed version started with
+func recordSecrets(stateDir string, config map[string]string, manifest *OverlayManifest, units []string) {
+	refs := secretRefs(config)
+	if len(refs) == 0 {
+		os.Remove(filepath.Join(stateDir, "secrets.json"))
+		return
+	}
+	hash, err := secretsHash(refs)
+	if err != nil {
+		log.Printf("secrets: %v", err)
+		return
+	}
+	state := SecretState{Hash: hash, Units: units, Env: map[string]map[string]string{}}
+	for _, svc := range manifest.Services {
+		if svc.SecretEnvFile != "" {
+			state.Env[svc.SecretEnvFile] = svc.SecretEnvironment
+		}
+	}
+	data, _ := json.MarshalIndent(state, "", "  ")
+	os.WriteFile(filepath.Join(stateDir, "secrets.json"), data, 0600)
+}
+
+func loadSecretState(stateDir string) *SecretState {
+	data, err := os.ReadFile(filepath.Join(stateDir, "secrets.json"))
+	if err != nil {
+		return nil
+	}
+	var state SecretState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil
+	}
+	return &state
+}
+
+func cmdSecrets(cfg Config) {
+	for _, name := range orderedOverlays(cfg.Overlays) {
+		if cfg.Overlays[name].Enabled {
+			rotateSecrets(cfg, name)
+		}
+	}
+}
+
+// rotateSecrets restarts an overlay's services onto rotated secrets
+func rotateSecrets(cfg Config, name string) {
+	stateDir := filepath.Join(cfg.StateDir, name)
+	if readState(stateDir) != "permanent" && readState(stateDir) != "rolled-back" {
+		return // an activation in flight reads the secrets itself
+	}
+	state := loadSecretState(stateDir)
+	if state == nil {
+		return
+	}
+	refs := secretRefs(cfg.Overlays[name].Config)
+	hash, err := secretsHash(refs)
+	if err != nil {
+		log.Printf("[%s] secrets: %v", name, err)
+		return
+	}
+	if hash == state.Hash {
+		return
+	}
+
+	log.Printf("[%s] secrets rotated, restarting %d service(s)", name, len(state.Units))
+	for path, env := range state.Env {
+		if err := writeSecretEnv(path, env, refs); err != nil {
+			log.Printf("[%s] %v; keeping the running services on the old secrets", name, err)
+			return
+		}
+	}
+	for _, unit := range state.Units {
+		if err := exec.Command("systemctl", "try-restart", unit).Run(); err != nil {
+			log.Printf("[%s] restart %s: %v", name, unit, err)
+		}
+	}
+	state.Hash = hash
+	data, _ := json.MarshalIndent(state, "", "  ")
+	os.WriteFile(filepath.Join(stateDir, "secrets.json"), data, 0600)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withSecrets points the manager at a temporary secrets directory holding
+// files, and a temporary environment file directory
+func withSecrets(t *testing.T, files map[string]string) {
+	t.Helper()
+	oldSecrets, oldEnv := secretsDir, secretEnvDir
+	secretsDir = t.TempDir()
+	secretEnvDir = filepath.Join(t.TempDir(), "secrets")
+	t.Cleanup(func() { secretsDir, secretEnvDir = oldSecrets, oldEnv })
+	for name, value := range files {
+		if err := os.WriteFile(filepath.Join(secretsDir, name), []byte(value), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEvalConfigNeverCarriesSecretValues(t *testing.T) {
+	withSecrets(t, map[string]string{"overlay-coffer-token": "hunter2\n"})
+	config := map[string]string{
+		"port":   "19876",
+		"token":  "%SECRET:overlay-coffer-token%",
+		"legacy": "%SECRET:/run/secrets/overlay-coffer-legacy%",
+	}
+
+	refs := secretRefs(config)
+	if refs["token"] != filepath.Join(secretsDir, "overlay-coffer-token") || refs["legacy"] != "/run/secrets/overlay-coffer-legacy" {
+		t.Errorf("refs = %v", refs)
+	}
+	// overlay.nix gets the secret file's path, usable outside systemd units
+	eval := evalConfig(config)
+	if eval["token"] != refs["token"] || eval["legacy"] != "/run/secrets/overlay-coffer-legacy" || eval["port"] != "19876" {
+		t.Errorf("eval config = %v", eval)
+	}
+	for _, v := range eval {
+		if strings.Contains(v, "hunter2") {
+			t.Errorf("secret leaked into eval config: %q", v)
+		}
+	}
+}
+
+func TestProvideSecretsAsCredentialsAndEnvFile(t *testing.T) {
+	withSecrets(t, map[string]string{"overlay-coffer-token": "hunter2\n", "overlay-coffer-tls": "pem"})
+	unitDir = t.TempDir()
+	defer func() { unitDir = "/run/systemd/system" }()
+
+	config := map[string]string{"token": "%SECRET:overlay-coffer-token%", "tls": "%SECRET:overlay-coffer-tls%"}
+	manifest := &OverlayManifest{Services: map[string]ServiceDef{
+		"api":    {Exec: "/bin/api --token-file %d/token"},
+		"proxy":  {Exec: "/bin/proxy", Environment: []string{"TLS_KEY=${CREDENTIALS_DIRECTORY}/tls"}, CredentialKeys: []string{"token"}},
+		"worker": {Exec: "/bin/worker", SecretEnvironment: map[string]string{"COFFER_TOKEN": "token"}},
+	}}
+	if err := provideSecrets("coffer", config, manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	envFile := secretEnvFile("coffer", "worker")
+	info, err := os.Stat(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("env file mode %v, want 0600", info.Mode().Perm())
+	}
+	if data, _ := os.ReadFile(envFile); string(data) != "COFFER_TOKEN=\"hunter2\"\n" {
+		t.Errorf("env file = %q", data)
+	}
+
+	// Each service loads only the secrets it reads as credentials
+	want := map[string][]string{"api": {"token"}, "proxy": {"tls", "token"}, "worker": nil}
+	for svcName, keys := range want {
+		unitName := serviceUnitName("coffer", svcName)
+		if err := writeServiceUnit("coffer", svcName, unitName, "overlay-coffer.target", manifest.Services[svcName], nil); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := os.ReadFile(filepath.Join(unitDir, unitName))
+		unit := string(data)
+		for _, key := range keys {
+			if !strings.Contains(unit, "LoadCredential="+key+":"+filepath.Join(secretsDir, "overlay-coffer-"+key)+"\n") {
+				t.Errorf("%s has no %s credential:\n%s", unitName, key, unit)
+			}
+		}
+		if got := strings.Count(unit, "LoadCredential="); got != len(keys) {
+			t.Errorf("%s loads %d credentials, want %d:\n%s", unitName, got, len(keys), unit)
+		}
+		if strings.Contains(unit, "hunter2") {
+			t.Errorf("%s contains the secret value:\n%s", unitName, unit)
+		}
+	}
+	unit, _ := os.ReadFile(filepath.Join(unitDir, "overlay-coffer-worker.service"))
+	if !strings.Contains(string(unit), "EnvironmentFile="+envFile+"\n") {
+		t.Errorf("worker unit has no secret environment file:\n%s", unit)
+	}
+}
+
+func TestServiceCredentialsMatchesWholeKeys(t *testing.T) {
+	refs := map[string]string{"token": "/run/secrets/a", "token2": "/run/secrets/b"}
+	creds, err := serviceCredentials(ServiceDef{Exec: "/bin/x --key $CREDENTIALS_DIRECTORY/token2"}, refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creds) != 1 || creds["token2"] != "/run/secrets/b" {
+		t.Errorf("creds = %v", creds)
+	}
+}
+
+func TestProvideSecretsRejects(t *testing.T) {
+	withSecrets(t, map[string]string{"overlay-coffer-token": "hunter2", "overlay-coffer-pem": "a\nb\n"})
+	cases := map[string]struct {
+		config map[string]string
+		svc    ServiceDef
+	}{
+		"missing file":     {map[string]string{"token": "%SECRET:overlay-coffer-nope%"}, ServiceDef{Exec: "/bin/x"}},
+		"not a secret":     {map[string]string{"port": "1"}, ServiceDef{Exec: "/bin/x", SecretEnvironment: map[string]string{"PORT": "port"}}},
+		"bad env var":      {map[string]string{"token": "%SECRET:overlay-coffer-token%"}, ServiceDef{Exec: "/bin/x", SecretEnvironment: map[string]string{"1X": "token"}}},
+		"multi-line env":   {map[string]string{"pem": "%SECRET:overlay-coffer-pem%"}, ServiceDef{Exec: "/bin/x", SecretEnvironment: map[string]string{"PEM": "pem"}}},
+		"not a credential": {map[string]string{"port": "1"}, ServiceDef{Exec: "/bin/x", CredentialKeys: []string{"port"}}},
+	}
+	for name, tc := range cases {
+		m := &OverlayManifest{Services: map[string]ServiceDef{"x": tc.svc}}
+		if err := provideSecrets("coffer", tc.config, m); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestRotateSecretsRewritesEnvironment(t *testing.T) {
+	withSecrets(t, map[string]string{"overlay-coffer-token": "hunter2"})
+	cfg := Config{StateDir: t.TempDir(), Overlays: map[string]OverlayConfig{
+		"coffer": {Enabled: true, Config: map[string]string{"token": "%SECRET:overlay-coffer-token%"}},
+	}}
+	stateDir := filepath.Join(cfg.StateDir, "coffer")
+	manifest := &OverlayManifest{Services: map[string]ServiceDef{
+		"coffer": {Exec: "/bin/cofferd", SecretEnvironment: map[string]string{"TOKEN": "token"}},
+	}}
+	if err := provideSecrets("coffer", cfg.Overlays["coffer"].Config, manifest); err != nil {
+		t.Fatal(err)
+	}
+	writeState(stateDir, "permanent")
+	recordSecrets(stateDir, cfg.Overlays["coffer"].Config, manifest, []string{"overlay-coffer.service"})
+	before := loadSecretState(stateDir)
+	if before == nil {
+		t.Fatal("secret state not recorded")
+	}
+
+	os.WriteFile(filepath.Join(secretsDir, "overlay-coffer-token"), []byte("correct-horse"), 0600)
+	rotateSecrets(cfg, "coffer")
+
+	if data, _ := os.ReadFile(secretEnvFile("coffer", "coffer")); string(data) != "TOKEN=\"correct-horse\"\n" {
+		t.Errorf("env file after rotation = %q", data)
+	}
+	if after := loadSecretState(stateDir); after == nil || after.Hash == before.Hash {
+		t.Error("rotation not recorded")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Timers and sockets. A manifest's timers and sockets are bound by name to
+// the service they activate, as in systemd: timers.backup runs
+// services.backup, sockets.api starts services.api on its first connection.
+// A triggered service is not wanted by the overlay target itself — its timer
+// or socket is — and every unit is PartOf the target, so stopping,
+// replacing and rolling back the overlay takes its timers and sockets along.
+// With accept = true each connection gets its own instance of a template
+// service (overlay-<name>-<service>@.service).
+//
+// Blue/green overlays cannot declare either: a socket would be bound by both
+// slots at once, and the slot switch has no notion of a scheduled job.
+
+type TimerDef struct {
+	OnCalendar         string `json:"onCalendar"`
+	OnBootSec          string `json:"onBootSec"`
+	OnUnitActiveSec    string `json:"onUnitActiveSec"`
+	RandomizedDelaySec string `json:"randomizedDelaySec"`
+	Persistent         bool   `json:"persistent"`
+}
+
+type SocketDef struct {
+	ListenStream []string `json:"listenStream"`
+	Accept       bool     `json:"accept"`
+}
+
+var timeSpanRe = regexp.MustCompile(`^[0-9]+ ?[a-z]*( [0-9]+ ?[a-z]*)*$`)
+
+// validateTriggers checks a manifest's timers and sockets against its
+// services
+func validateTriggers(m *OverlayManifest) error {
+	if (len(m.Timers) > 0 || len(m.Sockets) > 0) && m.blueGreen() {
+		return errors.New("timers and sockets are not supported with blue-green activation")
+	}
+	for _, name := range sortedKeys(m.Timers) {
+		t := m.Timers[name]
+		if _, ok := m.Services[name]; !ok {
+			return fmt.Errorf("timer %s: no service %s to run", name, name)
+		}
+		if _, ok := m.Sockets[name]; ok {
+			return fmt.Errorf("timer %s: service %s is already socket-activated", name, name)
+		}
+		if t.OnCalendar == "" && t.OnBootSec == "" && t.OnUnitActiveSec == "" {
+			return fmt.Errorf("timer %s: needs onCalendar, onBootSec or onUnitActiveSec", name)
+		}
+		if strings.ContainsAny(t.OnCalendar, "\n\r") {
+			return fmt.Errorf("timer %s: onCalendar contains a newline", name)
+		}
+		for _, span := range []string{t.OnBootSec, t.OnUnitActiveSec, t.RandomizedDelaySec} {
+			if span != "" && !timeSpanRe.MatchString(span) {
+				return fmt.Errorf("timer %s: invalid time span %q", name, span)
+			}
+		}
+	}
+	for _, name := range sortedKeys(m.Sockets) {
+		s := m.Sockets[name]
+		if _, ok := m.Services[name]; !ok {
+			return fmt.Errorf("socket %s: no service %s to activate", name, name)
+		}
+		if len(s.ListenStream) == 0 {
+			return fmt.Errorf("socket %s: listenStream is empty", name)
+		}
+		for _, listen := range s.ListenStream {
+			if listen == "" || strings.ContainsAny(listen, "\n\r ") {
+				return fmt.Errorf("socket %s: invalid listenStream %q", name, listen)
+			}
+		}
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// triggerUnitName is the timer or socket unit that activates svcName, if any
+func (m *OverlayManifest) triggerUnitName(overlay, svcName string) string {
+	base := strings.TrimSuffix(serviceUnitName(overlay, svcName), ".service")
+	if _, ok := m.Timers[svcName]; ok {
+		return base + ".timer"
+	}
+	if _, ok := m.Sockets[svcName]; ok {
+		return base + ".socket"
+	}
+	return ""
+}
+
+// unitNameFor is the service unit svcName is written as: a template for a
+// service behind an accepting socket
+func (m *OverlayManifest) unitNameFor(overlay, svcName string) string {
+	if s, ok := m.Sockets[svcName]; ok && s.Accept {
+		return strings.TrimSuffix(serviceUnitName(overlay, svcName), ".service") + "@.service"
+	}
+	return serviceUnitName(overlay, svcName)
+}
+
+func writeTimerUnit(overlay, svcName, unitName, partOf string, t TimerDef) error {
+	content := fmt.Sprintf(`[Unit]
+Description=Overlay %s - %s timer
+PartOf=%s
+
+[Timer]
+`, overlay, svcName, partOf)
+	if t.OnCalendar != "" {
+		content += fmt.Sprintf("OnCalendar=%s\n", t.OnCalendar)
+	}
+	if t.OnBootSec != "" {
+		content += fmt.Sprintf("OnBootSec=%s\n", t.OnBootSec)
+	}
+	if t.OnUnitActiveSec != "" {
+		content += fmt.Sprintf("OnUnitActiveSec=%s\n", t.OnUnitActiveSec)
+	}
+	if t.RandomizedDelaySec != "" {
+		content += fmt.Sprintf("RandomizedDelaySec=%s\n", t.RandomizedDelaySec)
+	}
+	if t.Persistent {
+		content += "Persistent=true\n"
+	}
+	if err := os.WriteFile(filepath.Join(unitDir, unitName), []byte(content), 0644); err != nil {
+		return fmt.Errorf("write timer %s: %w", unitName, err)
+	}
+	return nil
+}
+
+func writeSocketUnit(overlay, svcName, unitName, partOf string, s SocketDef) error {
+	content := fmt.Sprintf(`[Unit]
+Description=Overlay %s - %s socket
+PartOf=%s
+
+[Socket]
+`, overlay, svcName, partOf)
+	for _, listen := range s.ListenStream {
+		content += fmt.Sprintf("ListenStream=%s\n", listen)
+	}
+	if s.Accept {
+		content += "Accept=true\n"
+	}
+	if err := os.WriteFile(filepath.Join(unitDir, unitName), []byte(content), 0644); err != nil {
+		return fmt.Errorf("write socket %s: %w", unitName, err)
+	}
+	return nil
+}
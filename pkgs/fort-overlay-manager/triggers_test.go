@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func triggeredManifest() *OverlayManifest {
+	return &OverlayManifest{
+		Services: map[string]ServiceDef{
+			"coffer": {Exec: "/nix/store/aaa-coffer/bin/cofferd"},
+			"backup": {Exec: "/nix/store/aaa-coffer/bin/coffer-backup", Type: "oneshot"},
+			"api":    {Exec: "/nix/store/aaa-coffer/bin/coffer-api"},
+		},
+		Timers:  map[string]TimerDef{"backup": {OnCalendar: "*-*-* 03:00:00", Persistent: true}},
+		Sockets: map[string]SocketDef{"api": {ListenStream: []string{"127.0.0.1:19900"}, Accept: true}},
+	}
+}
+
+func TestValidateTriggers(t *testing.T) {
+	if err := validateTriggers(triggeredManifest()); err != nil {
+		t.Fatalf("valid manifest rejected: %v", err)
+	}
+	cases := map[string]func(m *OverlayManifest){
+		"timer without service":  func(m *OverlayManifest) { m.Timers["nightly"] = TimerDef{OnCalendar: "daily"} },
+		"timer without schedule": func(m *OverlayManifest) { m.Timers["backup"] = TimerDef{Persistent: true} },
+		"bad time span":          func(m *OverlayManifest) { m.Timers["backup"] = TimerDef{OnBootSec: "soon"} },
+		"socket without listen":  func(m *OverlayManifest) { m.Sockets["api"] = SocketDef{} },
+		"timer and socket":       func(m *OverlayManifest) { m.Timers["api"] = TimerDef{OnBootSec: "5min"} },
+		"blue-green": func(m *OverlayManifest) {
+			m.Activation = &ActivationConfig{Strategy: strategyBlueGreen, Socket: "/run/coffer.sock"}
+		},
+	}
+	for name, mutate := range cases {
+		m := triggeredManifest()
+		mutate(m)
+		if err := validateTriggers(m); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+// The target wants the timer and socket, never the services they activate
+func TestGenerateUnitsWiresTriggers(t *testing.T) {
+	unitDir = t.TempDir()
+	defer func() { unitDir = "/run/systemd/system" }()
+
+	if err := generateUnits("coffer", triggeredManifest(), nil); err != nil {
+		t.Fatal(err)
+	}
+	wants, _ := os.ReadDir(filepath.Join(unitDir, "overlay-coffer.target.wants"))
+	var wanted []string
+	for _, w := range wants {
+		wanted = append(wanted, w.Name())
+	}
+	if got, want := strings.Join(wanted, " "), "overlay-coffer-api.socket overlay-coffer-backup.timer overlay-coffer.service"; got != want {
+		t.Errorf("target wants %q, want %q", got, want)
+	}
+
+	timer, _ := os.ReadFile(filepath.Join(unitDir, "overlay-coffer-backup.timer"))
+	for _, want := range []string{"PartOf=overlay-coffer.target\n", "OnCalendar=*-*-* 03:00:00\n", "Persistent=true\n"} {
+		if !strings.Contains(string(timer), want) {
+			t.Errorf("timer missing %q:\n%s", want, timer)
+		}
+	}
+	socket, _ := os.ReadFile(filepath.Join(unitDir, "overlay-coffer-api.socket"))
+	if !strings.Contains(string(socket), "ListenStream=127.0.0.1:19900\nAccept=true\n") {
+		t.Errorf("socket:\n%s", socket)
+	}
+	if _, err := os.Stat(filepath.Join(unitDir, "overlay-coffer-api@.service")); err != nil {
+		t.Errorf("accepting socket has no template service: %v", err)
+	}
+
+	// A version without the timer leaves nothing wanting it
+	m := triggeredManifest()
+	delete(m.Timers, "backup")
+	if err := generateUnits("coffer", m, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(unitDir, "overlay-coffer.target.wants", "overlay-coffer-backup.timer")); err == nil {
+		t.Error("dropped timer still wanted by the target")
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Pre-activation validation. A manifest that evaluates can still fail on
+// this host only once its services start — after the running version has
+// been stopped. Activation therefore checks it against the host first:
+//
+//   - every exec, execStartPre, drain and bin is an executable, and one from
+//     the overlay's own store closure if it is in /nix/store at all
+//   - users and groups resolve
+//   - its ports (ports, blue/green ports, socket listenStream, expose) are
+//     not declared by another enabled overlay's running version
+//   - its exposed names are free and its SSO modes available (expose.go)
+//   - systemd-analyze verify accepts the units it generates, written to a
+//     temporary directory
+//
+// `fort-overlay-manager validate <name> --store-path <path>` runs the same
+// checks without activating anything.
+
+// systemdAnalyze is the systemd-analyze binary; overridden in tests
+var systemdAnalyze = "systemd-analyze"
+
+// storeClosure returns the store paths storePath depends on, itself
+// included; overridden in tests
+var storeClosure = func(storePath string) (map[string]bool, error) {
+	out, err := exec.Command("nix-store", "--query", "--requisites", storePath).Output()
+	if err != nil {
+		return nil, fmt.Errorf("nix-store --query --requisites: %w", err)
+	}
+	closure := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			closure[line] = true
+		}
+	}
+	return closure, nil
+}
+
+// validateManifest checks a manifest for consistency on its own
+func validateManifest(name string, m *OverlayManifest) error {
+	if err := validateActivation(m.Activation); err != nil {
+		return fmt.Errorf("invalid activation: %v", err)
+	}
+	if err := validateServices(m.Services); err != nil {
+		return fmt.Errorf("invalid service: %v", err)
+	}
+	if err := validateTriggers(m); err != nil {
+		return fmt.Errorf("invalid manifest: %v", err)
+	}
+	if err := validateHealth(m); err != nil {
+		return fmt.Errorf("invalid health: %v", err)
+	}
+	if err := validateExpose(name, m); err != nil {
+		return fmt.Errorf("invalid expose: %v", err)
+	}
+	for _, port := range m.Ports {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid manifest: invalid port %d", port)
+		}
+	}
+	return nil
+}
+
+// hostProblems checks a consistent manifest against this host, returning
+// everything that would keep it from running
+func hostProblems(cfg Config, name, storePath string, m *OverlayManifest) []string {
+	runs := m
+	if m.blueGreen() {
+		runs = m.forSlot("blue")
+	}
+
+	var problems []string
+	problems = append(problems, executableProblems(storePath, runs)...)
+	problems = append(problems, accountProblems(runs)...)
+	problems = append(problems, portConflicts(cfg, name, m)...)
+	problems = append(problems, exposureProblems(cfg, name, m)...)
+	if err := verifyUnits(name, runs, cfg.Overlays[name].DependsOn); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
+
+func executableProblems(storePath string, m *OverlayManifest) []string {
+	closure, err := storeClosure(storePath)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var problems []string
+	for _, svcName := range sortedKeys(m.Services) {
+		svc := m.Services[svcName]
+		commands := append([]string{svc.Exec}, svc.ExecStartPre...)
+		if svc.Drain != "" {
+			commands = append(commands, svc.Drain)
+		}
+		for _, command := range commands {
+			if problem := checkExecutable(commandPath(command), closure); problem != "" {
+				problems = append(problems, fmt.Sprintf("service %s: %s", svcName, problem))
+			}
+		}
+	}
+	for _, bin := range m.Bins {
+		if problem := checkExecutable(bin, closure); problem != "" {
+			problems = append(problems, "bin: "+problem)
+		}
+	}
+	return problems
+}
+
+// commandPath is the executable of a systemd command line, without the
+// "-", "@", ":", "+" and "!" prefixes
+func commandPath(command string) string {
+	command = strings.TrimLeft(strings.TrimSpace(command), "-@:+!")
+	if rest, ok := strings.CutPrefix(command, `"`); ok {
+		path, _, _ := strings.Cut(rest, `"`)
+		return path
+	}
+	path, _, _ := strings.Cut(command, " ")
+	return path
+}
+
+func checkExecutable(path string, closure map[string]bool) string {
+	if !filepath.IsAbs(path) {
+		return fmt.Sprintf("%q is not an absolute path", path)
+	}
+	if root := storeRoot(path); root != "" && !closure[root] {
+		return fmt.Sprintf("%s is not in the overlay's closure", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Sprintf("%s does not exist", path)
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return fmt.Sprintf("%s is not executable", path)
+	}
+	return ""
+}
+
+// storeRoot is the store path a path lies in, or "" outside /nix/store
+func storeRoot(path string) string {
+	rest, ok := strings.CutPrefix(path, "/nix/store/")
+	if !ok {
+		return ""
+	}
+	entry, _, _ := strings.Cut(rest, "/")
+	return "/nix/store/" + entry
+}
+
+func accountProblems(m *OverlayManifest) []string {
+	var problems []string
+	for _, svcName := range sortedKeys(m.Services) {
+		svc := m.Services[svcName]
+		if svc.DynamicUser {
+			continue
+		}
+		if svc.User != "" {
+			if _, err := user.Lookup(svc.User); err != nil {
+				problems = append(problems, fmt.Sprintf("service %s: user %s: %v", svcName, svc.User, err))
+			}
+		}
+		if svc.Group != "" {
+			if _, err := user.LookupGroup(svc.Group); err != nil {
+				problems = append(problems, fmt.Sprintf("service %s: group %s: %v", svcName, svc.Group, err))
+			}
+		}
+	}
+	return problems
+}
+
+// declaredPorts is every TCP port the manifest says it listens on
+func (m *OverlayManifest) declaredPorts() []int {
+	seen := map[int]bool{}
+	for _, port := range m.Ports {
+		seen[port] = true
+	}
+	if m.Activation != nil {
+		for _, port := range m.Activation.Ports {
+			seen[port] = true
+		}
+	}
+	for _, e := range m.Expose {
+		if e.Port != 0 {
+			seen[e.Port] = true
+		}
+	}
+	for _, s := range m.Sockets {
+		for _, listen := range s.ListenStream {
+			if port, ok := listenPort(listen); ok {
+				seen[port] = true
+			}
+		}
+	}
+	ports := make([]int, 0, len(seen))
+	for port := range seen {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// listenPort reads the port of a ListenStream= address ("8080",
+// "127.0.0.1:8080", "[::]:8080"); unix sockets have none
+func listenPort(listen string) (int, bool) {
+	if strings.HasPrefix(listen, "/") || strings.HasPrefix(listen, "@") {
+		return 0, false
+	}
+	if i := strings.LastIndex(listen, ":"); i >= 0 {
+		listen = listen[i+1:]
+	}
+	port, err := strconv.Atoi(listen)
+	return port, err == nil
+}
+
+// portConflicts reports the ports name would share with the running version
+// of another enabled overlay, as recorded when that version was activated
+func portConflicts(cfg Config, name string, m *OverlayManifest) []string {
+	mine := map[int]bool{}
+	for _, port := range m.declaredPorts() {
+		mine[port] = true
+	}
+	var problems []string
+	for _, other := range sortedKeys(cfg.Overlays) {
+		if other == name || !cfg.Overlays[other].Enabled {
+			continue
+		}
+		current := loadCurrentState(cfg.StateDir, other)
+		if current == nil {
+			continue
+		}
+		for _, port := range current.Ports {
+			if mine[port] {
+				problems = append(problems, fmt.Sprintf("port %d is already used by overlay %s", port, other))
+			}
+		}
+	}
+	return problems
+}
+
+// verifyUnits generates the manifest's units into a temporary directory and
+// runs systemd-analyze verify on them. The generators write to unitDir, so
+// it is pointed there for the duration; callers hold the state lock, as for
+// any other unit generation.
+func verifyUnits(name string, m *OverlayManifest, dependsOn []string) error {
+	dir, err := os.MkdirTemp("", "overlay-validate-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	saved := unitDir
+	unitDir = dir
+	if m.blueGreen() {
+		if err = writeOverlayTarget(name, dependsOn, "blue"); err == nil {
+			err = generateSlotUnits(name, "blue", m, dependsOn)
+		}
+	} else {
+		err = generateUnits(name, m, dependsOn)
+	}
+	unitDir = saved
+	if err != nil {
+		return fmt.Errorf("unit generation failed: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	args := []string{"verify", "--man=no"}
+	for _, entry := range entries {
+		// Templates (per-connection services) can't be verified on their
+		// own; their socket pulls them in
+		if !entry.IsDir() && !strings.Contains(entry.Name(), "@.") {
+			args = append(args, filepath.Join(dir, entry.Name()))
+		}
+	}
+	out, err := exec.Command(systemdAnalyze, args...).CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(strings.ReplaceAll(string(out), dir+"/", ""))
+		return fmt.Errorf("systemd-analyze verify: %v: %s", err, strings.ReplaceAll(msg, "\n", "; "))
+	}
+	return nil
+}
+
+// cmdValidate evaluates a store path as overlay name would run it and
+// reports every problem activation would stop at
+func cmdValidate(w io.Writer, cfg Config, name, storePath string) error {
+	ov, ok := cfg.Overlays[name]
+	if !ok {
+		return fmt.Errorf("[%s] not in config", name)
+	}
+	if err := fetchClosure(cfg, name, storePath); err != nil {
+		return fmt.Errorf("fetch failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(storePath, "overlay.nix")); err != nil {
+		return fmt.Errorf("no overlay.nix at %s", storePath)
+	}
+	manifest, err := evalOverlay(storePath, ov)
+	if err != nil {
+		return fmt.Errorf("eval failed: %v", err)
+	}
+	if err := validateManifest(name, manifest); err != nil {
+		return err
+	}
+	problems := hostProblems(cfg, name, storePath, manifest)
+	for _, problem := range problems {
+		fmt.Fprintln(w, problem)
+	}
+	if len(problems) > 0 {
+		return errors.New("validation failed")
+	}
+	fmt.Fprintf(w, "%s: %s is valid\n", name, storePath)
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommandPath(t *testing.T) {
+	cases := map[string]string{
+		"/nix/store/aaa-coffer/bin/cofferd --port 1": "/nix/store/aaa-coffer/bin/cofferd",
+		"-/nix/store/aaa-coffer/bin/migrate":         "/nix/store/aaa-coffer/bin/migrate",
+		`"/nix/store/aaa-coffer/bin/a b" --flag`:     "/nix/store/aaa-coffer/bin/a b",
+		"cofferd":                                    "cofferd",
+	}
+	for command, want := range cases {
+		if got := commandPath(command); got != want {
+			t.Errorf("commandPath(%q) = %q, want %q", command, got, want)
+		}
+	}
+}
+
+func TestExecutableProblems(t *testing.T) {
+	dir := t.TempDir()
+	tool := filepath.Join(dir, "tool")
+	os.WriteFile(tool, []byte("#!/bin/sh\n"), 0755)
+	data := filepath.Join(dir, "data")
+	os.WriteFile(data, []byte("x"), 0644)
+
+	saved := storeClosure
+	defer func() { storeClosure = saved }()
+	storeClosure = func(string) (map[string]bool, error) {
+		return map[string]bool{"/nix/store/aaa-coffer": true}, nil
+	}
+
+	m := &OverlayManifest{
+		Services: map[string]ServiceDef{
+			"coffer": {Exec: tool + " --serve", ExecStartPre: []string{"-" + data}, Drain: "cofferd"},
+			"api":    {Exec: "/nix/store/bbb-other/bin/api"},
+		},
+		Bins: []string{filepath.Join(dir, "missing")},
+	}
+	got := executableProblems("/nix/store/aaa-coffer", m)
+	want := []string{
+		"service api: /nix/store/bbb-other/bin/api is not in the overlay's closure",
+		"service coffer: " + data + " is not executable",
+		`service coffer: "cofferd" is not an absolute path`,
+		"bin: " + filepath.Join(dir, "missing") + " does not exist",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("problems = %q, want %q", got, want)
+	}
+}
+
+func TestAccountProblems(t *testing.T) {
+	m := &OverlayManifest{Services: map[string]ServiceDef{
+		"coffer":  {Exec: "/bin/true", User: "root", Group: "fort-no-such-group"},
+		"api":     {Exec: "/bin/true", User: "fort-no-such-user"},
+		"dynamic": {Exec: "/bin/true", User: "fort-no-such-user", DynamicUser: true},
+	}}
+	got := accountProblems(m)
+	if len(got) != 2 || !strings.HasPrefix(got[0], "service api: user fort-no-such-user") ||
+		!strings.HasPrefix(got[1], "service coffer: group fort-no-such-group") {
+		t.Errorf("problems = %q", got)
+	}
+}
+
+func TestDeclaredPorts(t *testing.T) {
+	m := &OverlayManifest{
+		Ports:      []int{8080},
+		Activation: &ActivationConfig{Strategy: strategyBlueGreen, Ports: map[string]int{"blue": 19877, "green": 19878}},
+		Sockets: map[string]SocketDef{
+			"api":  {ListenStream: []string{"127.0.0.1:19900", "[::]:8080"}},
+			"unix": {ListenStream: []string{"/run/coffer.sock", "@abstract"}},
+		},
+	}
+	if got, want := m.declaredPorts(), []int{8080, 19877, 19878, 19900}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ports = %v, want %v", got, want)
+	}
+}
+
+func TestPortConflicts(t *testing.T) {
+	cfg := Config{StateDir: t.TempDir(), Overlays: map[string]OverlayConfig{
+		"coffer":   {Enabled: true},
+		"knockout": {Enabled: true},
+		"disabled": {},
+	}}
+	for name, ports := range map[string][]int{"coffer": {8080}, "knockout": {9000, 9001}, "disabled": {9001}} {
+		stateDir := filepath.Join(cfg.StateDir, name)
+		os.MkdirAll(stateDir, 0755)
+		saveCurrentState(stateDir, OverlayState{StorePath: "/nix/store/aaa-" + name, Ports: ports})
+	}
+
+	// Its own running version doesn't count
+	m := &OverlayManifest{Ports: []int{8080, 9001}}
+	got := portConflicts(cfg, "coffer", m)
+	if want := []string{"port 9001 is already used by overlay knockout"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("conflicts = %q, want %q", got, want)
+	}
+}
+
+func TestVerifyUnits(t *testing.T) {
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	fake := filepath.Join(dir, "systemd-analyze")
+	os.WriteFile(fake, []byte("#!/bin/sh\necho \"$@\" > "+argsFile+"\n"), 0755)
+	saved := systemdAnalyze
+	defer func() { systemdAnalyze = saved }()
+	systemdAnalyze = fake
+
+	if err := verifyUnits("coffer", triggeredManifest(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if unitDir != "/run/systemd/system" {
+		t.Errorf("unitDir left at %s", unitDir)
+	}
+	args, _ := os.ReadFile(argsFile)
+	var units []string
+	for _, arg := range strings.Fields(string(args))[2:] {
+		units = append(units, filepath.Base(arg))
+	}
+	want := "overlay-coffer-api.socket overlay-coffer-backup.service overlay-coffer-backup.timer overlay-coffer.service overlay-coffer.target"
+	if got := strings.Join(units, " "); got != want {
+		t.Errorf("verified %q, want %q", got, want)
+	}
+
+	os.WriteFile(fake, []byte("#!/bin/sh\necho \"overlay-coffer.service:5: Unknown key name 'Bogus'\" >&2\nexit 1\n"), 0755)
+	err := verifyUnits("coffer", triggeredManifest(), nil)
+	if err == nil || !strings.Contains(err.Error(), "overlay-coffer.service:5: Unknown key name") {
+		t.Errorf("err = %v", err)
+	}
+}
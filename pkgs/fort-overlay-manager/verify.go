@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Registry entries carry their publisher's SSH signature over package,
+// channel, action, store path and timestamp (apps/overlay-registry). The
+// manager checks it against its own trustedKeys rather than trusting the
+// registry: anyone who can reach — or impersonate — the registry could
+// otherwise push arbitrary code to every subscribed host. The channel is the
+// one this overlay follows, so a path vouched for on canary is not taken for
+// stable.
+//
+// A valid signature is not enough on its own: a registry (or whoever
+// answers in its place) could serve an older signed entry and walk hosts
+// back to a version since replaced, bugs and all. Each overlay keeps the
+// newest entry it accepted in accepted.json and refuses anything signed
+// before it; only a new publish moves the overlay again. That includes an
+// aborted rollout, whose admitted hosts stay on the rolled-out path until
+// the next publish or a local rollback.
+const registrySignatureNamespace = "fort-overlay"
+
+// defaultChannel is the registry channel an overlay without one follows
+const defaultChannel = "stable"
+
+// entryActions are the signed actions that put a path at a channel head;
+// the registry's other signed actions (resume, abort, delete) never do
+var entryActions = map[string]bool{"publish": true, "promote": true, "rollout": true}
+
+// canonicalEntry is the message a publisher signs; it must match the
+// registry's
+func canonicalEntry(pkg, channel, action, storePath string, timestamp int64) string {
+	return fmt.Sprintf("%s\n%s\n%s\n%s\n%d", pkg, channel, action, storePath, timestamp)
+}
+
+// verifyEntry checks pkg's registry entry on channel against the trusted
+// publishers. It
+// fails closed: with no trusted keys configured nothing verifies, unless
+// allowUnsigned opts the host out — then unsigned entries, and every entry
+// when there are no keys to check against, are accepted with a warning on
+// each use so an unverified path is never mistaken for a verified one. A
+// signature that is present but wrong is rejected either way.
+func verifyEntry(cfg Config, pkg, channel string, entry RegistryEntry) error {
+	trusted := cfg.TrustedKeys
+	if cfg.AllowUnsigned && (len(trusted) == 0 || entry.Signature == "") {
+		log.Printf("WARNING: allowUnsigned is set; accepting %s for %s without verifying its publisher", entry.StorePath, pkg)
+		return nil
+	}
+	if len(trusted) == 0 {
+		return errors.New("no trustedKeys configured to verify it against (allowUnsigned to accept unverified entries)")
+	}
+	if entry.Signature == "" {
+		return errors.New("entry is unsigned")
+	}
+	pubkey, ok := trusted[entry.Publisher]
+	if !ok {
+		return fmt.Errorf("publisher %q is not trusted", entry.Publisher)
+	}
+	if !entryActions[entry.Action] {
+		return fmt.Errorf("entry signed for %q, not a publish", entry.Action)
+	}
+	if channel == "" {
+		channel = defaultChannel
+	}
+	return verifySignature(canonicalEntry(pkg, channel, entry.Action, entry.StorePath, entry.Timestamp), registrySignatureNamespace, entry.Signature, entry.Publisher, pubkey)
+}
+
+// AcceptedEntry is the newest signed registry entry an overlay accepted,
+// per package and channel: a config change to either starts afresh
+type AcceptedEntry struct {
+	Package   string `json:"package"`
+	Channel   string `json:"channel"`
+	StorePath string `json:"storePath"`
+	Publisher string `json:"publisher"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func loadAccepted(stateDir string) *AcceptedEntry {
+	data, err := os.ReadFile(filepath.Join(stateDir, "accepted.json"))
+	if err != nil {
+		return nil
+	}
+	var accepted AcceptedEntry
+	if err := json.Unmarshal(data, &accepted); err != nil {
+		return nil
+	}
+	return &accepted
+}
+
+// verifyFresh rejects a signed entry older than the last one stateDir's
+// overlay accepted on the same package and channel, or as old but for
+// another path. Unsigned entries (allowUnsigned) carry no timestamp worth
+// comparing.
+func verifyFresh(stateDir, pkg, channel string, entry RegistryEntry) error {
+	if entry.Signature == "" {
+		return nil
+	}
+	if channel == "" {
+		channel = defaultChannel
+	}
+	accepted := loadAccepted(stateDir)
+	if accepted == nil || accepted.Package != pkg || accepted.Channel != channel {
+		return nil
+	}
+	if entry.Timestamp < accepted.Timestamp || entry.Timestamp == accepted.Timestamp && entry.StorePath != accepted.StorePath {
+		return fmt.Errorf("entry signed at %d is older than the accepted %s (signed at %d)", entry.Timestamp, accepted.StorePath, accepted.Timestamp)
+	}
+	return nil
+}
+
+// recordAccepted remembers a verified entry as the one later entries must
+// not predate
+func recordAccepted(stateDir, pkg, channel string, entry RegistryEntry) {
+	if entry.Signature == "" {
+		return
+	}
+	if channel == "" {
+		channel = defaultChannel
+	}
+	if accepted := loadAccepted(stateDir); accepted != nil && accepted.Package == pkg && accepted.Channel == channel && accepted.Timestamp >= entry.Timestamp {
+		return
+	}
+	data, _ := json.MarshalIndent(AcceptedEntry{Package: pkg, Channel: channel, StorePath: entry.StorePath, Publisher: entry.Publisher, Timestamp: entry.Timestamp}, "", "  ")
+	os.MkdirAll(stateDir, 0755)
+	os.WriteFile(filepath.Join(stateDir, "accepted.json"), data, 0644)
+}
+
+// verifySignature checks a base64 SSH signature over message with ssh-keygen
+func verifySignature(message, namespace, signatureB64, principal, pubkey string) error {
+	sigBytes, err := base64.StdEncoding.DecodeString(signatureB64)
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "fort-overlay-verify-")
+	if err != nil {
+		return fmt.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	allowedSignersPath := filepath.Join(tmpDir, "allowed_signers")
+	if err := os.WriteFile(allowedSignersPath, []byte(fmt.Sprintf("%s %s\n", principal, pubkey)), 0600); err != nil {
+		return fmt.Errorf("write allowed_signers: %w", err)
+	}
+	sigPath := filepath.Join(tmpDir, "signature")
+	if err := os.WriteFile(sigPath, []byte(armorSignature(sigBytes)), 0600); err != nil {
+		return fmt.Errorf("write signature: %w", err)
+	}
+
+	cmd := exec.Command("ssh-keygen", "-Y", "verify",
+		"-f", allowedSignersPath,
+		"-n", namespace,
+		"-I", principal,
+		"-s", sigPath,
+	)
+	cmd.Stdin = strings.NewReader(message)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("signature: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func armorSignature(sig []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(sig)
+	var b strings.Builder
+	b.WriteString("-----BEGIN SSH SIGNATURE-----\n")
+	for len(encoded) > 70 {
+		b.WriteString(encoded[:70] + "\n")
+		encoded = encoded[70:]
+	}
+	b.WriteString(encoded + "\n")
+	b.WriteString("-----END SSH SIGNATURE-----\n")
+	return b.String()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// publisherKey creates an SSH key and returns its private key path and
+// public key
+func publisherKey(t *testing.T) (string, string) {
+	t.Helper()
+	keyPath := filepath.Join(t.TempDir(), "publisher")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", keyPath).CombinedOutput(); err != nil {
+		t.Skipf("ssh-keygen unavailable: %v %s", err, out)
+	}
+	pub, err := os.ReadFile(keyPath + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(string(pub))
+	return keyPath, fields[0] + " " + fields[1]
+}
+
+// signedEntry signs an entry the way `overlay-registry sign` does
+func signedEntry(t *testing.T, keyPath, publisher, pkg, channel, action, storePath string, timestamp int64) RegistryEntry {
+	t.Helper()
+	cmd := exec.Command("ssh-keygen", "-Y", "sign", "-f", keyPath, "-n", registrySignatureNamespace, "-q")
+	cmd.Stdin = strings.NewReader(canonicalEntry(pkg, channel, action, storePath, timestamp))
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sig strings.Builder
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.HasPrefix(line, "-----") {
+			sig.WriteString(strings.TrimSpace(line))
+		}
+	}
+	return RegistryEntry{StorePath: storePath, Action: action, Publisher: publisher, Timestamp: timestamp, Signature: sig.String()}
+}
+
+func TestVerifyEntry(t *testing.T) {
+	keyPath, pubkey := publisherKey(t)
+	_, otherPubkey := publisherKey(t)
+	trusted := map[string]string{"ci": pubkey}
+	entry := signedEntry(t, keyPath, "ci", "infra/coffer", "stable", "publish", "/nix/store/aaa-coffer", 1700000000)
+
+	if err := verifyEntry(Config{TrustedKeys: trusted}, "infra/coffer", "", entry); err != nil {
+		t.Errorf("valid entry rejected: %v", err)
+	}
+	canary := signedEntry(t, keyPath, "ci", "infra/coffer", "canary", "promote", "/nix/store/aaa-coffer", 1700000000)
+	if err := verifyEntry(Config{TrustedKeys: trusted}, "infra/coffer", "canary", canary); err != nil {
+		t.Errorf("valid canary entry rejected: %v", err)
+	}
+	resume := signedEntry(t, keyPath, "ci", "infra/coffer", "stable", "resume", "/nix/store/aaa-coffer", 1700000000)
+	relabelled := entry
+	relabelled.Action = "promote"
+
+	swapped := entry
+	swapped.StorePath = "/nix/store/evil-coffer"
+	forged := entry
+	forged.Publisher = "mallory"
+	unsigned := entry
+	unsigned.Signature = ""
+	cases := []struct {
+		name    string
+		trusted map[string]string
+		pkg     string
+		channel string
+		entry   RegistryEntry
+	}{
+		{"store path swapped", trusted, "infra/coffer", "", swapped},
+		{"signed for another package", trusted, "infra/knockout", "", entry},
+		{"untrusted publisher", trusted, "infra/coffer", "", forged},
+		{"unsigned", trusted, "infra/coffer", "", unsigned},
+		{"publisher key rotated away", map[string]string{"ci": otherPubkey}, "infra/coffer", "", entry},
+		{"canary entry served as stable", trusted, "infra/coffer", "stable", canary},
+		{"stable entry served as canary", trusted, "infra/coffer", "canary", entry},
+		{"action relabelled", trusted, "infra/coffer", "", relabelled},
+		{"rollout control signature", trusted, "infra/coffer", "", resume},
+	}
+	for _, tc := range cases {
+		if err := verifyEntry(Config{TrustedKeys: tc.trusted}, tc.pkg, tc.channel, tc.entry); err == nil {
+			t.Errorf("%s: accepted", tc.name)
+		}
+	}
+}
+
+func TestVerifyEntryWithoutTrustedKeysFailsClosed(t *testing.T) {
+	unsigned := RegistryEntry{StorePath: "/nix/store/aaa-coffer"}
+	if err := verifyEntry(Config{}, "infra/coffer", "", unsigned); err == nil {
+		t.Error("entry accepted with no trusted keys configured")
+	}
+	if err := verifyEntry(Config{AllowUnsigned: true}, "infra/coffer", "", unsigned); err != nil {
+		t.Errorf("allowUnsigned rejected an entry: %v", err)
+	}
+}
+
+func TestVerifyEntryAllowUnsignedStillRejectsBadSignatures(t *testing.T) {
+	keyPath, pubkey := publisherKey(t)
+	cfg := Config{TrustedKeys: map[string]string{"ci": pubkey}, AllowUnsigned: true}
+	entry := signedEntry(t, keyPath, "ci", "infra/coffer", "stable", "publish", "/nix/store/aaa-coffer", 1700000000)
+
+	if err := verifyEntry(cfg, "infra/coffer", "", RegistryEntry{StorePath: "/nix/store/bbb-coffer"}); err != nil {
+		t.Errorf("allowUnsigned rejected an unsigned entry: %v", err)
+	}
+	entry.StorePath = "/nix/store/evil-coffer"
+	if err := verifyEntry(cfg, "infra/coffer", "", entry); err == nil {
+		t.Error("allowUnsigned accepted a signature that does not match")
+	}
+}
+
+func TestVerifyFresh(t *testing.T) {
+	at := func(storePath string, timestamp int64) RegistryEntry {
+		return RegistryEntry{StorePath: storePath, Action: "publish", Publisher: "ci", Timestamp: timestamp, Signature: "sig"}
+	}
+	for _, tc := range []struct {
+		name    string
+		pkg     string
+		channel string
+		entry   RegistryEntry
+		ok      bool
+	}{
+		{"newer entry", "infra/coffer", "", at("/nix/store/ccc-coffer", 1700000200), true},
+		{"the accepted entry again", "infra/coffer", "stable", at("/nix/store/bbb-coffer", 1700000100), true},
+		{"older entry", "infra/coffer", "", at("/nix/store/aaa-coffer", 1700000000), false},
+		{"another path signed at the same time", "infra/coffer", "", at("/nix/store/evil-coffer", 1700000100), false},
+		{"older entry on another channel", "infra/coffer", "canary", at("/nix/store/aaa-coffer", 1700000000), true},
+		{"older entry of another package", "infra/knockout", "", at("/nix/store/aaa-knockout", 1700000000), true},
+		{"unsigned", "infra/coffer", "", RegistryEntry{StorePath: "/nix/store/aaa-coffer"}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stateDir := t.TempDir()
+			recordAccepted(stateDir, "infra/coffer", "", at("/nix/store/bbb-coffer", 1700000100))
+			err := verifyFresh(stateDir, tc.pkg, tc.channel, tc.entry)
+			if tc.ok && err != nil {
+				t.Errorf("rejected: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("accepted")
+			}
+		})
+	}
+
+	// Recording never moves the accepted entry back
+	stateDir := t.TempDir()
+	recordAccepted(stateDir, "infra/coffer", "", at("/nix/store/bbb-coffer", 1700000100))
+	recordAccepted(stateDir, "infra/coffer", "", at("/nix/store/aaa-coffer", 1700000000))
+	if accepted := loadAccepted(stateDir); accepted == nil || accepted.StorePath != "/nix/store/bbb-coffer" || accepted.Channel != "stable" {
+		t.Errorf("accepted = %+v", accepted)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Push-driven updates. The daemon (daemon.go) runs in place of a check timer:
+// one long-poll per subscribed channel on the registry's /_watch, narrowed to
+// the packages this host follows, and a check cycle as soon as one answers
+// with a new ETag. While any stream is down it falls back to a check every
+// PollInterval, and it reconnects with backoff.
+
+// watchPollTimeout is how long the registry may hold a watch; the client
+// waits a little longer
+const watchPollTimeout = 50 * time.Second
+
+// subscriptions maps each channel enabled overlays follow to their packages
+func subscriptions(cfg Config) map[string][]string {
+	subs := map[string][]string{}
+	seen := map[string]bool{}
+	for _, name := range orderedOverlays(cfg.Overlays) {
+		ov := cfg.Overlays[name]
+		if !ov.Enabled || seen[ov.Channel+"\x00"+ov.Package] {
+			continue
+		}
+		seen[ov.Channel+"\x00"+ov.Package] = true
+		subs[ov.Channel] = append(subs[ov.Channel], ov.Package)
+	}
+	for _, pkgs := range subs {
+		sort.Strings(pkgs)
+	}
+	return subs
+}
+
+// cmdWatch runs check cycles for the daemon, each under ops
+func cmdWatch(cfg Config, ops *sync.Mutex) {
+	host, err := hostName(cfg)
+	if err != nil {
+		log.Printf("watch: %v; following channel heads, outside any rollout", err)
+	}
+	interval := pollDuration(cfg.PollInterval)
+
+	trigger := make(chan string, 1)
+	var down atomic.Int32
+	for channel, pkgs := range subscriptions(cfg) {
+		go watchChannel(cfg.RegistryUrl, channel, host, pkgs, interval, trigger, &down)
+	}
+
+	check := func() {
+		ops.Lock()
+		defer ops.Unlock()
+		cmdCheck(cfg, "")
+	}
+
+	check()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case channel := <-trigger:
+			log.Printf("registry changed%s, checking", channelSuffix(channel))
+			check()
+		case <-ticker.C:
+			if n := down.Load(); n > 0 {
+				log.Printf("%d watch stream(s) down, polling", n)
+				check()
+			}
+		}
+	}
+}
+
+// watchChannel long-polls one channel forever, sending on trigger whenever
+// the listing for pkgs changes. down counts streams currently failing.
+func watchChannel(registryUrl, channel, host string, pkgs []string, interval time.Duration, trigger chan<- string, down *atomic.Int32) {
+	client := &http.Client{Timeout: watchPollTimeout + 30*time.Second}
+	etag := ""
+	failing := false
+	backoff := time.Second
+	for {
+		next, err := watchOnce(client, registryUrl, channel, host, pkgs, etag)
+		if err != nil {
+			if !failing {
+				failing = true
+				down.Add(1)
+				log.Printf("watch%s: %v; polling every %s until it reconnects", channelSuffix(channel), err, interval)
+			}
+			time.Sleep(backoff)
+			backoff = min(backoff*2, interval)
+			continue
+		}
+		if failing {
+			failing = false
+			down.Add(-1)
+			log.Printf("watch%s: reconnected", channelSuffix(channel))
+		}
+		backoff = time.Second
+
+		// The first answer only establishes the baseline; the check at
+		// startup (or the polling while down) covered it
+		if etag != "" && next != etag {
+			select {
+			case trigger <- channel:
+			default: // a check is already pending
+			}
+		}
+		etag = next
+	}
+}
+
+// watchOnce makes one /_watch request and returns the listing's ETag, which
+// is unchanged when the registry timed out with 304
+func watchOnce(client *http.Client, registryUrl, channel, host string, pkgs []string, etag string) (string, error) {
+	query := url.Values{}
+	if channel != "" {
+		query.Set("channel", channel)
+	}
+	if host != "" {
+		query.Set("host", host)
+	}
+	query.Set("packages", strings.Join(pkgs, ","))
+	query.Set("timeout", fmt.Sprint(int(watchPollTimeout.Seconds())))
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(registryUrl, "/")+"/_watch?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if next := resp.Header.Get("ETag"); next != "" {
+			return next, nil
+		}
+		return "", fmt.Errorf("registry sent no ETag")
+	case http.StatusNotModified:
+		return etag, nil
+	default:
+		return "", fmt.Errorf("registry returned %d", resp.StatusCode)
+	}
+}
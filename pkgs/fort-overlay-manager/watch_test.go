@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSubscriptionsGroupPackagesByChannel(t *testing.T) {
+	cfg := Config{Overlays: map[string]OverlayConfig{
+		"coffer":   {Package: "infra/coffer", Enabled: true},
+		"knockout": {Package: "infra/knockout", Channel: "canary", Enabled: true},
+		"ko-2":     {Package: "infra/knockout", Channel: "canary", Enabled: true},
+		"attic":    {Package: "infra/attic", Enabled: true},
+		"old":      {Package: "infra/old", Enabled: false},
+	}}
+	want := map[string][]string{
+		"":       {"infra/attic", "infra/coffer"},
+		"canary": {"infra/knockout"},
+	}
+	if got := subscriptions(cfg); !reflect.DeepEqual(got, want) {
+		t.Errorf("subscriptions = %v, want %v", got, want)
+	}
+}
+
+func TestWatchOnce(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		if req.URL.Path != "/_watch" || q.Get("channel") != "canary" || q.Get("host") != "ratched" || q.Get("packages") != "infra/a,infra/b" {
+			t.Errorf("unexpected watch request %s", req.URL)
+		}
+		if status == http.StatusOK {
+			w.Header().Set("ETag", `"v2"`)
+		} else if req.Header.Get("If-None-Match") != `"v1"` {
+			t.Errorf("If-None-Match = %q", req.Header.Get("If-None-Match"))
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	pkgs := []string{"infra/a", "infra/b"}
+
+	if etag, err := watchOnce(srv.Client(), srv.URL+"/", "canary", "ratched", pkgs, `"v1"`); err != nil || etag != `"v2"` {
+		t.Errorf("changed listing: etag %q, err %v", etag, err)
+	}
+	status = http.StatusNotModified
+	if etag, err := watchOnce(srv.Client(), srv.URL, "canary", "ratched", pkgs, `"v1"`); err != nil || etag != `"v1"` {
+		t.Errorf("timed out watch: etag %q, err %v", etag, err)
+	}
+	// e.g. a registry without /_watch: the daemon falls back to polling
+	status = http.StatusNotFound
+	if _, err := watchOnce(srv.Client(), srv.URL, "canary", "ratched", pkgs, `"v1"`); err == nil {
+		t.Error("404 not reported as a stream failure")
+	}
+}
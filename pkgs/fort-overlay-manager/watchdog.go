@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Post-activation watchdog. Health is otherwise checked only during the
+// PROVISIONAL window, after which a crash-looping service is left to
+// systemd's Restart= forever. An overlay that sets health.bake keeps being
+// watched for that many seconds after it goes permanent: each `watchdog` run
+// (a 30s timer, plus every check cycle) probes its health check once and
+// reads the units' systemd state. A version that degrades during the bake is
+// rolled back like a provisional failure — attempt recorded, so the check
+// cycle backs off instead of reinstalling it. health.type = "none" with a
+// bake watches systemd state alone.
+
+const (
+	bakeMaxRestarts      = 3 // automatic restarts tolerated per unit
+	bakeMaxProbeFailures = 3 // consecutive failed probes
+)
+
+// BakeState is the persisted watch on a freshly permanent version
+type BakeState struct {
+	StorePath string        `json:"storePath"`
+	Until     int64         `json:"until"`
+	Units     []string      `json:"units"`
+	Health    *HealthConfig `json:"health,omitempty"` // slot-substituted
+	Failures  int           `json:"failures"`         // consecutive failed probes
+}
+
+// serviceUnits lists the unit names a manifest runs as, in slot ("" when
+// replaced in place). Per-connection services behind an accepting socket
+// have no single unit to watch.
+func serviceUnits(name string, manifest *OverlayManifest, slot string) []string {
+	units := make([]string, 0, len(manifest.Services))
+	for svcName := range manifest.Services {
+		if s, ok := manifest.Sockets[svcName]; ok && s.Accept {
+			continue
+		}
+		if slot != "" {
+			units = append(units, slotUnitName(name, svcName, slot))
+		} else {
+			units = append(units, serviceUnitName(name, svcName))
+		}
+	}
+	return units
+}
+
+// startBake begins watching storePath, or drops a stale watch when the new
+// version asks for none
+func startBake(stateDir, name, storePath string, health *HealthConfig, units []string) {
+	if health == nil || health.Bake <= 0 {
+		clearBake(stateDir)
+		return
+	}
+	bake := BakeState{
+		StorePath: storePath,
+		Until:     time.Now().Add(time.Duration(health.Bake) * time.Second).Unix(),
+		Units:     units,
+	}
+	if health.enabled() {
+		bake.Health = health
+	}
+	saveBake(stateDir, bake)
+	log.Printf("[%s] baking for %ds", name, health.Bake)
+}
+
+// cmdWatchdog returns whether anything was rolled back
+func cmdWatchdog(cfg Config) bool {
+	rolledBack := false
+	for _, name := range orderedOverlays(cfg.Overlays) {
+		if watchBake(cfg, name) {
+			rolledBack = true
+		}
+	}
+	return rolledBack
+}
+
+// watchBake runs one watchdog tick for an overlay and returns whether it
+// rolled the overlay back
+func watchBake(cfg Config, name string) bool {
+	stateDir := filepath.Join(cfg.StateDir, name)
+	bake := loadBake(stateDir)
+	if bake == nil {
+		return false
+	}
+	// Another activation or a rollback is mid-flight; it owns the services
+	if state := readState(stateDir); state != "permanent" {
+		return false
+	}
+	if current := loadCurrentState(cfg.StateDir, name); current == nil || current.StorePath != bake.StorePath {
+		clearBake(stateDir)
+		return false
+	}
+
+	if reason := bakeDegraded(name, bake); reason != "" {
+		log.Printf("[%s] degraded during bake: %s, rolling back", name, reason)
+		clearBake(stateDir)
+		transition(stateDir, "rolling-back", bake.StorePath, "degraded during bake: "+reason)
+		rollbackOverlay(cfg, name, bake.StorePath, "degraded during bake: "+reason)
+		return true
+	}
+
+	if time.Now().Unix() >= bake.Until {
+		log.Printf("[%s] bake complete for %s", name, bake.StorePath)
+		clearBake(stateDir)
+		return false
+	}
+	saveBake(stateDir, *bake)
+	return false
+}
+
+// bakeDegraded probes once and returns why the version is unhealthy, or ""
+func bakeDegraded(name string, bake *BakeState) string {
+	for _, unit := range bake.Units {
+		out, err := exec.Command("systemctl", "show", unit, "--property=ActiveState,NRestarts").Output()
+		if err != nil {
+			log.Printf("[%s] watchdog: systemctl show %s: %v", name, unit, err)
+			continue
+		}
+		active, restarts := parseUnitShow(string(out))
+		if active == "failed" {
+			return fmt.Sprintf("%s failed", unit)
+		}
+		if restarts > bakeMaxRestarts {
+			return fmt.Sprintf("%s restarted %d times", unit, restarts)
+		}
+	}
+
+	if bake.Health != nil {
+		if probeHealth(bake.Health) {
+			bake.Failures = 0
+		} else {
+			bake.Failures++
+			log.Printf("[%s] watchdog: health probe failed (%d/%d)", name, bake.Failures, bakeMaxProbeFailures)
+			if bake.Failures >= bakeMaxProbeFailures {
+				return fmt.Sprintf("health probe failed %d times in a row", bake.Failures)
+			}
+		}
+	}
+	return ""
+}
+
+// parseUnitShow reads `systemctl show --property=ActiveState,NRestarts`
+func parseUnitShow(out string) (active string, restarts int) {
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "ActiveState":
+			active = value
+		case "NRestarts":
+			restarts, _ = strconv.Atoi(value)
+		}
+	}
+	return active, restarts
+}
+
+func loadBake(stateDir string) *BakeState {
+	data, err := os.ReadFile(filepath.Join(stateDir, "bake.json"))
+	if err != nil {
+		return nil
+	}
+	var bake BakeState
+	if err := json.Unmarshal(data, &bake); err != nil {
+		return nil
+	}
+	return &bake
+}
+
+func saveBake(stateDir string, bake BakeState) {
+	data, _ := json.MarshalIndent(bake, "", "  ")
+	os.MkdirAll(stateDir, 0755)
+	os.WriteFile(filepath.Join(stateDir, "bake.json"), data, 0644)
+}
+
+func clearBake(stateDir string) {
+	os.Remove(filepath.Join(stateDir, "bake.json"))
+}
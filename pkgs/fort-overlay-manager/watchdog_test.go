@@ -0,0 +1,100 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseUnitShow(t *testing.T) {
+	active, restarts := parseUnitShow("ActiveState=activating\nNRestarts=4\n")
+	if active != "activating" || restarts != 4 {
+		t.Errorf("got %q, %d; want activating, 4", active, restarts)
+	}
+	if active, restarts := parseUnitShow(""); active != "" || restarts != 0 {
+		t.Errorf("empty output: got %q, %d", active, restarts)
+	}
+}
+
+func TestStartBakeOnlyWhenRequested(t *testing.T) {
+	dir := t.TempDir()
+	startBake(dir, "coffer", "/nix/store/aaa-coffer", &HealthConfig{Type: "http", Bake: 600}, []string{"overlay-coffer.service"})
+
+	bake := loadBake(dir)
+	if bake == nil {
+		t.Fatal("bake not persisted")
+	}
+	if bake.StorePath != "/nix/store/aaa-coffer" || bake.Health == nil {
+		t.Errorf("bake = %+v", bake)
+	}
+	if until := time.Until(time.Unix(bake.Until, 0)); until < 590*time.Second || until > 600*time.Second {
+		t.Errorf("bake ends in %s, want ~10m", until)
+	}
+
+	// A following version without a bake must not inherit this watch
+	startBake(dir, "coffer", "/nix/store/bbb-coffer", &HealthConfig{Type: "http"}, nil)
+	if bake := loadBake(dir); bake != nil {
+		t.Errorf("stale bake kept: %+v", bake)
+	}
+}
+
+func TestStartBakeTypeNoneWatchesSystemdOnly(t *testing.T) {
+	dir := t.TempDir()
+	startBake(dir, "coffer", "/nix/store/aaa-coffer", &HealthConfig{Type: "none", Bake: 60}, []string{"overlay-coffer.service"})
+	if bake := loadBake(dir); bake == nil || bake.Health != nil {
+		t.Errorf("bake = %+v, want a watch without health probes", bake)
+	}
+}
+
+// One flaky probe is tolerated; a run of them is a degradation.
+func TestBakeDegradesAfterConsecutiveProbeFailures(t *testing.T) {
+	bake := &BakeState{Health: &HealthConfig{Type: "exec", Endpoint: "false"}}
+	for i := 1; i < bakeMaxProbeFailures; i++ {
+		if reason := bakeDegraded("coffer", bake); reason != "" {
+			t.Fatalf("probe %d: degraded early: %s", i, reason)
+		}
+	}
+	if reason := bakeDegraded("coffer", bake); reason == "" {
+		t.Fatal("not degraded after consecutive failures")
+	}
+
+	bake = &BakeState{Health: &HealthConfig{Type: "exec", Endpoint: "true"}, Failures: bakeMaxProbeFailures - 1}
+	if reason := bakeDegraded("coffer", bake); reason != "" || bake.Failures != 0 {
+		t.Errorf("healthy probe: reason %q, failures %d; want reset", reason, bake.Failures)
+	}
+}
+
+func TestWatchBakeDropsWatchOnReplacedVersion(t *testing.T) {
+	base := t.TempDir()
+	cfg := Config{StateDir: base, Overlays: map[string]OverlayConfig{"coffer": {Enabled: true}}}
+	stateDir := filepath.Join(base, "coffer")
+	writeState(stateDir, "permanent")
+	saveCurrentState(stateDir, OverlayState{StorePath: "/nix/store/bbb-coffer"})
+	saveBake(stateDir, BakeState{StorePath: "/nix/store/aaa-coffer", Until: time.Now().Add(time.Hour).Unix()})
+
+	watchBake(cfg, "coffer")
+	if bake := loadBake(stateDir); bake != nil {
+		t.Errorf("watch on a replaced version kept: %+v", bake)
+	}
+}
+
+func TestWatchBakeEndsAfterBakePeriod(t *testing.T) {
+	base := t.TempDir()
+	cfg := Config{StateDir: base, Overlays: map[string]OverlayConfig{"coffer": {Enabled: true}}}
+	stateDir := filepath.Join(base, "coffer")
+	writeState(stateDir, "permanent")
+	saveCurrentState(stateDir, OverlayState{StorePath: "/nix/store/aaa-coffer"})
+	saveBake(stateDir, BakeState{
+		StorePath: "/nix/store/aaa-coffer",
+		Until:     time.Now().Add(-time.Second).Unix(),
+		Health:    &HealthConfig{Type: "exec", Endpoint: "true"},
+	})
+
+	watchBake(cfg, "coffer")
+	if bake := loadBake(stateDir); bake != nil {
+		t.Errorf("bake still present after its period: %+v", bake)
+	}
+	if state := readState(stateDir); state != "permanent" {
+		t.Errorf("state = %q, want permanent", state)
+	}
+}
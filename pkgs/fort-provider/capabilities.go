@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// CapabilityInfo describes one capability in the capabilities listing
+type CapabilityInfo struct {
+	Name          string          `json:"name"`
+	Mode          string          `json:"mode"`
+	Format        string          `json:"format"`
+	TTL           int             `json:"ttl"`
+	Triggers      TriggerConfig   `json:"triggers"`
+	Description   string          `json:"description,omitempty"`
+	RequestSchema json.RawMessage `json:"requestSchema,omitempty"`
+	Allowed       []string        `json:"allowed"`
+}
+
+// handleCapabilities serves POST /fort/capabilities: the capabilities this
+// host exposes that origin is allowed to call, sorted by name. Lets the fort
+// CLI complete and validate calls, and cluster tooling map who provides what
+// to whom, without reading anyone's capabilities.json.
+func (h *AgentHandler) handleCapabilities(w http.ResponseWriter, origin string) {
+	list := h.capabilitiesFor(origin)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"capabilities": list})
+}
+
+// capabilitiesFor lists the capabilities origin may call. RBAC decides what is
+// listed; capabilities.json supplies the details, with the same defaults the
+// dispatcher applies (anything not async runs as rpc, legacy output format).
+func (h *AgentHandler) capabilitiesFor(origin string) []CapabilityInfo {
+	list := []CapabilityInfo{}
+	for name := range h.rbac {
+		if !h.isAllowed(name, origin) {
+			continue
+		}
+		cfg := h.capabilities[name]
+
+		mode := "rpc"
+		if cfg.Mode == "async" || cfg.NeedsGC {
+			mode = "async"
+		}
+		format := cfg.Format
+		if format == "" {
+			format = "legacy"
+		}
+		triggers := cfg.Triggers
+		if triggers.Systemd == nil {
+			triggers.Systemd = []string{}
+		}
+
+		list = append(list, CapabilityInfo{
+			Name:          name,
+			Mode:          mode,
+			Format:        format,
+			TTL:           cfg.TTL,
+			Triggers:      triggers,
+			Description:   cfg.Description,
+			RequestSchema: cfg.RequestSchema,
+			Allowed:       h.rbac[name],
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -0,0 +1,417 @@
+package main
+
+// Local development cluster
+//
+// `fort-provider dev-cluster` runs N providers in one process, each on its own
+// localhost port with its own config/state directories, a throwaway ed25519
+// key and a shared hosts.json. Peers reach each other through signedPeer, so
+// the full need -> handler -> callback -> fulfilment path (and GC, rotation,
+// revocation, RBAC) runs without real hosts, nginx or the fort CLI.
+//
+// Topology: hosts form a ring. Every host provides:
+//   needs - rpc, lists needs.json (what GC queries)
+//   echo  - rpc, returns the request body
+//   token - async, issues a fresh random token per state key; keys listed
+//           one per line in <host>/etc/revoked are left out (revocation)
+// and host i declares need token-default from host (i+1) % N, stored by a
+// stub need handler at <host>/state/token-default.json.
+//
+// Handlers are this binary re-invoked as `fort-provider dev-handler <kind>`.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// devCluster is a set of in-process providers sharing one hosts.json
+type devCluster struct {
+	dir       string
+	peersFile string
+	hosts     []*devHost
+}
+
+// devHost is one provider in a devCluster
+type devHost struct {
+	name    string
+	keyPath string
+	url     string
+	env     Env
+	handler *AgentHandler
+	server  *http.Server
+}
+
+// devCapabilities is the capabilities.json installed on every dev host
+var devCapabilities = map[string]CapabilityConfig{
+	"needs": {Mode: "rpc"},
+	"echo":  {Mode: "rpc"},
+	"token": {Mode: "async", NeedsGC: true, TTL: 86400, Format: "legacy"},
+}
+
+// newDevCluster lays out n hosts under dir and starts serving them. exe is the
+// binary the stub handler scripts exec (normally os.Executable()). basePort 0
+// picks free ports.
+func newDevCluster(dir string, n int, exe string, basePort int) (*devCluster, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("need at least one host")
+	}
+	c := &devCluster{dir: dir, peersFile: filepath.Join(dir, "peers.json")}
+
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("host%d", i)
+	}
+
+	// Keys and listeners first: hosts.json and peers.json need all of them
+	hosts := make(map[string]HostInfo)
+	peers := make(map[string]string)
+	listeners := make([]net.Listener, n)
+	for i, name := range names {
+		hostDir := filepath.Join(dir, name)
+		for _, sub := range []string{"etc/handlers", "etc/need-handlers", "state"} {
+			if err := os.MkdirAll(filepath.Join(hostDir, sub), 0755); err != nil {
+				return nil, err
+			}
+		}
+
+		keyPath := filepath.Join(hostDir, "ssh_host_ed25519_key")
+		pubkey, err := generateDevKey(keyPath, name)
+		if err != nil {
+			return nil, err
+		}
+		hosts[name] = HostInfo{Pubkey: pubkey}
+
+		addr := "127.0.0.1:0"
+		if basePort > 0 {
+			addr = fmt.Sprintf("127.0.0.1:%d", basePort+i)
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("listen for %s: %w", name, err)
+		}
+		listeners[i] = ln
+		peers[name] = "http://" + ln.Addr().String()
+
+		c.hosts = append(c.hosts, &devHost{name: name, keyPath: keyPath, url: peers[name]})
+	}
+
+	sharedHosts := filepath.Join(dir, "hosts.json")
+	if err := writeJSON(sharedHosts, hosts); err != nil {
+		closeListeners(listeners)
+		return nil, err
+	}
+	if err := writeJSON(c.peersFile, peers); err != nil {
+		closeListeners(listeners)
+		return nil, err
+	}
+
+	rbac := make(map[string][]string)
+	for capName := range devCapabilities {
+		rbac[capName] = names
+	}
+
+	for i, h := range c.hosts {
+		etc := filepath.Join(dir, h.name, "etc")
+		state := filepath.Join(dir, h.name, "state")
+		provider := names[(i+1)%n]
+
+		needs := []NeedConfig{{
+			ID:         "token-default",
+			Capability: "token",
+			From:       provider,
+			Request:    map[string]interface{}{},
+			Handler:    filepath.Join(etc, "need-handlers", "token-default"),
+			NagSeconds: 60,
+		}}
+
+		err := firstErr(
+			os.Symlink(sharedHosts, filepath.Join(etc, "hosts.json")),
+			writeJSON(filepath.Join(etc, "rbac.json"), rbac),
+			writeJSON(filepath.Join(etc, "capabilities.json"), devCapabilities),
+			writeJSON(filepath.Join(etc, "needs.json"), needs),
+			writeDevHandler(filepath.Join(etc, "handlers", "needs"), exe, "needs", etc),
+			writeDevHandler(filepath.Join(etc, "handlers", "echo"), exe, "echo"),
+			writeDevHandler(filepath.Join(etc, "handlers", "token"), exe, "token", filepath.Join(etc, "revoked")),
+			writeDevHandler(needs[0].Handler, exe, "store", filepath.Join(state, "token-default.json")),
+		)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("write config for %s: %w", h.name, err)
+		}
+
+		h.env = Env{
+			ConfigDir: etc,
+			StateDir:  state,
+			Peer:      &signedPeer{origin: h.name, keyPath: h.keyPath, peers: peers},
+		}
+		handler, err := NewAgentHandler(h.env)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("start %s: %w", h.name, err)
+		}
+		h.handler = handler
+
+		mux := http.NewServeMux()
+		mux.Handle("/fort/", handler)
+		h.server = &http.Server{Handler: mux}
+		go h.server.Serve(listeners[i])
+	}
+
+	return c, nil
+}
+
+// host returns the named dev host, or nil
+func (c *devCluster) host(name string) *devHost {
+	for _, h := range c.hosts {
+		if h.name == name {
+			return h
+		}
+	}
+	return nil
+}
+
+// fulfill makes one pass of the consumer loop on every host: each declared
+// need is requested from its provider with _fort_need_id injected. Async
+// capabilities answer via callback; RPC responses go straight to the need
+// handler. Mirrors common/fort/control-plane/fulfill.nix minus nag pacing.
+func (c *devCluster) fulfill() {
+	for _, h := range c.hosts {
+		for id, need := range h.handler.needs {
+			request := make(map[string]interface{})
+			for k, v := range need.Request {
+				request[k] = v
+			}
+			request["_fort_need_id"] = id
+			body, _ := json.Marshal(request)
+
+			output, err := h.env.Peer.Call(need.From, need.Capability, body)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[dev] %s/%s: %s failed: %v\n", h.name, id, need.From, err)
+				continue
+			}
+
+			var envelope struct {
+				Body   json.RawMessage `json:"body"`
+				Status int             `json:"status"`
+			}
+			json.Unmarshal(output, &envelope)
+			if envelope.Status == http.StatusAccepted {
+				fmt.Fprintf(os.Stderr, "[dev] %s/%s: accepted by %s, awaiting callback\n", h.name, id, need.From)
+				continue
+			}
+
+			cmd := exec.Command(need.Handler)
+			cmd.Stdin = bytes.NewReader(envelope.Body)
+			satisfied := cmd.Run() == nil
+			h.handler.updateFulfillmentState(id, satisfied)
+		}
+	}
+}
+
+// close stops every provider
+func (c *devCluster) close() {
+	for _, h := range c.hosts {
+		if h.server != nil {
+			h.server.Close()
+		}
+	}
+}
+
+// runDevCluster implements `fort-provider dev-cluster`
+func runDevCluster(args []string) error {
+	fs := flag.NewFlagSet("dev-cluster", flag.ExitOnError)
+	n := fs.Int("hosts", 3, "Number of providers to run")
+	dir := fs.String("dir", "", "Directory for keys, config and state (default: a temp dir removed on exit)")
+	basePort := fs.Int("port", 0, "First port to listen on; hosts use consecutive ports (default: random)")
+	fs.Parse(args)
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locate own executable: %w", err)
+	}
+
+	root := *dir
+	if root == "" {
+		root, err = os.MkdirTemp("", "fort-dev-cluster-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(root)
+	} else if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+
+	c, err := newDevCluster(root, *n, exe, *basePort)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	c.fulfill()
+
+	fmt.Printf("dev cluster: %d hosts in %s\n", len(c.hosts), root)
+	for _, h := range c.hosts {
+		fmt.Printf("  %-8s %s\n", h.name, h.url)
+	}
+	h := c.hosts[0]
+	fmt.Printf("\nRun one-shot modes against a host, e.g. GC or a forced trigger on %s:\n", h.name)
+	fmt.Printf("  FORT_CONFIG_DIR=%s FORT_STATE_DIR=%s FORT_PEERS=%s FORT_ORIGIN=%s FORT_SSH_KEY=%s %s --gc\n",
+		h.env.ConfigDir, h.env.StateDir, c.peersFile, h.name, h.keyPath, exe)
+	fmt.Printf("\nCtrl-C to stop.\n")
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	return nil
+}
+
+// runDevHandler implements the stub handlers used by dev-cluster hosts
+func runDevHandler(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: dev-handler <needs|echo|token|store> [arg]")
+	}
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "echo":
+		os.Stdout.Write(input)
+		return nil
+
+	case "needs":
+		// needs.json lives in the host's config dir, passed as the argument
+		if len(args) < 2 {
+			return fmt.Errorf("needs: config dir required")
+		}
+		paths := []string{}
+		data, err := os.ReadFile(filepath.Join(args[1], "needs.json"))
+		if err == nil {
+			var needs []NeedConfig
+			if err := json.Unmarshal(data, &needs); err != nil {
+				return err
+			}
+			for _, need := range needs {
+				paths = append(paths, needIDToPath(need.Capability, need.ID))
+			}
+		}
+		return json.NewEncoder(os.Stdout).Encode(map[string][]string{"needs": paths})
+
+	case "token":
+		// Optional argument: file of state keys to revoke, one per line
+		revoked := make(map[string]bool)
+		if len(args) >= 2 {
+			if data, err := os.ReadFile(args[1]); err == nil {
+				for _, key := range strings.Fields(string(data)) {
+					revoked[key] = true
+				}
+			}
+		}
+		var in AsyncHandlerInput
+		if err := json.Unmarshal(input, &in); err != nil {
+			return err
+		}
+		out := make(map[string]interface{})
+		for key := range in {
+			if revoked[key] {
+				continue
+			}
+			buf := make([]byte, 16)
+			rand.Read(buf)
+			out[key] = map[string]interface{}{
+				"token":     hex.EncodeToString(buf),
+				"issued_at": time.Now().Unix(),
+			}
+		}
+		return json.NewEncoder(os.Stdout).Encode(out)
+
+	case "store":
+		// Need handler: an empty payload is a revocation, which must leave
+		// the need unsatisfied
+		if len(args) < 2 {
+			return fmt.Errorf("store: path required")
+		}
+		trimmed := strings.TrimSpace(string(input))
+		if trimmed == "" || trimmed == "{}" {
+			os.Remove(args[1])
+			return fmt.Errorf("empty payload (revoked)")
+		}
+		return os.WriteFile(args[1], input, 0600)
+	}
+
+	return fmt.Errorf("unknown dev handler %q", args[0])
+}
+
+// generateDevKey creates an unencrypted ed25519 key and returns its public key
+// in hosts.json form ("ssh-ed25519 AAAA...")
+func generateDevKey(keyPath, comment string) (string, error) {
+	os.Remove(keyPath)
+	os.Remove(keyPath + ".pub")
+	cmd := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", comment, "-f", keyPath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("ssh-keygen: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	pub, err := os.ReadFile(keyPath + ".pub")
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(pub))
+	if len(fields) < 2 {
+		return "", fmt.Errorf("malformed public key %s.pub", keyPath)
+	}
+	return fields[0] + " " + fields[1], nil
+}
+
+// writeDevHandler writes an executable script that re-invokes exe as a stub handler
+func writeDevHandler(path, exe string, args ...string) error {
+	quoted := []string{shellQuote(exe), "dev-handler"}
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	script := "#!/bin/sh\nexec " + strings.Join(quoted, " ") + "\n"
+	return os.WriteFile(path, []byte(script), 0755)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func firstErr(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, ln := range listeners {
+		if ln != nil {
+			ln.Close()
+		}
+	}
+}
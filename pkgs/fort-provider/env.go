@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultConfigDir = "/etc/fort"
+	defaultStateDir  = "/var/lib/fort"
+	defaultSSHKey    = "/etc/ssh/ssh_host_ed25519_key"
+)
+
+// Env locates a provider's configuration and state and says how it reaches
+// peers. Production runs with the fixed /etc/fort + /var/lib/fort layout and
+// the fort CLI; every piece can be redirected so a whole cluster can run out
+// of a scratch directory (see dev-cluster).
+type Env struct {
+	ConfigDir string // hosts.json, rbac.json, capabilities.json, needs.json, handlers/
+	StateDir  string // provider-state.json, fulfillment-state.json, handles/
+	Peer      Peer   // outbound calls: callbacks and GC needs queries
+}
+
+func (e Env) hostsFile() string {
+	return filepath.Join(e.ConfigDir, "hosts.json")
+}
+
+func (e Env) rbacFile() string {
+	return filepath.Join(e.ConfigDir, "rbac.json")
+}
+
+func (e Env) capabilitiesFile() string {
+	return filepath.Join(e.ConfigDir, "capabilities.json")
+}
+
+func (e Env) needsFile() string {
+	return filepath.Join(e.ConfigDir, "needs.json")
+}
+
+func (e Env) handlersDir() string {
+	return filepath.Join(e.ConfigDir, "handlers")
+}
+
+func (e Env) handlesDir() string {
+	return filepath.Join(e.StateDir, "handles")
+}
+
+func (e Env) fulfillmentStateFile() string {
+	return filepath.Join(e.StateDir, "fulfillment-state.json")
+}
+
+func (e Env) providerStateFile() string {
+	return filepath.Join(e.StateDir, "provider-state.json")
+}
+
+// NewEnv builds an Env for the given directories. With an empty peersFile,
+// peers are reached through the fort CLI as in production. Otherwise
+// peersFile is a JSON map of hostname -> base URL and requests are signed
+// in-process with FORT_SSH_KEY as FORT_ORIGIN (the same variables the fort
+// CLI honours), presenting that key as a TLS client certificate to https
+// peers.
+func NewEnv(configDir, stateDir, peersFile string) (Env, error) {
+	env := Env{ConfigDir: configDir, StateDir: stateDir, Peer: fortCLIPeer{}}
+	if peersFile == "" {
+		return env, nil
+	}
+
+	data, err := os.ReadFile(peersFile)
+	if err != nil {
+		return Env{}, fmt.Errorf("read peers file: %w", err)
+	}
+	var peers map[string]string
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return Env{}, fmt.Errorf("parse peers file: %w", err)
+	}
+
+	origin := os.Getenv("FORT_ORIGIN")
+	if origin == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return Env{}, fmt.Errorf("determine origin: %w", err)
+		}
+		origin, _, _ = strings.Cut(hostname, ".")
+	}
+
+	peer := &signedPeer{
+		origin:  origin,
+		keyPath: envOr("FORT_SSH_KEY", defaultSSHKey),
+		peers:   peers,
+	}
+	// An ed25519 key doubles as the TLS client certificate, so https peers
+	// get mTLS and channel binding; other keys fall back to signature-only
+	if key, err := loadSSHEd25519PrivateKey(peer.keyPath); err == nil {
+		if cert, err := newClientCert(origin, key); err == nil {
+			peer.clientCert = &cert
+		}
+	}
+	env.Peer = peer
+	return env, nil
+}
+
+// envOr returns the environment variable key, or fallback when unset
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
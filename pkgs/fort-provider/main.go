@@ -19,6 +19,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -39,17 +40,8 @@ import (
 )
 
 const (
-	configDir             = "/etc/fort"
-	hostsFile             = configDir + "/hosts.json"
-	rbacFile              = configDir + "/rbac.json"
-	capabilitiesFile      = configDir + "/capabilities.json"
-	needsFile             = configDir + "/needs.json"
-	handlersDir           = configDir + "/handlers"
-	handlesDir            = "/var/lib/fort/handles"
-	fulfillmentStateFile  = "/var/lib/fort/fulfillment-state.json"
-	providerStateFile     = "/var/lib/fort/provider-state.json"
-	maxTimestampDrift     = 5 * time.Minute
-	signatureNamespace    = "fort-agent" // Keep for signing compatibility during rollout
+	maxTimestampDrift  = 5 * time.Minute
+	signatureNamespace = "fort-agent" // Keep for signing compatibility during rollout
 )
 
 // HostInfo contains public key info for a peer host
@@ -65,6 +57,10 @@ type CapabilityConfig struct {
 	CacheResponse bool          `json:"cacheResponse"` // persist responses for reuse
 	Triggers      TriggerConfig `json:"triggers"`      // boot/systemd triggers
 	Format        string        `json:"format"`        // "legacy" or "symmetric"
+
+	// Discovery metadata, reported by the capabilities route only
+	Description   string          `json:"description,omitempty"`
+	RequestSchema json.RawMessage `json:"requestSchema,omitempty"` // JSON Schema for the request body
 }
 
 // TriggerConfig defines when to automatically invoke a capability handler
@@ -78,6 +74,10 @@ type ProviderStateEntry struct {
 	Request   json.RawMessage `json:"request"`             // original request payload
 	Response  json.RawMessage `json:"response,omitempty"`  // handler response (if fulfilled)
 	UpdatedAt int64           `json:"updated_at"`          // unix timestamp of last update
+
+	// Outcome of the last callback delivery, surfaced via status
+	CallbackAt    int64  `json:"callback_at,omitempty"`
+	CallbackError string `json:"callback_error,omitempty"`
 }
 
 // ProviderState is the full provider state: capability -> origin:need -> entry
@@ -101,47 +101,108 @@ type FulfillmentState struct {
 
 // AgentHandler implements http.Handler for the agent FastCGI
 type AgentHandler struct {
+	env           Env                         // config/state locations and peer transport
 	hosts         map[string]HostInfo         // hostname -> pubkey
 	rbac          map[string][]string         // capability -> allowed hostnames
 	capabilities  map[string]CapabilityConfig // capability -> config
 	needs         map[string]NeedConfig       // need id -> config
 	providerState ProviderState               // async capability state
+
+	clientAuth  string         // transport client authentication (see mtls.go)
+	clientCAs   *x509.CertPool // optional cluster CA for client certificates
+	behindProxy bool           // TLS terminated by a loopback proxy that forwards the client cert
+
+	mu        sync.Mutex // serializes async handler runs and provider state writes
+	fulfillMu sync.Mutex // serializes fulfillment-state.json read-modify-write
 }
 
 func main() {
-	// Check for --trigger mode (systemd trigger invocation)
-	// Optional --force flag omits cached responses from handler input
-	if len(os.Args) >= 3 && os.Args[1] == "--trigger" {
-		capability := os.Args[2]
-		force := len(os.Args) >= 4 && os.Args[3] == "--force"
-		if err := runTrigger(capability, force); err != nil {
-			fmt.Fprintf(os.Stderr, "trigger failed: %v\n", err)
+	// dev-cluster: N in-process providers on localhost (local development)
+	if len(os.Args) >= 2 && os.Args[1] == "dev-cluster" {
+		if err := runDevCluster(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "dev-cluster failed: %v\n", err)
 			os.Exit(1)
 		}
 		os.Exit(0)
 	}
 
-	// Check for --gc mode (garbage collection sweep)
-	if len(os.Args) >= 2 && os.Args[1] == "--gc" {
-		if err := runGC(); err != nil {
-			fmt.Fprintf(os.Stderr, "gc failed: %v\n", err)
+	// client-cert: wrap an SSH key in a TLS client certificate (for curl)
+	if len(os.Args) >= 2 && os.Args[1] == "client-cert" {
+		if err := runClientCert(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "client-cert failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// dev-handler: stub capability/need handlers installed by dev-cluster
+	if len(os.Args) >= 2 && os.Args[1] == "dev-handler" {
+		if err := runDevHandler(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "dev-handler failed: %v\n", err)
 			os.Exit(1)
 		}
 		os.Exit(0)
 	}
 
-	// Parse flags for --listen mode (direct HTTPS, used on darwin)
+	// Paths default to /etc/fort and /var/lib/fort; FORT_CONFIG_DIR,
+	// FORT_STATE_DIR and FORT_PEERS override them, and the flags override both
+	configDir := flag.String("config-dir", envOr("FORT_CONFIG_DIR", defaultConfigDir), "Directory holding hosts.json, rbac.json, capabilities.json, needs.json and handlers/")
+	stateDir := flag.String("state-dir", envOr("FORT_STATE_DIR", defaultStateDir), "Directory holding provider and fulfillment state")
+	peersFile := flag.String("peers", os.Getenv("FORT_PEERS"), "JSON map of hostname to base URL; when set, peers are called directly instead of via the fort CLI")
+
+	// --trigger mode (systemd trigger invocation)
+	// Optional --force flag omits cached responses from handler input
+	trigger := flag.String("trigger", "", "Run the handler for a capability and dispatch callbacks")
+	force := flag.Bool("force", false, "With --trigger: omit cached responses from handler input")
+
+	// --gc mode (garbage collection sweep)
+	gc := flag.Bool("gc", false, "Run a garbage collection sweep")
+
+	// --listen mode (direct HTTPS, used on darwin)
 	listenAddr := flag.String("listen", "", "Listen address for direct HTTPS (e.g., 0.0.0.0:443)")
 	tlsCert := flag.String("tls-cert", "", "Path to TLS certificate")
 	tlsKey := flag.String("tls-key", "", "Path to TLS private key")
+
+	// Transport client authentication: with --listen the provider checks the
+	// TLS session itself; over FastCGI, nginx passes the client certificate
+	clientAuth := flag.String("client-auth", clientAuthOff, "Client certificate policy: off, optional or require")
+	clientCA := flag.String("client-ca", "", "PEM bundle of the cluster CA allowed to issue client certificates")
+	behindProxy := flag.Bool("behind-proxy", false, "With --listen: trust X-Fort-Client-Cert from a loopback TLS-terminating proxy")
 	flag.Parse()
 
-	handler, err := NewAgentHandler()
+	env, err := NewEnv(*configDir, *stateDir, *peersFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to initialize: %v\n", err)
 		os.Exit(1)
 	}
 
+	if *trigger != "" {
+		if err := runTrigger(env, *trigger, *force); err != nil {
+			fmt.Fprintf(os.Stderr, "trigger failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *gc {
+		if err := runGC(env); err != nil {
+			fmt.Fprintf(os.Stderr, "gc failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	handler, err := NewAgentHandler(env)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to initialize: %v\n", err)
+		os.Exit(1)
+	}
+	if err := handler.configureClientAuth(*clientAuth, *clientCA); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to initialize: %v\n", err)
+		os.Exit(1)
+	}
+	handler.behindProxy = *behindProxy
+
 	if *listenAddr != "" {
 		// Direct HTTPS mode (darwin — no nginx/fcgi)
 		if *tlsCert == "" || *tlsKey == "" {
@@ -165,6 +226,7 @@ func main() {
 			Handler: mux,
 			TLSConfig: &tls.Config{
 				Certificates: []tls.Certificate{cert},
+				ClientAuth:   tlsClientAuth(*clientAuth),
 			},
 		}
 
@@ -189,8 +251,9 @@ func main() {
 }
 
 // NewAgentHandler loads configuration and returns a ready handler
-func NewAgentHandler() (*AgentHandler, error) {
+func NewAgentHandler(env Env) (*AgentHandler, error) {
 	h := &AgentHandler{
+		env:           env,
 		hosts:         make(map[string]HostInfo),
 		rbac:          make(map[string][]string),
 		capabilities:  make(map[string]CapabilityConfig),
@@ -199,7 +262,7 @@ func NewAgentHandler() (*AgentHandler, error) {
 	}
 
 	// Load hosts.json
-	hostsData, err := os.ReadFile(hostsFile)
+	hostsData, err := os.ReadFile(env.hostsFile())
 	if err != nil {
 		return nil, fmt.Errorf("read hosts.json: %w", err)
 	}
@@ -208,7 +271,7 @@ func NewAgentHandler() (*AgentHandler, error) {
 	}
 
 	// Load rbac.json (optional - may not exist if no capabilities declared)
-	rbacData, err := os.ReadFile(rbacFile)
+	rbacData, err := os.ReadFile(env.rbacFile())
 	if err == nil {
 		if err := json.Unmarshal(rbacData, &h.rbac); err != nil {
 			return nil, fmt.Errorf("parse rbac.json: %w", err)
@@ -216,7 +279,7 @@ func NewAgentHandler() (*AgentHandler, error) {
 	}
 
 	// Load capabilities.json (optional)
-	capData, err := os.ReadFile(capabilitiesFile)
+	capData, err := os.ReadFile(env.capabilitiesFile())
 	if err == nil {
 		if err := json.Unmarshal(capData, &h.capabilities); err != nil {
 			return nil, fmt.Errorf("parse capabilities.json: %w", err)
@@ -224,7 +287,7 @@ func NewAgentHandler() (*AgentHandler, error) {
 	}
 
 	// Load needs.json (optional - array of needs, indexed by id)
-	needsData, err := os.ReadFile(needsFile)
+	needsData, err := os.ReadFile(env.needsFile())
 	if err == nil {
 		var needsList []NeedConfig
 		if err := json.Unmarshal(needsData, &needsList); err != nil {
@@ -236,7 +299,7 @@ func NewAgentHandler() (*AgentHandler, error) {
 	}
 
 	// Load provider state (optional - persists across restarts)
-	stateData, err := os.ReadFile(providerStateFile)
+	stateData, err := os.ReadFile(env.providerStateFile())
 	if err == nil {
 		if err := json.Unmarshal(stateData, &h.providerState); err != nil {
 			return nil, fmt.Errorf("parse provider-state.json: %w", err)
@@ -244,7 +307,7 @@ func NewAgentHandler() (*AgentHandler, error) {
 	}
 
 	// Ensure handles directory exists
-	os.MkdirAll(handlesDir, 0700)
+	os.MkdirAll(env.handlesDir(), 0700)
 
 	// Run boot-time initialization for capabilities with triggers.initialize = true
 	h.initializeCapabilities()
@@ -294,7 +357,7 @@ func (h *AgentHandler) initializeCapabilities() {
 		}
 
 		// Invoke handler
-		handlerPath := filepath.Join(handlersDir, capName)
+		handlerPath := filepath.Join(h.env.handlersDir(), capName)
 		if _, err := os.Stat(handlerPath); os.IsNotExist(err) {
 			fmt.Fprintf(os.Stderr, "[init] %s: handler not found at %s\n", capName, handlerPath)
 			continue
@@ -388,6 +451,44 @@ func (h *AgentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	origin, ok := h.authenticate(w, r, path, body)
+	if !ok {
+		return
+	}
+
+	// Built-in discovery route: any authenticated caller may ask, the
+	// listing itself is filtered by RBAC
+	if capability == "capabilities" {
+		h.handleCapabilities(w, origin)
+		return
+	}
+
+	// Check RBAC
+	if _, ok := h.rbac[capability]; !ok {
+		h.errorResponse(w, http.StatusNotFound, "capability not found")
+		return
+	}
+	if !h.isAllowed(capability, origin) {
+		h.errorResponse(w, http.StatusForbidden, "not authorized for this capability")
+		return
+	}
+
+	// Execute handler
+	handlerPath := filepath.Join(h.env.handlersDir(), capability)
+	if _, err := os.Stat(handlerPath); os.IsNotExist(err) {
+		h.errorResponse(w, http.StatusNotFound, "handler not found")
+		return
+	}
+
+	// Get capability config for GC handling
+	capConfig := h.capabilities[capability]
+
+	h.executeHandler(w, handlerPath, capability, origin, body, capConfig)
+}
+
+// authenticate validates the X-Fort-* headers of a request to path and returns
+// the caller's origin. On failure the error response has already been written.
+func (h *AgentHandler) authenticate(w http.ResponseWriter, r *http.Request, path string, body []byte) (string, bool) {
 	// Extract auth headers
 	origin := r.Header.Get("X-Fort-Origin")
 	timestampStr := r.Header.Get("X-Fort-Timestamp")
@@ -395,14 +496,14 @@ func (h *AgentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	if origin == "" || timestampStr == "" || signatureB64 == "" {
 		h.errorResponse(w, http.StatusUnauthorized, "missing auth headers")
-		return
+		return "", false
 	}
 
 	// Validate timestamp
 	timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
 	if err != nil {
 		h.errorResponse(w, http.StatusUnauthorized, "invalid timestamp")
-		return
+		return "", false
 	}
 	requestTime := time.Unix(timestamp, 0)
 	drift := time.Since(requestTime)
@@ -411,58 +512,45 @@ func (h *AgentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	if drift > maxTimestampDrift {
 		h.errorResponse(w, http.StatusUnauthorized, "timestamp drift too large")
-		return
+		return "", false
 	}
 
 	// Look up origin's public key
 	hostInfo, ok := h.hosts[origin]
 	if !ok {
 		h.errorResponse(w, http.StatusUnauthorized, "unknown origin")
-		return
+		return "", false
+	}
+
+	// Check the transport: client certificate and channel binding
+	binding, err := h.checkTransport(r, origin, hostInfo.Pubkey)
+	if err != nil {
+		h.errorResponse(w, http.StatusUnauthorized, fmt.Sprintf("transport authentication failed: %v", err))
+		return "", false
 	}
 
 	// Verify signature
-	if err := h.verifySignature(r.Method, path, timestampStr, body, signatureB64, origin, hostInfo.Pubkey); err != nil {
+	if err := h.verifySignature(r.Method, path, timestampStr, body, binding, signatureB64, origin, hostInfo.Pubkey); err != nil {
 		h.errorResponse(w, http.StatusUnauthorized, fmt.Sprintf("signature verification failed: %v", err))
-		return
+		return "", false
 	}
 
-	// Check RBAC
-	allowedHosts, ok := h.rbac[capability]
-	if !ok {
-		h.errorResponse(w, http.StatusNotFound, "capability not found")
-		return
-	}
-	allowed := false
-	for _, host := range allowedHosts {
+	return origin, true
+}
+
+// isAllowed reports whether origin may call capability per rbac.json
+func (h *AgentHandler) isAllowed(capability, origin string) bool {
+	for _, host := range h.rbac[capability] {
 		if host == origin {
-			allowed = true
-			break
+			return true
 		}
 	}
-	if !allowed {
-		h.errorResponse(w, http.StatusForbidden, "not authorized for this capability")
-		return
-	}
-
-	// Execute handler
-	handlerPath := filepath.Join(handlersDir, capability)
-	if _, err := os.Stat(handlerPath); os.IsNotExist(err) {
-		h.errorResponse(w, http.StatusNotFound, "handler not found")
-		return
-	}
-
-	// Get capability config for GC handling
-	capConfig := h.capabilities[capability]
-
-	h.executeHandler(w, handlerPath, capability, origin, body, capConfig)
+	return false
 }
 
 // verifySignature checks the SSH signature against the canonical request string
-func (h *AgentHandler) verifySignature(method, path, timestamp string, body []byte, signatureB64, origin, pubkey string) error {
-	// Build canonical string: METHOD\nPATH\nTIMESTAMP\nSHA256(body)
-	bodyHash := sha256.Sum256(body)
-	canonical := fmt.Sprintf("%s\n%s\n%s\n%s", method, path, timestamp, hex.EncodeToString(bodyHash[:]))
+func (h *AgentHandler) verifySignature(method, path, timestamp string, body []byte, binding, signatureB64, origin, pubkey string) error {
+	canonical := canonicalRequest(method, path, timestamp, body, binding)
 
 	// Decode signature from base64
 	sigBytes, err := base64.StdEncoding.DecodeString(signatureB64)
@@ -653,6 +741,11 @@ func parseHandlerOutput(data []byte, format string) (AsyncHandlerOutput, error)
 
 // executeAsyncHandler runs an async handler with aggregate state
 func (h *AgentHandler) executeAsyncHandler(w http.ResponseWriter, handlerPath, capability, origin string, body []byte, capConfig CapabilityConfig) {
+	// Requests are served concurrently; the handler sees (and rewrites) the
+	// whole capability state, so runs must not interleave
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
 	// Record the new/updated request in state, get the state key for this request
 	triggerKey := h.recordProviderRequest(capability, origin, json.RawMessage(body))
 
@@ -789,7 +882,7 @@ func computeHandle(data []byte) string {
 func (h *AgentHandler) persistHandle(handle string, data []byte, ttl int) error {
 	// Use handle as filename (replace : with -)
 	filename := strings.ReplaceAll(handle, ":", "-")
-	handlePath := filepath.Join(handlesDir, filename)
+	handlePath := filepath.Join(h.env.handlesDir(), filename)
 
 	// Write data
 	if err := os.WriteFile(handlePath, data, 0600); err != nil {
@@ -839,42 +932,8 @@ func (h *AgentHandler) handleCallback(w http.ResponseWriter, r *http.Request, pa
 		return
 	}
 
-	// Extract and validate auth headers
-	origin := r.Header.Get("X-Fort-Origin")
-	timestampStr := r.Header.Get("X-Fort-Timestamp")
-	signatureB64 := r.Header.Get("X-Fort-Signature")
-
-	if origin == "" || timestampStr == "" || signatureB64 == "" {
-		h.errorResponse(w, http.StatusUnauthorized, "missing auth headers")
-		return
-	}
-
-	// Validate timestamp
-	timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
-	if err != nil {
-		h.errorResponse(w, http.StatusUnauthorized, "invalid timestamp")
-		return
-	}
-	requestTime := time.Unix(timestamp, 0)
-	drift := time.Since(requestTime)
-	if drift < 0 {
-		drift = -drift
-	}
-	if drift > maxTimestampDrift {
-		h.errorResponse(w, http.StatusUnauthorized, "timestamp drift too large")
-		return
-	}
-
-	// Look up origin's public key
-	hostInfo, ok := h.hosts[origin]
+	origin, ok := h.authenticate(w, r, path, body)
 	if !ok {
-		h.errorResponse(w, http.StatusUnauthorized, "unknown origin")
-		return
-	}
-
-	// Verify signature
-	if err := h.verifySignature(r.Method, path, timestampStr, body, signatureB64, origin, hostInfo.Pubkey); err != nil {
-		h.errorResponse(w, http.StatusUnauthorized, fmt.Sprintf("signature verification failed: %v", err))
 		return
 	}
 
@@ -944,9 +1003,12 @@ func (h *AgentHandler) handleCallback(w http.ResponseWriter, r *http.Request, pa
 func (h *AgentHandler) updateFulfillmentState(needID string, satisfied bool) error {
 	fmt.Fprintf(os.Stderr, "[state] updating %s to satisfied=%v\n", needID, satisfied)
 
+	h.fulfillMu.Lock()
+	defer h.fulfillMu.Unlock()
+
 	// Read current state
 	state := make(map[string]FulfillmentState)
-	data, err := os.ReadFile(fulfillmentStateFile)
+	data, err := os.ReadFile(h.env.fulfillmentStateFile())
 	if err == nil {
 		json.Unmarshal(data, &state)
 	} else {
@@ -965,11 +1027,11 @@ func (h *AgentHandler) updateFulfillmentState(needID string, satisfied bool) err
 		return fmt.Errorf("marshal state: %w", err)
 	}
 
-	if err := os.WriteFile(fulfillmentStateFile, newData, 0644); err != nil {
+	if err := os.WriteFile(h.env.fulfillmentStateFile(), newData, 0644); err != nil {
 		return fmt.Errorf("write state: %w", err)
 	}
 
-	fmt.Fprintf(os.Stderr, "[state] wrote %s satisfied=%v to %s\n", needID, satisfied, fulfillmentStateFile)
+	fmt.Fprintf(os.Stderr, "[state] wrote %s satisfied=%v to %s\n", needID, satisfied, h.env.fulfillmentStateFile())
 	return nil
 }
 
@@ -1072,7 +1134,7 @@ func (h *AgentHandler) saveProviderState() error {
 		return fmt.Errorf("marshal provider state: %w", err)
 	}
 
-	if err := os.WriteFile(providerStateFile, data, 0644); err != nil {
+	if err := os.WriteFile(h.env.providerStateFile(), data, 0644); err != nil {
 		return fmt.Errorf("write provider state: %w", err)
 	}
 
@@ -1089,9 +1151,12 @@ func (h *AgentHandler) getProviderState(capability string) map[string]ProviderSt
 
 // dispatchCallbacks sends responses to consumer callback endpoints
 // changedKeys is a list of state keys (origin:needID format) that have new responses
-// Waits for all callbacks to complete before returning
+// Waits for all callbacks to complete before returning, then records each
+// delivery outcome in provider state
 func (h *AgentHandler) dispatchCallbacks(capability string, changedKeys []string, responses AsyncHandlerOutput) {
 	var wg sync.WaitGroup
+	var resultsMu sync.Mutex
+	results := make(map[string]error)
 
 	for _, key := range changedKeys {
 		origin, needID := parseStateKey(key)
@@ -1113,37 +1178,60 @@ func (h *AgentHandler) dispatchCallbacks(capability string, changedKeys []string
 
 		// Send callback in goroutine, tracked by WaitGroup
 		wg.Add(1)
-		go func(origin, path string, resp json.RawMessage) {
+		go func(key, origin, path string, resp json.RawMessage) {
 			defer wg.Done()
-			h.sendCallback(origin, path, resp)
-		}(origin, callbackPath, response)
+			err := h.sendCallback(origin, path, resp)
+			resultsMu.Lock()
+			results[key] = err
+			resultsMu.Unlock()
+		}(key, origin, callbackPath, response)
 	}
 
 	// Wait for all callbacks to complete
 	wg.Wait()
+
+	if len(results) == 0 {
+		return
+	}
+	now := time.Now().Unix()
+	for key, err := range results {
+		entry, ok := h.providerState[capability][key]
+		if !ok {
+			continue
+		}
+		entry.CallbackAt = now
+		entry.CallbackError = ""
+		if err != nil {
+			entry.CallbackError = err.Error()
+		}
+		h.providerState[capability][key] = entry
+	}
+	if err := h.saveProviderState(); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to save provider state: %v\n", err)
+	}
 }
 
 // sendCallback POSTs a response to a consumer's callback endpoint
-// This is fire-and-forget - errors are logged but not retried
-func (h *AgentHandler) sendCallback(origin, path string, response json.RawMessage) {
-	// Use fort CLI to send callback (it handles signing)
+// Errors are logged and returned for bookkeeping but not retried
+func (h *AgentHandler) sendCallback(origin, path string, response json.RawMessage) error {
+	// Use the peer transport to send callback (it handles signing)
 	// path is like "/fort/needs/oidc/outline" -> capability is "needs/oidc/outline"
 	capability := strings.TrimPrefix(path, "/fort/")
 
-	cmd := exec.Command("fort", origin, capability, string(response))
-	output, err := cmd.CombinedOutput()
+	output, err := h.env.Peer.Call(origin, capability, response)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "[callback] failed POST to %s%s: %v\n%s\n", origin, path, err, string(output))
-		return
+		return err
 	}
 
 	fmt.Fprintf(os.Stderr, "[callback] sent to %s%s\n", origin, path)
+	return nil
 }
 
 // runTrigger runs a capability handler in response to a systemd trigger or refresh request
 // This is invoked via: fort-provider --trigger <capability> [--force]
 // When force is true, cached responses are omitted from handler input, forcing recomputation
-func runTrigger(capability string, force bool) error {
+func runTrigger(env Env, capability string, force bool) error {
 	if force {
 		fmt.Fprintf(os.Stderr, "[trigger] starting FORCE refresh for capability: %s\n", capability)
 	} else {
@@ -1151,7 +1239,7 @@ func runTrigger(capability string, force bool) error {
 	}
 
 	// Load capabilities config
-	capData, err := os.ReadFile(capabilitiesFile)
+	capData, err := os.ReadFile(env.capabilitiesFile())
 	if err != nil {
 		return fmt.Errorf("read capabilities.json: %w", err)
 	}
@@ -1166,7 +1254,7 @@ func runTrigger(capability string, force bool) error {
 
 	// Load provider state
 	var providerState ProviderState
-	stateData, err := os.ReadFile(providerStateFile)
+	stateData, err := os.ReadFile(env.providerStateFile())
 	if err == nil {
 		if err := json.Unmarshal(stateData, &providerState); err != nil {
 			return fmt.Errorf("parse provider-state.json: %w", err)
@@ -1207,7 +1295,7 @@ func runTrigger(capability string, force bool) error {
 	}
 
 	// Invoke handler
-	handlerPath := filepath.Join(handlersDir, capability)
+	handlerPath := filepath.Join(env.handlersDir(), capability)
 	if _, err := os.Stat(handlerPath); os.IsNotExist(err) {
 		return fmt.Errorf("handler not found: %s", handlerPath)
 	}
@@ -1273,12 +1361,13 @@ func runTrigger(capability string, force bool) error {
 	if err != nil {
 		return fmt.Errorf("marshal provider state: %w", err)
 	}
-	if err := os.WriteFile(providerStateFile, stateBytes, 0644); err != nil {
+	if err := os.WriteFile(env.providerStateFile(), stateBytes, 0644); err != nil {
 		return fmt.Errorf("write provider state: %w", err)
 	}
 
 	// Create handler for callback dispatch
 	h := &AgentHandler{
+		env:           env,
 		providerState: providerState,
 		capabilities:  capabilities,
 	}
@@ -1309,11 +1398,11 @@ func runTrigger(capability string, force bool) error {
 
 // runGC performs garbage collection sweep for async capabilities
 // This is invoked via: fort-provider --gc
-func runGC() error {
+func runGC(env Env) error {
 	fmt.Fprintf(os.Stderr, "[gc] starting garbage collection sweep\n")
 
 	// Load capabilities config
-	capData, err := os.ReadFile(capabilitiesFile)
+	capData, err := os.ReadFile(env.capabilitiesFile())
 	if err != nil {
 		return fmt.Errorf("read capabilities.json: %w", err)
 	}
@@ -1324,7 +1413,7 @@ func runGC() error {
 
 	// Load provider state
 	var providerState ProviderState
-	stateData, err := os.ReadFile(providerStateFile)
+	stateData, err := os.ReadFile(env.providerStateFile())
 	if err == nil {
 		if err := json.Unmarshal(stateData, &providerState); err != nil {
 			return fmt.Errorf("parse provider-state.json: %w", err)
@@ -1369,7 +1458,7 @@ func runGC() error {
 		originReachable := make(map[string]bool)
 
 		for origin := range origins {
-			needs, err := queryOriginNeeds(origin)
+			needs, err := queryOriginNeeds(env, origin)
 			if err != nil {
 				// Network failure - assume still in use, skip this origin
 				fmt.Fprintf(os.Stderr, "[gc] %s: origin %s unreachable (%v), skipping\n", capName, origin, err)
@@ -1424,7 +1513,7 @@ func runGC() error {
 		if err != nil {
 			return fmt.Errorf("marshal provider state: %w", err)
 		}
-		if err := os.WriteFile(providerStateFile, stateBytes, 0644); err != nil {
+		if err := os.WriteFile(env.providerStateFile(), stateBytes, 0644); err != nil {
 			return fmt.Errorf("write provider state: %w", err)
 		}
 	}
@@ -1432,7 +1521,7 @@ func runGC() error {
 	// Invoke handlers for modified capabilities (so they can clean up resources)
 	for capName := range modifiedCapabilities {
 		fmt.Fprintf(os.Stderr, "[gc] %s: invoking handler for cleanup\n", capName)
-		if err := invokeHandlerForGC(capName, capabilities[capName], providerState[capName], false); err != nil {
+		if err := invokeHandlerForGC(env, capName, capabilities[capName], providerState, false); err != nil {
 			fmt.Fprintf(os.Stderr, "[gc] %s: handler invocation failed: %v\n", capName, err)
 			// Continue with other capabilities, don't fail the whole GC
 		}
@@ -1478,7 +1567,7 @@ func runGC() error {
 			continue // Already handled above
 		}
 		fmt.Fprintf(os.Stderr, "[gc] %s: invoking handler for TTL rotation\n", capName)
-		if err := invokeHandlerForGC(capName, capabilities[capName], providerState[capName], true); err != nil {
+		if err := invokeHandlerForGC(env, capName, capabilities[capName], providerState, true); err != nil {
 			fmt.Fprintf(os.Stderr, "[gc] %s: rotation handler failed: %v\n", capName, err)
 		}
 	}
@@ -1488,15 +1577,11 @@ func runGC() error {
 }
 
 // queryOriginNeeds queries a host's /fort/needs endpoint and returns set of declared need paths
-func queryOriginNeeds(origin string) (map[string]bool, error) {
-	// Use fort CLI to query the needs endpoint
-	cmd := exec.Command("fort", origin, "needs", "{}")
-	output, err := cmd.Output()
+func queryOriginNeeds(env Env, origin string) (map[string]bool, error) {
+	// Use the peer transport to query the needs endpoint
+	output, err := env.Peer.Call(origin, "needs", []byte("{}"))
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return nil, fmt.Errorf("fort command failed: %s", strings.TrimSpace(string(exitErr.Stderr)))
-		}
-		return nil, fmt.Errorf("fort command exec failed: %w", err)
+		return nil, err
 	}
 
 	// Parse the response envelope
@@ -1552,12 +1637,16 @@ func needIDToPath(capName, needID string) string {
 // invokeHandlerForGC invokes a capability handler after GC cleanup or for TTL rotation
 // When dispatchCallbacks is true, sends callbacks for changed responses (used for rotation)
 // When false, just updates state (used for cleanup after orphan removal)
-func invokeHandlerForGC(capName string, capConfig CapabilityConfig, state map[string]ProviderStateEntry, dispatchCallbacks bool) error {
-	handlerPath := filepath.Join(handlersDir, capName)
+// providerState is the whole loaded state: updated responses are written back
+// to it and persisted along with every other capability's entries
+func invokeHandlerForGC(env Env, capName string, capConfig CapabilityConfig, providerState ProviderState, dispatchCallbacks bool) error {
+	handlerPath := filepath.Join(env.handlersDir(), capName)
 	if _, err := os.Stat(handlerPath); os.IsNotExist(err) {
 		return fmt.Errorf("handler not found: %s", handlerPath)
 	}
 
+	state := providerState[capName]
+
 	// Build aggregate input from remaining state entries
 	// Only include cached responses if cacheResponse is enabled
 	input := make(AsyncHandlerInput)
@@ -1617,10 +1706,16 @@ func invokeHandlerForGC(capName string, capConfig CapabilityConfig, state map[st
 		}
 	}
 
+	// Persist the new responses; the handler owns the loaded state, so
+	// callback outcomes recorded below are saved into it too
+	h := &AgentHandler{env: env, providerState: providerState}
+	if err := h.saveProviderState(); err != nil {
+		return err
+	}
+
 	// Dispatch callbacks for changed responses (rotation)
 	if dispatchCallbacks && len(changedKeys) > 0 {
 		fmt.Fprintf(os.Stderr, "[gc] %s: dispatching callbacks for %d rotated entries\n", capName, len(changedKeys))
-		h := &AgentHandler{} // Minimal handler for dispatch
 		h.dispatchCallbacks(capName, changedKeys, handlerOutput)
 	}
 
@@ -0,0 +1,732 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockPeer stands in for the fort CLI: records every outbound call and
+// answers from per-host canned envelopes
+type mockPeer struct {
+	mu        sync.Mutex
+	calls     []mockCall
+	responses map[string]string // host -> envelope JSON; missing host = unreachable
+}
+
+type mockCall struct {
+	host, capability string
+	body             string
+}
+
+func (m *mockPeer) Call(host, capability string, body []byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, mockCall{host, capability, string(body)})
+	resp, ok := m.responses[host]
+	if !ok {
+		return nil, fmt.Errorf("connect to %s: connection refused", host)
+	}
+	return []byte(resp), nil
+}
+
+func (m *mockPeer) callsTo(capability string) []mockCall {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []mockCall
+	for _, c := range m.calls {
+		if c.capability == capability {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// testProvider is a provider laid out in a temp dir: alice and bob are known
+// hosts with throwaway keys, mallory has a key but is not in hosts.json
+type testProvider struct {
+	env  Env
+	peer *mockPeer
+	keys map[string]string // name -> private key path
+	dir  string
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+	dir := t.TempDir()
+	etc := filepath.Join(dir, "etc")
+	state := filepath.Join(dir, "state")
+	for _, d := range []string{filepath.Join(etc, "handlers"), state} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := &testProvider{dir: dir, keys: make(map[string]string), peer: &mockPeer{responses: map[string]string{}}}
+	hosts := make(map[string]HostInfo)
+	for _, name := range []string{"alice", "bob", "mallory"} {
+		keyPath := filepath.Join(dir, name)
+		pubkey, err := generateDevKey(keyPath, name)
+		if err != nil {
+			t.Fatalf("generate key: %v", err)
+		}
+		p.keys[name] = keyPath
+		if name != "mallory" {
+			hosts[name] = HostInfo{Pubkey: pubkey}
+		}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	triggerLog := filepath.Join(dir, "token-triggers")
+	tokenScript := fmt.Sprintf("#!/bin/sh\necho \"${FORT_TRIGGER:-request}\" >> %s\nexec %s dev-handler token %s\n",
+		shellQuote(triggerLog), shellQuote(exe), shellQuote(filepath.Join(etc, "revoked")))
+
+	err = firstErr(
+		writeJSON(filepath.Join(etc, "hosts.json"), hosts),
+		writeJSON(filepath.Join(etc, "rbac.json"), map[string][]string{
+			"whoami": {"alice", "bob"},
+			"token":  {"alice", "bob"},
+			"secret": {"bob"},
+		}),
+		writeJSON(filepath.Join(etc, "capabilities.json"), map[string]CapabilityConfig{
+			"whoami": {Mode: "rpc"},
+			"token":  {Mode: "async", NeedsGC: true, TTL: 86400},
+			"secret": {Mode: "rpc"},
+		}),
+		writeJSON(filepath.Join(etc, "needs.json"), []NeedConfig{
+			{ID: "token-default", Capability: "token", From: "bob", Handler: filepath.Join(dir, "need-handler")},
+			{ID: "ping-default", Capability: "ping", From: "bob"},
+		}),
+		os.WriteFile(filepath.Join(etc, "handlers", "whoami"),
+			[]byte("#!/bin/sh\nprintf '{\"origin\":\"%s\",\"capability\":\"%s\"}' \"$FORT_ORIGIN\" \"$FORT_CAPABILITY\"\n"), 0755),
+		os.WriteFile(filepath.Join(etc, "handlers", "secret"), []byte("#!/bin/sh\necho '{}'\n"), 0755),
+		os.WriteFile(filepath.Join(etc, "handlers", "token"), []byte(tokenScript), 0755),
+		writeDevHandler(filepath.Join(dir, "need-handler"), exe, "store", filepath.Join(dir, "stored.json")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.env = Env{ConfigDir: etc, StateDir: state, Peer: p.peer}
+	return p
+}
+
+func (p *testProvider) handler(t *testing.T) *AgentHandler {
+	t.Helper()
+	h, err := NewAgentHandler(p.env)
+	if err != nil {
+		t.Fatalf("NewAgentHandler: %v", err)
+	}
+	return h
+}
+
+// signed builds a request signed with signer's key but claiming origin
+func (p *testProvider) signed(t *testing.T, signer, origin, path, body string, at time.Time) *http.Request {
+	t.Helper()
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	sig, err := signRequest(p.keys[signer], "POST", path, timestamp, []byte(body), "")
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("X-Fort-Origin", origin)
+	req.Header.Set("X-Fort-Timestamp", timestamp)
+	req.Header.Set("X-Fort-Signature", sig)
+	return req
+}
+
+func serve(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func (p *testProvider) triggers(t *testing.T) []string {
+	data, _ := os.ReadFile(filepath.Join(p.dir, "token-triggers"))
+	return strings.Fields(string(data))
+}
+
+func TestServeHTTPRPC(t *testing.T) {
+	p := newTestProvider(t)
+	h := p.handler(t)
+
+	rec := serve(h, p.signed(t, "alice", "alice", "/fort/whoami", "{}", time.Now()))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+	}
+	var got map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("response not JSON: %s", rec.Body)
+	}
+	if got["origin"] != "alice" || got["capability"] != "whoami" {
+		t.Errorf("handler env = %v, want origin alice, capability whoami", got)
+	}
+}
+
+func TestServeHTTPDeprecatedAgentPath(t *testing.T) {
+	p := newTestProvider(t)
+	h := p.handler(t)
+
+	rec := serve(h, p.signed(t, "bob", "bob", "/agent/whoami", "{}", time.Now()))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200 for /agent/ alias", rec.Code)
+	}
+}
+
+func TestServeHTTPRejects(t *testing.T) {
+	p := newTestProvider(t)
+	h := p.handler(t)
+	now := time.Now()
+
+	tampered := p.signed(t, "alice", "alice", "/fort/whoami", "{}", now)
+	tampered.Body = http.NoBody
+	tampered.ContentLength = 0
+
+	noHeaders := httptest.NewRequest("POST", "/fort/whoami", strings.NewReader("{}"))
+
+	cases := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"missing headers", noHeaders, http.StatusUnauthorized},
+		{"unknown origin", p.signed(t, "mallory", "mallory", "/fort/whoami", "{}", now), http.StatusUnauthorized},
+		{"impersonation", p.signed(t, "mallory", "alice", "/fort/whoami", "{}", now), http.StatusUnauthorized},
+		{"stale timestamp", p.signed(t, "alice", "alice", "/fort/whoami", "{}", now.Add(-10*time.Minute)), http.StatusUnauthorized},
+		{"future timestamp", p.signed(t, "alice", "alice", "/fort/whoami", "{}", now.Add(10*time.Minute)), http.StatusUnauthorized},
+		{"tampered body", tampered, http.StatusUnauthorized},
+		{"rbac denied", p.signed(t, "alice", "alice", "/fort/secret", "{}", now), http.StatusForbidden},
+		{"unknown capability", p.signed(t, "alice", "alice", "/fort/nope", "{}", now), http.StatusNotFound},
+		{"nested capability", p.signed(t, "alice", "alice", "/fort/whoami/x", "{}", now), http.StatusNotFound},
+		{"outside prefix", p.signed(t, "alice", "alice", "/other/whoami", "{}", now), http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if rec := serve(h, tc.req); rec.Code != tc.want {
+				t.Errorf("status = %d, want %d (body %s)", rec.Code, tc.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestServeHTTPRBACAllowsListedHost(t *testing.T) {
+	p := newTestProvider(t)
+	h := p.handler(t)
+
+	if rec := serve(h, p.signed(t, "bob", "bob", "/fort/secret", "{}", time.Now())); rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200 for bob on secret", rec.Code)
+	}
+}
+
+func TestServeHTTPAsyncRecordsStateAndCallsBack(t *testing.T) {
+	p := newTestProvider(t)
+	h := p.handler(t)
+
+	body := `{"scope":"ro","_fort_need_id":"token-default"}`
+	rec := serve(h, p.signed(t, "alice", "alice", "/fort/token", body, time.Now()))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202 (body %s)", rec.Code, rec.Body)
+	}
+
+	handle := rec.Header().Get("X-Fort-Handle")
+	if !strings.HasPrefix(handle, "sha256:") {
+		t.Errorf("X-Fort-Handle = %q", handle)
+	}
+	if rec.Header().Get("X-Fort-TTL") != "86400" {
+		t.Errorf("X-Fort-TTL = %q, want 86400", rec.Header().Get("X-Fort-TTL"))
+	}
+	handleFile := filepath.Join(p.env.handlesDir(), strings.ReplaceAll(handle, ":", "-"))
+	if _, err := os.Stat(handleFile); err != nil {
+		t.Errorf("handle not persisted: %v", err)
+	}
+	if _, err := os.Stat(handleFile + ".meta"); err != nil {
+		t.Errorf("handle metadata not persisted: %v", err)
+	}
+
+	// State persisted under origin:needID with the handler's response
+	data, err := os.ReadFile(p.env.providerStateFile())
+	if err != nil {
+		t.Fatalf("provider state not saved: %v", err)
+	}
+	var saved ProviderState
+	json.Unmarshal(data, &saved)
+	entry, ok := saved["token"]["alice:token-default"]
+	if !ok {
+		t.Fatalf("state keys = %v, want alice:token-default", saved["token"])
+	}
+	if !jsonEqual(entry.Request, []byte(body)) {
+		t.Errorf("stored request = %s", entry.Request)
+	}
+	if !strings.Contains(string(entry.Response), "token") {
+		t.Errorf("stored response = %s", entry.Response)
+	}
+
+	// New response -> callback to the consumer's need endpoint
+	calls := p.peer.callsTo("needs/token/default")
+	if len(calls) != 1 || calls[0].host != "alice" {
+		t.Fatalf("callbacks = %+v, want one to alice", calls)
+	}
+	if !jsonEqual([]byte(calls[0].body), entry.Response) {
+		t.Errorf("callback payload %s != stored response %s", calls[0].body, entry.Response)
+	}
+}
+
+func TestServeHTTPAsyncWithoutNeedIDSkipsCallback(t *testing.T) {
+	p := newTestProvider(t)
+	h := p.handler(t)
+
+	if rec := serve(h, p.signed(t, "bob", "bob", "/fort/token", "{}", time.Now())); rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	if _, ok := h.getProviderState("token")["bob"]; !ok {
+		t.Error("request without _fort_need_id not keyed by bare origin")
+	}
+	if calls := p.peer.callsTo("needs/token/"); len(calls) != 0 {
+		t.Errorf("unexpected callbacks: %+v", calls)
+	}
+}
+
+func TestServeHTTPAsyncRecordsCallbackOutcome(t *testing.T) {
+	p := newTestProvider(t)
+	p.peer.responses["alice"] = `{"body":{},"status":200}` // bob stays unreachable
+	h := p.handler(t)
+
+	for _, origin := range []string{"alice", "bob"} {
+		body := `{"_fort_need_id":"token-default"}`
+		if rec := serve(h, p.signed(t, origin, origin, "/fort/token", body, time.Now())); rec.Code != http.StatusAccepted {
+			t.Fatalf("%s: status = %d", origin, rec.Code)
+		}
+	}
+
+	state := loadTokenState(t, p)
+	delivered := state["alice:token-default"]
+	if delivered.CallbackAt == 0 || delivered.CallbackError != "" {
+		t.Errorf("alice entry = %+v, want a clean delivery", delivered)
+	}
+	failed := state["bob:token-default"]
+	if failed.CallbackAt == 0 || !strings.Contains(failed.CallbackError, "connection refused") {
+		t.Errorf("bob entry = %+v, want the delivery error recorded", failed)
+	}
+}
+
+func TestHandleCallback(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name          string
+		signer        string
+		path          string
+		body          string
+		wantCode      int
+		wantSatisfied bool
+	}{
+		{"declared provider, handler accepts", "bob", "/fort/needs/token/default", `{"token":"t"}`, http.StatusOK, true},
+		{"declared provider, handler rejects", "bob", "/fort/needs/token/default", `{}`, http.StatusOK, false},
+		{"no handler, payload", "bob", "/fort/needs/ping/default", `{"ok":true}`, http.StatusOK, true},
+		{"no handler, empty payload", "bob", "/fort/needs/ping/default", ``, http.StatusOK, false},
+		{"wrong provider", "alice", "/fort/needs/token/default", `{"token":"t"}`, http.StatusForbidden, false},
+		{"undeclared need", "bob", "/fort/needs/token/other", `{"token":"t"}`, http.StatusNotFound, false},
+		{"malformed path", "bob", "/fort/needs/token", `{}`, http.StatusNotFound, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestProvider(t)
+			h := p.handler(t)
+
+			rec := serve(h, p.signed(t, tc.signer, tc.signer, tc.path, tc.body, now))
+			if rec.Code != tc.wantCode {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, tc.wantCode, rec.Body)
+			}
+			if tc.wantCode != http.StatusOK {
+				if _, err := os.Stat(p.env.fulfillmentStateFile()); err == nil {
+					t.Error("rejected callback touched fulfillment state")
+				}
+				return
+			}
+			var resp struct {
+				NeedID    string `json:"need_id"`
+				Satisfied bool   `json:"satisfied"`
+			}
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			if resp.Satisfied != tc.wantSatisfied {
+				t.Errorf("satisfied = %v, want %v", resp.Satisfied, tc.wantSatisfied)
+			}
+		})
+	}
+}
+
+func TestHandleCallbackRequiresValidSignature(t *testing.T) {
+	p := newTestProvider(t)
+	h := p.handler(t)
+
+	// mallory signs but claims to be bob, the declared provider
+	rec := serve(h, p.signed(t, "mallory", "bob", "/fort/needs/token/default", `{"token":"t"}`, time.Now()))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rec.Code)
+	}
+}
+
+func TestUpdateFulfillmentStatePreservesLastSought(t *testing.T) {
+	p := newTestProvider(t)
+	h := p.handler(t)
+
+	writeJSON(p.env.fulfillmentStateFile(), map[string]FulfillmentState{
+		"token-default": {Satisfied: false, LastSought: 1234},
+		"other-default": {Satisfied: true, LastSought: 99},
+	})
+
+	if err := h.updateFulfillmentState("token-default", true); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(p.env.fulfillmentStateFile())
+	var state map[string]FulfillmentState
+	json.Unmarshal(data, &state)
+	if got := state["token-default"]; !got.Satisfied || got.LastSought != 1234 {
+		t.Errorf("token-default = %+v, want satisfied with last_sought 1234", got)
+	}
+	if got := state["other-default"]; !got.Satisfied || got.LastSought != 99 {
+		t.Errorf("other-default = %+v, want untouched", got)
+	}
+}
+
+func TestUpdateFulfillmentStateStartsFresh(t *testing.T) {
+	p := newTestProvider(t)
+	h := p.handler(t)
+
+	if err := h.updateFulfillmentState("ping-default", true); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(p.env.fulfillmentStateFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"satisfied": true`)) {
+		t.Errorf("state = %s", data)
+	}
+}
+
+// seedTokenState writes provider state for the token capability with the
+// given keys, all answered at updatedAt
+func seedTokenState(t *testing.T, p *testProvider, updatedAt int64, keys ...string) {
+	t.Helper()
+	entries := make(map[string]ProviderStateEntry)
+	for _, key := range keys {
+		entries[key] = ProviderStateEntry{
+			Request:   json.RawMessage(`{}`),
+			Response:  json.RawMessage(`{"token":"old"}`),
+			UpdatedAt: updatedAt,
+		}
+	}
+	if err := writeJSON(p.env.providerStateFile(), ProviderState{"token": entries}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadTokenState(t *testing.T, p *testProvider) map[string]ProviderStateEntry {
+	t.Helper()
+	data, err := os.ReadFile(p.env.providerStateFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state ProviderState
+	json.Unmarshal(data, &state)
+	return state["token"]
+}
+
+func needsEnvelope(needs ...string) string {
+	body, _ := json.Marshal(map[string][]string{"needs": needs})
+	return fmt.Sprintf(`{"body":%s,"status":200}`, body)
+}
+
+func TestRunGCRemovesOnlyPositivelyAbsentNeeds(t *testing.T) {
+	p := newTestProvider(t)
+	seedTokenState(t, p, time.Now().Unix(),
+		"alice:token-default", // still declared
+		"bob:token-default",   // bob dropped the need
+		"bob:token-extra",     // still declared
+		"carol:token-default", // carol unreachable
+	)
+	p.peer.responses["alice"] = needsEnvelope("token/default")
+	p.peer.responses["bob"] = needsEnvelope("token/extra", "ssl-cert/default")
+
+	if err := runGC(p.env); err != nil {
+		t.Fatal(err)
+	}
+
+	state := loadTokenState(t, p)
+	for _, key := range []string{"alice:token-default", "bob:token-extra", "carol:token-default"} {
+		if _, ok := state[key]; !ok {
+			t.Errorf("%s removed, want kept", key)
+		}
+	}
+	if _, ok := state["bob:token-default"]; ok {
+		t.Error("bob:token-default kept, want removed")
+	}
+	if got := p.triggers(t); len(got) != 1 || got[0] != "gc" {
+		t.Errorf("handler triggers = %v, want one gc cleanup run", got)
+	}
+}
+
+func TestRunGCTreatsErrorStatusAsUnreachable(t *testing.T) {
+	p := newTestProvider(t)
+	seedTokenState(t, p, time.Now().Unix(), "alice:token-default")
+	p.peer.responses["alice"] = `{"body":{"error":"boom"},"status":500}`
+
+	if err := runGC(p.env); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loadTokenState(t, p)["alice:token-default"]; !ok {
+		t.Error("entry removed although origin answered 500")
+	}
+	if got := p.triggers(t); len(got) != 0 {
+		t.Errorf("handler ran (%v) with nothing removed or expiring", got)
+	}
+}
+
+func TestRunGCRotatesEntriesNearExpiry(t *testing.T) {
+	p := newTestProvider(t)
+	// TTL is 24h; an entry 23h old is inside the 2h rotation window
+	seedTokenState(t, p, time.Now().Add(-23*time.Hour).Unix(), "alice:token-default")
+	p.peer.responses["alice"] = needsEnvelope("token/default")
+
+	if err := runGC(p.env); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := p.triggers(t); len(got) != 1 || got[0] != "gc" {
+		t.Errorf("handler triggers = %v, want one rotation run", got)
+	}
+	calls := p.peer.callsTo("needs/token/default")
+	if len(calls) != 1 || calls[0].host != "alice" {
+		t.Fatalf("rotation callbacks = %+v, want one to alice", calls)
+	}
+	if strings.Contains(calls[0].body, `"old"`) {
+		t.Errorf("rotation delivered the old token: %s", calls[0].body)
+	}
+
+	// The rotated entry survives in the state file, with its new response
+	// and the callback outcome
+	entry, ok := loadTokenState(t, p)["alice:token-default"]
+	if !ok {
+		t.Fatal("rotated entry missing from provider state")
+	}
+	if strings.Contains(string(entry.Response), `"old"`) || entry.CallbackAt == 0 {
+		t.Errorf("rotated entry = %+v", entry)
+	}
+}
+
+func TestRunGCWithoutStateIsNoop(t *testing.T) {
+	p := newTestProvider(t)
+	if err := runGC(p.env); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.peer.calls) != 0 {
+		t.Errorf("queried peers with no state: %+v", p.peer.calls)
+	}
+}
+
+func TestRunTriggerForceOmitsCachedResponses(t *testing.T) {
+	p := newTestProvider(t)
+	seedTokenState(t, p, time.Now().Unix(), "alice:token-default")
+
+	if err := runTrigger(p.env, "token", true); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.triggers(t); len(got) != 1 || got[0] != "force-refresh" {
+		t.Errorf("triggers = %v, want force-refresh", got)
+	}
+	if calls := p.peer.callsTo("needs/token/default"); len(calls) != 1 {
+		t.Errorf("callbacks = %+v, want one for the changed token", calls)
+	}
+}
+
+func TestParseHandlerOutput(t *testing.T) {
+	cases := []struct {
+		name    string
+		format  string
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:   "legacy",
+			format: "legacy",
+			input:  `{"alice:x":{"token":"a"},"bob:y":{"token":"b"}}`,
+			want:   map[string]string{"alice:x": `{"token":"a"}`, "bob:y": `{"token":"b"}`},
+		},
+		{
+			name:   "empty format is legacy",
+			format: "",
+			input:  `{"alice:x":{"token":"a"}}`,
+			want:   map[string]string{"alice:x": `{"token":"a"}`},
+		},
+		{
+			name:   "symmetric unwraps response",
+			format: "symmetric",
+			input:  `{"alice:x":{"request":{"scope":"ro"},"response":{"token":"a"}}}`,
+			want:   map[string]string{"alice:x": `{"token":"a"}`},
+		},
+		{
+			name:   "symmetric read as legacy keeps the wrapper",
+			format: "legacy",
+			input:  `{"alice:x":{"request":{"scope":"ro"},"response":{"token":"a"}}}`,
+			want:   map[string]string{"alice:x": `{"request":{"scope":"ro"},"response":{"token":"a"}}`},
+		},
+		{name: "invalid legacy", format: "legacy", input: `[1,2]`, wantErr: true},
+		{name: "invalid symmetric", format: "symmetric", input: `{"alice:x":"flat"}`, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseHandlerOutput([]byte(tc.input), tc.format)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %d keys, want %d", len(got), len(tc.want))
+			}
+			for key, want := range tc.want {
+				if !jsonEqual(got[key], []byte(want)) {
+					t.Errorf("%s = %s, want %s", key, got[key], want)
+				}
+			}
+		})
+	}
+}
+
+func TestNeedIDToPath(t *testing.T) {
+	cases := []struct{ capName, needID, want string }{
+		{"oidc-register", "oidc-register-outline", "oidc-register/outline"},
+		{"ssl-cert", "ssl-cert-default", "ssl-cert/default"},
+		{"git-token", "git-token-my-repo", "git-token/my-repo"},
+		{"other", "git-token-default", "git-token/default"},
+		{"x", "nohyphen", "nohyphen"},
+	}
+	for _, tc := range cases {
+		if got := needIDToPath(tc.capName, tc.needID); got != tc.want {
+			t.Errorf("needIDToPath(%q, %q) = %q, want %q", tc.capName, tc.needID, got, tc.want)
+		}
+	}
+}
+
+func TestStateKeys(t *testing.T) {
+	if got := makeStateKey("alice", json.RawMessage(`{"_fort_need_id":"token-default"}`)); got != "alice:token-default" {
+		t.Errorf("makeStateKey = %q", got)
+	}
+	if got := makeStateKey("alice", json.RawMessage(`{}`)); got != "alice" {
+		t.Errorf("makeStateKey without need id = %q", got)
+	}
+	origin, needID := parseStateKey("alice:token-default")
+	if origin != "alice" || needID != "token-default" {
+		t.Errorf("parseStateKey = %q, %q", origin, needID)
+	}
+}
+
+func TestJSONEqual(t *testing.T) {
+	if !jsonEqual([]byte(`{"a":1,"b":2}`), []byte(`{"b":2, "a":1}`)) {
+		t.Error("reordered keys not equal")
+	}
+	if jsonEqual([]byte(`{"a":1}`), []byte(`{"a":2}`)) {
+		t.Error("different values equal")
+	}
+	if jsonEqual(nil, []byte(`{}`)) {
+		t.Error("empty vs {} equal: a first response must count as a change")
+	}
+}
+
+func TestCapabilitiesListingFollowsRBAC(t *testing.T) {
+	p := newTestProvider(t)
+	h := p.handler(t)
+
+	list := func(who string) []CapabilityInfo {
+		rec := serve(h, p.signed(t, who, who, "/fort/capabilities", "{}", time.Now()))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d (body %s)", who, rec.Code, rec.Body)
+		}
+		var resp struct {
+			Capabilities []CapabilityInfo `json:"capabilities"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Capabilities
+	}
+
+	names := func(caps []CapabilityInfo) string {
+		var out []string
+		for _, c := range caps {
+			out = append(out, c.Name)
+		}
+		return strings.Join(out, ",")
+	}
+
+	if got := names(list("alice")); got != "token,whoami" {
+		t.Errorf("alice sees %s, want token,whoami", got)
+	}
+	bobs := list("bob")
+	if got := names(bobs); got != "secret,token,whoami" {
+		t.Errorf("bob sees %s, want secret,token,whoami", got)
+	}
+
+	token := bobs[1]
+	if token.Mode != "async" || token.TTL != 86400 || token.Format != "legacy" {
+		t.Errorf("token = %+v, want async, ttl 86400, legacy", token)
+	}
+	if rpc := bobs[2]; rpc.Mode != "rpc" {
+		t.Errorf("whoami mode = %q, want rpc", rpc.Mode)
+	}
+}
+
+func TestCapabilitiesListingRequiresAuth(t *testing.T) {
+	p := newTestProvider(t)
+	h := p.handler(t)
+
+	rec := serve(h, p.signed(t, "mallory", "mallory", "/fort/capabilities", "{}", time.Now()))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rec.Code)
+	}
+}
+
+func TestCapabilitiesListingCarriesDiscoveryMetadata(t *testing.T) {
+	h := &AgentHandler{
+		rbac: map[string][]string{"git-token": {"alice"}},
+		capabilities: map[string]CapabilityConfig{"git-token": {
+			Mode:          "rpc",
+			Description:   "Issue Forgejo tokens",
+			RequestSchema: json.RawMessage(`{"type":"object"}`),
+			Triggers:      TriggerConfig{Initialize: true, Systemd: []string{"forgejo.service"}},
+		}},
+	}
+
+	caps := h.capabilitiesFor("alice")
+	if len(caps) != 1 {
+		t.Fatalf("got %d capabilities", len(caps))
+	}
+	c := caps[0]
+	if c.Description != "Issue Forgejo tokens" || string(c.RequestSchema) != `{"type":"object"}` {
+		t.Errorf("metadata = %q / %s", c.Description, c.RequestSchema)
+	}
+	if !c.Triggers.Initialize || len(c.Triggers.Systemd) != 1 {
+		t.Errorf("triggers = %+v", c.Triggers)
+	}
+	if len(c.Allowed) != 1 || c.Allowed[0] != "alice" {
+		t.Errorf("allowed = %v", c.Allowed)
+	}
+}
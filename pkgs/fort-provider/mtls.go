@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Client authentication modes (--client-auth). Client certificates wrap the
+// caller's SSH key (see client-cert) or are issued by the cluster CA
+// (--client-ca); either way the certificate must name the same identity as
+// X-Fort-Origin, so a captured signature can't be replayed by anyone who
+// doesn't also hold the origin's private key.
+const (
+	clientAuthOff      = "off"      // no client certificates (default)
+	clientAuthOptional = "optional" // verify a presented certificate, accept requests without one
+	clientAuthRequire  = "require"  // every request must come over an authenticated channel
+)
+
+// Channel binding: when the provider terminates TLS itself (--listen), a
+// client may sign the session's RFC 9266 tls-exporter value along with the
+// request. The signature then can't be replayed on any other connection.
+const (
+	channelBindingHeader = "X-Fort-Channel-Binding"
+	channelBindingLabel  = "EXPORTER-Channel-Binding"
+	channelBindingLength = 32
+)
+
+// proxyCertHeader carries the client certificate from a local TLS-terminating
+// reverse proxy (darwin nginx, $ssl_client_escaped_cert) when --behind-proxy
+const proxyCertHeader = "X-Fort-Client-Cert"
+
+// configureClientAuth sets the client authentication mode and, optionally,
+// the cluster CA bundle that may issue client certificates
+func (h *AgentHandler) configureClientAuth(mode, caFile string) error {
+	switch mode {
+	case clientAuthOff, clientAuthOptional, clientAuthRequire:
+	default:
+		return fmt.Errorf("invalid client auth mode %q (want off, optional or require)", mode)
+	}
+	h.clientAuth = mode
+
+	if caFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates in %s", caFile)
+	}
+	h.clientCAs = pool
+	return nil
+}
+
+// tlsClientAuth maps a client auth mode to the server's TLS policy. Chains
+// are not verified during the handshake: self-signed key-wrapping certs are
+// pinned against hosts.json per request, in checkTransport.
+func tlsClientAuth(mode string) tls.ClientAuthType {
+	switch mode {
+	case clientAuthOptional:
+		return tls.RequestClientCert
+	case clientAuthRequire:
+		return tls.RequireAnyClientCert
+	default:
+		return tls.NoClientCert
+	}
+}
+
+// checkTransport verifies what the transport says about the caller: a client
+// certificate must belong to origin, and a channel binding must match this
+// connection. Returns the binding to fold into the signed canonical string
+// ("" when the client didn't bind).
+func (h *AgentHandler) checkTransport(r *http.Request, origin, pubkey string) (string, error) {
+	if h.clientAuth != clientAuthOff && h.clientAuth != "" {
+		cert, err := h.clientCertificate(r)
+		if err != nil {
+			return "", err
+		}
+		if cert == nil {
+			if h.clientAuth == clientAuthRequire {
+				return "", errors.New("client certificate required")
+			}
+		} else if err := h.verifyClientCert(cert, origin, pubkey); err != nil {
+			return "", err
+		}
+	}
+
+	binding := r.Header.Get(channelBindingHeader)
+	if binding == "" {
+		return "", nil
+	}
+	if r.TLS == nil || h.behindProxy {
+		// The client's session ends at nginx, so there is nothing to compare
+		// against here; the binding is still covered by the signature, and
+		// the client certificate nginx forwarded is what ties the request to
+		// the transport on this path
+		return binding, nil
+	}
+	expected, err := r.TLS.ExportKeyingMaterial(channelBindingLabel, nil, channelBindingLength)
+	if err != nil {
+		return "", fmt.Errorf("export channel binding: %w", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(binding), []byte(base64.StdEncoding.EncodeToString(expected))) != 1 {
+		return "", errors.New("channel binding mismatch")
+	}
+	return binding, nil
+}
+
+// clientCertificate returns the caller's certificate: from the TLS session
+// when the provider terminates TLS, from nginx's SSL_CLIENT_CERT FastCGI param
+// on the Linux socket path, or from X-Fort-Client-Cert sent by a loopback
+// proxy with --behind-proxy. nil, nil when the caller presented none.
+func (h *AgentHandler) clientCertificate(r *http.Request) (*x509.Certificate, error) {
+	if h.behindProxy {
+		if !isLoopback(r.RemoteAddr) {
+			return nil, errors.New("client certificate header from non-loopback peer")
+		}
+		return parseEscapedCert(r.Header.Get(proxyCertHeader))
+	}
+	if r.TLS != nil {
+		if len(r.TLS.PeerCertificates) == 0 {
+			return nil, nil
+		}
+		return r.TLS.PeerCertificates[0], nil
+	}
+	return certFromFCGIParams(fcgi.ProcessEnv(r))
+}
+
+func certFromFCGIParams(params map[string]string) (*x509.Certificate, error) {
+	return parseEscapedCert(params["SSL_CLIENT_CERT"])
+}
+
+// parseEscapedCert decodes nginx's $ssl_client_escaped_cert (URL-encoded PEM)
+func parseEscapedCert(escaped string) (*x509.Certificate, error) {
+	if escaped == "" {
+		return nil, nil
+	}
+	pemData, err := url.QueryUnescape(escaped)
+	if err != nil {
+		return nil, fmt.Errorf("decode client certificate: %w", err)
+	}
+	block, _ := pem.Decode([]byte(pemData))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("decode client certificate: no PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse client certificate: %w", err)
+	}
+	return cert, nil
+}
+
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// verifyClientCert accepts a certificate wrapping origin's hosts.json key, or
+// one issued to origin (CN) by the cluster CA
+func (h *AgentHandler) verifyClientCert(cert *x509.Certificate, origin, pubkey string) error {
+	if want, err := parseSSHEd25519PublicKey(pubkey); err == nil {
+		if got, ok := cert.PublicKey.(ed25519.PublicKey); ok && got.Equal(want) {
+			return nil
+		}
+	}
+
+	if h.clientCAs != nil {
+		_, err := cert.Verify(x509.VerifyOptions{
+			Roots:     h.clientCAs,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err == nil && cert.Subject.CommonName == origin {
+			return nil
+		}
+	}
+	return fmt.Errorf("client certificate does not belong to %s", origin)
+}
+
+// parseSSHEd25519PublicKey decodes an authorized_keys-style "ssh-ed25519
+// <base64> [comment]" line
+func parseSSHEd25519PublicKey(line string) (ed25519.PublicKey, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "ssh-ed25519" {
+		return nil, errors.New("not an ssh-ed25519 key")
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("decode key: %w", err)
+	}
+	r := sshReader{buf: blob}
+	if string(r.next()) != "ssh-ed25519" {
+		return nil, errors.New("key type mismatch")
+	}
+	key := r.next()
+	if r.err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("malformed ssh-ed25519 key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// loadSSHEd25519PrivateKey reads an unencrypted OpenSSH ed25519 private key
+// (the format of /etc/ssh/ssh_host_ed25519_key)
+func loadSSHEd25519PrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "OPENSSH PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: not an OpenSSH private key", path)
+	}
+	const magic = "openssh-key-v1\x00"
+	if !bytes.HasPrefix(block.Bytes, []byte(magic)) {
+		return nil, fmt.Errorf("%s: bad OpenSSH key magic", path)
+	}
+
+	r := sshReader{buf: block.Bytes[len(magic):]}
+	cipher, kdf := string(r.next()), string(r.next())
+	r.next() // kdf options
+	if cipher != "none" || kdf != "none" {
+		return nil, fmt.Errorf("%s: encrypted keys are not supported", path)
+	}
+	if r.uint32() != 1 {
+		return nil, fmt.Errorf("%s: expected exactly one key", path)
+	}
+	r.next() // public key blob
+
+	priv := sshReader{buf: r.next()}
+	if priv.uint32() != priv.uint32() {
+		return nil, fmt.Errorf("%s: checkint mismatch", path)
+	}
+	if string(priv.next()) != "ssh-ed25519" {
+		return nil, fmt.Errorf("%s: not an ed25519 key", path)
+	}
+	priv.next() // public key
+	key := priv.next()
+	if r.err != nil || priv.err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("%s: malformed ed25519 key", path)
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// sshReader walks SSH wire-format length-prefixed fields
+type sshReader struct {
+	buf []byte
+	err error
+}
+
+func (r *sshReader) uint32() uint32 {
+	if r.err != nil || len(r.buf) < 4 {
+		r.err = errors.New("short buffer")
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.buf)
+	r.buf = r.buf[4:]
+	return v
+}
+
+func (r *sshReader) next() []byte {
+	n := r.uint32()
+	if r.err != nil || uint32(len(r.buf)) < n {
+		r.err = errors.New("short buffer")
+		return nil
+	}
+	field := r.buf[:n]
+	r.buf = r.buf[n:]
+	return field
+}
+
+// newClientCert wraps an ed25519 key in a self-signed client certificate
+// naming origin. Servers pin the key, so the certificate itself carries no
+// trust beyond proving possession of it.
+func newClientCert(origin string, key ed25519.PrivateKey) (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: origin},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("create certificate: %w", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// runClientCert writes a client certificate and PKCS#8 key wrapping an SSH
+// host key, for callers that can't sign TLS with an OpenSSH key directly
+// (the fort CLI's curl):
+//
+//	fort-provider client-cert --ssh-key K --origin O --cert C --key K2
+func runClientCert(args []string) error {
+	fs := flag.NewFlagSet("client-cert", flag.ContinueOnError)
+	sshKey := fs.String("ssh-key", defaultSSHKey, "OpenSSH ed25519 private key to wrap")
+	origin := fs.String("origin", "", "Identity to name in the certificate (default: short hostname)")
+	certOut := fs.String("cert", "", "Output path for the PEM certificate")
+	keyOut := fs.String("key", "", "Output path for the PEM private key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *certOut == "" || *keyOut == "" {
+		return errors.New("--cert and --key are required")
+	}
+	if *origin == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("determine origin: %w", err)
+		}
+		*origin, _, _ = strings.Cut(hostname, ".")
+	}
+
+	key, err := loadSSHEd25519PrivateKey(*sshKey)
+	if err != nil {
+		return err
+	}
+	cert, err := newClientCert(*origin, key)
+	if err != nil {
+		return err
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("marshal key: %w", err)
+	}
+
+	if err := os.WriteFile(*keyOut, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600); err != nil {
+		return fmt.Errorf("write key: %w", err)
+	}
+	if err := os.WriteFile(*certOut, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644); err != nil {
+		return fmt.Errorf("write certificate: %w", err)
+	}
+	return nil
+}
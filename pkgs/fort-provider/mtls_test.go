@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (p *testProvider) clientCert(t *testing.T, name string) *tls.Certificate {
+	t.Helper()
+	key, err := loadSSHEd25519PrivateKey(p.keys[name])
+	if err != nil {
+		t.Fatalf("load %s key: %v", name, err)
+	}
+	cert, err := newClientCert(name, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cert
+}
+
+// startTLSProvider serves h over TLS with the given client auth mode, the way
+// --listen does
+func startTLSProvider(t *testing.T, h *AgentHandler, mode string) *httptest.Server {
+	t.Helper()
+	if err := h.configureClientAuth(mode, ""); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(h)
+	srv.TLS = &tls.Config{ClientAuth: tlsClientAuth(mode)}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestLoadSSHEd25519PrivateKeyMatchesPublicKey(t *testing.T) {
+	p := newTestProvider(t)
+	hosts := p.handler(t).hosts
+
+	key, err := loadSSHEd25519PrivateKey(p.keys["alice"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := parseSSHEd25519PublicKey(hosts["alice"].Pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(key.Public().(ed25519.PublicKey)) {
+		t.Error("private key does not match hosts.json pubkey")
+	}
+}
+
+func TestMTLSPinnedClientCert(t *testing.T) {
+	p := newTestProvider(t)
+	srv := startTLSProvider(t, p.handler(t), clientAuthRequire)
+
+	cases := []struct {
+		name string
+		cert *tls.Certificate
+		want bool
+	}{
+		{"own key", p.clientCert(t, "alice"), true},
+		{"someone else's key", p.clientCert(t, "mallory"), false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			peer := &signedPeer{
+				origin:     "alice",
+				keyPath:    p.keys["alice"],
+				peers:      map[string]string{"bob": srv.URL},
+				clientCert: tc.cert,
+			}
+			output, err := peer.Call("bob", "whoami", []byte("{}"))
+			if ok := err == nil; ok != tc.want {
+				t.Errorf("err = %v, want success %v (%s)", err, tc.want, output)
+			}
+		})
+	}
+}
+
+func TestMTLSMissingCertOptionalVersusRequire(t *testing.T) {
+	p := newTestProvider(t)
+	srv := startTLSProvider(t, p.handler(t), clientAuthOptional)
+
+	// optional: no certificate is fine
+	peer := &signedPeer{origin: "alice", keyPath: p.keys["alice"], peers: map[string]string{"bob": srv.URL}}
+	if output, err := peer.Call("bob", "whoami", []byte("{}")); err != nil {
+		t.Fatalf("optional mode without cert: %v (%s)", err, output)
+	}
+
+	// require: the handshake itself fails without a certificate
+	strict := startTLSProvider(t, p.handler(t), clientAuthRequire)
+	peer.peers["bob"] = strict.URL
+	if _, err := peer.Call("bob", "whoami", []byte("{}")); err == nil {
+		t.Error("require mode accepted a request without a client certificate")
+	}
+}
+
+func TestChannelBindingMustMatchSession(t *testing.T) {
+	p := newTestProvider(t)
+	srv := startTLSProvider(t, p.handler(t), clientAuthOff)
+
+	// A binding lifted from another session: validly signed, wrong channel
+	stolen := "c3RvbGVuLWJpbmRpbmctZnJvbS1hbm90aGVyLXNlc3Npb24="
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	sig, err := signRequest(p.keys["alice"], "POST", "/fort/whoami", timestamp, []byte("{}"), stolen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("POST", srv.URL+"/fort/whoami", strings.NewReader("{}"))
+	req.Header.Set("X-Fort-Origin", "alice")
+	req.Header.Set("X-Fort-Timestamp", timestamp)
+	req.Header.Set("X-Fort-Signature", sig)
+	req.Header.Set(channelBindingHeader, stolen)
+
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401 for mismatched binding", resp.StatusCode)
+	}
+
+	// The same client binding its own session succeeds, even without mTLS
+	peer := &signedPeer{origin: "alice", keyPath: p.keys["alice"], peers: map[string]string{"bob": srv.URL}, clientCert: p.clientCert(t, "alice")}
+	if output, err := peer.Call("bob", "whoami", []byte("{}")); err != nil {
+		t.Errorf("bound call: %v (%s)", err, output)
+	}
+}
+
+func TestClientCertFromNginxFCGIParams(t *testing.T) {
+	p := newTestProvider(t)
+	h := p.handler(t)
+	cert := p.clientCert(t, "alice")
+	escaped := url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})))
+
+	parsed, err := certFromFCGIParams(map[string]string{"SSL_CLIENT_CERT": escaped})
+	if err != nil || parsed == nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if err := h.verifyClientCert(parsed, "alice", h.hosts["alice"].Pubkey); err != nil {
+		t.Errorf("alice's cert rejected for alice: %v", err)
+	}
+	if err := h.verifyClientCert(parsed, "bob", h.hosts["bob"].Pubkey); err == nil {
+		t.Error("alice's cert accepted for bob")
+	}
+
+	if parsed, err := certFromFCGIParams(map[string]string{}); parsed != nil || err != nil {
+		t.Errorf("no param: cert %v err %v, want nil, nil", parsed, err)
+	}
+}
+
+func TestBehindProxyTrustsCertHeaderFromLoopbackOnly(t *testing.T) {
+	p := newTestProvider(t)
+	h := p.handler(t)
+	if err := h.configureClientAuth(clientAuthRequire, ""); err != nil {
+		t.Fatal(err)
+	}
+	h.behindProxy = true
+	cert := p.clientCert(t, "alice")
+	escaped := url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})))
+
+	fromProxy := p.signed(t, "alice", "alice", "/fort/whoami", "{}", time.Now())
+	fromProxy.RemoteAddr = "127.0.0.1:50000"
+	fromProxy.Header.Set(proxyCertHeader, escaped)
+	if rec := serve(h, fromProxy); rec.Code != http.StatusOK {
+		t.Errorf("loopback proxy: status = %d (%s)", rec.Code, rec.Body)
+	}
+
+	direct := p.signed(t, "alice", "alice", "/fort/whoami", "{}", time.Now())
+	direct.Header.Set(proxyCertHeader, escaped) // httptest RemoteAddr is 192.0.2.1
+	if rec := serve(h, direct); rec.Code != http.StatusUnauthorized {
+		t.Errorf("non-loopback: status = %d, want 401", rec.Code)
+	}
+}
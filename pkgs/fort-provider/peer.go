@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Peer makes a signed capability call on another host. The returned bytes are
+// the fort CLI response envelope ({body, status, handle, ttl}); a non-2xx
+// status is an error, but the envelope is still returned for logging.
+type Peer interface {
+	Call(host, capability string, body []byte) ([]byte, error)
+}
+
+// fortCLIPeer shells out to the fort CLI, which signs with the host key and
+// resolves <host>.fort.<domain>. This is the production transport.
+type fortCLIPeer struct{}
+
+func (fortCLIPeer) Call(host, capability string, body []byte) ([]byte, error) {
+	cmd := exec.Command("fort", host, capability, string(body))
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return output, fmt.Errorf("fort command failed: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return output, fmt.Errorf("fort command exec failed: %w", err)
+	}
+	return output, nil
+}
+
+// signedPeer calls peers directly at a configured base URL, signing each
+// request exactly as the fort CLI does. Used when hosts aren't reachable at
+// <host>.fort.<domain> — the dev cluster, or anything pointing FORT_PEERS at
+// a peer map.
+type signedPeer struct {
+	origin  string
+	keyPath string
+	peers   map[string]string // hostname -> base URL (e.g. http://127.0.0.1:18001)
+	client  *http.Client
+
+	// With a client certificate, https peers are called over a dedicated
+	// connection that presents it and binds the signature to the session
+	clientCert *tls.Certificate
+}
+
+func (p *signedPeer) Call(host, capability string, body []byte) ([]byte, error) {
+	base, ok := p.peers[host]
+	if !ok {
+		return nil, fmt.Errorf("unknown peer %q", host)
+	}
+
+	path := "/fort/" + capability
+	req, err := http.NewRequest("POST", strings.TrimSuffix(base, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Fort-Origin", p.origin)
+
+	if p.clientCert != nil && req.URL.Scheme == "https" {
+		return p.callBound(host, req, body)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature, err := signRequest(p.keyPath, "POST", path, timestamp, body, "")
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Fort-Timestamp", timestamp)
+	req.Header.Set("X-Fort-Signature", signature)
+
+	client := p.client
+	if client == nil {
+		// Same posture as the fort CLI (curl -sk): peers use self-signed
+		// certs and authenticity comes from the request signature
+		client = &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", host, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response from %s: %w", host, err)
+	}
+
+	envelope := responseEnvelope(resp, respBody)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return envelope, fmt.Errorf("%s returned HTTP %d", host, resp.StatusCode)
+	}
+	return envelope, nil
+}
+
+// callBound sends req over a fresh mTLS connection, signing the session's
+// tls-exporter value along with the request (X-Fort-Channel-Binding)
+func (p *signedPeer) callBound(host string, req *http.Request, body []byte) ([]byte, error) {
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), "443")
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+		Certificates:       []tls.Certificate{*p.clientCert},
+		InsecureSkipVerify: true, // as above: authenticity comes from the signature
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", host, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	state := conn.ConnectionState()
+	exported, err := state.ExportKeyingMaterial(channelBindingLabel, nil, channelBindingLength)
+	if err != nil {
+		return nil, fmt.Errorf("export channel binding: %w", err)
+	}
+	binding := base64.StdEncoding.EncodeToString(exported)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature, err := signRequest(p.keyPath, "POST", req.URL.Path, timestamp, body, binding)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Fort-Timestamp", timestamp)
+	req.Header.Set("X-Fort-Signature", signature)
+	req.Header.Set(channelBindingHeader, binding)
+	req.Close = true
+
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("send to %s: %w", host, err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return nil, fmt.Errorf("read response from %s: %w", host, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response from %s: %w", host, err)
+	}
+
+	envelope := responseEnvelope(resp, respBody)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return envelope, fmt.Errorf("%s returned HTTP %d", host, resp.StatusCode)
+	}
+	return envelope, nil
+}
+
+// responseEnvelope renders a response the way the fort CLI prints it
+func responseEnvelope(resp *http.Response, body []byte) []byte {
+	envelope := struct {
+		Body   json.RawMessage `json:"body"`
+		Status int             `json:"status"`
+		Handle *string         `json:"handle"`
+		TTL    *int            `json:"ttl"`
+	}{Status: resp.StatusCode}
+
+	if json.Valid(body) && len(bytes.TrimSpace(body)) > 0 {
+		envelope.Body = body
+	} else {
+		envelope.Body, _ = json.Marshal(string(body))
+	}
+	if handle := resp.Header.Get("X-Fort-Handle"); handle != "" {
+		envelope.Handle = &handle
+	}
+	if ttl, err := strconv.Atoi(resp.Header.Get("X-Fort-TTL")); err == nil {
+		envelope.TTL = &ttl
+	}
+
+	data, _ := json.Marshal(envelope)
+	return data
+}
+
+// canonicalRequest builds the string covered by X-Fort-Signature:
+// METHOD\nPATH\nTIMESTAMP\nSHA256(body), plus \nBINDING when the request is
+// bound to its TLS session (X-Fort-Channel-Binding)
+func canonicalRequest(method, path, timestamp string, body []byte, binding string) string {
+	bodyHash := sha256.Sum256(body)
+	canonical := fmt.Sprintf("%s\n%s\n%s\n%s", method, path, timestamp, hex.EncodeToString(bodyHash[:]))
+	if binding != "" {
+		canonical += "\n" + binding
+	}
+	return canonical
+}
+
+// signRequest signs a request with ssh-keygen -Y sign and returns the
+// signature with its armor stripped, ready for the X-Fort-Signature header
+func signRequest(keyPath, method, path, timestamp string, body []byte, binding string) (string, error) {
+	cmd := exec.Command("ssh-keygen", "-Y", "sign", "-f", keyPath, "-n", signatureNamespace, "-q")
+	cmd.Stdin = strings.NewReader(canonicalRequest(method, path, timestamp, body, binding))
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("ssh-keygen sign: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var b64 strings.Builder
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "-----") {
+			continue
+		}
+		b64.WriteString(strings.TrimSpace(line))
+	}
+	return b64.String(), nil
+}
@@ -21,7 +21,8 @@ let
     usage() {
       echo "Usage: fort <host> <capability> [request-json]" >&2
       echo "  host: target hostname" >&2
-      echo "  capability: agent endpoint (e.g., status, ssl-cert)" >&2
+      echo "  capability: agent endpoint (e.g., status, ssl-cert;" >&2
+      echo "              'capabilities' lists the ones you may call)" >&2
       echo "  request-json: optional JSON body (default: {})" >&2
       exit 1
     }
@@ -45,6 +46,22 @@ let
       exit 2
     fi
 
+    # TLS client certificate wrapping the signing key (control plane
+    # clientAuth; minted by `fort-provider client-cert`). The host's own pair
+    # is only a default when signing with the host key — a principal key
+    # needs its own FORT_CLIENT_CERT/FORT_CLIENT_KEY.
+    if [ -n "''${FORT_SSH_KEY:-}" ]; then
+      CLIENT_CERT="''${FORT_CLIENT_CERT:-}"
+      CLIENT_KEY="''${FORT_CLIENT_KEY:-}"
+    else
+      CLIENT_CERT="''${FORT_CLIENT_CERT:-/var/lib/fort/tls/client-cert.pem}"
+      CLIENT_KEY="''${FORT_CLIENT_KEY:-/var/lib/fort/tls/client-key.pem}"
+    fi
+    CERT_ARGS=()
+    if [ -n "$CLIENT_CERT" ] && [ -r "$CLIENT_CERT" ] && [ -r "$CLIENT_KEY" ]; then
+      CERT_ARGS=(--cert "$CLIENT_CERT" --key "$CLIENT_KEY")
+    fi
+
     # Build request components
     METHOD="POST"
     REQ_PATH="/fort/$CAPABILITY"
@@ -74,6 +91,7 @@ let
 
     HTTP_CODE="$(${pkgs.curl}/bin/curl -sk -w '%{http_code}' -o "$BODY_FILE" \
       --max-time 30 \
+      "''${CERT_ARGS[@]}" \
       -X POST \
       -H "Content-Type: application/json" \
       -H "X-Fort-Origin: $ORIGIN" \